@@ -3,7 +3,9 @@ package main
 import (
 	"github.com/mrecachinas/dcserver/internal/app"
 	"github.com/mrecachinas/dcserver/internal/config"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
 	"github.com/spf13/pflag"
+	"golang.org/x/crypto/acme"
 )
 
 func main() {
@@ -11,6 +13,10 @@ func main() {
 	pflag.StringVarP(&cfg.Host, "host", "i", "localhost", "The URL to listen on")
 	pflag.IntVarP(&cfg.Port, "port", "p", 1337, "The port to run on")
 	pflag.BoolVarP(&cfg.Debug, "debug", "d", false, "Whether or not to enable debug logging")
+	pflag.StringVar(&cfg.Store, "store", "mongo", "Storage backend to use: mongo, bolt or memory")
+	pflag.StringVar(&cfg.BoltPath, "bolt-path", "dc.db", "Path to the database file when using the bolt store")
+	pflag.StringVar(&cfg.Bus, "bus", "amqp", "Message bus to use: amqp, nats or inproc")
+	pflag.StringVar(&cfg.NATSURL, "nats-url", "nats://localhost:4222", "The URL NATS is running on when using the nats bus")
 	pflag.StringVar(&cfg.MongoHost, "mongo-host", "localhost", "The host MongoDB is running on")
 	pflag.IntVar(&cfg.MongoPort, "mongo-port", 27017, "The port MongoDB is running on")
 	pflag.StringVar(&cfg.MongoDatabaseName, "mongo-dbname", "dc", "Name of MongoDB database to use")
@@ -19,10 +25,47 @@ func main() {
 	pflag.StringVar(&cfg.AMQPUser, "amqp-user", "guest", "Username for RabbitMQ")
 	pflag.StringVar(&cfg.AMQPPassword, "amqp-password", "guest", "Password for RabbitMQ")
 	pflag.StringVar(&cfg.AMQPOutputExchange, "amqp-output-exchange", "dc", "Output exchange to send start requests")
+	pflag.StringVar(&cfg.AMQPControlExchange, "amqp-control-exchange", protocol.DefaultControlExchange, "Topic exchange to send task commands (e.g., stop)")
+	pflag.StringVar(&cfg.AMQPReportQueue, "amqp-report-queue", protocol.DefaultReportQueue, "Queue to consume worker reports from")
+	pflag.StringVar(&cfg.TaskURL, "task-url", "", "URL of the external XML API listing the available tasks")
+	pflag.IntVar(&cfg.CatalogInterval, "catalog-interval", 300, "Number of seconds between task catalog refreshes")
 	pflag.StringVar(&cfg.ClientCertFile, "client-cert", "", "Client public key file")
 	pflag.StringVar(&cfg.ClientKeyFile, "client-key", "", "Client private key file")
 	pflag.StringVar(&cfg.CACertFile, "cacert", "", "CA Certificate file")
-	pflag.IntVar(&cfg.PollingInterval, "polling-interval", 5, "Number of seconds between database polls")
+	pflag.IntVar(&cfg.PollingInterval, "polling-interval", 5, "Number of seconds between database polls when change streams are unavailable")
+	pflag.IntVar(&cfg.HeartbeatInterval, "heartbeat-interval", 10, "Number of seconds between worker heartbeats")
+	pflag.IntVar(&cfg.HeartbeatMisses, "heartbeat-misses", 3, "Number of missed heartbeats before a task is marked lost (0 disables)")
+	pflag.IntVar(&cfg.OutboxMaxAttempts, "outbox-max-attempts", 10, "Number of times to try publishing a start message before giving up")
+	pflag.IntVar(&cfg.StopGracePeriod, "stop-grace-period", 30, "Number of seconds a stopping task has before it's killed (0 disables)")
+	pflag.IntVar(&cfg.StreamBuffer, "stream-buffer", 64, "Number of frames a stream viewer may fall behind before frames are dropped for it")
+	pflag.IntVar(&cfg.StreamMaxFrame, "stream-max-frame", 4<<20, "Largest stream frame, in bytes, a worker may publish")
+	pflag.StringVar(&cfg.ArtifactStore, "artifact-store", "fs", "Where task artifacts are kept: fs or s3")
+	pflag.StringVar(&cfg.ArtifactDir, "artifact-dir", "artifacts", "Directory to keep artifacts in when using the fs artifact store")
+	pflag.Int64Var(&cfg.ArtifactMaxSize, "artifact-max-size", 8<<30, "Largest artifact, in bytes, a worker may upload (0 for no limit)")
+	pflag.StringVar(&cfg.S3Endpoint, "s3-endpoint", "http://localhost:9000", "URL of the S3-compatible service when using the s3 artifact store")
+	pflag.StringVar(&cfg.S3Bucket, "s3-bucket", "dc-artifacts", "Bucket to keep artifacts in when using the s3 artifact store")
+	pflag.StringVar(&cfg.S3Region, "s3-region", "us-east-1", "Region of the s3 artifact store's bucket")
+	pflag.StringVar(&cfg.S3AccessKey, "s3-access-key", "", "Access key for the s3 artifact store")
+	pflag.StringVar(&cfg.S3SecretKey, "s3-secret-key", "", "Secret key for the s3 artifact store")
+	pflag.StringSliceVar(&cfg.Auth, "auth", nil, "Ways clients may authenticate: jwt, token and/or mtls (none leaves the API open)")
+	pflag.StringVar(&cfg.JWKSURL, "jwks-url", "", "URL of the JSON Web Key Set JWTs are signed with, for jwt authentication")
+	pflag.StringVar(&cfg.JWTIssuer, "jwt-issuer", "", "Issuer JWTs must be from, for jwt authentication")
+	pflag.StringVar(&cfg.JWTAudience, "jwt-audience", "", "Audience JWTs must be for, for jwt authentication")
+	pflag.StringVar(&cfg.JWTRolesClaim, "jwt-roles-claim", "roles", "Claim holding the roles in JWTs, e.g. realm_access.roles, for jwt authentication")
+	pflag.StringSliceVar(&cfg.MTLSRoles, "mtls-roles", []string{"worker"}, "Roles of clients authenticated by certificate, for mtls authentication")
+	pflag.StringVar(&cfg.CreateAPIToken, "create-api-token", "", "Create an API token with this name, print it and exit")
+	pflag.StringSliceVar(&cfg.APITokenRoles, "api-token-roles", []string{"admin"}, "Roles of the API token made by --create-api-token")
+	pflag.StringVar(&cfg.TLSCertFile, "tls-cert", "", "Certificate file to serve the API over TLS with, reloaded when it changes")
+	pflag.StringVar(&cfg.TLSKeyFile, "tls-key", "", "Private key file of --tls-cert")
+	pflag.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", "", "CA certificate file to verify TLS client certificates against, for mtls authentication")
+	pflag.BoolVar(&cfg.TLSRequireClientCert, "tls-require-client-cert", false, "Refuse TLS connections without a client certificate signed by --tls-client-ca")
+	pflag.IntVar(&cfg.TLSReloadInterval, "tls-reload-interval", 10, "Number of seconds between checks of the TLS files for changes")
+	pflag.StringSliceVar(&cfg.ACMEDomains, "acme-domain", nil, "Domains to get certificates for from an ACME CA, instead of --tls-cert")
+	pflag.StringVar(&cfg.ACMEDirectoryURL, "acme-directory", acme.LetsEncryptURL, "Directory URL of the ACME CA")
+	pflag.StringVar(&cfg.ACMECacheDir, "acme-cache-dir", "acme", "Directory to keep ACME account keys and certificates in")
+	pflag.StringVar(&cfg.ACMEEmail, "acme-email", "", "Contact email to register with the ACME CA")
+	pflag.StringVar(&cfg.ACMECACertFile, "acme-cacert", "", "CA certificate file to trust the ACME CA's directory with, e.g. for a private CA")
+	pflag.StringVar(&cfg.ACMEHTTPAddress, "acme-http-address", "", "Address to answer ACME http-01 challenges on, e.g. :80 (without it only tls-alpn-01 is used)")
 	pflag.Parse()
 
 	app.Run(cfg)
@@ -3,10 +3,15 @@ module github.com/mrecachinas/dcserver
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.34.28
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/labstack/echo/v4 v4.1.17
 	github.com/labstack/gommon v0.3.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/spf13/pflag v1.0.5
 	github.com/streadway/amqp v1.0.0
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.4.4
-	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
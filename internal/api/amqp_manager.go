@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/streadway/amqp"
+)
+
+// How long AMQPManager waits between reconnection attempts
+const (
+	amqpMinBackoff = time.Second
+	amqpMaxBackoff = 30 * time.Second
+)
+
+// AMQPManager keeps a connection and publishing channel to RabbitMQ
+// open. It watches both with NotifyClose and, when either goes away,
+// reconnects with exponential backoff and re-declares the topology
+// on the new channel. Everything using the broker goes through the
+// manager's current session rather than holding on to a channel.
+type AMQPManager struct {
+	dial     func() (*amqp.Connection, *amqp.Channel, error)
+	topology func(ch *amqp.Channel) error
+	health   *busHealthTracker
+
+	mu      sync.RWMutex
+	session *amqpSession
+	// changed is closed (and replaced) whenever session changes
+	changed chan struct{}
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// amqpSession is one connection to the broker and its publishing
+// channel, which is in confirm mode.
+type amqpSession struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	// closed is closed once the connection or channel goes away, and
+	// reason is set before to why the broker closed the channel, if
+	// it did
+	closed chan struct{}
+	reason *amqp.Error
+
+	// mu serializes publishes so each one can wait for its own confirm
+	mu  sync.Mutex
+	tag uint64
+}
+
+// NewAMQPManager starts supervising a connection made by dial. topology
+// is run on every new channel before it's handed out. The first
+// connection is made in the background, so the manager is returned
+// (disconnected) even if the broker isn't up yet.
+func NewAMQPManager(dial func() (*amqp.Connection, *amqp.Channel, error), topology func(ch *amqp.Channel) error) *AMQPManager {
+	m := &AMQPManager{
+		dial:     dial,
+		topology: topology,
+		health:   newBusHealthTracker(BusAMQP),
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go m.supervise()
+	return m
+}
+
+// Session returns the current session, or ErrBusUnavailable
+// while disconnected.
+func (m *AMQPManager) Session() (*amqpSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.session == nil {
+		return nil, ErrBusUnavailable
+	}
+	return m.session, nil
+}
+
+// WaitSession blocks until there's a session or ctx is cancelled.
+func (m *AMQPManager) WaitSession(ctx context.Context) (*amqpSession, error) {
+	for {
+		m.mu.RLock()
+		session, changed := m.session, m.changed
+		m.mu.RUnlock()
+		if session != nil {
+			return session, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Health describes the connection.
+func (m *AMQPManager) Health() BusHealth {
+	return m.health.get()
+}
+
+// Close stops reconnecting and closes the current connection.
+func (m *AMQPManager) Close() error {
+	close(m.stop)
+	<-m.stopped
+	return nil
+}
+
+// supervise connects, waits for the connection to die and reconnects,
+// until the manager is closed.
+func (m *AMQPManager) supervise() {
+	defer close(m.stopped)
+
+	backoff := amqpMinBackoff
+	for {
+		session, err := m.connect()
+		if err != nil {
+			m.health.down(err)
+			log.Errorf("Error connecting to AMQP, retrying in %s: %v", backoff, err)
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > amqpMaxBackoff {
+				backoff = amqpMaxBackoff
+			}
+			continue
+		}
+
+		backoff = amqpMinBackoff
+		m.setSession(session)
+		m.health.up()
+		log.Info("Connected to AMQP")
+
+		select {
+		case <-m.stop:
+			m.setSession(nil)
+			session.conn.Close()
+			return
+		case <-session.closed:
+			m.setSession(nil)
+			if session.refused() {
+				log.Warnf("AMQP channel closed by the broker, reopening: %v", session.reason)
+			} else {
+				log.Warn("Lost AMQP connection, reconnecting")
+			}
+		}
+	}
+}
+
+// connect dials the broker, declares the topology and puts the channel
+// into confirm mode.
+func (m *AMQPManager) connect() (*amqpSession, error) {
+	conn, ch, err := m.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.topology(ch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	session := &amqpSession{
+		conn:     conn,
+		channel:  ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 16)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 16)),
+		closed:   make(chan struct{}),
+	}
+
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+			// A channel can die on its own (e.g., a publish to a
+			// missing exchange); start over with a fresh connection
+			session.reason = reason
+			conn.Close()
+		}
+		// A publish the broker refused doesn't mean it's gone
+		if !session.refused() {
+			err := ErrBusUnavailable
+			if reason != nil {
+				err = reason
+			}
+			m.health.down(err)
+		}
+		close(session.closed)
+	}()
+
+	return session, nil
+}
+
+// refused reports whether the broker closed the session's channel
+// because something it was asked for, like the exchange of a publish,
+// doesn't exist.
+func (s *amqpSession) refused() bool {
+	return s.reason != nil && s.reason.Code == amqp.NotFound
+}
+
+// closeError waits for the session to close and returns why a publish
+// to exchange on it failed: ErrExchangeNotFound if the broker refused
+// it, or ErrBusUnavailable.
+func (s *amqpSession) closeError(exchange string) error {
+	<-s.closed
+	if s.refused() {
+		return fmt.Errorf("%w: %q: %s", ErrExchangeNotFound, exchange, s.reason.Reason)
+	}
+	return ErrBusUnavailable
+}
+
+func (m *AMQPManager) setSession(session *amqpSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.session = session
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AMQP frame types
+const (
+	frameMethod = 1
+	frameHeader = 2
+	frameBody   = 3
+	frameEnd    = 0xce
+)
+
+// fakeBroker speaks just enough AMQP 0-9-1 to be connected to, have
+// topology declared and take confirmed publishes. Like RabbitMQ, it
+// closes the channel with 404 NOT_FOUND over a publish to an exchange
+// that hasn't been declared.
+type fakeBroker struct {
+	net.Listener
+
+	mu          sync.Mutex
+	refuse      bool
+	exchanges   map[string]bool
+	conns       []net.Conn
+	connections int
+	published   []string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{Listener: listener, exchanges: map[string]bool{"": true}}
+	t.Cleanup(func() {
+		listener.Close()
+		b.drop()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			refuse := b.refuse
+			if !refuse {
+				b.conns = append(b.conns, conn)
+				b.connections++
+			}
+			b.mu.Unlock()
+			if refuse {
+				conn.Close()
+				continue
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// dial connects to the broker the way AMQPDispatcher does.
+func (b *fakeBroker) dial() (*amqp.Connection, *amqp.Channel, error) {
+	addr := b.Addr().(*net.TCPAddr)
+	return SetupAMQP(addr.IP.String(), addr.Port, "guest", "guest")
+}
+
+// setRefuse makes the broker turn away new connections, or not.
+func (b *fakeBroker) setRefuse(refuse bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = refuse
+}
+
+// drop cuts every connection, as a broker restart would.
+func (b *fakeBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// amqpArgs encodes method arguments.
+type amqpArgs []byte
+
+func (a amqpArgs) octet(v byte) amqpArgs { return append(a, v) }
+
+func (a amqpArgs) short(v uint16) amqpArgs {
+	return append(a, byte(v>>8), byte(v))
+}
+
+func (a amqpArgs) long(v uint32) amqpArgs {
+	return append(a, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (a amqpArgs) longlong(v uint64) amqpArgs {
+	return a.long(uint32(v >> 32)).long(uint32(v))
+}
+
+func (a amqpArgs) shortstr(s string) amqpArgs {
+	return append(a.octet(byte(len(s))), s...)
+}
+
+func (a amqpArgs) longstr(s string) amqpArgs {
+	return append(a.long(uint32(len(s))), s...)
+}
+
+func writeMethod(w io.Writer, channel uint16, class uint16, method uint16, args amqpArgs) error {
+	payload := amqpArgs{}.short(class).short(method)
+	payload = append(payload, args...)
+	frame := amqpArgs{}.octet(frameMethod).short(channel).long(uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame.octet(frameEnd))
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[len(payload)-1] != frameEnd {
+		return 0, 0, nil, errors.New("frame doesn't end in a frame-end")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:len(payload)-1], nil
+}
+
+// shortstrAt decodes the short string at the start of raw.
+func shortstrAt(raw []byte) string {
+	return string(raw[1 : 1+int(raw[0])])
+}
+
+// serve carries out one connection, replying to every method the
+// client sends with its -ok.
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	err := writeMethod(conn, 0, 10, 10, amqpArgs{}.octet(0).octet(9).long(0).longstr("PLAIN").longstr("en_US"))
+	if err != nil {
+		return
+	}
+
+	// What's being published, per channel
+	exchanges := map[uint16]string{}
+	remaining := map[uint16]uint64{}
+	tags := map[uint16]uint64{}
+	published := func(channel uint16) error {
+		exchange := exchanges[channel]
+		b.mu.Lock()
+		known := b.exchanges[exchange]
+		if known {
+			b.published = append(b.published, exchange)
+		}
+		b.mu.Unlock()
+		if !known {
+			text := fmt.Sprintf("NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+			return writeMethod(conn, channel, 20, 40, amqpArgs{}.short(amqp.NotFound).shortstr(text).short(60).short(40))
+		}
+		tags[channel]++
+		return writeMethod(conn, channel, 60, 80, amqpArgs{}.longlong(tags[channel]).octet(0))
+	}
+
+	for {
+		typ, channel, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameHeader:
+			remaining[channel] = binary.BigEndian.Uint64(payload[4:])
+			if remaining[channel] == 0 {
+				err = published(channel)
+			}
+		case frameBody:
+			remaining[channel] -= uint64(len(payload))
+			if remaining[channel] == 0 {
+				err = published(channel)
+			}
+		case frameMethod:
+			class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+			args := payload[4:]
+			switch {
+			case class == 10 && method == 11: // connection.start-ok
+				err = writeMethod(conn, 0, 10, 30, amqpArgs{}.short(0).long(131072).short(0))
+			case class == 10 && method == 40: // connection.open
+				err = writeMethod(conn, 0, 10, 41, amqpArgs{}.shortstr(""))
+			case class == 10 && method == 50: // connection.close
+				writeMethod(conn, 0, 10, 51, nil)
+				return
+			case class == 20 && method == 10: // channel.open
+				err = writeMethod(conn, channel, 20, 11, amqpArgs{}.longstr(""))
+			case class == 20 && method == 40: // channel.close
+				err = writeMethod(conn, channel, 20, 41, nil)
+			case class == 40 && method == 10: // exchange.declare
+				b.mu.Lock()
+				b.exchanges[shortstrAt(args[2:])] = true
+				b.mu.Unlock()
+				err = writeMethod(conn, channel, 40, 11, nil)
+			case class == 50 && method == 10: // queue.declare
+				err = writeMethod(conn, channel, 50, 11, amqpArgs{}.shortstr(shortstrAt(args[2:])).long(0).long(0))
+			case class == 85 && method == 10: // confirm.select
+				err = writeMethod(conn, channel, 85, 11, nil)
+			case class == 60 && method == 40: // basic.publish
+				exchanges[channel] = shortstrAt(args[2:])
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAMQPMissingExchange(t *testing.T) {
+	broker := newFakeBroker(t)
+	d := &AMQPDispatcher{OutputExchange: "dc.tasks", ControlExchange: "dc.control", ReportQueue: "dc.reports"}
+	d.Conn = NewAMQPManager(broker.dial, d.declareTopology)
+	t.Cleanup(func() { d.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := d.Conn.WaitSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody has declared the output exchange
+	err := d.PublishStart(ctx, Task{Id: primitive.NewObjectID(), Type: "collect"})
+	if !errors.Is(err, ErrExchangeNotFound) {
+		t.Fatalf("publishing to a missing exchange: got %v, want ErrExchangeNotFound", err)
+	}
+	if health := d.Health(); !health.Connected || health.Reconnects != 0 {
+		t.Errorf("after a refused publish, health is %+v", health)
+	}
+
+	// The manager starts over on a fresh channel, and publishes to
+	// exchanges that are there go through
+	command := protocol.Command{Kind: protocol.CommandStop, TaskId: primitive.NewObjectID().Hex()}
+	waitFor(t, "the bus to take publishes again", func() bool {
+		err = d.PublishCommand(ctx, command)
+		return err != ErrBusUnavailable
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.mu.Lock()
+	published, connections := append([]string(nil), broker.published...), broker.connections
+	broker.mu.Unlock()
+	if len(published) != 1 || published[0] != "dc.control" {
+		t.Errorf("broker took publishes to %v, want dc.control", published)
+	}
+	if connections != 2 {
+		t.Errorf("%d connections, want 2", connections)
+	}
+}
+
+func TestAMQPConnectionLost(t *testing.T) {
+	broker := newFakeBroker(t)
+	d := &AMQPDispatcher{OutputExchange: "dc.tasks", ControlExchange: "dc.control", ReportQueue: "dc.reports"}
+	d.Conn = NewAMQPManager(broker.dial, d.declareTopology)
+	t.Cleanup(func() { d.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := d.Conn.WaitSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker goes away for a while
+	broker.setRefuse(true)
+	broker.drop()
+	waitFor(t, "the connection to go down", func() bool { return !d.Health().Connected })
+	command := protocol.Command{Kind: protocol.CommandStop, TaskId: primitive.NewObjectID().Hex()}
+	if err := d.PublishCommand(ctx, command); err != ErrBusUnavailable {
+		t.Errorf("publishing while disconnected: got %v, want ErrBusUnavailable", err)
+	}
+
+	broker.setRefuse(false)
+	waitFor(t, "the connection to come back", func() bool { return d.Health().Connected })
+	if health := d.Health(); health.Reconnects != 1 {
+		t.Errorf("health after reconnecting is %+v", health)
+	}
+	if err := d.PublishCommand(ctx, command); err != nil {
+		t.Errorf("publishing after reconnecting: %v", err)
+	}
+}
@@ -2,50 +2,97 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/streadway/amqp"
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // GetStatus returns a single status object
 // to the client given an id.
 func (a *Api) GetStatus(c echo.Context) error {
 	id := c.Param("id")
-	status, err := a.DB.GetSingleStatus(id)
+	status, err := a.getVisibleStatus(c, id)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	return c.JSON(http.StatusOK, status)
 }
 
-// GetAllStatus queries the tasks collection
-// for every record and returns it as JSON.
+// GetAllStatus queries the tasks collection for the records
+// matching the request's filters (see ParseStatusQuery) and returns
+// a page of them as JSON, along with how many match in total.
 func (a *Api) GetAllStatus(c echo.Context) error {
-	statusList, err := a.DB.GetAllStatus()
+	query, err := ParseStatusQuery(c.QueryParams())
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	restrictToVisible(c, query)
+	page, err := a.DB.QueryStatus(query)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// GetActiveStatus is GetAllStatus restricted to tasks that
+// haven't finished, the active list of websocket snapshots.
+func (a *Api) GetActiveStatus(c echo.Context) error {
+	return a.getStatusList(c, activeStates)
+}
+
+// GetHistoricalStatus is GetAllStatus restricted to tasks that
+// have finished, the historical list of websocket snapshots.
+func (a *Api) GetHistoricalStatus(c echo.Context) error {
+	return a.getStatusList(c, historicalStates)
+}
+
+func (a *Api) getStatusList(c echo.Context, states []State) error {
+	query, err := ParseStatusQuery(c.QueryParams())
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	restrictToVisible(c, query)
+	restricted, ok := query.restrictStates(states)
+	if !ok {
+		return c.JSON(http.StatusOK, StatusPage{Status: []Status{}, Counts: map[State]int64{}})
+	}
+	page, err := a.DB.QueryStatus(restricted)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(errorStatus(err), err.Error())
 	}
-	return c.JSON(http.StatusOK, statusList)
+	return c.JSON(http.StatusOK, page)
 }
 
-// GetTasks hits the external API for the tasks list XML
-// and returns it serialized as JSON.
+// GetTasks returns the cached task catalog, along with its
+// version and whether it's stale, serialized as JSON. It doesn't
+// wait on the external API; the catalog is refreshed in the background.
 func (a *Api) GetTasks(c echo.Context) error {
-	tasks, err := QueryExternal(a.Cfg.TaskURL, a.HTTPClient)
+	catalog, err := a.Catalog.Response()
+	if err == ErrCatalogNotFound {
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
 	if err != nil {
 		c.Logger().Error(err)
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
-	return c.JSON(http.StatusOK, &tasks)
+	return c.JSON(http.StatusOK, catalog)
 }
 
-// CreateTask inserts the client-requested task
-// into the tasks collection and pushes a message
-// onto the RabbitMQ exchange for creation.
+// CreateTask validates the client-requested task against
+// the catalog and inserts it into the tasks collection along
+// with an outbox entry the relay publishes as its start message.
+// The task is owned by whoever created it, whatever the request says.
+// Invalid tasks are rejected with a 422 listing every bad field.
 // TODO: Do we need to check if a similar task currently exists?
 func (a *Api) CreateTask(c echo.Context) error {
 	// Deserialize the task JSON request into a `Task` object
@@ -53,55 +100,179 @@ func (a *Api) CreateTask(c echo.Context) error {
 	err := json.NewDecoder(c.Request().Body).Decode(&task)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
 	}
 
-	oid, err := a.DB.CreateTask(task)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
+	task.Owner = ownerOf(c)
+	oid, err := a.submitTask(task, actorOf(c))
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return c.JSON(http.StatusUnprocessableEntity, Response{
+			Msg:    "Invalid task",
+			Errors: validationErr.Errors,
+		})
 	}
-
-	task.Id = *oid
-
-	// Serialize the task object augmented with the new
-	// ObjectId and push it onto RabbitMQ
-	taskJson, err := json.Marshal(task)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
 	}
 
-	err = a.AMQPChannel.Publish(
-		a.Cfg.AMQPOutputExchange,
-		"",
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/json",
-			Body:        taskJson,
-		},
-	)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.String(http.StatusInternalServerError, err.Error())
-	}
 	return c.JSON(http.StatusCreated, Response{
 		Msg: "Successfully submitted start task request",
 		Id:  oid.Hex(),
 	})
 }
 
-// StopTask sets the `stop_flag` field in the requested task
-// in the tasks collection to `true`, which indicates it
-// has been requested to stop.
+// submitTask validates a task against the catalog and creates it.
+// Tasks without a start time start now.
+// Tasks of a type with a maximum duration are given a stop time no
+// later than that. Without a catalog to check against, tasks are only
+// accepted if catalog sync is turned off altogether.
+func (a *Api) submitTask(task Task, actor string) (*primitive.ObjectID, error) {
+	if task.StartTime == 0 {
+		task.StartTime = primitive.NewDateTimeFromTime(time.Now())
+	}
+	catalog, err := a.Catalog.Current()
+	switch {
+	case err == nil:
+		if err := validateTask(catalog, &task); err != nil {
+			return nil, err
+		}
+		// Record which catalog the task was created against
+		task.CatalogVersion = catalog.Version
+		entry, _ := catalog.Entry(task.Type)
+		limitDuration(&task, entry, time.Now())
+	case err == ErrCatalogNotFound && a.Catalog.URL == "":
+		if errs := checkParameterNames(task.Parameters); len(errs) > 0 {
+			return nil, &ValidationError{Errors: errs}
+		}
+	default:
+		return nil, err
+	}
+
+	oid, err := a.DB.CreateTask(task, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// The start message went into the outbox with the task;
+	// let the relay publish it now rather than on its next tick
+	a.Outbox.Kick()
+	return oid, nil
+}
+
+// StopTask moves the requested task to stopping and sets its
+// `stop_flag` field to `true`, which indicates it has been
+// requested to stop, then sends its worker a stop command.
+// The optional StopRequest body sets how long the task has to
+// stop before it's killed. Tasks that can't be stopped from their
+// current state are rejected with a 409.
 func (a *Api) StopTask(c echo.Context) error {
 	id := c.Param("id")
-	err := a.DB.StopTask(id)
+	if err := a.authorizeControl(c, id); err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	request := StopRequest{GracePeriod: a.Cfg.StopGracePeriod}
+	if c.Request().ContentLength != 0 {
+		err := json.NewDecoder(c.Request().Body).Decode(&request)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+		}
+	}
+	var deadline time.Time
+	if request.GracePeriod > 0 {
+		deadline = time.Now().Add(time.Duration(request.GracePeriod) * time.Second)
+	}
+
+	err := a.DB.StopTask(id, deadline, actorOf(c))
 	if err != nil {
 		c.Logger().Error(err)
-		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
 	}
+	a.sendCommand(c.Request().Context(), id, protocol.CommandStop, "stop requested", deadline)
+
 	msg := fmt.Sprintf("Successfully submitted stop task request for %s", id)
 	return c.JSON(http.StatusOK, Response{Msg: msg})
 }
+
+// actorOf identifies who made a request, for recording in task history:
+// the authenticated subject or, with authentication off, the client's
+// address.
+func actorOf(c echo.Context) string {
+	if identity := auth.FromContext(c); identity != nil {
+		return identity.Subject
+	}
+	return c.RealIP()
+}
+
+// ownerOf is who owns the tasks a request creates: the authenticated
+// subject or, with authentication off, no one.
+func ownerOf(c echo.Context) string {
+	if identity := auth.FromContext(c); identity != nil {
+		return identity.Subject
+	}
+	return ""
+}
+
+// restrictToVisible narrows a query to the tasks the request's identity
+// may see, which for identities that may only see their own is the
+// tasks they own.
+func restrictToVisible(c echo.Context, query *StatusQuery) {
+	if identity := auth.FromContext(c); identity != nil && !identity.Can(auth.PermStatusRead) {
+		query.Owner = identity.Subject
+	}
+}
+
+// getVisibleStatus gets a task's status if the request's identity may
+// see it. Other people's tasks are ErrTaskNotFound to identities that
+// may only see their own, rather than giving away that they exist.
+func (a *Api) getVisibleStatus(c echo.Context, id string) (*Status, error) {
+	status, err := a.DB.GetSingleStatus(id)
+	if err != nil {
+		return nil, err
+	}
+	identity := auth.FromContext(c)
+	if identity != nil && !identity.Can(auth.PermStatusRead) && status.Owner != identity.Subject {
+		return nil, ErrTaskNotFound
+	}
+	return status, nil
+}
+
+// authorizeControl checks the request's identity may stop, kill or
+// reconfigure a task: any task with PermTaskControl, or its own with
+// PermTaskControlOwn.
+func (a *Api) authorizeControl(c echo.Context, id string) error {
+	identity := auth.FromContext(c)
+	if identity == nil || identity.Can(auth.PermTaskControl) {
+		return nil
+	}
+	status, err := a.getVisibleStatus(c, id)
+	if err != nil {
+		return err
+	}
+	if !identity.Can(auth.PermTaskControlOwn) || status.Owner != identity.Subject {
+		return fmt.Errorf("%w: %s can't control task %s", auth.ErrForbidden, identity.Subject, id)
+	}
+	return nil
+}
+
+// errorStatus maps errors from the DB layer to the HTTP status code
+// they should be reported with.
+func errorStatus(err error) int {
+	var transitionErr *TransitionError
+	switch {
+	case errors.Is(err, auth.ErrForbidden):
+		return http.StatusForbidden
+	case errors.As(err, &transitionErr), errors.Is(err, ErrScheduleConflict), errors.Is(err, ErrTaskNotRunning):
+		return http.StatusConflict
+	case errors.Is(err, ErrTaskNotFound), errors.Is(err, ErrScheduleNotFound), errors.Is(err, ErrArtifactNotFound), errors.Is(err, auth.ErrAPITokenNotFound), errors.Is(err, mongo.ErrNoDocuments):
+		return http.StatusNotFound
+	case errors.Is(err, primitive.ErrInvalidHex), errors.Is(err, ErrInvalidReport), errors.Is(err, ErrInvalidQuery), errors.Is(err, ErrInvalidAuditQuery), errors.Is(err, ErrInvalidArtifact), errors.Is(err, ErrInvalidView):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBusUnavailable), errors.Is(err, ErrCatalogNotFound):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
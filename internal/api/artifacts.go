@@ -0,0 +1,307 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/bluefile"
+	"github.com/mrecachinas/dcserver/internal/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Names of the supported artifact store backends (`--artifact-store`)
+const (
+	ArtifactStoreFS = "fs"
+	ArtifactStoreS3 = "s3"
+)
+
+// ErrArtifactNotFound is returned for artifacts a task doesn't have,
+// or that are missing from the artifact store.
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// ErrInvalidArtifact is returned for uploads dc can't accept as
+// artifacts.
+var ErrInvalidArtifact = errors.New("invalid artifact")
+
+// artifactNamePattern is what artifact names may look like: a single
+// path element that isn't hidden.
+var artifactNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,254}$`)
+
+// blueExtensions are the file extensions of BLUE files, which SigPlot
+// reads natively.
+var blueExtensions = map[string]bool{".tmp": true, ".prm": true, ".blue": true}
+
+// FormatBlue is the format of BLUE file artifacts.
+const FormatBlue = "blue"
+
+// Artifact is an output file of a task, such as a recording, as
+// registered when its worker uploaded it.
+type Artifact struct {
+	Name        string             `json:"name" bson:"name"`
+	Size        int64              `json:"size" bson:"size"`
+	Checksum    string             `json:"checksum" bson:"checksum"`
+	Format      string             `json:"format,omitempty" bson:"format,omitempty"`
+	ContentType string             `json:"content_type" bson:"content_type"`
+	CreatedAt   primitive.DateTime `json:"created_at" bson:"created_at"`
+	CreatedBy   string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	// Header is the parsed header of a BLUE file artifact
+	Header *bluefile.Header `json:"header,omitempty" bson:"header,omitempty"`
+}
+
+// ArtifactStore holds the contents of artifacts, by key. The tasks
+// they belong to record what's in it.
+type ArtifactStore interface {
+	// Put stores size bytes from body under key, replacing whatever
+	// was there. sha256 is the hex SHA-256 of the bytes.
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, sha256 string, contentType string) error
+	// Open opens the size bytes stored under key.
+	Open(ctx context.Context, key string, size int64) (io.ReadSeekCloser, error)
+}
+
+// SetupArtifactStore opens the artifact store backend named in the
+// config.
+func SetupArtifactStore(cfg *config.Config, client *http.Client) (ArtifactStore, error) {
+	switch cfg.ArtifactStore {
+	case ArtifactStoreFS, "":
+		return NewFSArtifactStore(cfg.ArtifactDir)
+	case ArtifactStoreS3:
+		return NewS3ArtifactStore(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3Region, cfg.S3AccessKey, cfg.S3SecretKey, client)
+	default:
+		return nil, fmt.Errorf("unknown artifact store %q", cfg.ArtifactStore)
+	}
+}
+
+// artifactKey is where a task's artifact is kept in the artifact store.
+func artifactKey(id string, name string) string {
+	return id + "/" + name
+}
+
+// findArtifact looks up one of a task's artifacts by name.
+func findArtifact(status *Status, name string) (*Artifact, bool) {
+	for i := range status.Artifacts {
+		if status.Artifacts[i].Name == name {
+			return &status.Artifacts[i], true
+		}
+	}
+	return nil, false
+}
+
+// artifactFormat guesses an artifact's format from its file extension.
+func artifactFormat(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if blueExtensions[ext] {
+		return FormatBlue
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// GetArtifacts lists a task's artifacts.
+func (a *Api) GetArtifacts(c echo.Context) error {
+	status, err := a.getVisibleStatus(c, c.Param("id"))
+	if err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	artifacts := status.Artifacts
+	if artifacts == nil {
+		artifacts = []Artifact{}
+	}
+	return c.JSON(http.StatusOK, artifacts)
+}
+
+// PutArtifact uploads one of a task's output files and registers it
+// with the task, replacing any artifact it had with the same name. The
+// size and SHA-256 checksum are worked out from the upload; if the
+// worker sends its own `X-Checksum-Sha256`, the upload has to match it.
+// The `format` parameter defaults to one guessed from the name's
+// extension, and the content type to the request's. The headers of
+// BLUE files are indexed along with the artifact; uploads that claim
+// to be BLUE files but aren't are rejected, as are uploads over the
+// configured maximum size.
+func (a *Api) PutArtifact(c echo.Context) error {
+	id, name := c.Param("id"), c.Param("name")
+	if !artifactNamePattern.MatchString(name) {
+		return c.JSON(http.StatusBadRequest, Response{Msg: fmt.Sprintf("%v: bad name %q", ErrInvalidArtifact, name)})
+	}
+	if _, err := a.DB.GetSingleStatus(id); err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	// Spool the upload so its size and checksum are known before it
+	// goes into the artifact store
+	spool, err := os.CreateTemp("", "dc-artifact-*")
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	body := c.Request().Body
+	limit := a.Cfg.ArtifactMaxSize
+	if limit > 0 {
+		if c.Request().ContentLength > limit {
+			return c.JSON(http.StatusRequestEntityTooLarge, Response{Msg: artifactTooLarge(limit)})
+		}
+		body = http.MaxBytesReader(c.Response(), body, limit)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), body)
+	if err != nil && limit > 0 && size == limit {
+		return c.JSON(http.StatusRequestEntityTooLarge, Response{Msg: artifactTooLarge(limit)})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if expected := c.Request().Header.Get("X-Checksum-Sha256"); expected != "" && !strings.EqualFold(expected, checksum) {
+		msg := fmt.Sprintf("%v: upload's SHA-256 is %s, not %s", ErrInvalidArtifact, checksum, expected)
+		return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+	}
+
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = artifactFormat(name)
+	}
+	header, err := bluefile.ReadHeader(spool)
+	switch {
+	case err == nil:
+		format = FormatBlue
+	case errors.Is(err, bluefile.ErrNotBlue) && c.QueryParam("format") != FormatBlue:
+		// Not every .tmp file is a BLUE file
+		if format == FormatBlue {
+			format = strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+		}
+	default:
+		msg := fmt.Sprintf("%v: bad BLUE file: %v", ErrInvalidArtifact, err)
+		return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	err = a.Artifacts.Put(ctx, artifactKey(id, name), spool, size, checksum, contentType)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadGateway, Response{Msg: err.Error()})
+	}
+
+	artifact := Artifact{
+		Name:        name,
+		Size:        size,
+		Checksum:    "sha256:" + checksum,
+		Format:      format,
+		ContentType: contentType,
+		CreatedAt:   primitive.NewDateTimeFromTime(time.Now()),
+		CreatedBy:   actorOf(c),
+		Header:      header,
+	}
+	if err := a.DB.AddArtifact(id, artifact, actorOf(c)); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusCreated, artifact)
+}
+
+// artifactTooLarge is the message uploads over limit are turned away with.
+func artifactTooLarge(limit int64) string {
+	return fmt.Sprintf("%v: larger than %d bytes", ErrInvalidArtifact, limit)
+}
+
+// GetArtifact serves one of a task's artifacts, with support for
+// Range requests so clients like SigPlot can page through large files
+// without downloading them whole.
+func (a *Api) GetArtifact(c echo.Context) error {
+	id, name := c.Param("id"), c.Param("name")
+	status, err := a.getVisibleStatus(c, id)
+	if err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	artifact, ok := findArtifact(status, name)
+	if !ok {
+		return c.JSON(http.StatusNotFound, Response{Msg: ErrArtifactNotFound.Error()})
+	}
+
+	content, err := a.Artifacts.Open(c.Request().Context(), artifactKey(id, name), artifact.Size)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	defer content.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, artifact.ContentType)
+	header.Set("ETag", fmt.Sprintf("%q", artifact.Checksum))
+	http.ServeContent(c.Response(), c.Request(), artifact.Name, artifact.CreatedAt.Time(), content)
+	return nil
+}
+
+// GetArtifactHeader returns the parsed header of a BLUE file artifact:
+// its type, format, xstart/xdelta and the rest of its adjunct header,
+// how much data it holds and its keywords. Headers are indexed when
+// artifacts are uploaded; older artifacts have theirs read from the
+// artifact store, which only fetches the header, not the data.
+func (a *Api) GetArtifactHeader(c echo.Context) error {
+	id, name := c.Param("id"), c.Param("name")
+	status, err := a.getVisibleStatus(c, id)
+	if err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	artifact, ok := findArtifact(status, name)
+	if !ok {
+		return c.JSON(http.StatusNotFound, Response{Msg: ErrArtifactNotFound.Error()})
+	}
+	if artifact.Header != nil {
+		return c.JSON(http.StatusOK, artifact.Header)
+	}
+
+	header, err := a.readArtifactHeader(c.Request().Context(), id, artifact)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusOK, header)
+}
+
+// readArtifactHeader reads the BLUE header of an artifact from the
+// artifact store.
+func (a *Api) readArtifactHeader(ctx context.Context, id string, artifact *Artifact) (*bluefile.Header, error) {
+	if artifact.Header != nil {
+		return artifact.Header, nil
+	}
+	if artifact.Format != FormatBlue {
+		return nil, fmt.Errorf("%w: %s isn't a BLUE file", ErrInvalidArtifact, artifact.Name)
+	}
+	content, err := a.Artifacts.Open(ctx, artifactKey(id, artifact.Name), artifact.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	header, err := bluefile.ReadHeader(content)
+	if errors.Is(err, bluefile.ErrNotBlue) {
+		return nil, fmt.Errorf("%w: %s isn't a BLUE file", ErrInvalidArtifact, artifact.Name)
+	}
+	return header, err
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FSArtifactStore keeps artifacts as files under a directory on the
+// local filesystem, one subdirectory per task.
+type FSArtifactStore struct {
+	Dir string
+}
+
+// NewFSArtifactStore creates an FSArtifactStore, creating dir if it
+// doesn't exist.
+func NewFSArtifactStore(dir string) (*FSArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FSArtifactStore{Dir: dir}, nil
+}
+
+func (s *FSArtifactStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the artifact to a temporary file next to where it goes,
+// then renames it into place, so readers never see a partial artifact.
+func (s *FSArtifactStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, sha256 string, contentType string) error {
+	target := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Open opens the artifact's file.
+func (s *FSArtifactStore) Open(ctx context.Context, key string, size int64) (io.ReadSeekCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrArtifactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
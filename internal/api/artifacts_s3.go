@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// S3ArtifactStore keeps artifacts as objects in an S3-compatible
+// bucket (e.g., MinIO), addressed path-style as
+// `<endpoint>/<bucket>/<key>` and signed with AWS Signature Version 4.
+type S3ArtifactStore struct {
+	Endpoint *url.URL
+	Bucket   string
+	Region   string
+
+	signer *v4.Signer
+	client *http.Client
+}
+
+// NewS3ArtifactStore creates an S3ArtifactStore for bucket at endpoint
+// (e.g. http://localhost:9000 for a local MinIO). If client is nil,
+// http.DefaultClient is used.
+func NewS3ArtifactStore(endpoint string, bucket string, region string, accessKey string, secretKey string, client *http.Client) (*S3ArtifactStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("the s3 artifact store needs an endpoint and a bucket")
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3ArtifactStore{
+		Endpoint: u,
+		Bucket:   bucket,
+		Region:   region,
+		signer:   v4.NewSigner(credentials.NewStaticCredentials(accessKey, secretKey, "")),
+		client:   client,
+	}, nil
+}
+
+// s3Error is the error document S3 replies with.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for the object under key. body, if given,
+// must be the whole payload, size bytes long, and payloadHash its hex
+// SHA-256.
+func (s *S3ArtifactStore) do(ctx context.Context, method string, key string, header http.Header, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	objectURL := *s.Endpoint
+	objectURL.Path += "/" + s.Bucket + "/" + key
+	request, err := http.NewRequestWithContext(ctx, method, objectURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if payloadHash != "" {
+		// Saves the signer reading the body to hash it
+		request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if _, err := s.signer.Sign(request, body, "s3", s.Region, time.Now()); err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 300 {
+		return response, nil
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrArtifactNotFound
+	}
+	var s3Err s3Error
+	raw, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if xml.Unmarshal(raw, &s3Err) != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("s3 %s %s: HTTP %d", method, key, response.StatusCode)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+}
+
+// Put uploads the artifact as a single object.
+func (s *S3ArtifactStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, sha256 string, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	response, err := s.do(ctx, http.MethodPut, key, header, body, size, sha256)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Open returns a reader for the object that fetches it with ranged
+// GETs as it's read, so seeking around a large artifact only
+// downloads the parts that are read.
+func (s *S3ArtifactStore) Open(ctx context.Context, key string, size int64) (io.ReadSeekCloser, error) {
+	response, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return &s3Object{ctx: ctx, store: s, key: key, size: size}, nil
+}
+
+// s3Object reads an object from its offset onward, starting a new
+// ranged GET whenever it's read after a seek.
+type s3Object struct {
+	ctx    context.Context
+	store  *S3ArtifactStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		response, err := o.store.do(o.ctx, http.MethodGet, o.key, header, nil, 0, "")
+		if err != nil {
+			return 0, err
+		}
+		o.body = response.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3Object.Seek: negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
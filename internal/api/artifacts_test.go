@@ -0,0 +1,296 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/config"
+)
+
+// testArtifact is content with no repeats, so any misplaced range
+// shows.
+func testArtifact(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+	return content
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFSArtifactStore(t *testing.T) {
+	store, err := NewFSArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := store.Open(ctx, "task/missing.tmp", 0); err != ErrArtifactNotFound {
+		t.Errorf("opening a missing artifact: got %v, want ErrArtifactNotFound", err)
+	}
+
+	for _, content := range [][]byte{testArtifact(1000), []byte("replaced")} {
+		err := store.Put(ctx, "task/a.tmp", bytes.NewReader(content), int64(len(content)), sha256Hex(content), echo.MIMEOctetStream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := store.Open(ctx, "task/a.tmp", int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("read back %d bytes (%v), want the %d put", len(got), err, len(content))
+		}
+	}
+}
+
+// s3Stub is an S3 stand-in that checks every request's signature
+// and serves objects with Range support.
+type s3Stub struct {
+	*httptest.Server
+	t      *testing.T
+	signer *v4.Signer
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	ranges  []string
+}
+
+func newS3Stub(t *testing.T) *s3Stub {
+	s := &s3Stub{
+		t:       t,
+		signer:  v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")),
+		objects: make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// verify signs the request's signed headers again with the same
+// credentials and time, and checks that gives the same signature.
+func (s *s3Stub) verify(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/") {
+		return false
+	}
+	signed := ""
+	for _, part := range strings.Split(authorization, ", ") {
+		if strings.HasPrefix(part, "SignedHeaders=") {
+			signed = strings.TrimPrefix(part, "SignedHeaders=")
+		}
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	resigned, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range strings.Split(signed, ";") {
+		if name != "host" && name != "x-amz-date" {
+			resigned.Header[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+		}
+	}
+	if _, err := s.signer.Sign(resigned, nil, "s3", "eu-west-1", signTime); err != nil {
+		return false
+	}
+	return resigned.Header.Get("Authorization") == authorization
+}
+
+func (s *s3Stub) serve(w http.ResponseWriter, r *http.Request) {
+	if !s.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>bad signature</Message></Error>")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		content, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(content) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "<Error><Code>XAmzContentSHA256Mismatch</Code><Message>bad hash</Message></Error>")
+			return
+		}
+		s.objects[key] = content
+	case http.MethodGet, http.MethodHead:
+		content, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(content))
+	}
+}
+
+func TestS3ArtifactStore(t *testing.T) {
+	stub := newS3Stub(t)
+	store, err := NewS3ArtifactStore(stub.URL, "bucket", "eu-west-1", "AKID", "SECRET", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	content := testArtifact(1000)
+	err = store.Put(ctx, "task/a.tmp", bytes.NewReader(content), int64(len(content)), sha256Hex(content), echo.MIMEOctetStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx, "task/missing.tmp", 0); err != ErrArtifactNotFound {
+		t.Errorf("opening a missing artifact: got %v, want ErrArtifactNotFound", err)
+	}
+
+	object, err := store.Open(ctx, "task/a.tmp", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	read := func(offset int64, whence int, n int, want []byte) {
+		t.Helper()
+		if _, err := object.Seek(offset, whence); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, n)
+		if _, err := io.ReadFull(object, got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("seek %d (whence %d): read %v (%v), want %v", offset, whence, got, err, want)
+		}
+	}
+	read(100, io.SeekStart, 10, content[100:110])
+	// Reading on from where it left off carries on with the same GET
+	read(0, io.SeekCurrent, 10, content[110:120])
+	read(-10, io.SeekEnd, 10, content[990:])
+	if n, err := object.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("reading past the end: %d bytes, %v", n, err)
+	}
+	stub.mu.Lock()
+	ranges := stub.ranges
+	stub.mu.Unlock()
+	if want := []string{"bytes=100-", "bytes=990-"}; strings.Join(ranges, " ") != strings.Join(want, " ") {
+		t.Errorf("fetched ranges %v, want %v", ranges, want)
+	}
+
+	// The stub does check signatures
+	wrong, err := NewS3ArtifactStore(stub.URL, "bucket", "eu-west-1", "AKID", "WRONG", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wrong.Put(ctx, "task/b.tmp", bytes.NewReader(content), int64(len(content)), sha256Hex(content), echo.MIMEOctetStream)
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("putting with the wrong secret: got %v", err)
+	}
+}
+
+// newArtifactApi serves artifacts of tasks in a memory store from an
+// fs artifact store, taking uploads of up to maxSize bytes.
+func newArtifactApi(t *testing.T, maxSize int64) (*Api, *echo.Echo) {
+	t.Helper()
+	artifacts, err := NewFSArtifactStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Api{DB: NewMemoryStore(), Artifacts: artifacts, Cfg: &config.Config{ArtifactMaxSize: maxSize}}
+	e := echo.New()
+	e.GET("/api/tasks/:id/artifacts/:name", a.GetArtifact)
+	e.PUT("/api/tasks/:id/artifacts/:name", a.PutArtifact)
+	return a, e
+}
+
+func putArtifact(e *echo.Echo, id string, name string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/tasks/"+id+"/artifacts/"+name, body))
+	return rec
+}
+
+func TestArtifactRange(t *testing.T) {
+	a, e := newArtifactApi(t, 0)
+	id := createTestTask(t, a.DB, Task{Type: "collect"})
+	content := testArtifact(1000)
+	if rec := putArtifact(e, id, "a.dat", bytes.NewReader(content)); rec.Code != http.StatusCreated {
+		t.Fatalf("upload answered %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		rangeHeader string
+		status      int
+		want        []byte
+	}{
+		{"", http.StatusOK, content},
+		{"bytes=100-199", http.StatusPartialContent, content[100:200]},
+		{"bytes=-10", http.StatusPartialContent, content[990:]},
+		{"bytes=2000-", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/tasks/"+id+"/artifacts/a.dat", nil)
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("range %q answered %d, want %d", test.rangeHeader, rec.Code, test.status)
+			continue
+		}
+		if test.want != nil && !bytes.Equal(rec.Body.Bytes(), test.want) {
+			t.Errorf("range %q got %d bytes, not the %d wanted", test.rangeHeader, rec.Body.Len(), len(test.want))
+		}
+	}
+}
+
+// unsized hides the size of a body, so it's sent chunked.
+type unsized struct{ io.Reader }
+
+func TestArtifactMaxSize(t *testing.T) {
+	a, e := newArtifactApi(t, 100)
+	id := createTestTask(t, a.DB, Task{Type: "collect"})
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{"at the limit", bytes.NewReader(testArtifact(100)), http.StatusCreated},
+		{"over the limit", bytes.NewReader(testArtifact(101)), http.StatusRequestEntityTooLarge},
+		{"over the limit, chunked", unsized{bytes.NewReader(testArtifact(101))}, http.StatusRequestEntityTooLarge},
+		{"under the limit, chunked", unsized{bytes.NewReader(testArtifact(50))}, http.StatusCreated},
+	}
+	for _, test := range tests {
+		name := strings.ReplaceAll(strings.ReplaceAll(test.name, " ", "-"), ",", "") + ".dat"
+		if rec := putArtifact(e, id, name, test.body); rec.Code != test.status {
+			t.Errorf("%s: upload answered %d, want %d: %s", test.name, rec.Code, test.status, rec.Body)
+		}
+	}
+
+	status := getTestStatus(t, a.DB, id)
+	if len(status.Artifacts) != 2 {
+		t.Errorf("task has %d artifacts, want the 2 under the limit", len(status.Artifacts))
+	}
+	for _, artifact := range status.Artifacts {
+		if _, err := a.Artifacts.Open(context.Background(), artifactKey(id, artifact.Name), artifact.Size); errors.Is(err, ErrArtifactNotFound) {
+			t.Errorf("%s is registered but not stored", artifact.Name)
+		}
+	}
+}
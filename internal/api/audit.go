@@ -0,0 +1,487 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audited actions
+const (
+	AuditTaskCreate     = "task.create"
+	AuditTaskUpdate     = "task.update"
+	AuditTaskStop       = "task.stop"
+	AuditTaskKill       = "task.kill"
+	AuditScheduleCreate = "schedule.create"
+	AuditScheduleDelete = "schedule.delete"
+	AuditSchedulePause  = "schedule.pause"
+	AuditScheduleResume = "schedule.resume"
+	AuditTokenCreate    = "token.create"
+	AuditTokenDelete    = "token.delete"
+)
+
+// Outcomes of audited actions
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	// AuditDenied actions were refused for lack of permission
+	AuditDenied = "denied"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// maxAuditResponse is how much of a response is kept to find the id
+	// of what was created and the error message in
+	maxAuditResponse = 64 << 10
+	// maxAuditedBody is the largest request body an audited route
+	// takes, all of which is kept in memory and recorded
+	maxAuditedBody = 1 << 20
+	// auditAppendAttempts is how many times an append is retried when
+	// another server appends to the log at the same time
+	auditAppendAttempts = 5
+)
+
+// ErrInvalidAuditQuery is returned for malformed audit queries.
+var ErrInvalidAuditQuery = errors.New("invalid audit query")
+
+// ErrAuditConflict is returned by Store.AppendAuditEntry when an entry
+// with the same sequence number already exists.
+var ErrAuditConflict = errors.New("audit log was appended to concurrently")
+
+// AuditEntry is one action in the audit log. Entries are chained
+// together by hash: each one's Hash covers its contents and the Hash of
+// the entry before it, so changing or deleting an entry breaks the
+// chain from there on.
+type AuditEntry struct {
+	// Seq numbers entries from 1, in the order they were appended
+	Seq    int64              `json:"seq" bson:"_id"`
+	Time   primitive.DateTime `json:"time" bson:"time"`
+	Actor  string             `json:"actor" bson:"actor"`
+	Action string             `json:"action" bson:"action"`
+	// Target is the id of the task, schedule or token acted on
+	Target string `json:"target,omitempty" bson:"target,omitempty"`
+	// Params are the request's query and body parameters, as JSON. They
+	// are kept as the bytes that were hashed so the hash can be checked
+	Params   json.RawMessage `json:"params,omitempty" bson:"params,omitempty"`
+	SourceIP string          `json:"source_ip,omitempty" bson:"source_ip,omitempty"`
+	Outcome  string          `json:"outcome" bson:"outcome"`
+	// Status is the HTTP status the request was answered with
+	Status   int    `json:"status,omitempty" bson:"status,omitempty"`
+	Error    string `json:"error,omitempty" bson:"error,omitempty"`
+	PrevHash string `json:"prev_hash" bson:"prev_hash"`
+	Hash     string `json:"hash" bson:"hash"`
+}
+
+// computeHash returns the hex SHA-256 of the entry's canonical
+// encoding: its fields but Hash, in a fixed order, with the time in
+// milliseconds since the Unix epoch. Unlike the entry's JSON, that
+// doesn't depend on the time zone of the server that wrote it.
+func (e AuditEntry) computeHash() string {
+	encoded, _ := json.Marshal(struct {
+		Seq      int64           `json:"seq"`
+		Time     int64           `json:"time"`
+		Actor    string          `json:"actor"`
+		Action   string          `json:"action"`
+		Target   string          `json:"target"`
+		Params   json.RawMessage `json:"params"`
+		SourceIP string          `json:"source_ip"`
+		Outcome  string          `json:"outcome"`
+		Status   int             `json:"status"`
+		Error    string          `json:"error"`
+		PrevHash string          `json:"prev_hash"`
+	}{e.Seq, int64(e.Time), e.Actor, e.Action, e.Target, e.Params, e.SourceIP, e.Outcome, e.Status, e.Error, e.PrevHash})
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:])
+}
+
+// AuditLog appends entries to the store's audit log, chaining each one
+// to the last.
+type AuditLog struct {
+	DB Store
+
+	mu     sync.Mutex
+	last   *AuditEntry
+	loaded bool
+}
+
+// SetupAuditLog creates an AuditLog.
+func SetupAuditLog(db Store) *AuditLog {
+	return &AuditLog{DB: db}
+}
+
+// Append numbers entry, chains it to the last entry and stores it. If
+// another server got there first, the last entry is read again and the
+// append retried.
+func (l *AuditLog) Append(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.Time == 0 {
+		entry.Time = primitive.NewDateTimeFromTime(time.Now())
+	}
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		if !l.loaded {
+			last, err := l.DB.LastAuditEntry()
+			if err != nil {
+				return err
+			}
+			l.last, l.loaded = last, true
+		}
+
+		entry.Seq, entry.PrevHash = 1, ""
+		if l.last != nil {
+			entry.Seq, entry.PrevHash = l.last.Seq+1, l.last.Hash
+		}
+		entry.Hash = entry.computeHash()
+		err := l.DB.AppendAuditEntry(entry)
+		if errors.Is(err, ErrAuditConflict) {
+			l.loaded = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		l.last = &entry
+		return nil
+	}
+	return ErrAuditConflict
+}
+
+// AuditQuery filters the audit log. Entries come oldest first.
+type AuditQuery struct {
+	Actor   string
+	Actions []string
+	Target  string
+	Outcome string
+	// Since and Until bound the entries' times, inclusive and
+	// exclusive respectively
+	Since time.Time
+	Until time.Time
+	// After is the Seq to continue after, e.g. the NextAfter of the
+	// previous page
+	After int64
+	Limit int
+}
+
+// Matches reports whether entry passes the query's filters.
+func (q *AuditQuery) Matches(entry *AuditEntry) bool {
+	if q.Actor != "" && entry.Actor != q.Actor {
+		return false
+	}
+	if len(q.Actions) > 0 && !containsString(q.Actions, entry.Action) {
+		return false
+	}
+	if q.Target != "" && entry.Target != q.Target {
+		return false
+	}
+	if q.Outcome != "" && entry.Outcome != q.Outcome {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time < primitive.NewDateTimeFromTime(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time >= primitive.NewDateTimeFromTime(q.Until) {
+		return false
+	}
+	return entry.Seq > q.After
+}
+
+// AuditPage is one page of audit entries matching a query.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	// NextAfter fetches the next page as `after`; it's left out on the
+	// last one
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+// AuditVerification is the result of checking the audit log's chain.
+type AuditVerification struct {
+	Valid bool `json:"valid"`
+	// Entries is how many entries were checked
+	Entries int64 `json:"entries"`
+	// BrokenAt is the Seq of the first entry that doesn't check out
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// ParseAuditQuery reads an AuditQuery from query parameters: `actor`,
+// `action` (repeatable or comma-separated), `target`, `outcome`,
+// `since` and `until` (RFC 3339), `after` and `limit`.
+func ParseAuditQuery(params url.Values) (*AuditQuery, error) {
+	q := &AuditQuery{
+		Actor:   params.Get("actor"),
+		Actions: listParam(params, "action"),
+		Target:  params.Get("target"),
+		Outcome: params.Get("outcome"),
+		Limit:   defaultAuditLimit,
+	}
+
+	switch q.Outcome {
+	case "", AuditSuccess, AuditFailure, AuditDenied:
+	default:
+		return nil, fmt.Errorf("%w: unknown outcome %q", ErrInvalidAuditQuery, q.Outcome)
+	}
+
+	for name, bound := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidAuditQuery, name)
+			}
+			*bound = t
+		}
+	}
+
+	if value := params.Get("after"); value != "" {
+		after, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || after < 0 {
+			return nil, fmt.Errorf("%w: after must be a sequence number", ErrInvalidAuditQuery)
+		}
+		q.After = after
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			return nil, fmt.Errorf("%w: limit must be a number from 1 to %d", ErrInvalidAuditQuery, maxAuditLimit)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// GetAudit returns a page of the audit log entries matching the
+// request's filters (see ParseAuditQuery), oldest first. With
+// `format=jsonl` it instead exports every matching entry as JSON
+// Lines, ignoring `limit`.
+func (a *Api) GetAudit(c echo.Context) error {
+	query, err := ParseAuditQuery(c.QueryParams())
+	if err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	switch format := c.QueryParam("format"); format {
+	case "", "json":
+	case "jsonl":
+		return a.exportAudit(c, query)
+	default:
+		return c.JSON(http.StatusBadRequest, Response{Msg: fmt.Sprintf("%v: unknown format %q", ErrInvalidAuditQuery, format)})
+	}
+
+	entries, err := a.DB.QueryAudit(query)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	page := AuditPage{Entries: *entries}
+	if len(page.Entries) == query.Limit {
+		page.NextAfter = page.Entries[len(page.Entries)-1].Seq
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// exportAudit streams every entry matching query as JSON Lines.
+func (a *Api) exportAudit(c echo.Context, query *AuditQuery) error {
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	response.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+	response.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(response)
+	query.Limit = maxAuditLimit
+	for {
+		entries, err := a.DB.QueryAudit(query)
+		if err != nil {
+			// Too late to change the status; cut the export short
+			c.Logger().Error(err)
+			return nil
+		}
+		for i := range *entries {
+			if err := encoder.Encode(&(*entries)[i]); err != nil {
+				return nil
+			}
+		}
+		response.Flush()
+		if len(*entries) < query.Limit {
+			return nil
+		}
+		query.After = (*entries)[len(*entries)-1].Seq
+	}
+}
+
+// VerifyAudit walks the whole audit log, checking every entry's hash
+// and that each follows on from the one before.
+func (a *Api) VerifyAudit(c echo.Context) error {
+	var result AuditVerification
+	query := &AuditQuery{Limit: maxAuditLimit}
+	prevHash := ""
+	for {
+		entries, err := a.DB.QueryAudit(query)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+		}
+		for _, entry := range *entries {
+			problem := ""
+			switch {
+			case entry.Seq != result.Entries+1:
+				problem = fmt.Sprintf("expected entry %d, found %d", result.Entries+1, entry.Seq)
+			case entry.PrevHash != prevHash:
+				problem = "previous hash doesn't match the entry before"
+			case entry.computeHash() != entry.Hash:
+				problem = "hash doesn't match the entry's contents"
+			}
+			if problem != "" {
+				result.BrokenAt, result.Problem = entry.Seq, problem
+				return c.JSON(http.StatusOK, result)
+			}
+			result.Entries++
+			prevHash = entry.Hash
+		}
+		if len(*entries) < query.Limit {
+			break
+		}
+		query.After = (*entries)[len(*entries)-1].Seq
+	}
+	result.Valid = true
+	return c.JSON(http.StatusOK, result)
+}
+
+// Audited records requests to a route in the audit log as action,
+// whether they succeed, fail or are denied. The target is the route's
+// `:id`, the `id` in the request body or, for requests that create
+// something, the id in the response. Bodies over maxAuditedBody are
+// refused, and recorded as failures without their content.
+func (a *Api) Audited(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxAuditedBody+1))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+			}
+			request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			recorder := &auditRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			if len(body) > maxAuditedBody {
+				body = nil
+				msg := fmt.Sprintf("request body is larger than %d bytes", maxAuditedBody)
+				c.JSON(http.StatusRequestEntityTooLarge, Response{Msg: msg})
+			} else if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			var requestBody, response struct {
+				Id  string `json:"id"`
+				Msg string `json:"msg"`
+			}
+			_ = json.Unmarshal(body, &requestBody)
+			_ = json.Unmarshal(recorder.body.Bytes(), &response)
+
+			entry := AuditEntry{
+				Actor:    actorOf(c),
+				Action:   action,
+				Target:   c.Param("id"),
+				Params:   auditParams(c.QueryParams(), body),
+				SourceIP: c.RealIP(),
+				Status:   c.Response().Status,
+			}
+			if entry.Target == "" {
+				entry.Target = requestBody.Id
+			}
+			if entry.Target == "" {
+				entry.Target = response.Id
+			}
+			switch {
+			case entry.Status == http.StatusUnauthorized || entry.Status == http.StatusForbidden:
+				entry.Outcome = AuditDenied
+			case entry.Status >= http.StatusBadRequest:
+				entry.Outcome = AuditFailure
+			default:
+				entry.Outcome = AuditSuccess
+			}
+			if entry.Outcome != AuditSuccess {
+				entry.Error = response.Msg
+			}
+
+			// The action has happened either way; a failure to record
+			// it is for the operators to chase up
+			if err := a.Audit.Append(entry); err != nil {
+				c.Logger().Errorf("Error recording %s by %s in the audit log: %v", action, entry.Actor, err)
+			}
+			return nil
+		}
+	}
+}
+
+// auditAction records an action the server took of its own accord,
+// such as starting a scheduled task, in the audit log.
+func (a *Api) auditAction(actor string, action string, target string, params map[string]interface{}, err error) {
+	entry := AuditEntry{Actor: actor, Action: action, Target: target, Outcome: AuditSuccess}
+	if len(params) > 0 {
+		entry.Params, _ = json.Marshal(params)
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = AuditFailure, err.Error()
+	}
+	if err := a.Audit.Append(entry); err != nil {
+		log.Errorf("Error recording %s by %s in the audit log: %v", action, actor, err)
+	}
+}
+
+// auditParams encodes a request's query parameters and JSON body for
+// an audit entry. Bodies that aren't JSON are left out.
+func auditParams(query url.Values, body []byte) json.RawMessage {
+	params := map[string]interface{}{}
+	if len(query) > 0 {
+		params["query"] = query
+	}
+	var decoded interface{}
+	if len(body) > 0 && json.Unmarshal(body, &decoded) == nil {
+		params["body"] = decoded
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(params)
+	return encoded
+}
+
+// auditRecorder keeps the start of a response while passing it on.
+type auditRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if room := maxAuditResponse - r.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		r.body.Write(p[:room])
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes on, which streaming responses rely on.
+func (r *auditRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
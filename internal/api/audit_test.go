@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestAuditLog appends count entries to an audit log in a memory store.
+func newTestAuditLog(t *testing.T, count int) *kvStore {
+	t.Helper()
+	db := NewMemoryStore()
+	log := SetupAuditLog(db)
+	for i := 0; i < count; i++ {
+		err := log.Append(AuditEntry{
+			Actor:   "alice",
+			Action:  AuditTaskCreate,
+			Target:  primitive.NewObjectID().Hex(),
+			Params:  json.RawMessage(`{"body":{"type":"collect"}}`),
+			Outcome: AuditSuccess,
+			Status:  http.StatusCreated,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db.(*kvStore)
+}
+
+func verifyAudit(t *testing.T, db Store) AuditVerification {
+	t.Helper()
+	a := &Api{DB: db}
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/audit/verify", nil), rec)
+	if err := a.VerifyAudit(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify answered %d: %s", rec.Code, rec.Body)
+	}
+	var result AuditVerification
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestVerifyAudit(t *testing.T) {
+	modify := func(t *testing.T, db *kvStore, seq int64) {
+		err := db.kv.Update(func(tx kvTx) error {
+			var entry AuditEntry
+			if err := tx.Get(auditBucket, auditKey(seq), &entry); err != nil {
+				return err
+			}
+			entry.Actor = "mallory"
+			return tx.Put(auditBucket, auditKey(seq), &entry)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	remove := func(t *testing.T, db *kvStore, seq int64) {
+		err := db.kv.Update(func(tx kvTx) error {
+			return tx.Delete(auditBucket, auditKey(seq))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		tamper   func(t *testing.T, db *kvStore)
+		brokenAt int64
+	}{
+		{"intact", func(t *testing.T, db *kvStore) {}, 0},
+		{"modified", func(t *testing.T, db *kvStore) { modify(t, db, 3) }, 3},
+		{"deleted", func(t *testing.T, db *kvStore) { remove(t, db, 6) }, 7},
+		// The chain can't tell a truncated log from a shorter one
+		{"last deleted", func(t *testing.T, db *kvStore) { remove(t, db, 10) }, 0},
+		{"modified and deleted", func(t *testing.T, db *kvStore) {
+			remove(t, db, 6)
+			modify(t, db, 3)
+		}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestAuditLog(t, 10)
+			test.tamper(t, db)
+			result := verifyAudit(t, db)
+			if result.BrokenAt != test.brokenAt {
+				t.Errorf("broken at %d (%s), want %d", result.BrokenAt, result.Problem, test.brokenAt)
+			}
+			if result.Valid != (test.brokenAt == 0) {
+				t.Errorf("valid = %v with the chain broken at %d", result.Valid, result.BrokenAt)
+			}
+		})
+	}
+}
+
+func TestAuditHashIgnoresTimeZone(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	entry := AuditEntry{
+		Seq:     1,
+		Time:    primitive.NewDateTimeFromTime(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)),
+		Actor:   "alice",
+		Action:  AuditTaskStop,
+		Outcome: AuditSuccess,
+	}
+
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.UTC
+	utc := entry.computeHash()
+	time.Local = kolkata
+	if hash := entry.computeHash(); hash != utc {
+		t.Errorf("hash is %s in Asia/Kolkata and %s in UTC", hash, utc)
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// limitDuration caps a task's stop time at its type's MaxDuration
+// after its start time (or now, if it doesn't have one), so every task
+// of a type with a MaxDuration has a stop time for RunAutoStop to
+// enforce.
+func limitDuration(task *Task, entry *CatalogEntry, now time.Time) {
+	if entry.MaxDuration <= 0 {
+		return
+	}
+	start := now
+	if task.StartTime != 0 {
+		start = task.StartTime.Time()
+	}
+	latest := primitive.NewDateTimeFromTime(start.Add(time.Duration(entry.MaxDuration) * time.Second))
+	if task.StopTime == 0 || task.StopTime > latest {
+		task.StopTime = latest
+	}
+}
+
+// RunAutoStop stops pending and running tasks once their stop time
+// arrives, checking every second until ctx is cancelled. They're
+// stopped through the same path as StopTask, with a deadline of
+// `Cfg.StopGracePeriod` after which RunStopEscalation kills them.
+func (a *Api) RunAutoStop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.autoStop(ctx, time.Now())
+		}
+	}
+}
+
+// autoStop stops every task whose stop time passed by now.
+func (a *Api) autoStop(ctx context.Context, now time.Time) {
+	due, err := a.DB.GetDueStops(now)
+	if err != nil {
+		log.Errorf("Error looking for tasks due to stop: %v", err)
+		return
+	}
+
+	var deadline time.Time
+	if a.Cfg.StopGracePeriod > 0 {
+		deadline = now.Add(time.Duration(a.Cfg.StopGracePeriod) * time.Second)
+	}
+	for _, status := range *due {
+		id := status.Id.Hex()
+		err := a.DB.StopTask(id, deadline, "auto-stop")
+		var transitionErr *TransitionError
+		if errors.As(err, &transitionErr) {
+			// It finished or was stopped in the meantime
+			continue
+		}
+		a.auditAction("auto-stop", AuditTaskStop, id, map[string]interface{}{"reason": "stop time reached"}, err)
+		if err != nil {
+			log.Errorf("Error stopping task %s: %v", id, err)
+			continue
+		}
+		log.Infof("Stopping task %s: stop time reached", id)
+		a.sendCommand(ctx, id, protocol.CommandStop, "stop time reached", deadline)
+	}
+}
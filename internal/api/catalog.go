@@ -0,0 +1,312 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrCatalogNotFound is returned when no catalog has been fetched yet.
+var ErrCatalogNotFound = errors.New("task catalog has not been fetched yet")
+
+// CatalogEntry is a type of task the external API says can be run.
+type CatalogEntry struct {
+	Name        string `json:"name" xml:"name" bson:"name"`
+	Description string `json:"description,omitempty" xml:"description" bson:"description,omitempty"`
+	// MaxDuration is the longest, in seconds, a task of this type may
+	// run; zero means there's no limit
+	MaxDuration int `json:"max_duration,omitempty" xml:"max_duration" bson:"max_duration,omitempty"`
+	// Parameters are the parameters tasks of this type take
+	Parameters []CatalogParameter `json:"parameters,omitempty" xml:"parameters>parameter" bson:"parameters,omitempty"`
+}
+
+// CatalogVersion is one version of the catalog, as fetched from the
+// external API. A new version is only stored when the entries change.
+type CatalogVersion struct {
+	Version      int                `json:"version" bson:"_id"`
+	FetchedAt    primitive.DateTime `json:"fetched_at" bson:"fetched_at"`
+	ETag         string             `json:"etag,omitempty" bson:"etag,omitempty"`
+	LastModified string             `json:"last_modified,omitempty" bson:"last_modified,omitempty"`
+	Hash         string             `json:"hash" bson:"hash"`
+	Entries      []CatalogEntry     `json:"entries" bson:"entries"`
+	Changes      CatalogChanges     `json:"changes" bson:"changes"`
+}
+
+// Entry looks up a task type by name.
+func (v *CatalogVersion) Entry(name string) (*CatalogEntry, bool) {
+	for i := range v.Entries {
+		if v.Entries[i].Name == name {
+			return &v.Entries[i], true
+		}
+	}
+	return nil, false
+}
+
+// CatalogChanges lists the task types that differ from the previous
+// catalog version, by name.
+type CatalogChanges struct {
+	Added   []string `json:"added,omitempty" bson:"added,omitempty"`
+	Removed []string `json:"removed,omitempty" bson:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty" bson:"changed,omitempty"`
+}
+
+// CatalogChange is a catalog version's changes, for /api/catalog/changes.
+type CatalogChange struct {
+	Version   int                `json:"version"`
+	FetchedAt primitive.DateTime `json:"fetched_at"`
+	CatalogChanges
+}
+
+// CatalogResponse is the cached catalog along with how fresh it is.
+type CatalogResponse struct {
+	Version   int       `json:"version"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// CheckedAt is when the external API last confirmed this version
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// Stale is set when the external API hasn't confirmed the catalog
+	// recently, e.g. because it's down
+	Stale bool           `json:"stale"`
+	Error string         `json:"error,omitempty"`
+	Tasks []CatalogEntry `json:"tasks"`
+}
+
+// CatalogCache keeps the latest catalog in memory, refreshing it from
+// the external API every Interval with a conditional GET. New versions
+// are saved in the store, so the cache survives restarts and the
+// external API being down.
+type CatalogCache struct {
+	DB         Store
+	HTTPClient *http.Client
+	URL        string
+	Interval   time.Duration
+
+	// refreshing serializes refreshes, which mu isn't held across
+	refreshing sync.Mutex
+	mu         sync.RWMutex
+	current    *CatalogVersion
+	checkedAt  time.Time
+	lastError  error
+}
+
+// SetupCatalogCache creates a CatalogCache, loading the latest stored
+// catalog version, if there is one.
+func SetupCatalogCache(db Store, client *http.Client, url string, interval time.Duration) (*CatalogCache, error) {
+	cache := &CatalogCache{DB: db, HTTPClient: client, URL: url, Interval: interval}
+	current, err := db.GetLatestCatalog()
+	if err != nil && err != ErrCatalogNotFound {
+		return nil, err
+	}
+	cache.current = current
+	return cache, nil
+}
+
+// Current returns the latest catalog version, or ErrCatalogNotFound.
+func (c *CatalogCache) Current() (*CatalogVersion, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.current == nil {
+		return nil, ErrCatalogNotFound
+	}
+	return c.current, nil
+}
+
+// Run refreshes the catalog right away and then every Interval until
+// ctx is cancelled.
+func (c *CatalogCache) Run(ctx context.Context) {
+	if c.URL == "" || c.Interval <= 0 {
+		log.Info("Catalog sync disabled; serving the stored catalog only")
+		return
+	}
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			log.Errorf("Error refreshing task catalog: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the catalog if it changed since the version we have,
+// storing it as a new version if its entries differ.
+func (c *CatalogCache) Refresh(ctx context.Context) error {
+	c.refreshing.Lock()
+	defer c.refreshing.Unlock()
+
+	current, _ := c.Current()
+	var etag, lastModified string
+	if current != nil {
+		etag, lastModified = current.ETag, current.LastModified
+	}
+
+	result, err := QueryExternal(ctx, c.URL, c.HTTPClient, etag, lastModified)
+	if err != nil {
+		c.mu.Lock()
+		c.lastError = err
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	c.checkedAt = time.Now()
+	c.lastError = nil
+	next, err := c.nextVersion(result)
+	c.mu.Unlock()
+	if next == nil || err != nil {
+		return err
+	}
+
+	// The current version is served until the next one is saved
+	if err := c.DB.SaveCatalog(*next); err != nil {
+		return err
+	}
+	log.Infof("Task catalog updated to version %d", next.Version)
+	c.mu.Lock()
+	c.current = next
+	c.mu.Unlock()
+	return nil
+}
+
+// nextVersion returns the catalog version a fetch makes, or nil if its
+// entries are the ones we have; then, only the validators are updated.
+// c.mu must be held.
+func (c *CatalogCache) nextVersion(result *ExternalCatalog) (*CatalogVersion, error) {
+	if result.NotModified {
+		return nil, nil
+	}
+	hash, err := catalogHash(result.Entries)
+	if err != nil {
+		return nil, err
+	}
+	if c.current != nil && c.current.Hash == hash {
+		// Same catalog served with new validators
+		updated := *c.current
+		updated.ETag = result.ETag
+		updated.LastModified = result.LastModified
+		c.current = &updated
+		return nil, nil
+	}
+
+	next := &CatalogVersion{
+		Version:      1,
+		FetchedAt:    primitive.NewDateTimeFromTime(time.Now()),
+		ETag:         result.ETag,
+		LastModified: result.LastModified,
+		Hash:         hash,
+		Entries:      result.Entries,
+	}
+	if c.current != nil {
+		next.Version = c.current.Version + 1
+		next.Changes = diffCatalogs(c.current.Entries, result.Entries)
+	} else {
+		next.Changes = diffCatalogs(nil, result.Entries)
+	}
+	return next, nil
+}
+
+// Response describes the cached catalog and how fresh it is.
+func (c *CatalogCache) Response() (*CatalogResponse, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.current == nil {
+		return nil, ErrCatalogNotFound
+	}
+
+	response := &CatalogResponse{
+		Version:   c.current.Version,
+		FetchedAt: c.current.FetchedAt.Time().UTC(),
+		Tasks:     c.current.Entries,
+	}
+	if !c.checkedAt.IsZero() {
+		checkedAt := c.checkedAt.UTC()
+		response.CheckedAt = &checkedAt
+	}
+	if c.lastError != nil {
+		response.Error = c.lastError.Error()
+	}
+	// Allow one missed refresh before calling it stale
+	response.Stale = c.checkedAt.IsZero() || c.lastError != nil ||
+		(c.Interval > 0 && time.Since(c.checkedAt) > 2*c.Interval)
+	return response, nil
+}
+
+// catalogHash fingerprints a catalog's entries, to tell whether a
+// fetched catalog is actually new.
+func catalogHash(entries []CatalogEntry) (string, error) {
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// diffCatalogs lists the task types added, removed or changed in next.
+func diffCatalogs(previous []CatalogEntry, next []CatalogEntry) CatalogChanges {
+	var changes CatalogChanges
+	before := make(map[string]CatalogEntry, len(previous))
+	for _, entry := range previous {
+		before[entry.Name] = entry
+	}
+	after := make(map[string]bool, len(next))
+	for _, entry := range next {
+		after[entry.Name] = true
+		old, ok := before[entry.Name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, entry.Name)
+		case !reflect.DeepEqual(old, entry):
+			changes.Changed = append(changes.Changed, entry.Name)
+		}
+	}
+	for _, entry := range previous {
+		if !after[entry.Name] {
+			changes.Removed = append(changes.Removed, entry.Name)
+		}
+	}
+	return changes
+}
+
+// GetCatalogChanges returns what changed in every catalog version
+// after the optional `since` version, oldest first.
+func (a *Api) GetCatalogChanges(c echo.Context) error {
+	since := 0
+	if param := c.QueryParam("since"); param != "" {
+		var err error
+		since, err = strconv.Atoi(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "since must be a catalog version number")
+		}
+	}
+
+	versions, err := a.DB.GetCatalogVersions(since)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	changes := make([]CatalogChange, 0, len(*versions))
+	for _, version := range *versions {
+		changes = append(changes, CatalogChange{
+			Version:        version.Version,
+			FetchedAt:      version.FetchedAt,
+			CatalogChanges: version.Changes,
+		})
+	}
+	return c.JSON(http.StatusOK, changes)
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// catalogServer is the external API, serving catalog with an ETag
+// that changes along with it.
+type catalogServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	catalog     string
+	etag        string
+	status      int
+	conditional int
+}
+
+func newCatalogServer(t *testing.T) *catalogServer {
+	t.Helper()
+	s := &catalogServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			s.conditional++
+			if match == s.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("ETag", s.etag)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, s.catalog)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// serve changes the catalog to tasks, given as name, description pairs.
+func (s *catalogServer) serve(etag string, tasks ...string) {
+	var xml strings.Builder
+	xml.WriteString("<tasks>")
+	for i := 0; i < len(tasks); i += 2 {
+		fmt.Fprintf(&xml, "<task><name>%s</name><description>%s</description></task>", tasks[i], tasks[i+1])
+	}
+	xml.WriteString("</tasks>")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalog, s.etag = xml.String(), etag
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	server := newCatalogServer(t)
+	db := NewMemoryStore()
+	cache, err := SetupCatalogCache(db, server.Client(), server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Current(); err != ErrCatalogNotFound {
+		t.Fatalf("before fetching: got %v, want ErrCatalogNotFound", err)
+	}
+	refresh := func() *CatalogVersion {
+		t.Helper()
+		if err := cache.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		current, err := cache.Current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+
+	server.serve(`"1"`, "collect", "Collect samples", "survey", "Sweep the band")
+	first := refresh()
+	if first.Version != 1 || len(first.Entries) != 2 || first.ETag != `"1"` {
+		t.Fatalf("first version is %+v", first)
+	}
+	if want := (CatalogChanges{Added: []string{"collect", "survey"}}); !reflect.DeepEqual(first.Changes, want) {
+		t.Errorf("first version's changes are %+v, want %+v", first.Changes, want)
+	}
+
+	// Unchanged, as the external API says with a 304
+	current := refresh()
+	server.mu.Lock()
+	conditional := server.conditional
+	server.mu.Unlock()
+	if current.Version != 1 || conditional != 1 {
+		t.Errorf("after a 304: version %d, %d conditional requests", current.Version, conditional)
+	}
+
+	// The same catalog under a new ETag isn't a new version
+	server.serve(`"2"`, "collect", "Collect samples", "survey", "Sweep the band")
+	if current := refresh(); current.Version != 1 || current.ETag != `"2"` {
+		t.Errorf("same catalog, new ETag: version %d with ETag %s", current.Version, current.ETag)
+	}
+
+	server.serve(`"3"`, "collect", "Collect more samples", "monitor", "Watch a channel")
+	second := refresh()
+	if second.Version != 2 {
+		t.Fatalf("after a change, version %d", second.Version)
+	}
+	want := CatalogChanges{Added: []string{"monitor"}, Removed: []string{"survey"}, Changed: []string{"collect"}}
+	if !reflect.DeepEqual(second.Changes, want) {
+		t.Errorf("second version's changes are %+v, want %+v", second.Changes, want)
+	}
+	if entry, ok := second.Entry("collect"); !ok || entry.Description != "Collect more samples" {
+		t.Errorf("collect is %+v", entry)
+	}
+
+	// Versions are stored, and the cache starts from the latest
+	reloaded, err := SetupCatalogCache(db, server.Client(), server.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := reloaded.Current(); err != nil || current.Version != 2 {
+		t.Errorf("reloaded cache is at %+v, %v", current, err)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/catalog/changes?since=1", nil), rec)
+	if err := (&Api{DB: db}).GetCatalogChanges(c); err != nil {
+		t.Fatal(err)
+	}
+	var changes []CatalogChange
+	if err := json.Unmarshal(rec.Body.Bytes(), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Version != 2 || !reflect.DeepEqual(changes[0].CatalogChanges, want) {
+		t.Errorf("changes since version 1 are %+v", changes)
+	}
+
+	// With the external API down, the stored catalog is served as stale
+	server.mu.Lock()
+	server.status = http.StatusServiceUnavailable
+	server.mu.Unlock()
+	if err := cache.Refresh(context.Background()); err == nil {
+		t.Fatal("refreshed from a failing external API")
+	}
+	response, err := cache.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Version != 2 || !response.Stale || response.Error == "" {
+		t.Errorf("while the external API is down: version %d, stale %v, error %q", response.Version, response.Stale, response.Error)
+	}
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	a := CatalogEntry{Name: "a"}
+	b := CatalogEntry{Name: "b", MaxDuration: 60}
+	c := CatalogEntry{Name: "c"}
+	longerB := CatalogEntry{Name: "b", MaxDuration: 120}
+
+	tests := []struct {
+		name           string
+		previous, next []CatalogEntry
+		want           CatalogChanges
+	}{
+		{"first", nil, []CatalogEntry{a, b}, CatalogChanges{Added: []string{"a", "b"}}},
+		{"same", []CatalogEntry{a, b}, []CatalogEntry{a, b}, CatalogChanges{}},
+		{"reordered", []CatalogEntry{a, b}, []CatalogEntry{b, a}, CatalogChanges{}},
+		{"removed", []CatalogEntry{a, b}, []CatalogEntry{b}, CatalogChanges{Removed: []string{"a"}}},
+		{"changed", []CatalogEntry{a, b}, []CatalogEntry{a, longerB}, CatalogChanges{Changed: []string{"b"}}},
+		{"all", []CatalogEntry{a, b}, []CatalogEntry{longerB, c}, CatalogChanges{
+			Added:   []string{"c"},
+			Removed: []string{"a"},
+			Changed: []string{"b"},
+		}},
+	}
+	for _, test := range tests {
+		if got := diffCatalogs(test.previous, test.next); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: changes are %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// StopRequest is the optional body of a stop request.
+type StopRequest struct {
+	// GracePeriod is how many seconds the task has to stop before
+	// it's killed. Zero (or less) means it's never killed.
+	GracePeriod int `json:"grace_period"`
+}
+
+// KillTask moves the requested task to stopping (or escalates a
+// stop already in progress) with `kill_requested` set, and sends
+// its worker a kill command. The worker abandons the task without
+// waiting for it to wind down.
+func (a *Api) KillTask(c echo.Context) error {
+	id := c.Param("id")
+	if err := a.authorizeControl(c, id); err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	err := a.DB.KillTask(id, actorOf(c), "kill requested")
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	a.sendCommand(c.Request().Context(), id, protocol.CommandKill, "kill requested", time.Time{})
+
+	msg := fmt.Sprintf("Successfully submitted kill task request for %s", id)
+	return c.JSON(http.StatusOK, Response{Msg: msg})
+}
+
+// sendCommand publishes a command for a task, routed to its worker if
+// it has one. The command is only a shortcut: the task's record already
+// says what was asked, and the worker finds out from the Ack to its
+// next report if the command doesn't get through.
+func (a *Api) sendCommand(ctx context.Context, id string, kind protocol.CommandKind, reason string, deadline time.Time) {
+	err := a.publishCommand(ctx, protocol.Command{
+		Kind:     kind,
+		TaskId:   id,
+		Reason:   reason,
+		Deadline: deadline,
+	})
+	if err != nil {
+		log.Warnf("Error sending %s command for task %s, its worker will find out on its next report: %v", kind, id, err)
+	}
+}
+
+// publishCommand fills in the worker running the command's task and
+// the time, and publishes it.
+func (a *Api) publishCommand(ctx context.Context, command protocol.Command) error {
+	status, err := a.DB.GetSingleStatus(command.TaskId)
+	if err != nil {
+		return err
+	}
+	command.WorkerId = status.WorkerId
+	command.Time = time.Now().UTC()
+	return a.Bus.PublishCommand(ctx, command)
+}
+
+// RunStopEscalation kills tasks that are still stopping after their
+// stop deadline, checking every second until ctx is cancelled.
+func (a *Api) RunStopEscalation(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.escalate(time.Now())
+		}
+	}
+}
+
+// escalate kills every task whose stop deadline passed by now.
+func (a *Api) escalate(now time.Time) {
+	overdue, err := a.DB.GetOverdueStops(now)
+	if err != nil {
+		log.Errorf("Error looking for overdue stops: %v", err)
+		return
+	}
+
+	for _, status := range *overdue {
+		id := status.Id.Hex()
+		reason := "stop deadline passed"
+		err := a.DB.KillTask(id, "escalation", reason)
+		if err == ErrTaskNotFound {
+			// It stopped in the meantime
+			continue
+		}
+		a.auditAction("escalation", AuditTaskKill, id, map[string]interface{}{"reason": reason}, err)
+		if err != nil {
+			log.Errorf("Error killing task %s: %v", id, err)
+			continue
+		}
+		log.Warnf("Killing task %s: %s", id, reason)
+		a.sendCommand(context.Background(), id, protocol.CommandKill, reason, time.Time{})
+	}
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week). Each field is a
+// bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Standard cron matches a day if either day field does, unless
+	// one of them is `*`, in which case only the other counts.
+	domStar, dowStar bool
+}
+
+// cronDescriptors are the @-shorthands for common expressions.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron parses a cron expression. Fields may be `*`, numbers (or
+// month and day names), ranges (`1-5`), steps (`*/15`, `0-30/10`) and
+// comma-separated lists of those. Day of week 7 is Sunday, like 0.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*" || fields[2] == "?"
+	c.dowStar = fields[4] == "*" || fields[4] == "?"
+	return &c, nil
+}
+
+// parseCronField parses one field into a bitset of the values in
+// [min, max] it matches.
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		stepped := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:i]
+			stepped = true
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			lo, hi = min, max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(bounds[1], names); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if lo, err = parseCronValue(rangePart, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if stepped {
+				// `5/15` means every 15 starting at 5
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
+
+// next returns the first time after `after` that the expression
+// matches, in after's location, or the zero time if there is none
+// within five years (e.g., `0 0 30 2 *`). Where daylight saving time
+// starts, times that don't exist that day are skipped; where it ends,
+// times that happen twice only match the first time, unless the
+// expression runs every hour.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var n time.Time
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			n = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			n = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			// Not time.Date, which may pick either of an hour that
+			// happens twice
+			n = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			n = t.Add(time.Minute)
+		case c.hour != cronEveryHour && repeatsWallClock(t):
+			n = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// Midnight may not exist because the clocks went forward, and
+		// time.Date then goes back instead; step through the gap a
+		// minute at a time
+		if !n.After(t) {
+			n = t.Add(time.Minute)
+		}
+		t = n
+	}
+	return time.Time{}
+}
+
+// cronEveryHour is the hour field of an expression that runs every hour.
+const cronEveryHour = 1<<24 - 1
+
+// repeatsWallClock reports whether t's wall clock time already
+// happened a little earlier, as it does when the clocks go back.
+// Daylight saving shifts are multiples of half an hour, of at most two.
+func repeatsWallClock(t time.Time) bool {
+	for shift := 30 * time.Minute; shift <= 2*time.Hour; shift += 30 * time.Minute {
+		earlier := t.Add(-shift)
+		if earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dowMatch
+	case c.dowStar:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skip(err)
+	}
+	// A Sunday
+	feb1 := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  []string
+	}{
+		{
+			"day of month or day of week", "0 0 13 * 1", feb1,
+			[]string{"2026-02-02T00:00:00Z", "2026-02-09T00:00:00Z", "2026-02-13T00:00:00Z", "2026-02-16T00:00:00Z"},
+		},
+		{
+			"day of week is *", "0 0 13 * *", feb1,
+			[]string{"2026-02-13T00:00:00Z", "2026-03-13T00:00:00Z", "2026-04-13T00:00:00Z"},
+		},
+		{
+			"day of month is *", "0 0 * * 1", feb1,
+			[]string{"2026-02-02T00:00:00Z", "2026-02-09T00:00:00Z", "2026-02-16T00:00:00Z"},
+		},
+		{
+			"day of month is ?", "0 0 ? * mon", feb1,
+			[]string{"2026-02-02T00:00:00Z", "2026-02-09T00:00:00Z"},
+		},
+		{
+			"step from a start", "5/15 * * * *", feb1,
+			[]string{"2026-02-01T00:05:00Z", "2026-02-01T00:20:00Z", "2026-02-01T00:35:00Z", "2026-02-01T00:50:00Z", "2026-02-01T01:05:00Z"},
+		},
+		{
+			"stepped range", "0-30/10 9 * * mon-fri", feb1,
+			[]string{"2026-02-02T09:00:00Z", "2026-02-02T09:10:00Z", "2026-02-02T09:20:00Z", "2026-02-02T09:30:00Z", "2026-02-03T09:00:00Z"},
+		},
+		{
+			"day of week 7 is Sunday", "0 12 * * 7", feb1,
+			[]string{"2026-02-01T12:00:00Z", "2026-02-08T12:00:00Z"},
+		},
+		{
+			"range up to 7", "0 12 * * 5-7", feb1,
+			[]string{"2026-02-01T12:00:00Z", "2026-02-06T12:00:00Z", "2026-02-07T12:00:00Z", "2026-02-08T12:00:00Z"},
+		},
+		{
+			"lists and month names", "0 6,18 1 jan,jul *", feb1,
+			[]string{"2026-07-01T06:00:00Z", "2026-07-01T18:00:00Z", "2027-01-01T06:00:00Z"},
+		},
+		{
+			"descriptor", "@monthly", feb1,
+			[]string{"2026-03-01T00:00:00Z", "2026-04-01T00:00:00Z"},
+		},
+		{
+			"strictly after", "0 0 * * *", feb1,
+			[]string{"2026-02-02T00:00:00Z"},
+		},
+		{
+			"leap day", "0 0 29 2 *", feb1,
+			[]string{"2028-02-29T00:00:00Z"},
+		},
+		{
+			"never", "0 0 30 2 *", feb1,
+			[]string{"0001-01-01T00:00:00Z"},
+		},
+		{
+			"skipped when clocks go forward", "30 2 * * *", time.Date(2026, 3, 7, 0, 0, 0, 0, newYork),
+			[]string{"2026-03-07T02:30:00-05:00", "2026-03-09T02:30:00-04:00"},
+		},
+		{
+			"hourly when clocks go forward", "0 * * * *", time.Date(2026, 3, 8, 0, 0, 0, 0, newYork),
+			[]string{"2026-03-08T01:00:00-05:00", "2026-03-08T03:00:00-04:00", "2026-03-08T04:00:00-04:00"},
+		},
+		{
+			"once when clocks go back", "30 1 * * *", time.Date(2026, 10, 31, 0, 0, 0, 0, newYork),
+			[]string{"2026-10-31T01:30:00-04:00", "2026-11-01T01:30:00-04:00", "2026-11-02T01:30:00-05:00"},
+		},
+		{
+			"hourly when clocks go back", "0 * * * *", time.Date(2026, 11, 1, 0, 0, 0, 0, newYork),
+			[]string{"2026-11-01T01:00:00-04:00", "2026-11-01T01:00:00-05:00", "2026-11-01T02:00:00-05:00"},
+		},
+		{
+			"first of a repeated hour", "30 2 * * *", time.Date(2026, 4, 4, 0, 0, 0, 0, sydney),
+			[]string{"2026-04-04T02:30:00+11:00", "2026-04-05T02:30:00+11:00", "2026-04-06T02:30:00+10:00"},
+		},
+		{
+			"skipped when clocks go forward south", "30 2 * * *", time.Date(2026, 10, 3, 0, 0, 0, 0, sydney),
+			[]string{"2026-10-03T02:30:00+10:00", "2026-10-05T02:30:00+11:00"},
+		},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		after := test.after
+		for i, want := range test.want {
+			after = c.next(after)
+			if got := after.Format(time.RFC3339); got != want {
+				t.Errorf("%s: %q run %d is %s, want %s", test.name, test.expr, i+1, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-2-3 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q parsed", expr)
+		}
+	}
+}
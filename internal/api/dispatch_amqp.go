@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/internal/config"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"github.com/streadway/amqp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrPublishNacked is returned when the broker refuses a publish.
+var ErrPublishNacked = errors.New("broker nacked the publish")
+
+// ErrExchangeNotFound is returned for publishes to an exchange that
+// doesn't exist. The broker closes the channel over them, but unlike
+// losing the connection, it's the publish that failed, not the bus.
+var ErrExchangeNotFound = errors.New("exchange not found")
+
+// AMQPDispatcher is the RabbitMQ Dispatcher. Start messages go to the
+// output exchange, commands to the control exchange and reports come
+// in on the report queue. The connection is owned by an AMQPManager,
+// which reconnects when it drops; publishes fail with ErrBusUnavailable
+// until it's back, and only succeed once the broker has confirmed them.
+type AMQPDispatcher struct {
+	Conn            *AMQPManager
+	OutputExchange  string
+	ControlExchange string
+	ReportQueue     string
+}
+
+// NewAMQPDispatcher starts an AMQPManager that connects to RabbitMQ
+// and (re-)declares the control exchange and report queue on every
+// connection.
+func NewAMQPDispatcher(cfg *config.Config) (*AMQPDispatcher, error) {
+	d := &AMQPDispatcher{
+		OutputExchange:  cfg.AMQPOutputExchange,
+		ControlExchange: cfg.AMQPControlExchange,
+		ReportQueue:     cfg.AMQPReportQueue,
+	}
+	dial := func() (*amqp.Connection, *amqp.Channel, error) {
+		return SetupAMQP(cfg.AMQPHost, cfg.AMQPPort, cfg.AMQPUser, cfg.AMQPPassword)
+	}
+	d.Conn = NewAMQPManager(dial, d.declareTopology)
+	return d, nil
+}
+
+// declareTopology declares the exchanges and queues dc owns. The output
+// exchange belongs to whoever deploys the workers, so it isn't declared.
+func (d *AMQPDispatcher) declareTopology(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(d.ControlExchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(d.ReportQueue, true, false, false, false, nil)
+	return err
+}
+
+// PublishStart serializes the task and pushes it onto
+// the output exchange for a worker to pick up. It's published as
+// mandatory, so it fails if no queue is bound to take it.
+func (d *AMQPDispatcher) PublishStart(ctx context.Context, task Task) error {
+	taskJson, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	return d.publish(
+		ctx,
+		d.OutputExchange,
+		"",
+		true,
+		amqp.Publishing{
+			ContentType:  "text/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         taskJson,
+		},
+	)
+}
+
+// PublishCommand pushes the command onto the control exchange
+// under its routing key.
+func (d *AMQPDispatcher) PublishCommand(ctx context.Context, command protocol.Command) error {
+	body, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+
+	return d.publish(
+		ctx,
+		d.ControlExchange,
+		command.RoutingKey(),
+		false,
+		amqp.Publishing{
+			ContentType: "application/json",
+			Type:        string(command.Kind),
+			Body:        body,
+		},
+	)
+}
+
+// ConsumeReports consumes worker reports from the report queue
+// until ctx is cancelled, resubscribing whenever the connection comes
+// back. Reports with a ReplyTo get a protocol.Ack published back to them.
+func (d *AMQPDispatcher) ConsumeReports(ctx context.Context, handle ReportHandler) error {
+	go func() {
+		for {
+			session, err := d.Conn.WaitSession(ctx)
+			if err != nil {
+				return
+			}
+			err = d.consumeReports(ctx, session, handle)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("Stopped consuming reports: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-session.closed:
+			case <-time.After(amqpMinBackoff):
+			}
+		}
+	}()
+	return nil
+}
+
+// consumeReports consumes reports on its own channel of session
+// until ctx is cancelled or the channel goes away.
+func (d *AMQPDispatcher) consumeReports(ctx context.Context, session *amqpSession, handle ReportHandler) error {
+	ch, err := session.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	deliveries, err := ch.Consume(d.ReportQueue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return ErrBusUnavailable
+			}
+			handleReportDelivery(ch, delivery, handle)
+		}
+	}
+}
+
+// Health describes the connection to RabbitMQ.
+func (d *AMQPDispatcher) Health() BusHealth {
+	return d.Conn.Health()
+}
+
+// Close stops reconnecting and closes the connection.
+func (d *AMQPDispatcher) Close() error {
+	return d.Conn.Close()
+}
+
+// publish publishes msg on the current session and waits for the
+// broker to confirm it. A mandatory message the broker couldn't route
+// is returned to us before it's confirmed, and counts as a failure, as
+// does a publish to a missing exchange, which the broker answers by
+// closing the channel.
+func (d *AMQPDispatcher) publish(ctx context.Context, exchange string, key string, mandatory bool, msg amqp.Publishing) error {
+	session, err := d.Conn.Session()
+	if err != nil {
+		return err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	msg.MessageId = primitive.NewObjectID().Hex()
+	if err := session.channel.Publish(exchange, key, mandatory, false, msg); err != nil {
+		if err == amqp.ErrClosed {
+			return ErrBusUnavailable
+		}
+		return err
+	}
+	session.tag++
+
+	var returned *amqp.Return
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.closed:
+			return session.closeError(exchange)
+		case r, ok := <-session.returns:
+			if !ok {
+				return session.closeError(exchange)
+			}
+			if r.MessageId == msg.MessageId {
+				returned = &r
+			}
+		case c, ok := <-session.confirms:
+			if !ok {
+				return session.closeError(exchange)
+			}
+			if c.DeliveryTag < session.tag {
+				// Confirm for an earlier publish we stopped waiting on
+				continue
+			}
+			if !c.Ack {
+				return ErrPublishNacked
+			}
+			if returned == nil {
+				select {
+				case r := <-session.returns:
+					if r.MessageId == msg.MessageId {
+						returned = &r
+					}
+				default:
+				}
+			}
+			if returned != nil {
+				return fmt.Errorf("message to exchange %q was returned: %s", exchange, returned.ReplyText)
+			}
+			return nil
+		}
+	}
+}
+
+// handleReportDelivery applies a single report from AMQP and replies to it.
+func handleReportDelivery(ch *amqp.Channel, delivery amqp.Delivery, handle ReportHandler) {
+	var report protocol.Report
+	ack := &protocol.Ack{}
+	err := json.Unmarshal(delivery.Body, &report)
+	if err == nil {
+		ack, err = handle(report)
+	}
+	if err != nil {
+		log.Errorf("Error handling report for task %s: %v", report.TaskId, err)
+		ack = &protocol.Ack{Error: err.Error()}
+	}
+
+	if delivery.ReplyTo != "" {
+		body, err := json.Marshal(ack)
+		if err == nil {
+			err = ch.Publish("", delivery.ReplyTo, false, false, amqp.Publishing{
+				ContentType:   "application/json",
+				CorrelationId: delivery.CorrelationId,
+				Body:          body,
+			})
+		}
+		if err != nil {
+			log.Errorf("Error replying to report for task %s: %v", report.TaskId, err)
+		}
+	}
+	delivery.Ack(false)
+}
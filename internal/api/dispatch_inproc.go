@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"github.com/mrecachinas/dcserver/pkg/worker"
+)
+
+// channelBusCapacity is how many start messages ChannelBus holds
+// before PublishStart starts failing.
+const channelBusCapacity = 1024
+
+// ErrBusFull is returned when the in-process bus has no room left.
+var ErrBusFull = errors.New("in-process bus is full")
+
+// ChannelBus is an in-process Dispatcher built on channels. It's meant
+// for tests and single-binary demos: workers run in the same process
+// and connect through WorkerTransport. Messages still go through their
+// JSON encoding so they look exactly like they would on a real bus.
+type ChannelBus struct {
+	starts  chan protocol.StartMessage
+	reports chan busReport
+
+	mu          sync.Mutex
+	subscribers map[string][]chan protocol.Command
+
+	health *busHealthTracker
+}
+
+// busReport is a report in flight along with where its Ack goes.
+type busReport struct {
+	report protocol.Report
+	reply  chan *protocol.Ack
+}
+
+// NewChannelBus creates an empty ChannelBus.
+func NewChannelBus() *ChannelBus {
+	b := &ChannelBus{
+		starts:      make(chan protocol.StartMessage, channelBusCapacity),
+		reports:     make(chan busReport),
+		subscribers: make(map[string][]chan protocol.Command),
+		health:      newBusHealthTracker(BusInProc),
+	}
+	b.health.up()
+	return b
+}
+
+// PublishStart queues the task's start message.
+func (b *ChannelBus) PublishStart(ctx context.Context, task Task) error {
+	taskJson, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	var start protocol.StartMessage
+	if err := json.Unmarshal(taskJson, &start); err != nil {
+		return err
+	}
+
+	select {
+	case b.starts <- start:
+		return nil
+	default:
+		return ErrBusFull
+	}
+}
+
+// PublishCommand hands the command to everyone subscribed to its
+// routing key. As on a real bus, a command nobody is subscribed to
+// is dropped.
+func (b *ChannelBus) PublishCommand(ctx context.Context, command protocol.Command) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscriber := range b.subscribers[command.RoutingKey()] {
+		select {
+		case subscriber <- command:
+		default:
+		}
+	}
+	return nil
+}
+
+// SubscribeCommands delivers every command published under routingKey
+// (see protocol.Command.RoutingKey) until the returned cancel function
+// is called.
+func (b *ChannelBus) SubscribeCommands(routingKey string) (<-chan protocol.Command, func()) {
+	commands := make(chan protocol.Command, 16)
+	b.mu.Lock()
+	b.subscribers[routingKey] = append(b.subscribers[routingKey], commands)
+	b.mu.Unlock()
+
+	return commands, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subscribers := b.subscribers[routingKey]
+		for i, subscriber := range subscribers {
+			if subscriber == commands {
+				b.subscribers[routingKey] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(b.subscribers[routingKey]) == 0 {
+			delete(b.subscribers, routingKey)
+		}
+	}
+}
+
+// ConsumeReports hands reports sent through WorkerTransport to handle
+// until ctx is cancelled.
+func (b *ChannelBus) ConsumeReports(ctx context.Context, handle ReportHandler) error {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case inflight := <-b.reports:
+				ack, err := handle(inflight.report)
+				if err != nil {
+					ack = &protocol.Ack{Error: err.Error()}
+				}
+				inflight.reply <- ack
+			}
+		}
+	}()
+	return nil
+}
+
+// Health always reports the bus as connected.
+func (b *ChannelBus) Health() BusHealth {
+	return b.health.get()
+}
+
+// Close is a no-op; there's nothing to disconnect from.
+func (b *ChannelBus) Close() error {
+	return nil
+}
+
+// WorkerTransport returns a worker.Transport connected to this bus,
+// so pkg/worker workers can run in the same process as dc.
+func (b *ChannelBus) WorkerTransport() worker.Transport {
+	return &channelBusTransport{bus: b}
+}
+
+type channelBusTransport struct {
+	bus *ChannelBus
+}
+
+func (t *channelBusTransport) Receive(ctx context.Context) (<-chan *worker.Delivery, error) {
+	deliveries := make(chan *worker.Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case start := <-t.bus.starts:
+				delivery := &worker.Delivery{
+					Task: start,
+					Ack:  func() error { return nil },
+					Nack: func(requeue bool) error {
+						if requeue {
+							t.bus.starts <- start
+						}
+						return nil
+					},
+				}
+				select {
+				case deliveries <- delivery:
+				case <-ctx.Done():
+					t.bus.starts <- start
+					return
+				}
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+func (t *channelBusTransport) Commands(ctx context.Context, workerId string) (<-chan protocol.Command, error) {
+	subscription, cancel := t.bus.SubscribeCommands(protocol.WorkerRoutingKey(workerId))
+	commands := make(chan protocol.Command)
+	go func() {
+		defer close(commands)
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case command := <-subscription:
+				select {
+				case commands <- command:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return commands, nil
+}
+
+func (t *channelBusTransport) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	// Round-trip through JSON like a real transport would
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var decoded protocol.Report
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil, err
+	}
+
+	inflight := busReport{report: decoded, reply: make(chan *protocol.Ack, 1)}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case t.bus.reports <- inflight:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ack := <-inflight.reply:
+		if ack.Error != "" {
+			return ack, errors.New(ack.Error)
+		}
+		return ack, nil
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// Subjects and stream used on NATS
+const (
+	natsStartStream    = "DC_TASKS"
+	natsStartSubject   = "dc.tasks.start"
+	natsControlSubject = "dc.control"
+	natsReportSubject  = "dc.reports"
+	natsReportQueue    = "dc"
+)
+
+// NATSDispatcher is the NATS Dispatcher. Start messages are published
+// to a JetStream work-queue stream so they survive until a worker takes
+// them; commands and reports (request/reply) use core NATS. The client
+// reconnects on its own, and publishes fail with ErrBusUnavailable
+// while it's disconnected.
+type NATSDispatcher struct {
+	Conn      *nats.Conn
+	JetStream nats.JetStreamContext
+
+	health *busHealthTracker
+}
+
+// NewNATSDispatcher connects to NATS and makes sure the start stream exists.
+func NewNATSDispatcher(url string) (*NATSDispatcher, error) {
+	health := newBusHealthTracker(BusNATS)
+	conn, err := nats.Connect(
+		url,
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err == nil {
+				err = ErrBusUnavailable
+			}
+			log.Warnf("Lost NATS connection, reconnecting: %v", err)
+			health.down(err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Info("Reconnected to NATS")
+			health.up()
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	health.up()
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := js.StreamInfo(natsStartStream); err != nil {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      natsStartStream,
+			Subjects:  []string{natsStartSubject},
+			Retention: nats.WorkQueuePolicy,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &NATSDispatcher{Conn: conn, JetStream: js, health: health}, nil
+}
+
+// PublishStart publishes the task's start message to JetStream and
+// waits for the stream to acknowledge it.
+func (d *NATSDispatcher) PublishStart(ctx context.Context, task Task) error {
+	if !d.Conn.IsConnected() {
+		return ErrBusUnavailable
+	}
+	taskJson, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = d.JetStream.Publish(natsStartSubject, taskJson, nats.Context(ctx))
+	return err
+}
+
+// PublishCommand publishes the command on its control subject.
+func (d *NATSDispatcher) PublishCommand(ctx context.Context, command protocol.Command) error {
+	if !d.Conn.IsConnected() {
+		return ErrBusUnavailable
+	}
+	body, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return d.Conn.Publish(natsControlSubject+"."+command.RoutingKey(), body)
+}
+
+// ConsumeReports answers report requests until ctx is cancelled. Every
+// dc instance joins the same queue group, so each report is handled once.
+func (d *NATSDispatcher) ConsumeReports(ctx context.Context, handle ReportHandler) error {
+	sub, err := d.Conn.QueueSubscribe(natsReportSubject, natsReportQueue, func(msg *nats.Msg) {
+		var report protocol.Report
+		ack := &protocol.Ack{}
+		err := json.Unmarshal(msg.Data, &report)
+		if err == nil {
+			ack, err = handle(report)
+		}
+		if err != nil {
+			log.Errorf("Error handling report for task %s: %v", report.TaskId, err)
+			ack = &protocol.Ack{Error: err.Error()}
+		}
+
+		if msg.Reply == "" {
+			return
+		}
+		body, err := json.Marshal(ack)
+		if err == nil {
+			err = msg.Respond(body)
+		}
+		if err != nil {
+			log.Errorf("Error replying to report for task %s: %v", report.TaskId, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+	return nil
+}
+
+// Health describes the connection to NATS.
+func (d *NATSDispatcher) Health() BusHealth {
+	return d.health.get()
+}
+
+// Close drains and closes the connection.
+func (d *NATSDispatcher) Close() error {
+	return d.Conn.Drain()
+}
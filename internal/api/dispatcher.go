@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mrecachinas/dcserver/internal/config"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// ErrBusUnavailable is returned by publishes made while the connection
+// to the message bus is down. Start messages stay in the outbox until
+// it's back; anything else has to be retried by the caller.
+var ErrBusUnavailable = errors.New("message bus is unavailable")
+
+// ReportHandler applies a worker's report and returns the Ack to send back.
+type ReportHandler func(report protocol.Report) (*protocol.Ack, error)
+
+// Dispatcher is the message bus between dc and its workers. It
+// publishes start messages and commands, and consumes reports.
+// AMQPDispatcher is the original (and default) bus; ChannelBus runs
+// everything in-process, and NATSDispatcher uses NATS/JetStream.
+type Dispatcher interface {
+	// PublishStart publishes a task's start message for a worker to pick up
+	PublishStart(ctx context.Context, task Task) error
+	// PublishCommand publishes a command to whichever worker is running its task
+	PublishCommand(ctx context.Context, command protocol.Command) error
+	// ConsumeReports hands every worker report to handle until ctx is cancelled
+	ConsumeReports(ctx context.Context, handle ReportHandler) error
+	// Health describes the connection to the bus
+	Health() BusHealth
+	Close() error
+}
+
+// BusHealth describes the connection to the message bus, for /healthz.
+type BusHealth struct {
+	Bus       string `json:"bus"`
+	Connected bool   `json:"connected"`
+	// Since is when the connection last came up or went down
+	Since      time.Time `json:"since"`
+	LastError  string    `json:"last_error,omitempty"`
+	Reconnects int       `json:"reconnects"`
+}
+
+// busHealthTracker keeps a Dispatcher's BusHealth up to date as its
+// connection comes and goes.
+type busHealthTracker struct {
+	mu        sync.RWMutex
+	health    BusHealth
+	connected bool // ever
+}
+
+func newBusHealthTracker(bus string) *busHealthTracker {
+	return &busHealthTracker{health: BusHealth{Bus: bus, Since: time.Now()}}
+}
+
+// up records that the connection is (back) up.
+func (t *busHealthTracker) up() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.health.Connected {
+		return
+	}
+	if t.connected {
+		t.health.Reconnects++
+	}
+	t.connected = true
+	t.health.Connected = true
+	t.health.Since = time.Now()
+}
+
+// down records that the connection went down because of err.
+func (t *busHealthTracker) down(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.health.LastError = err.Error()
+	}
+	if t.health.Connected {
+		t.health.Connected = false
+		t.health.Since = time.Now()
+	}
+}
+
+func (t *busHealthTracker) get() BusHealth {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.health
+}
+
+// Names of the supported message buses (`--bus`)
+const (
+	BusAMQP   = "amqp"
+	BusNATS   = "nats"
+	BusInProc = "inproc"
+)
+
+// SetupDispatcher connects to the message bus named in the config.
+func SetupDispatcher(cfg *config.Config) (Dispatcher, error) {
+	switch cfg.Bus {
+	case BusAMQP, "":
+		return NewAMQPDispatcher(cfg)
+	case BusNATS:
+		return NewNATSDispatcher(cfg.NATSURL)
+	case BusInProc:
+		return NewChannelBus(), nil
+	default:
+		return nil, fmt.Errorf("unknown bus %q", cfg.Bus)
+	}
+}
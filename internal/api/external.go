@@ -1,29 +1,81 @@
 package api
 
 import (
+	"context"
 	"encoding/xml"
+	"fmt"
 	"net/http"
+	"time"
 )
 
+// ExternalCatalog is the result of a QueryExternal.
+type ExternalCatalog struct {
+	// NotModified is set when the catalog hasn't changed since the
+	// validators passed to QueryExternal; Entries is empty then
+	NotModified  bool
+	ETag         string
+	LastModified string
+	Entries      []CatalogEntry
+}
+
+// externalCatalogDocument is the XML the external API serves: a root
+// element (whatever its name) with one <task> element per task type.
+type externalCatalogDocument struct {
+	Tasks []CatalogEntry `xml:"task"`
+}
+
+// externalFetchTimeout is how long QueryExternal waits for the
+// external API, response body included.
+const externalFetchTimeout = 30 * time.Second
+
 // QueryExternal submits a GET request to the external
-// XML API to get all available task options.
-func QueryExternal(taskURL string, client *http.Client) ([]Task, error) {
+// XML API to get all available task options. If etag or
+// lastModified are given, the request is conditional on the
+// catalog having changed since.
+func QueryExternal(ctx context.Context, taskURL string, client *http.Client, etag string, lastModified string) (*ExternalCatalog, error) {
+	ctx, cancel := context.WithTimeout(ctx, externalFetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, taskURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		request.Header.Set("If-Modified-Since", lastModified)
+	}
+
 	// Submit the HTTP request
-	response, err := client.Get(taskURL)
+	response, err := client.Do(request)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	// Deserialize the XML response to a list of `Task`s
+	result := &ExternalCatalog{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		result.NotModified = true
+		return result, nil
+	default:
+		return nil, fmt.Errorf("task catalog request failed: %s", response.Status)
+	}
+
+	// Deserialize the XML response to a list of `CatalogEntry`s
 	// Note: Using xml.NewDecoder(...).Decode(...) allows
 	// pulling from a stream rather than reading it all
 	// into memory at once (as in xml.Unmarshal(...))
-	var tasks []Task
-	err = xml.NewDecoder(response.Body).Decode(&tasks)
+	var document externalCatalogDocument
+	err = xml.NewDecoder(response.Body).Decode(&document)
 	if err != nil {
 		return nil, err
 	}
+	result.Entries = document.Tasks
 
-	return tasks, nil
+	return result, nil
 }
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Health is the body of a /healthz response.
+type Health struct {
+	Status string    `json:"status"`
+	Bus    BusHealth `json:"bus"`
+}
+
+// Healthz reports whether dc is connected to its message bus. It
+// answers 503 while the connection is down, so load balancers and
+// orchestrators can tell this instance can't dispatch work.
+func (a *Api) Healthz(c echo.Context) error {
+	health := Health{Status: "ok", Bus: a.Bus.Health()}
+	if !health.Bus.Connected {
+		health.Status = "unavailable"
+		return c.JSON(http.StatusServiceUnavailable, health)
+	}
+	return c.JSON(http.StatusOK, health)
+}
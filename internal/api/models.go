@@ -4,48 +4,93 @@ import (
 	"net/http"
 	"sync"
 
+	"github.com/mrecachinas/dcserver/internal/auth"
 	"github.com/mrecachinas/dcserver/internal/config"
-	"github.com/streadway/amqp"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/net/websocket"
 )
 
 // Api is a wrapper around various state including
-// the MongoDB connection, the AMQP connection and channel,
-// and the passed CLI parameters.
+// the store backend, the message bus, and the passed
+// CLI parameters.
 type Api struct {
-	MongoClient *mongo.Client
-	DB          DB
-	AMQPClient  *amqp.Connection
-	AMQPChannel *amqp.Channel
-	HTTPClient  *http.Client
-	Websocket   *WebsocketConnectionPool
-	Cfg         *config.Config
+	DB         Store
+	Bus        Dispatcher
+	HTTPClient *http.Client
+	Websocket  *WebsocketConnectionPool
+	Watcher    *StatusWatcher
+	Outbox     *OutboxRelay
+	Catalog    *CatalogCache
+	Streams    *StreamRelay
+	Artifacts  ArtifactStore
+	Audit      *AuditLog
+	// Authenticators are the ways clients may authenticate; with
+	// none, the API is open
+	Authenticators []auth.Authenticator
+	Cfg            *config.Config
 }
 
 // WebsocketConnectionPool holds a map of every websocket
 // connection, so we can broadcast updates to everyone,
-// thus requiring only one pull from the database.
+// thus requiring only one pull from the database. Each
+// connection maps to its subscriber: the query it subscribed
+// with, whose filter decides which changes are sent to it, and
+// the queue of messages waiting to be written to it.
 type WebsocketConnectionPool struct {
 	sync.RWMutex
-	Connections map[*websocket.Conn]struct{}
+	Connections map[*websocket.Conn]*WebsocketSubscriber
 }
 
-// TODO: Status and Task can probably be combined into just Task or status
-// Status is the primary data structure for DC. It includes information
-// such as start time, stop time, etc.
+// Status is the primary data structure for DC. It is the Task as
+// requested plus everything dc and the worker have recorded about
+// it since, such as its state and history.
 type Status struct {
-	Id        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	StartTime primitive.DateTime `json:"start_time" bson:"start_time"`
-	StopTime  primitive.DateTime `json:"stop_time,omitempty" bson:"stop_time"`
-	StopFlag  bool               `json:"stop_flag" bson:"stop_flag"`
+	Task            `bson:",inline"`
+	StopFlag        bool               `json:"stop_flag" bson:"stop_flag"`
+	StopDeadline    primitive.DateTime `json:"stop_deadline,omitempty" bson:"stop_deadline,omitempty"`
+	KillRequested   bool               `json:"kill_requested" bson:"kill_requested"`
+	State           State              `json:"state" bson:"state"`
+	History         []HistoryEntry     `json:"history" bson:"history"`
+	WorkerId        string             `json:"worker_id,omitempty" bson:"worker_id,omitempty"`
+	Progress        float64            `json:"progress" bson:"progress"`
+	ProgressMessage string             `json:"progress_message,omitempty" bson:"progress_message,omitempty"`
+	LastHeartbeat   primitive.DateTime `json:"last_heartbeat,omitempty" bson:"last_heartbeat,omitempty"`
+	Attempt         int                `json:"attempt" bson:"attempt"`
+	Dispatch        DispatchState      `json:"dispatch" bson:"dispatch"`
+	// ConfigRevision counts the parameters updates requested while the
+	// task ran; Reconfiguration is the latest one
+	ConfigRevision  int              `json:"config_revision,omitempty" bson:"config_revision,omitempty"`
+	Reconfiguration *Reconfiguration `json:"reconfiguration,omitempty" bson:"reconfiguration,omitempty"`
+	// Artifacts are the output files the task's worker uploaded
+	Artifacts []Artifact `json:"artifacts,omitempty" bson:"artifacts,omitempty"`
 }
 
+// Task is the client-requested task; it is what gets inserted into the
+// tasks collection and published to the AMQP output exchange.
 type Task struct {
-	Id        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	StartTime primitive.DateTime `json:"start_time" bson:"start_time"`
-	StopTime  primitive.DateTime `json:"stop_time,omitempty" bson:"stop_time,omitempty"`
+	Id          primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Type        string             `json:"type,omitempty" bson:"type,omitempty"`
+	StartTime   primitive.DateTime `json:"start_time" bson:"start_time"`
+	StopTime    primitive.DateTime `json:"stop_time,omitempty" bson:"stop_time,omitempty"`
+	RetryPolicy *RetryPolicy       `json:"retry_policy,omitempty" bson:"retry_policy,omitempty"`
+	// Parameters are as requested until the task is created, after
+	// which they're resolved against the catalog: typed, with defaults
+	// filled in
+	Parameters map[string]interface{} `json:"parameters,omitempty" bson:"parameters,omitempty"`
+	// CatalogVersion is the version of the task catalog that was
+	// current when the task was created
+	CatalogVersion int `json:"catalog_version,omitempty" bson:"catalog_version,omitempty"`
+	// Tags are free-form labels to find the task by
+	Tags []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	// Owner is the subject of whoever created the task, empty when
+	// authentication is off
+	Owner string `json:"owner,omitempty" bson:"owner,omitempty"`
+}
+
+// RetryPolicy says how many times a task may be dispatched in total
+// when its worker is lost.
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts" bson:"max_attempts"`
 }
 
 // Response is a fairly generic response struct to handle common responses,
@@ -54,4 +99,73 @@ type Response struct {
 	Msg    string `json:"msg,omitempty"`
 	Result string `json:"result,omitempty"`
 	Id     string `json:"id,omitempty"`
+	// Errors lists what's wrong with each invalid field of the request
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// WebsocketVersion is the version of the messages sent to websocket
+// subscribers, which every message carries as `v`. Clients may ask for
+// a version with `?v=`; the server refuses versions it can't speak, so
+// the format can change without older clients misreading it.
+const WebsocketVersion = 1
+
+// Types of messages sent to websocket subscribers
+const (
+	StatusEventSnapshot = "snapshot"
+	StatusEventInsert   = "insert"
+	StatusEventUpdate   = "update"
+	StatusEventDelete   = "delete"
+	StatusEventLost     = "lost"
+	// StatusEventRemove tells a subscriber a task it was sent no
+	// longer matches its filter
+	StatusEventRemove = "remove"
+)
+
+// The lists a task's status is shown in
+const (
+	// StatusListActive holds tasks that haven't finished
+	StatusListActive = "active"
+	// StatusListHistorical holds tasks that have
+	StatusListHistorical = "historical"
+)
+
+// StatusLists are statuses split into active and historical tasks.
+type StatusLists struct {
+	Active     []Status `json:"active"`
+	Historical []Status `json:"historical"`
+}
+
+// StatusSnapshot is the first message a websocket subscriber receives
+// (unless it resumes). It holds the statuses matching the subscriber's
+// query, every active one and the first page of historical ones, and
+// the task catalog, along with the resume token that the following
+// StatusEvents continue from.
+type StatusSnapshot struct {
+	Version     int            `json:"v"`
+	Type        string         `json:"type"`
+	ResumeToken string         `json:"resume_token"`
+	Status      StatusLists    `json:"status"`
+	Tasks       []CatalogEntry `json:"tasks"`
+	// Counts is how many tasks match the query in each state
+	Counts map[State]int64 `json:"counts"`
+	// HistoricalCursor fetches the next page of historical statuses
+	// from /api/status/historical, with the same query
+	HistoricalCursor string `json:"historical_cursor,omitempty"`
+}
+
+// StatusEvent is a single insert, update or delete in the tasks
+// collection, or a notice that a task was lost. Status is omitted
+// for deletes.
+type StatusEvent struct {
+	Version     int    `json:"v"`
+	Type        string `json:"type"`
+	ResumeToken string `json:"resume_token"`
+	Id          string `json:"id"`
+	// List is the list the task belongs in now, for events with a Status
+	List   string  `json:"list,omitempty"`
+	Status *Status `json:"status,omitempty"`
+
+	// owner is the deleted task's owner, for deletes, so they only go
+	// to subscribers who may see the task
+	owner string
 }
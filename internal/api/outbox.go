@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DispatchState is how far a task's start message has got.
+type DispatchState string
+
+const (
+	// DispatchPending start messages are in the outbox waiting to be published
+	DispatchPending DispatchState = "pending"
+	// DispatchDelivered start messages were confirmed by the bus
+	DispatchDelivered DispatchState = "delivered"
+	// DispatchFailed start messages were never confirmed and dc gave up
+	DispatchFailed DispatchState = "failed"
+)
+
+// OutboxEntry is a start message waiting to be published. It is written
+// in the same operation as the task (or re-dispatch) it belongs to, so a
+// task can't exist without a way of reaching a worker.
+type OutboxEntry struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	TaskId      primitive.ObjectID `json:"task_id" bson:"task_id"`
+	Task        Task               `json:"task" bson:"task"`
+	State       DispatchState      `json:"state" bson:"state"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	NextAttempt primitive.DateTime `json:"next_attempt" bson:"next_attempt"`
+	LastError   string             `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	CreatedAt   primitive.DateTime `json:"created_at" bson:"created_at"`
+	DeliveredAt primitive.DateTime `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+}
+
+// newOutboxEntry builds the outbox entry for publishing task right away.
+func newOutboxEntry(task Task) OutboxEntry {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	return OutboxEntry{
+		Id:          primitive.NewObjectID(),
+		TaskId:      task.Id,
+		Task:        task,
+		State:       DispatchPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+}
+
+// Limits on how hard the relay tries
+const (
+	outboxBatchSize  = 100
+	outboxMaxBackoff = 5 * time.Minute
+	// outboxOrphanAge is how long the relay waits for an entry's task
+	// to show up before deciding it was never written
+	outboxOrphanAge = time.Minute
+)
+
+// OutboxRelay publishes the start messages left in the outbox and waits
+// for the bus to confirm each one, retrying with exponential backoff
+// until it's confirmed or MaxAttempts is reached.
+type OutboxRelay struct {
+	DB          Store
+	Bus         Dispatcher
+	MaxAttempts int
+	kick        chan struct{}
+}
+
+// SetupOutboxRelay creates an OutboxRelay.
+func SetupOutboxRelay(db Store, bus Dispatcher, maxAttempts int) *OutboxRelay {
+	return &OutboxRelay{
+		DB:          db,
+		Bus:         bus,
+		MaxAttempts: maxAttempts,
+		kick:        make(chan struct{}, 1),
+	}
+}
+
+// Kick wakes the relay up early, e.g. right after a task is created.
+func (r *OutboxRelay) Kick() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays the outbox every second (or when kicked) until ctx is cancelled.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		r.relay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.kick:
+		}
+	}
+}
+
+// relay makes one attempt at every entry that's due.
+func (r *OutboxRelay) relay(ctx context.Context) {
+	due, err := r.DB.GetDueDispatches(time.Now(), outboxBatchSize)
+	if err != nil {
+		log.Errorf("Error reading outbox: %v", err)
+		return
+	}
+
+	for _, entry := range *due {
+		if ctx.Err() != nil {
+			return
+		}
+		id := entry.Id.Hex()
+
+		// Without transactions, the entry is written before its task;
+		// if the task never shows up there's nothing to start.
+		_, err := r.DB.GetSingleStatus(entry.TaskId.Hex())
+		if err == ErrTaskNotFound {
+			if time.Since(entry.CreatedAt.Time()) > outboxOrphanAge {
+				r.DB.FailDispatch(id, "task record was never written")
+			}
+			continue
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err = r.Bus.PublishStart(publishCtx, entry.Task)
+		cancel()
+		if err == ErrBusUnavailable {
+			// Nothing will get through until the bus is back, and
+			// that isn't the entry's fault; leave it be until then
+			return
+		}
+		if err == nil {
+			if err := r.DB.MarkDispatchDelivered(id); err != nil {
+				log.Errorf("Error marking dispatch %s delivered: %v", id, err)
+			}
+			continue
+		}
+
+		attempts := entry.Attempts + 1
+		if attempts >= r.MaxAttempts {
+			log.Errorf("Giving up dispatching task %s after %d attempts: %v", entry.TaskId.Hex(), attempts, err)
+			if err := r.DB.FailDispatch(id, err.Error()); err != nil {
+				log.Errorf("Error marking dispatch %s failed: %v", id, err)
+			}
+			continue
+		}
+		backoff := time.Second << uint(attempts)
+		if backoff > outboxMaxBackoff {
+			backoff = outboxMaxBackoff
+		}
+		log.Warnf("Dispatching task %s failed (attempt %d), retrying in %s: %v", entry.TaskId.Hex(), attempts, backoff, err)
+		if err := r.DB.RetryDispatch(id, err.Error(), time.Now().Add(backoff)); err != nil {
+			log.Errorf("Error rescheduling dispatch %s: %v", id, err)
+		}
+	}
+}
+
+// GetUndelivered returns every start message the bus hasn't confirmed
+// yet, including those dc has given up on.
+func (a *Api) GetUndelivered(c echo.Context) error {
+	entries, err := a.DB.GetUndeliveredDispatches()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, entries)
+}
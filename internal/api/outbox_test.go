@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stubBus is a ChannelBus whose start messages fail with err, if it's set.
+type stubBus struct {
+	*ChannelBus
+	err error
+}
+
+func (b *stubBus) PublishStart(ctx context.Context, task Task) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.ChannelBus.PublishStart(ctx, task)
+}
+
+// outboxEntryOf returns the outbox entry of the task with id.
+func outboxEntryOf(t *testing.T, db Store, id string) OutboxEntry {
+	t.Helper()
+	var found []OutboxEntry
+	err := db.(*kvStore).kv.View(func(tx kvTx) error {
+		return tx.ForEach(outboxBucket, func(key string, raw []byte) error {
+			var entry OutboxEntry
+			if err := bson.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if entry.TaskId.Hex() == id {
+				found = append(found, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("task %s has %d outbox entries, want 1", id, len(found))
+	}
+	return found[0]
+}
+
+// makeDue brings an outbox entry's next attempt forward to now.
+func makeDue(t *testing.T, db Store, entry OutboxEntry) {
+	t.Helper()
+	err := db.(*kvStore).updateDispatch(entry.Id.Hex(), func(entry *OutboxEntry) {
+		entry.NextAttempt = primitive.NewDateTimeFromTime(time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getUndelivered(t *testing.T, db Store) []OutboxEntry {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/tasks/undelivered", nil), rec)
+	if err := (&Api{DB: db}).GetUndelivered(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("undelivered answered %d: %s", rec.Code, rec.Body)
+	}
+	var entries []OutboxEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestOutboxRelayDelivers(t *testing.T) {
+	db := NewMemoryStore()
+	bus := NewChannelBus()
+	relay := SetupOutboxRelay(db, bus, 3)
+	id := createTestTask(t, db, Task{Type: "collect"})
+	if undelivered := getUndelivered(t, db); len(undelivered) != 1 || undelivered[0].TaskId.Hex() != id {
+		t.Fatalf("undelivered before relaying: %+v", undelivered)
+	}
+
+	relay.relay(context.Background())
+	select {
+	case start := <-bus.starts:
+		if start.Id != id || start.Type != "collect" {
+			t.Errorf("published start message %+v", start)
+		}
+	default:
+		t.Fatal("nothing was published")
+	}
+	if entry := outboxEntryOf(t, db, id); entry.State != DispatchDelivered || entry.Attempts != 1 {
+		t.Errorf("entry is %s after %d attempts", entry.State, entry.Attempts)
+	}
+	if status := getTestStatus(t, db, id); status.Dispatch != DispatchDelivered {
+		t.Errorf("task's dispatch is %s", status.Dispatch)
+	}
+	if undelivered := getUndelivered(t, db); len(undelivered) != 0 {
+		t.Errorf("undelivered after relaying: %+v", undelivered)
+	}
+
+	// Delivered entries aren't published again
+	relay.relay(context.Background())
+	if len(bus.starts) != 0 {
+		t.Error("a delivered start message was published again")
+	}
+}
+
+func TestOutboxRelayBackoff(t *testing.T) {
+	db := NewMemoryStore()
+	bus := &stubBus{ChannelBus: NewChannelBus(), err: ErrBusFull}
+	relay := SetupOutboxRelay(db, bus, 3)
+	id := createTestTask(t, db, Task{Type: "collect"})
+
+	for attempt, backoff := range []time.Duration{2 * time.Second, 4 * time.Second} {
+		before := time.Now()
+		relay.relay(context.Background())
+		entry := outboxEntryOf(t, db, id)
+		if entry.State != DispatchPending || entry.Attempts != attempt+1 || entry.LastError != ErrBusFull.Error() {
+			t.Fatalf("after attempt %d: %s after %d attempts (%s)", attempt+1, entry.State, entry.Attempts, entry.LastError)
+		}
+		next := entry.NextAttempt.Time()
+		if next.Before(before.Add(backoff).Truncate(time.Millisecond)) || next.After(time.Now().Add(backoff)) {
+			t.Errorf("after attempt %d: next attempt in %v, want %v", attempt+1, next.Sub(before), backoff)
+		}
+
+		// It isn't tried again until then
+		relay.relay(context.Background())
+		if again := outboxEntryOf(t, db, id); again.Attempts != entry.Attempts {
+			t.Fatalf("after attempt %d: tried again before the backoff was up", attempt+1)
+		}
+		makeDue(t, db, entry)
+	}
+
+	// The third failure is the last
+	relay.relay(context.Background())
+	if entry := outboxEntryOf(t, db, id); entry.State != DispatchFailed || entry.Attempts != 3 {
+		t.Errorf("after MaxAttempts: %s after %d attempts", entry.State, entry.Attempts)
+	}
+	if status := getTestStatus(t, db, id); status.Dispatch != DispatchFailed {
+		t.Errorf("task's dispatch is %s", status.Dispatch)
+	}
+	undelivered := getUndelivered(t, db)
+	if len(undelivered) != 1 || undelivered[0].State != DispatchFailed || undelivered[0].LastError != ErrBusFull.Error() {
+		t.Errorf("undelivered after giving up: %+v", undelivered)
+	}
+}
+
+func TestOutboxRelayWaitsForBus(t *testing.T) {
+	db := NewMemoryStore()
+	bus := &stubBus{ChannelBus: NewChannelBus(), err: ErrBusUnavailable}
+	relay := SetupOutboxRelay(db, bus, 3)
+	id := createTestTask(t, db, Task{Type: "collect"})
+
+	// Attempts while the bus is down don't count against the entry
+	for i := 0; i < 5; i++ {
+		relay.relay(context.Background())
+	}
+	if entry := outboxEntryOf(t, db, id); entry.State != DispatchPending || entry.Attempts != 0 {
+		t.Fatalf("while the bus was down: %s after %d attempts", entry.State, entry.Attempts)
+	}
+
+	bus.err = nil
+	relay.relay(context.Background())
+	if entry := outboxEntryOf(t, db, id); entry.State != DispatchDelivered {
+		t.Errorf("once the bus was back: %s", entry.State)
+	}
+}
+
+func TestOutboxRelayMissingExchange(t *testing.T) {
+	db := NewMemoryStore()
+	bus := &stubBus{ChannelBus: NewChannelBus(), err: fmt.Errorf("%w: %q", ErrExchangeNotFound, "dc.tasks")}
+	relay := SetupOutboxRelay(db, bus, 2)
+	id := createTestTask(t, db, Task{Type: "collect"})
+
+	// The bus is up; it's the publish that fails, and it counts
+	relay.relay(context.Background())
+	entry := outboxEntryOf(t, db, id)
+	if entry.State != DispatchPending || entry.Attempts != 1 {
+		t.Fatalf("after a refused publish: %s after %d attempts", entry.State, entry.Attempts)
+	}
+	makeDue(t, db, entry)
+	relay.relay(context.Background())
+	if entry := outboxEntryOf(t, db, id); entry.State != DispatchFailed || entry.Attempts != 2 {
+		t.Errorf("after MaxAttempts refused publishes: %s after %d attempts", entry.State, entry.Attempts)
+	}
+}
+
+func TestOutboxRelayOrphans(t *testing.T) {
+	db := NewMemoryStore()
+	bus := NewChannelBus()
+	relay := SetupOutboxRelay(db, bus, 3)
+
+	// Entries whose tasks were never written, as can happen without
+	// transactions: one just now and one long enough ago to give up on
+	fresh := newOutboxEntry(Task{Id: primitive.NewObjectID(), Type: "collect"})
+	old := newOutboxEntry(Task{Id: primitive.NewObjectID(), Type: "collect"})
+	old.CreatedAt = primitive.NewDateTimeFromTime(time.Now().Add(-2 * outboxOrphanAge))
+	err := db.(*kvStore).kv.Update(func(tx kvTx) error {
+		for _, entry := range []OutboxEntry{fresh, old} {
+			if err := tx.Put(outboxBucket, entry.Id.Hex(), &entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay.relay(context.Background())
+	if len(bus.starts) != 0 {
+		t.Error("published a start message for a task that doesn't exist")
+	}
+	if entry := outboxEntryOf(t, db, fresh.TaskId.Hex()); entry.State != DispatchPending || entry.Attempts != 0 {
+		t.Errorf("fresh orphan is %s after %d attempts; want it left for its task", entry.State, entry.Attempts)
+	}
+	if entry := outboxEntryOf(t, db, old.TaskId.Hex()); entry.State != DispatchFailed {
+		t.Errorf("old orphan is %s, want failed", entry.State)
+	}
+	undelivered := getUndelivered(t, db)
+	if len(undelivered) != 2 {
+		t.Errorf("%d undelivered entries, want both orphans", len(undelivered))
+	}
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Limits on how many statuses a query returns
+const (
+	defaultStatusLimit = 100
+	maxStatusLimit     = 1000
+)
+
+// defaultStatusSort is newest first.
+const defaultStatusSort = "-start_time"
+
+// ErrInvalidQuery is returned for malformed status queries.
+var ErrInvalidQuery = errors.New("invalid status query")
+
+// knownStates are the states a filter may ask for.
+var knownStates = []State{StatePending, StateRunning, StateStopping, StateStopped, StateFailed, StateLost}
+
+// The states of the tasks in each status list
+var (
+	activeStates     = []State{StatePending, StateRunning, StateStopping, StateLost}
+	historicalStates = []State{StateStopped, StateFailed}
+)
+
+// statusSortFields are the fields statuses can be sorted by, mapped to
+// their stored names. Ties are broken by id, in the same direction.
+var statusSortFields = map[string]string{
+	"start_time": "start_time",
+	"state":      "state",
+	"id":         "_id",
+}
+
+// StatusFilter picks out statuses. Every field that's set has to match;
+// within a field, any of the listed values will do, except tags, which
+// a task has to have all of.
+type StatusFilter struct {
+	States []State
+	Types  []string
+	Tags   []string
+	// Since and Until bound the tasks' start times, inclusive
+	// and exclusive respectively
+	Since time.Time
+	Until time.Time
+	// Owner, if set, is the subject whose tasks to keep
+	Owner string
+}
+
+// StatusQuery is a filter plus the order and page of results wanted.
+type StatusQuery struct {
+	StatusFilter
+	// Sort is the field to sort by, prefixed with `-` for descending
+	Sort string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// StatusPage is one page of statuses matching a query.
+type StatusPage struct {
+	Status []Status `json:"status"`
+	// Total is how many statuses match the filter, across every page
+	Total int64 `json:"total"`
+	// Counts breaks Total down by state
+	Counts map[State]int64 `json:"counts"`
+	// NextCursor fetches the next page; it's left out on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ParseStatusQuery reads a StatusQuery from query parameters: `state`,
+// `type` and `tag` (each repeatable or comma-separated), `since` and
+// `until` (RFC 3339), `owner`, `sort`, `cursor` and `limit`.
+func ParseStatusQuery(params url.Values) (*StatusQuery, error) {
+	q := &StatusQuery{Sort: defaultStatusSort, Limit: defaultStatusLimit}
+
+	for _, state := range listParam(params, "state") {
+		if !isKnownState(State(state)) {
+			return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidQuery, state)
+		}
+		q.States = append(q.States, State(state))
+	}
+	q.Types = listParam(params, "type")
+	q.Tags = listParam(params, "tag")
+	q.Owner = params.Get("owner")
+
+	for name, bound := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidQuery, name)
+			}
+			*bound = t
+		}
+	}
+
+	if value := params.Get("sort"); value != "" {
+		if _, ok := statusSortFields[strings.TrimPrefix(value, "-")]; !ok {
+			return nil, fmt.Errorf("%w: can't sort by %q", ErrInvalidQuery, value)
+		}
+		q.Sort = value
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxStatusLimit {
+			return nil, fmt.Errorf("%w: limit must be a number from 1 to %d", ErrInvalidQuery, maxStatusLimit)
+		}
+		q.Limit = limit
+	}
+
+	q.Cursor = params.Get("cursor")
+	if q.Cursor != "" {
+		if _, err := q.decodeCursor(); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// listParam collects a repeatable, comma-separated query parameter.
+func listParam(params url.Values, name string) []string {
+	var values []string
+	for _, value := range params[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+func isKnownState(state State) bool {
+	for _, known := range knownStates {
+		if state == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether status passes the filter.
+func (f *StatusFilter) Matches(status *Status) bool {
+	if len(f.States) > 0 && !containsState(f.States, status.State) {
+		return false
+	}
+	if len(f.Types) > 0 && !containsString(f.Types, status.Type) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !containsString(status.Tags, tag) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && status.StartTime < primitive.NewDateTimeFromTime(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && status.StartTime >= primitive.NewDateTimeFromTime(f.Until) {
+		return false
+	}
+	if f.Owner != "" && status.Owner != f.Owner {
+		return false
+	}
+	return true
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictStates narrows the query to tasks in one of states, or
+// returns false if its filter rules all of them out.
+func (q *StatusQuery) restrictStates(states []State) (*StatusQuery, bool) {
+	restricted := *q
+	if len(q.States) == 0 {
+		restricted.States = states
+		return &restricted, true
+	}
+	restricted.States = nil
+	for _, state := range q.States {
+		if containsState(states, state) {
+			restricted.States = append(restricted.States, state)
+		}
+	}
+	return &restricted, len(restricted.States) > 0
+}
+
+// sortField is the stored name of the field the query sorts by, and
+// whether it's descending.
+func (q *StatusQuery) sortField() (string, bool) {
+	name := q.Sort
+	if name == "" {
+		name = defaultStatusSort
+	}
+	descending := strings.HasPrefix(name, "-")
+	return statusSortFields[strings.TrimPrefix(name, "-")], descending
+}
+
+// statusCursor is the position after the last status of a page: its
+// sort field's value and its id. It's only valid for the sort it was
+// made with.
+type statusCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	Id    string      `json:"id"`
+}
+
+// sortValue is the value of field in status, as compared for sorting.
+func sortValue(status *Status, field string) interface{} {
+	switch field {
+	case "start_time":
+		return status.StartTime
+	case "state":
+		return string(status.State)
+	default:
+		return status.Id.Hex()
+	}
+}
+
+// encodeCursor makes the cursor for the page after status.
+func (q *StatusQuery) encodeCursor(status *Status) string {
+	field, _ := q.sortField()
+	cursor := statusCursor{Sort: q.Sort, Id: status.Id.Hex()}
+	switch field {
+	case "start_time":
+		// As milliseconds; DateTimes marshal to JSON as strings
+		cursor.Value = int64(status.StartTime)
+	case "state":
+		cursor.Value = string(status.State)
+	}
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor parses the query's cursor, converting its value back to
+// the sort field's type.
+func (q *StatusQuery) decodeCursor() (*statusCursor, error) {
+	invalid := fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	var cursor statusCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, invalid
+	}
+	if cursor.Sort != q.Sort {
+		return nil, fmt.Errorf("%w: cursor is for a different sort", ErrInvalidQuery)
+	}
+	if _, err := primitive.ObjectIDFromHex(cursor.Id); err != nil {
+		return nil, invalid
+	}
+
+	switch field, _ := q.sortField(); field {
+	case "start_time":
+		ms, ok := cursor.Value.(float64)
+		if !ok {
+			return nil, invalid
+		}
+		cursor.Value = primitive.DateTime(int64(ms))
+	case "state":
+		if _, ok := cursor.Value.(string); !ok {
+			return nil, invalid
+		}
+	}
+	return &cursor, nil
+}
+
+// compareSortValues orders two values of the same sort field.
+func compareSortValues(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case primitive.DateTime:
+		b := b.(primitive.DateTime)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	default:
+		return strings.Compare(a.(string), b.(string))
+	}
+}
+
+// pageStatus answers a query over statuses that already match its
+// filter, for stores that can't do it themselves.
+func pageStatus(statuses []Status, q *StatusQuery) (*StatusPage, error) {
+	page := &StatusPage{
+		Status: []Status{},
+		Total:  int64(len(statuses)),
+		Counts: make(map[State]int64),
+	}
+	for i := range statuses {
+		page.Counts[statuses[i].State]++
+	}
+
+	field, descending := q.sortField()
+	compare := func(a *Status, b *Status) int {
+		if c := compareSortValues(sortValue(a, field), sortValue(b, field)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id.Hex(), b.Id.Hex())
+	}
+	if descending {
+		ascending := compare
+		compare = func(a *Status, b *Status) int { return -ascending(a, b) }
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return compare(&statuses[i], &statuses[j]) < 0
+	})
+
+	start := 0
+	if q.Cursor != "" {
+		cursor, err := q.decodeCursor()
+		if err != nil {
+			return nil, err
+		}
+		oid, _ := primitive.ObjectIDFromHex(cursor.Id)
+		after := Status{Task: Task{Id: oid}}
+		switch field {
+		case "start_time":
+			after.StartTime = cursor.Value.(primitive.DateTime)
+		case "state":
+			after.State = State(cursor.Value.(string))
+		}
+		start = sort.Search(len(statuses), func(i int) bool {
+			return compare(&statuses[i], &after) > 0
+		})
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultStatusLimit
+	}
+	end := start + limit
+	if end >= len(statuses) {
+		end = len(statuses)
+	} else {
+		page.NextCursor = q.encodeCursor(&statuses[end-1])
+	}
+	page.Status = append(page.Status, statuses[start:end]...)
+	return page, nil
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// queryTestStatuses are five statuses, with ids ending 1 to 5, that tie
+// on both start time and state.
+func queryTestStatuses() []Status {
+	status := func(n int, start int64, state State) Status {
+		oid, _ := primitive.ObjectIDFromHex(fmt.Sprintf("%024x", n))
+		return Status{Task: Task{Id: oid, StartTime: primitive.DateTime(start)}, State: state}
+	}
+	return []Status{
+		status(1, 100, StateRunning),
+		status(2, 200, StatePending),
+		status(3, 100, StateStopped),
+		status(4, 300, StateRunning),
+		status(5, 200, StateRunning),
+	}
+}
+
+func TestPageStatus(t *testing.T) {
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{"start_time", []int{1, 3, 2, 5, 4}},
+		{"-start_time", []int{4, 5, 2, 3, 1}},
+		{"state", []int{2, 1, 4, 5, 3}},
+		{"-state", []int{3, 5, 4, 1, 2}},
+		{"id", []int{1, 2, 3, 4, 5}},
+		{"-id", []int{5, 4, 3, 2, 1}},
+	}
+	for _, test := range tests {
+		for _, limit := range []int{1, 2, 5} {
+			q := &StatusQuery{Sort: test.sort, Limit: limit}
+			var got []int
+			for pages := 0; ; pages++ {
+				if pages > len(test.want) {
+					t.Fatalf("sort %s, limit %d: the cursors never run out", test.sort, limit)
+				}
+				page, err := pageStatus(queryTestStatuses(), q)
+				if err != nil {
+					t.Fatalf("sort %s, limit %d: %v", test.sort, limit, err)
+				}
+				if page.Total != 5 || page.Counts[StateRunning] != 3 || page.Counts[StatePending] != 1 || page.Counts[StateStopped] != 1 {
+					t.Errorf("sort %s, limit %d: total %d, counts %v", test.sort, limit, page.Total, page.Counts)
+				}
+				for _, status := range page.Status {
+					n := 0
+					fmt.Sscanf(status.Id.Hex(), "%x", &n)
+					got = append(got, n)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				// The cursor survives being passed back as a parameter
+				q, err = ParseStatusQuery(url.Values{
+					"sort":   {test.sort},
+					"limit":  {fmt.Sprint(limit)},
+					"cursor": {page.NextCursor},
+				})
+				if err != nil {
+					t.Fatalf("sort %s, limit %d: %v", test.sort, limit, err)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("sort %s, limit %d: paged through %v, want %v", test.sort, limit, got, test.want)
+			}
+		}
+	}
+}
+
+func TestStatusCursorSortMismatch(t *testing.T) {
+	page, err := pageStatus(queryTestStatuses(), &StatusQuery{Sort: "start_time", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := url.Values{"sort": {"state"}, "cursor": {page.NextCursor}}
+	if _, err := ParseStatusQuery(params); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("a start_time cursor with sort=state: got %v, want ErrInvalidQuery", err)
+	}
+	// Descending is a different sort too
+	_, err = pageStatus(queryTestStatuses(), &StatusQuery{Sort: "-start_time", Cursor: page.NextCursor, Limit: 2})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("a start_time cursor with sort=-start_time: got %v, want ErrInvalidQuery", err)
+	}
+	for _, cursor := range []string{"not base64!", "bm90IGpzb24", page.NextCursor[:len(page.NextCursor)-4]} {
+		params := url.Values{"sort": {"start_time"}, "cursor": {cursor}}
+		if _, err := ParseStatusQuery(params); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("cursor %q: got %v, want ErrInvalidQuery", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// RunReaper looks for running tasks whose workers have missed
+// `Cfg.HeartbeatMisses` heartbeats in a row, marks them lost and,
+// if their retry policy allows, re-dispatches them. It checks every
+// heartbeat interval until ctx is cancelled.
+func (a *Api) RunReaper(ctx context.Context) {
+	interval := time.Duration(a.Cfg.HeartbeatInterval) * time.Second
+	if interval <= 0 || a.Cfg.HeartbeatMisses <= 0 {
+		log.Info("Heartbeat checking disabled; tasks will never be marked lost")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.reap(time.Now().Add(-interval * time.Duration(a.Cfg.HeartbeatMisses)))
+		}
+	}
+}
+
+// reap handles every task that hasn't heard from its worker since cutoff.
+func (a *Api) reap(cutoff time.Time) {
+	stale, err := a.DB.GetStaleTasks(cutoff)
+	if err != nil {
+		log.Errorf("Error looking for stale tasks: %v", err)
+		return
+	}
+
+	for _, status := range *stale {
+		id := status.Id.Hex()
+		reason := fmt.Sprintf("missed %d heartbeats", a.Cfg.HeartbeatMisses)
+		err := a.DB.MarkTaskLost(id, cutoff, "reaper", reason)
+		if err == ErrTaskNotFound {
+			// It heard from its worker (or finished) in the meantime
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error marking task %s lost: %v", id, err)
+			continue
+		}
+		log.Warnf("Task %s lost: %s", id, reason)
+
+		lost, err := a.DB.GetSingleStatus(id)
+		if err != nil {
+			log.Errorf("Error reading lost task %s: %v", id, err)
+			continue
+		}
+		a.Watcher.Publish(StatusEvent{Type: StatusEventLost, Id: id, Status: lost})
+
+		// Only retry tasks that were running; one that was already
+		// stopping was on its way out anyway.
+		if status.State != StateRunning || status.RetryPolicy == nil || status.Attempt >= status.RetryPolicy.MaxAttempts {
+			continue
+		}
+		attempt := status.Attempt + 1
+		reason = fmt.Sprintf("re-dispatching lost task, attempt %d of %d", attempt, status.RetryPolicy.MaxAttempts)
+		if err := a.DB.RedispatchTask(id, attempt, "reaper", reason); err != nil {
+			log.Errorf("Error re-dispatching task %s: %v", id, err)
+			continue
+		}
+		a.Outbox.Kick()
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reconfigureAckTimeout is how long UpdateTask waits for the worker to
+// acknowledge a parameters update before answering without it.
+const reconfigureAckTimeout = 5 * time.Second
+
+// The outcomes of a parameters update UpdateTask reports as Result
+const (
+	ReconfigureApplied = "applied"
+	ReconfigureRefused = "refused"
+	ReconfigurePending = "pending"
+)
+
+// ErrTaskNotRunning is returned when updating the parameters of a task
+// that isn't running.
+var ErrTaskNotRunning = errors.New("task isn't running")
+
+// Reconfiguration is a parameters update requested for a running task,
+// and what its worker made of it.
+type Reconfiguration struct {
+	Revision    int                    `json:"revision" bson:"revision"`
+	Parameters  map[string]interface{} `json:"parameters" bson:"parameters"`
+	RequestedAt primitive.DateTime     `json:"requested_at" bson:"requested_at"`
+	Actor       string                 `json:"actor" bson:"actor"`
+	// AckedAt is when the worker acknowledged the update, Applied
+	// whether it applied it and Error why not, if it didn't
+	AckedAt primitive.DateTime `json:"acked_at,omitempty" bson:"acked_at,omitempty"`
+	Applied bool               `json:"applied" bson:"applied"`
+	Error   string             `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// UpdateRequest is the body of a parameters update.
+type UpdateRequest struct {
+	Id         string                 `json:"id"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// UpdateTask changes some of a running task's parameters. The changes
+// are validated against the task type's catalog definition (or, with
+// catalog sync off, only their names are checked), recorded in the
+// task's history and sent to its worker as a reconfigure command.
+// It then waits a few seconds for the worker to acknowledge them: the
+// Result is `applied` or `refused` if it did, and `pending` (with a 202)
+// if it didn't, in which case the task's `reconfiguration` shows how it
+// turns out.
+func (a *Api) UpdateTask(c echo.Context) error {
+	var request UpdateRequest
+	err := json.NewDecoder(c.Request().Body).Decode(&request)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+
+	if err := a.authorizeControl(c, request.Id); err != nil {
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	status, err := a.DB.GetSingleStatus(request.Id)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	if status.State != StateRunning {
+		return c.JSON(http.StatusConflict, Response{Msg: fmt.Sprintf("%v: it's %s", ErrTaskNotRunning, status.State)})
+	}
+
+	changes := request.Parameters
+	catalog, err := a.Catalog.Current()
+	switch {
+	case err == nil:
+		changes, err = validateUpdate(catalog, status.Type, request.Parameters)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return c.JSON(http.StatusUnprocessableEntity, Response{
+				Msg:    "Invalid parameters update",
+				Errors: validationErr.Errors,
+			})
+		}
+	case err == ErrCatalogNotFound && a.Catalog.URL == "":
+		errs := checkParameterNames(changes)
+		if len(changes) == 0 {
+			errs = []FieldError{{Field: "parameters", Message: "must change at least one parameter"}}
+		}
+		if len(errs) > 0 {
+			return c.JSON(http.StatusUnprocessableEntity, Response{
+				Msg:    "Invalid parameters update",
+				Errors: errs,
+			})
+		}
+	default:
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	revision, err := a.DB.RequestReconfigure(request.Id, changes, actorOf(c))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	err = a.publishCommand(ctx, protocol.Command{
+		Kind:       protocol.CommandReconfigure,
+		TaskId:     request.Id,
+		Reason:     "parameters update requested",
+		Parameters: changes,
+		Revision:   revision,
+	})
+	if err != nil {
+		c.Logger().Warnf("Error sending parameters update %d for task %s: %v", revision, request.Id, err)
+		return c.JSON(http.StatusAccepted, Response{
+			Msg:    fmt.Sprintf("Recorded parameters update %d for %s, but couldn't send it to its worker: %v", revision, request.Id, err),
+			Result: ReconfigurePending,
+			Id:     request.Id,
+		})
+	}
+
+	reconfig, err := a.awaitReconfigure(ctx, request.Id, revision)
+	switch {
+	case err != nil:
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	case reconfig == nil:
+		return c.JSON(http.StatusAccepted, Response{
+			Msg:    fmt.Sprintf("Sent parameters update %d for %s; its worker hasn't acknowledged it yet", revision, request.Id),
+			Result: ReconfigurePending,
+			Id:     request.Id,
+		})
+	case !reconfig.Applied:
+		return c.JSON(http.StatusOK, Response{
+			Msg:    fmt.Sprintf("Worker refused parameters update %d for %s: %s", revision, request.Id, reconfig.Error),
+			Result: ReconfigureRefused,
+			Id:     request.Id,
+		})
+	}
+	return c.JSON(http.StatusOK, Response{
+		Msg:    fmt.Sprintf("Worker applied parameters update %d for %s", revision, request.Id),
+		Result: ReconfigureApplied,
+		Id:     request.Id,
+	})
+}
+
+// awaitReconfigure polls the task until its worker acknowledges the
+// parameters update with revision, returning nil if that doesn't happen
+// within reconfigureAckTimeout or the update is superseded first.
+func (a *Api) awaitReconfigure(ctx context.Context, id string, revision int) (*Reconfiguration, error) {
+	ctx, cancel := context.WithTimeout(ctx, reconfigureAckTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+
+		status, err := a.DB.GetSingleStatus(id)
+		if err != nil {
+			return nil, err
+		}
+		reconfig := status.Reconfiguration
+		if reconfig == nil || reconfig.Revision != revision {
+			return nil, nil
+		}
+		if reconfig.AckedAt != 0 {
+			return reconfig, nil
+		}
+	}
+}
+
+// describeChanges lists a parameters update for the task's history.
+func describeChanges(changes map[string]interface{}) string {
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	described := make([]string, len(names))
+	for i, name := range names {
+		described[i] = fmt.Sprintf("%s=%v", name, changes[name])
+	}
+	return strings.Join(described, ", ")
+}
+
+// ackReason is the history entry for a worker's acknowledgement of a
+// parameters update.
+func ackReason(revision int, rejection string) string {
+	if rejection != "" {
+		return fmt.Sprintf("worker refused parameters update %d: %s", revision, rejection)
+	}
+	return fmt.Sprintf("worker applied parameters update %d", revision)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// ErrInvalidReport is returned for worker reports dc doesn't understand.
+var ErrInvalidReport = errors.New("invalid report")
+
+// ReportTask accepts a worker's report about a task over HTTP
+// and replies with a protocol.Ack.
+func (a *Api) ReportTask(c echo.Context) error {
+	var report protocol.Report
+	err := json.NewDecoder(c.Request().Body).Decode(&report)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadRequest, protocol.Ack{Error: err.Error()})
+	}
+	report.TaskId = c.Param("id")
+
+	ack, err := a.HandleReport(report)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), protocol.Ack{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, ack)
+}
+
+// HandleReport applies a worker's report to its task, moving it through
+// the state machine where the report calls for it, and tells the worker
+// whether the task has been asked to stop or been killed.
+func (a *Api) HandleReport(report protocol.Report) (*protocol.Ack, error) {
+	actor := "worker"
+	if report.WorkerId != "" {
+		actor = "worker:" + report.WorkerId
+	}
+
+	var err error
+	switch report.Kind {
+	case protocol.ReportStarted:
+		err = a.DB.StartTask(report.TaskId, report.WorkerId, actor)
+		// If the task was asked to stop before a worker picked it up,
+		// the Ack below tells the worker so.
+		var transitionErr *TransitionError
+		if errors.As(err, &transitionErr) && transitionErr.From == StateStopping {
+			err = nil
+		}
+	case protocol.ReportHeartbeat:
+		err = a.DB.RecordHeartbeat(report.TaskId, report.WorkerId)
+		if err == nil {
+			// A worker we'd given up on may turn out to be alive after all
+			err = a.DB.ResumeTask(report.TaskId, report.WorkerId, actor)
+		}
+	case protocol.ReportProgress:
+		err = a.DB.UpdateProgress(report.TaskId, report.WorkerId, report.Progress, report.Message)
+	case protocol.ReportSucceeded:
+		err = a.DB.FinishTask(report.TaskId, report.WorkerId, StateStopped, actor, reasonOr(report.Message, "task completed"))
+	case protocol.ReportStopped:
+		err = a.DB.FinishTask(report.TaskId, report.WorkerId, StateStopped, actor, reasonOr(report.Message, "task stopped"))
+	case protocol.ReportFailed:
+		err = a.DB.FinishTask(report.TaskId, report.WorkerId, StateFailed, actor, reasonOr(report.Message, "task failed"))
+	case protocol.ReportStopAck:
+		command := report.Command
+		if command == "" {
+			command = protocol.CommandStop
+		}
+		err = a.DB.AddHistory(report.TaskId, actor, fmt.Sprintf("worker acknowledged %s", command))
+	case protocol.ReportReconfigureAck:
+		err = a.DB.AckReconfigure(report.TaskId, report.Revision, report.Error, actor)
+	default:
+		err = fmt.Errorf("%w: unknown kind %q", ErrInvalidReport, report.Kind)
+	}
+	// Heartbeats, progress and results only count from the task's
+	// own worker; whether the task is there at all is checked below
+	if err != nil && err != ErrTaskNotFound {
+		return nil, err
+	}
+
+	status, err := a.DB.GetSingleStatus(report.TaskId)
+	if err != nil {
+		return nil, err
+	}
+	// A task that was re-dispatched after being lost belongs to
+	// whichever worker picks it up next, not the one that lost it.
+	reassigned := status.WorkerId != report.WorkerId
+	ack := &protocol.Ack{
+		StopRequested: status.StopFlag || status.State == StateStopping || reassigned,
+		KillRequested: status.KillRequested,
+	}
+	if status.StopDeadline != 0 {
+		ack.StopDeadline = status.StopDeadline.Time().UTC()
+	}
+	return ack, nil
+}
+
+// HeartbeatTask accepts a heartbeat for a task over HTTP. The body is
+// optional; if given, it is a protocol.Report identifying the worker.
+func (a *Api) HeartbeatTask(c echo.Context) error {
+	var report protocol.Report
+	if c.Request().ContentLength != 0 {
+		err := json.NewDecoder(c.Request().Body).Decode(&report)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusBadRequest, protocol.Ack{Error: err.Error()})
+		}
+	}
+	report.TaskId = c.Param("id")
+	report.Kind = protocol.ReportHeartbeat
+
+	ack, err := a.HandleReport(report)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), protocol.Ack{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, ack)
+}
+
+// reasonOr returns reason, or fallback if reason is empty.
+func reasonOr(reason string, fallback string) string {
+	if reason == "" {
+		return fallback
+	}
+	return reason
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func report(t *testing.T, a *Api, id string, workerId string, kind protocol.ReportKind) *protocol.Ack {
+	t.Helper()
+	ack, err := a.HandleReport(protocol.Report{TaskId: id, WorkerId: workerId, Kind: kind})
+	if err != nil {
+		t.Fatalf("%s from %s: %v", kind, workerId, err)
+	}
+	return ack
+}
+
+func TestReportsFromAnotherWorker(t *testing.T) {
+	a := &Api{DB: NewMemoryStore()}
+	id := createTestTask(t, a.DB, Task{Type: "test"})
+	if ack := report(t, a, id, "worker-1", protocol.ReportStarted); ack.StopRequested {
+		t.Fatal("the worker that started the task was told to stop")
+	}
+
+	// worker-1 goes quiet and the task is handed to worker-2
+	if err := a.DB.MarkTaskLost(id, time.Now().Add(time.Hour), "reaper", "no heartbeats"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DB.RedispatchTask(id, 1, "reaper", "redispatched"); err != nil {
+		t.Fatal(err)
+	}
+	if ack := report(t, a, id, "worker-2", protocol.ReportStarted); ack.StopRequested {
+		t.Fatal("the worker the task was handed to was told to stop")
+	}
+	before := getTestStatus(t, a.DB, id)
+
+	// worker-1 comes back, and is told to stop whatever it says
+	for _, kind := range []protocol.ReportKind{
+		protocol.ReportHeartbeat,
+		protocol.ReportProgress,
+		protocol.ReportSucceeded,
+		protocol.ReportStopped,
+		protocol.ReportFailed,
+	} {
+		if ack := report(t, a, id, "worker-1", kind); !ack.StopRequested {
+			t.Errorf("%s from the old worker: not told to stop", kind)
+		}
+		status := getTestStatus(t, a.DB, id)
+		if status.State != StateRunning || status.WorkerId != "worker-2" || status.LastHeartbeat != before.LastHeartbeat {
+			t.Errorf("%s from the old worker: task is %s on %s", kind, status.State, status.WorkerId)
+		}
+	}
+
+	if ack := report(t, a, id, "worker-2", protocol.ReportHeartbeat); ack.StopRequested {
+		t.Error("heartbeat from the task's worker: told to stop")
+	}
+	report(t, a, id, "worker-2", protocol.ReportSucceeded)
+	if status := getTestStatus(t, a.DB, id); status.State != StateStopped {
+		t.Errorf("after its worker succeeded the task is %s", status.State)
+	}
+}
+
+func TestReportForMissingTask(t *testing.T) {
+	a := &Api{DB: NewMemoryStore()}
+	missing := primitive.NewObjectID().Hex()
+	for _, kind := range []protocol.ReportKind{protocol.ReportHeartbeat, protocol.ReportFailed} {
+		if _, err := a.HandleReport(protocol.Report{TaskId: missing, WorkerId: "worker-1", Kind: kind}); err != ErrTaskNotFound {
+			t.Errorf("%s: got %v, want ErrTaskNotFound", kind, err)
+		}
+	}
+}
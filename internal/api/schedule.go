@@ -0,0 +1,549 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Kinds of schedule
+const (
+	// ScheduleOnce runs a single time, at At
+	ScheduleOnce = "once"
+	// ScheduleCron runs whenever Cron matches, in Location
+	ScheduleCron = "cron"
+	// ScheduleInterval runs every Every seconds, counting from At
+	ScheduleInterval = "interval"
+)
+
+// What the scheduler does with a run it missed by more than
+// MisfireGrace, e.g. because dc was down
+const (
+	// MisfireFire runs it once, late. Any other runs missed in
+	// the meantime are skipped.
+	MisfireFire = "fire"
+	// MisfireSkip skips it and waits for the next one
+	MisfireSkip = "skip"
+)
+
+// defaultMisfireGrace is how late, in seconds, a run may start
+// without counting as a misfire, when the schedule doesn't say.
+const defaultMisfireGrace = 60
+
+// maxPreviewRuns caps how many upcoming runs a preview lists.
+const maxPreviewRuns = 100
+
+var (
+	// ErrScheduleNotFound is returned for operations on schedules
+	// that don't exist.
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrScheduleConflict is returned by Store.UpdateSchedule when the
+	// schedule changed since it was read.
+	ErrScheduleConflict = errors.New("schedule was modified concurrently")
+)
+
+// Schedule creates tasks from a template at planned times. If it has
+// a Duration, each task is given a stop time that far after it starts,
+// which RunAutoStop enforces.
+type Schedule struct {
+	Id   primitive.ObjectID `json:"id" bson:"_id"`
+	Name string             `json:"name,omitempty" bson:"name,omitempty"`
+	Kind string             `json:"kind" bson:"kind"`
+	// At is when a one-shot schedule runs, or when an interval
+	// schedule's first run is (now, if left out)
+	At primitive.DateTime `json:"at,omitempty" bson:"at,omitempty"`
+	// Cron is a five-field cron expression, for cron schedules
+	Cron string `json:"cron,omitempty" bson:"cron,omitempty"`
+	// Every is the number of seconds between runs of an interval schedule
+	Every int `json:"every,omitempty" bson:"every,omitempty"`
+	// Duration is how many seconds each run lasts; zero leaves the
+	// task running (up to its type's maximum duration)
+	Duration int `json:"duration,omitempty" bson:"duration,omitempty"`
+	// Location is the IANA time zone cron expressions are evaluated
+	// in; UTC if left out
+	Location string `json:"location,omitempty" bson:"location,omitempty"`
+	// Task is the template for the tasks the schedule creates; their
+	// start and stop times are filled in for each run
+	Task          Task   `json:"task" bson:"task"`
+	MisfirePolicy string `json:"misfire_policy,omitempty" bson:"misfire_policy,omitempty"`
+	// MisfireGrace is how many seconds late a run may start before it
+	// counts as a misfire
+	MisfireGrace int  `json:"misfire_grace,omitempty" bson:"misfire_grace,omitempty"`
+	Paused       bool `json:"paused" bson:"paused"`
+	// NextRun is zero once a one-shot schedule has run
+	NextRun    primitive.DateTime `json:"next_run,omitempty" bson:"next_run,omitempty"`
+	LastRun    primitive.DateTime `json:"last_run,omitempty" bson:"last_run,omitempty"`
+	LastTaskId string             `json:"last_task_id,omitempty" bson:"last_task_id,omitempty"`
+	LastError  string             `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	Misfires   int                `json:"misfires,omitempty" bson:"misfires,omitempty"`
+	CreatedAt  primitive.DateTime `json:"created_at" bson:"created_at"`
+	CreatedBy  string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	// Revision is bumped on every update, so concurrent updates
+	// (e.g., from two dc instances) can't both win
+	Revision int `json:"revision" bson:"revision"`
+}
+
+// SchedulePreview lists a schedule's upcoming runs.
+type SchedulePreview struct {
+	Paused bool         `json:"paused"`
+	Runs   []PlannedRun `json:"runs"`
+}
+
+// PlannedRun is when a run will start and, if the schedule has a
+// duration, stop.
+type PlannedRun struct {
+	Start time.Time  `json:"start"`
+	Stop  *time.Time `json:"stop,omitempty"`
+}
+
+// location is the time zone the schedule is evaluated in.
+func (s *Schedule) location() (*time.Location, error) {
+	if s.Location == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Location)
+}
+
+// firstRun is the schedule's first run at or after now: At, for
+// one-shot schedules, even if it's passed, so misfire handling
+// decides whether it still runs.
+func (s *Schedule) firstRun(now time.Time) (time.Time, error) {
+	switch s.Kind {
+	case ScheduleOnce:
+		return s.At.Time(), nil
+	case ScheduleInterval:
+		if at := s.At.Time(); !at.Before(now) {
+			return at, nil
+		}
+	}
+	return s.nextAfter(now)
+}
+
+// nextAfter is the schedule's first run strictly after t, or the zero
+// time if it has none.
+func (s *Schedule) nextAfter(t time.Time) (time.Time, error) {
+	switch s.Kind {
+	case ScheduleOnce:
+		if at := s.At.Time(); at.After(t) {
+			return at, nil
+		}
+		return time.Time{}, nil
+	case ScheduleInterval:
+		anchor := s.At.Time()
+		every := time.Duration(s.Every) * time.Second
+		if t.Before(anchor) {
+			return anchor, nil
+		}
+		// Runs stay on the anchor's grid however late we are
+		return anchor.Add((t.Sub(anchor)/every + 1) * every), nil
+	case ScheduleCron:
+		loc, err := s.location()
+		if err != nil {
+			return time.Time{}, err
+		}
+		cron, err := parseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return cron.next(t.In(loc)), nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown schedule kind %q", s.Kind)
+	}
+}
+
+// misfireGrace is how late a run may start before it's a misfire.
+func (s *Schedule) misfireGrace() time.Duration {
+	if s.MisfireGrace > 0 {
+		return time.Duration(s.MisfireGrace) * time.Second
+	}
+	return defaultMisfireGrace * time.Second
+}
+
+// preview lists up to count runs from now on.
+func (s *Schedule) preview(now time.Time, count int) (*SchedulePreview, error) {
+	preview := &SchedulePreview{Paused: s.Paused, Runs: []PlannedRun{}}
+	var next time.Time
+	var err error
+	switch {
+	case s.NextRun != 0:
+		next = s.NextRun.Time()
+	case s.Kind == ScheduleOnce && s.LastRun != 0:
+		// Already ran
+		return preview, nil
+	default:
+		next, err = s.firstRun(now)
+	}
+
+	for ; err == nil && !next.IsZero() && len(preview.Runs) < count; next, err = s.nextAfter(next) {
+		run := PlannedRun{Start: next.UTC()}
+		if s.Duration > 0 {
+			stop := run.Start.Add(time.Duration(s.Duration) * time.Second)
+			run.Stop = &stop
+		}
+		preview.Runs = append(preview.Runs, run)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// prepareSchedule checks a new schedule and fills in its defaults and
+// first run. The task template is checked against the catalog, if
+// there is one, the same way CreateTask checks tasks.
+func (a *Api) prepareSchedule(s *Schedule, now time.Time) error {
+	// Stored times only have millisecond precision
+	now = now.Truncate(time.Millisecond)
+	var errs []FieldError
+	switch s.Kind {
+	case ScheduleOnce:
+		if s.At == 0 {
+			errs = append(errs, FieldError{Field: "at", Message: "is required for one-shot schedules"})
+		}
+	case ScheduleCron:
+		if _, err := parseCron(s.Cron); err != nil {
+			errs = append(errs, FieldError{Field: "cron", Message: err.Error()})
+		}
+	case ScheduleInterval:
+		if s.Every <= 0 {
+			errs = append(errs, FieldError{Field: "every", Message: "must be a positive number of seconds"})
+		}
+		if s.At == 0 {
+			s.At = primitive.NewDateTimeFromTime(now)
+		}
+	default:
+		errs = append(errs, FieldError{Field: "kind", Message: fmt.Sprintf("must be %s, %s or %s", ScheduleOnce, ScheduleCron, ScheduleInterval)})
+	}
+	if s.Duration < 0 {
+		errs = append(errs, FieldError{Field: "duration", Message: "must not be negative"})
+	}
+	if s.MisfireGrace < 0 {
+		errs = append(errs, FieldError{Field: "misfire_grace", Message: "must not be negative"})
+	}
+	switch s.MisfirePolicy {
+	case "":
+		s.MisfirePolicy = MisfireFire
+	case MisfireFire, MisfireSkip:
+	default:
+		errs = append(errs, FieldError{Field: "misfire_policy", Message: fmt.Sprintf("must be %s or %s", MisfireFire, MisfireSkip)})
+	}
+	if _, err := s.location(); err != nil {
+		errs = append(errs, FieldError{Field: "location", Message: err.Error()})
+	}
+	if s.Kind == ScheduleOnce && s.At != 0 && now.Sub(s.At.Time()) > s.misfireGrace() {
+		errs = append(errs, FieldError{Field: "at", Message: "is in the past"})
+	}
+
+	// Validate a copy; the template keeps its parameters as given,
+	// so each run is resolved against the catalog of its day
+	template := s.Task
+	catalog, err := a.Catalog.Current()
+	switch {
+	case err == nil:
+		var validationErr *ValidationError
+		if err := validateTask(catalog, &template); errors.As(err, &validationErr) {
+			for _, fieldErr := range validationErr.Errors {
+				fieldErr.Field = "task." + fieldErr.Field
+				errs = append(errs, fieldErr)
+			}
+		}
+	case err == ErrCatalogNotFound && a.Catalog.URL == "":
+	default:
+		return err
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+
+	next, err := s.firstRun(now)
+	if err != nil {
+		return err
+	}
+	if next.IsZero() {
+		return &ValidationError{Errors: []FieldError{{Field: "cron", Message: "never matches"}}}
+	}
+	s.NextRun = primitive.NewDateTimeFromTime(next)
+	return nil
+}
+
+// updateSchedule applies update to the latest version of a schedule
+// and saves it, starting over if someone else saved it first. update
+// returns false to leave the schedule alone.
+func (a *Api) updateSchedule(id string, update func(*Schedule) bool) (*Schedule, error) {
+	for {
+		schedule, err := a.DB.GetSchedule(id)
+		if err != nil {
+			return nil, err
+		}
+		if !update(schedule) {
+			return schedule, nil
+		}
+		err = a.DB.UpdateSchedule(*schedule)
+		if err == ErrScheduleConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		schedule.Revision++
+		return schedule, nil
+	}
+}
+
+// RunScheduler starts the runs of every schedule that's due, checking
+// every second until ctx is cancelled.
+func (a *Api) RunScheduler(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.schedule(time.Now())
+		}
+	}
+}
+
+// schedule starts every run that's due by now.
+func (a *Api) schedule(now time.Time) {
+	schedules, err := a.DB.GetAllSchedules()
+	if err != nil {
+		log.Errorf("Error reading schedules: %v", err)
+		return
+	}
+
+	due := primitive.NewDateTimeFromTime(now)
+	for _, schedule := range *schedules {
+		if !schedule.Paused && schedule.NextRun != 0 && schedule.NextRun <= due {
+			a.startRun(schedule.Id.Hex(), now)
+		}
+	}
+}
+
+// startRun claims a schedule's due run, by moving its NextRun on,
+// and creates the run's task. Runs missed by more than the schedule's
+// misfire grace are started or skipped according to its policy.
+func (a *Api) startRun(id string, now time.Time) {
+	var fire bool
+	var missed time.Time
+	_, err := a.updateSchedule(id, func(s *Schedule) bool {
+		fire = false
+		if s.Paused || s.NextRun == 0 || s.NextRun.Time().After(now) {
+			// Someone else got to it first
+			return false
+		}
+
+		missed = s.NextRun.Time()
+		fire = s.MisfirePolicy != MisfireSkip || now.Sub(missed) <= s.misfireGrace()
+		if !fire {
+			s.Misfires++
+			s.LastError = fmt.Sprintf("skipped run due at %s", missed.UTC().Format(time.RFC3339))
+		}
+
+		next, err := s.nextAfter(now)
+		if err != nil {
+			s.LastError = err.Error()
+		}
+		s.NextRun = 0
+		if !next.IsZero() {
+			s.NextRun = primitive.NewDateTimeFromTime(next)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("Error claiming run of schedule %s: %v", id, err)
+		return
+	}
+	if !fire {
+		if !missed.IsZero() {
+			log.Warnf("Skipping run of schedule %s missed at %s", id, missed.UTC().Format(time.RFC3339))
+		}
+		return
+	}
+
+	schedule, err := a.DB.GetSchedule(id)
+	if err != nil {
+		log.Errorf("Error reading schedule %s: %v", id, err)
+		return
+	}
+	task := schedule.Task
+	task.Id = primitive.NilObjectID
+	task.StartTime = primitive.NewDateTimeFromTime(now)
+	task.StopTime = 0
+	if schedule.Duration > 0 {
+		task.StopTime = primitive.NewDateTimeFromTime(now.Add(time.Duration(schedule.Duration) * time.Second))
+	}
+
+	actor := "scheduler:" + id
+	oid, submitErr := a.submitTask(task, actor)
+	if submitErr != nil {
+		log.Errorf("Error creating task for schedule %s: %v", id, submitErr)
+		a.auditAction(actor, AuditTaskCreate, "", map[string]interface{}{"schedule": id}, submitErr)
+	} else {
+		log.Infof("Schedule %s started task %s", id, oid.Hex())
+		a.auditAction(actor, AuditTaskCreate, oid.Hex(), map[string]interface{}{"schedule": id}, nil)
+	}
+
+	_, err = a.updateSchedule(id, func(s *Schedule) bool {
+		s.LastRun = primitive.NewDateTimeFromTime(now)
+		if submitErr != nil {
+			s.LastError = submitErr.Error()
+			return true
+		}
+		s.LastTaskId = oid.Hex()
+		s.LastError = ""
+		return true
+	})
+	if err != nil {
+		log.Errorf("Error recording run of schedule %s: %v", id, err)
+	}
+}
+
+// GetSchedules returns every schedule.
+func (a *Api) GetSchedules(c echo.Context) error {
+	schedules, err := a.DB.GetAllSchedules()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+// GetSchedule returns a single schedule given its id.
+func (a *Api) GetSchedule(c echo.Context) error {
+	schedule, err := a.DB.GetSchedule(c.Param("id"))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// CreateSchedule validates the client-requested schedule and stores
+// it. Invalid schedules are rejected with a 422 listing every bad field.
+func (a *Api) CreateSchedule(c echo.Context) error {
+	var schedule Schedule
+	err := json.NewDecoder(c.Request().Body).Decode(&schedule)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+
+	now := time.Now()
+	err = a.prepareSchedule(&schedule, now)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return c.JSON(http.StatusUnprocessableEntity, Response{
+			Msg:    "Invalid schedule",
+			Errors: validationErr.Errors,
+		})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	schedule.Id = primitive.NewObjectID()
+	schedule.CreatedAt = primitive.NewDateTimeFromTime(now)
+	schedule.CreatedBy = actorOf(c)
+	// The schedule's tasks belong to whoever created it
+	schedule.Task.Owner = ownerOf(c)
+	schedule.Revision = 0
+	schedule.LastRun, schedule.LastTaskId, schedule.LastError, schedule.Misfires = 0, "", "", 0
+	if err := a.DB.CreateSchedule(schedule); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Msg: "Successfully created schedule",
+		Id:  schedule.Id.Hex(),
+	})
+}
+
+// DeleteSchedule deletes a schedule. Tasks it already started are left
+// alone, and still stop at their stop time.
+func (a *Api) DeleteSchedule(c echo.Context) error {
+	id := c.Param("id")
+	err := a.DB.DeleteSchedule(id)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, Response{Msg: fmt.Sprintf("Successfully deleted schedule %s", id)})
+}
+
+// PauseSchedule stops a schedule from starting runs until it's resumed.
+// Runs already started still stop at their stop time.
+func (a *Api) PauseSchedule(c echo.Context) error {
+	return a.setPaused(c, true)
+}
+
+// ResumeSchedule lets a paused schedule start runs again. Its next run
+// is worked out from now, so runs due while it was paused are skipped,
+// other than a one-shot schedule's, which is subject to misfire handling.
+func (a *Api) ResumeSchedule(c echo.Context) error {
+	return a.setPaused(c, false)
+}
+
+func (a *Api) setPaused(c echo.Context, paused bool) error {
+	id := c.Param("id")
+	now := time.Now()
+	schedule, err := a.updateSchedule(id, func(s *Schedule) bool {
+		if s.Paused == paused {
+			return false
+		}
+		s.Paused = paused
+		if !paused && !(s.Kind == ScheduleOnce && s.LastRun != 0) {
+			next, err := s.firstRun(now)
+			if err != nil {
+				s.LastError = err.Error()
+			}
+			s.NextRun = 0
+			if !next.IsZero() {
+				s.NextRun = primitive.NewDateTimeFromTime(next)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// PreviewSchedule lists a schedule's next `count` runs (10 by default).
+func (a *Api) PreviewSchedule(c echo.Context) error {
+	count := 10
+	if param := c.QueryParam("count"); param != "" {
+		var err error
+		count, err = strconv.Atoi(param)
+		if err != nil || count < 1 || count > maxPreviewRuns {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("count must be a number from 1 to %d", maxPreviewRuns))
+		}
+	}
+
+	schedule, err := a.DB.GetSchedule(c.Param("id"))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(errorStatus(err), err.Error())
+	}
+	preview, err := schedule.preview(time.Now(), count)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, preview)
+}
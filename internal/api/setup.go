@@ -13,18 +13,20 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
+	"github.com/mrecachinas/dcserver/internal/auth"
 	"github.com/mrecachinas/dcserver/internal/config"
 	"golang.org/x/net/websocket"
 )
 
-// NewDCAPI creates a new api.Api with MongoDB and AMQP connections
+// NewDCAPI creates a new api.Api with the configured store
+// backend and message bus
 func NewDCAPI(cfg *config.Config) (*Api, error) {
-	client, err := SetupMongoConnection(cfg.MongoHost, cfg.MongoPort)
+	db, err := SetupStore(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	amqpConnection, amqpChannel, err := SetupAMQP(cfg.AMQPHost, cfg.AMQPPort, cfg.AMQPUser, cfg.AMQPPassword)
+	bus, err := SetupDispatcher(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -39,18 +41,70 @@ func NewDCAPI(cfg *config.Config) (*Api, error) {
 		}
 	}
 
+	catalogInterval := time.Duration(cfg.CatalogInterval) * time.Second
+	catalog, err := SetupCatalogCache(db, httpClient, cfg.TaskURL, catalogInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts, err := SetupArtifactStore(cfg, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticators, err := SetupAuthenticators(cfg, db, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := SetupWebsocketConnectionPool()
+	pollingInterval := time.Duration(cfg.PollingInterval) * time.Second
+
 	dcapi := &Api{
-		MongoClient: client,
-		DB:          DB{client.Database(cfg.MongoDatabaseName)},
-		AMQPClient:  amqpConnection,
-		AMQPChannel: amqpChannel,
-		HTTPClient:  httpClient,
-		Websocket:   SetupWebsocketConnectionPool(),
-		Cfg:         cfg,
+		DB:         db,
+		Bus:        bus,
+		HTTPClient: httpClient,
+		Websocket:  pool,
+		Watcher:    SetupStatusWatcher(db, pool, catalog, pollingInterval),
+		Outbox:     SetupOutboxRelay(db, bus, cfg.OutboxMaxAttempts),
+		Catalog:    catalog,
+		Streams:    SetupStreamRelay(cfg.StreamBuffer, cfg.StreamMaxFrame),
+		Artifacts:  artifacts,
+		Audit:      SetupAuditLog(db),
+		Cfg:        cfg,
+
+		Authenticators: authenticators,
 	}
 	return dcapi, nil
 }
 
+// SetupAuthenticators sets up the ways of authenticating named in the
+// config, in order. API tokens are looked up in db and JWT keys are
+// fetched with client.
+func SetupAuthenticators(cfg *config.Config, db Store, client *http.Client) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	for _, method := range cfg.Auth {
+		switch method {
+		case auth.MethodJWT:
+			authenticator, err := auth.NewJWTAuthenticator(cfg.JWKSURL, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTRolesClaim, client)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, authenticator)
+		case auth.MethodToken:
+			authenticators = append(authenticators, &auth.TokenAuthenticator{Tokens: db})
+		case auth.MethodMTLS:
+			if err := auth.CheckRoles(cfg.MTLSRoles); err != nil {
+				return nil, fmt.Errorf("mtls roles: %w", err)
+			}
+			authenticators = append(authenticators, auth.CertAuthenticator{Roles: cfg.MTLSRoles})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
+
 // SetupMongoConnection simply (attempts to) connects to MongoDB and returns
 // a pointer to a mongo.Client.
 func SetupMongoConnection(mongohost string, mongoport int) (*mongo.Client, error) {
@@ -59,7 +113,8 @@ func SetupMongoConnection(mongohost string, mongoport int) (*mongo.Client, error
 	if err != nil {
 		return nil, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
 		return nil, err
@@ -78,6 +133,7 @@ func SetupAMQP(amqphost string, amqpport int, amqpuser string, amqppassword stri
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return nil, nil, err
 	}
 
@@ -123,5 +179,5 @@ func SetupHTTPSClient(certfile string, keyfile string, cacertfile string) (*http
 // SetupWebsocketConnectionPool establishes a WebsocketConnectionPool object
 // and makes an empty *websocket.Conn map.
 func SetupWebsocketConnectionPool() *WebsocketConnectionPool {
-	return &WebsocketConnectionPool{Connections: make(map[*websocket.Conn]struct{})}
+	return &WebsocketConnectionPool{Connections: make(map[*websocket.Conn]*WebsocketSubscriber)}
 }
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/bluefile"
+	"github.com/mrecachinas/dcserver/internal/dsp"
+)
+
+// Spectral products of recordings
+const (
+	// SpectrumFFT is the complex spectrum of the window's first frame
+	SpectrumFFT = "fft"
+	// SpectrumPSD is the power spectral density of the window, in dB,
+	// averaged over its frames
+	SpectrumPSD = "psd"
+	// SpectrumSpectrogram is the power spectral density of each frame
+	// of the window, in dB, as a type 2000 raster
+	SpectrumSpectrogram = "spectrogram"
+)
+
+const (
+	defaultSpectrumSize   = 1024
+	minSpectrumSize       = 16
+	maxSpectrumSize       = 65536
+	defaultSpectrumFrames = 512
+	maxSpectrumFrames     = 4096
+	// maxSpectrogramValues caps a spectrogram's rows times bins, so a
+	// big nfft can't be combined with many frames
+	maxSpectrogramValues = 64 * maxViewPoints
+)
+
+// xunitsHertz is the BLUE units code for frequencies.
+const xunitsHertz = 3
+
+// spectrumRequest is a requested spectral product of a recording.
+type spectrumRequest struct {
+	Product string
+	Size    int
+	Overlap float64
+	Window  string
+	// Frames is at most how many rows a spectrogram has
+	Frames int
+	Output string
+}
+
+// parseSpectrumRequest reads a spectrumRequest from query parameters:
+// the `product`, the FFT size `nfft`, the fraction of each frame the
+// next `overlap`s, the `window` function, at most how many `frames` a
+// spectrogram has and the `output` form.
+func parseSpectrumRequest(params url.Values) (*spectrumRequest, error) {
+	req := &spectrumRequest{
+		Product: SpectrumPSD,
+		Size:    defaultSpectrumSize,
+		Overlap: 0.5,
+		Window:  dsp.WindowHann,
+		Frames:  defaultSpectrumFrames,
+	}
+	if value := params.Get("product"); value != "" {
+		switch value {
+		case SpectrumFFT, SpectrumPSD, SpectrumSpectrogram:
+			req.Product = value
+		default:
+			return nil, fmt.Errorf("%w: unknown product %q", ErrInvalidView, value)
+		}
+	}
+	if value := params.Get("nfft"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minSpectrumSize || size > maxSpectrumSize || size&(size-1) != 0 {
+			return nil, fmt.Errorf("%w: nfft must be a power of two from %d to %d", ErrInvalidView, minSpectrumSize, maxSpectrumSize)
+		}
+		req.Size = size
+	}
+	if value := params.Get("overlap"); value != "" {
+		overlap, err := strconv.ParseFloat(value, 64)
+		if err != nil || overlap < 0 || overlap >= 1 {
+			return nil, fmt.Errorf("%w: overlap must be a fraction from 0 up to 1", ErrInvalidView)
+		}
+		req.Overlap = overlap
+	}
+	if value := params.Get("window"); value != "" {
+		switch value {
+		case dsp.WindowRect, dsp.WindowHann, dsp.WindowHamming, dsp.WindowBlackman:
+			req.Window = value
+		default:
+			return nil, fmt.Errorf("%w: unknown window %q", ErrInvalidView, value)
+		}
+	}
+	if value := params.Get("frames"); value != "" {
+		frames, err := strconv.Atoi(value)
+		if err != nil || frames < 1 || frames > maxSpectrumFrames {
+			return nil, fmt.Errorf("%w: frames must be a number from 1 to %d", ErrInvalidView, maxSpectrumFrames)
+		}
+		req.Frames = frames
+	}
+	output, err := parseViewOutput(params)
+	req.Output = output
+	return req, err
+}
+
+// GetArtifactSpectrum computes a spectral product of a window of a
+// type 1000 BLUE file artifact: the complex FFT of its first frame,
+// its averaged power spectral density (the default), or a spectrogram
+// of the density of each frame, with consecutive frames averaged so it
+// has at most `frames` rows. Frames are `nfft` samples long, overlap
+// by `overlap` and are weighted by a Hann (the default), Hamming,
+// Blackman or rectangular `window`. The product is returned as a BLUE
+// file SigPlot can load (type 2000 for spectrograms, which it draws as
+// a raster), or as raw float32s with `output=raw`. Spectrograms are
+// limited to maxSpectrogramValues values.
+func (a *Api) GetArtifactSpectrum(c echo.Context) error {
+	req, err := parseSpectrumRequest(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+	rec, err := a.openRecording(c)
+	if err != nil {
+		return recordingError(c, err)
+	}
+	defer rec.Close()
+
+	header := rec.Header
+	if header.XDelta <= 0 {
+		msg := fmt.Sprintf("%v: the file's xdelta is %v", ErrInvalidView, header.XDelta)
+		return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+	}
+	sampleRate := 1 / header.XDelta
+	spectrum, err := dsp.NewSpectrum(req.Size, req.Overlap, req.Window, rec.Data.Components(), sampleRate)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{Msg: fmt.Sprintf("%v: %v", ErrInvalidView, err)})
+	}
+	frames := spectrum.Frames(rec.Window.Count)
+	if frames == 0 {
+		msg := fmt.Sprintf("%v: the window has %d samples, fewer than nfft", ErrInvalidView, rec.Window.Count)
+		return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+	}
+
+	// Spectrogram rows each average this many frames
+	averaged := int64(1)
+	if req.Product == SpectrumSpectrogram {
+		averaged = 1 + (frames-1)/int64(req.Frames)
+		rows := 1 + (frames-1)/averaged
+		if rows*int64(spectrum.Bins()) > maxSpectrogramValues {
+			msg := fmt.Sprintf("%v: a spectrogram of %d frames of %d bins is over the limit of %d values; ask for fewer frames or a smaller nfft",
+				ErrInvalidView, rows, spectrum.Bins(), maxSpectrogramValues)
+			return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+		}
+	}
+
+	var values []float64
+	var rows int
+	psd := make([]float64, spectrum.Bins())
+	sample := make([]float64, rec.Data.Components())
+	n := int64(0)
+	for {
+		err := rec.Data.ReadElement(sample)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusBadGateway, Response{Msg: err.Error()})
+		}
+		frame, ok := spectrum.Add(sample)
+		if !ok {
+			continue
+		}
+		if req.Product == SpectrumFFT {
+			for _, bin := range spectrum.Ordered(frame) {
+				values = append(values, real(bin), imag(bin))
+			}
+			break
+		}
+		spectrum.AddPower(psd, frame)
+		n++
+		if req.Product == SpectrumSpectrogram && n == averaged {
+			values = appendDecibels(values, psd, n)
+			rows++
+			n = 0
+		}
+	}
+	if n > 0 {
+		values = appendDecibels(values, psd, n)
+		rows++
+	}
+
+	data := bluefile.EncodeFloat32(values, binary.LittleEndian)
+	keywords := []bluefile.Keyword{
+		{Name: "PRODUCT", Type: "A", Value: req.Product},
+		{Name: "NFFT", Type: "A", Value: strconv.Itoa(req.Size)},
+		{Name: "WINDOW", Type: "A", Value: req.Window},
+	}
+	var out *bluefile.Header
+	switch req.Product {
+	case SpectrumFFT:
+		out = bluefile.NewHeader(1000, "CF", int64(len(data)), keywords)
+	case SpectrumPSD:
+		keywords = append(keywords, bluefile.Keyword{Name: "AVERAGES", Type: "A", Value: strconv.FormatInt(frames, 10)})
+		out = bluefile.NewHeader(1000, "SF", int64(len(data)), keywords)
+	case SpectrumSpectrogram:
+		keywords = append(keywords, bluefile.Keyword{Name: "AVERAGES", Type: "A", Value: strconv.FormatInt(averaged, 10)})
+		out = bluefile.NewHeader(2000, "SF", int64(len(data)), keywords)
+		out.Subsize = spectrum.Bins()
+		out.YStart = rec.XStart()
+		out.YDelta = header.XDelta * float64(int64(spectrum.Step())*averaged)
+		out.YUnits = header.XUnits
+	}
+	out.XStart = spectrum.FirstBin() * sampleRate
+	out.XDelta = sampleRate / float64(req.Size)
+	if header.XUnits == 1 {
+		out.XUnits = xunitsHertz
+	}
+	out.TimeCode = rec.timeCode(rec.XStart())
+
+	response := c.Response().Header()
+	response.Set("X-Product", req.Product)
+	if req.Product == SpectrumSpectrogram {
+		response.Set("X-Frames", strconv.Itoa(rows))
+	}
+	return sendSignal(c, req.Output, out, data)
+}
+
+// appendDecibels appends the average of n summed power spectral
+// densities, in dB, to values and clears psd for the next sum.
+func appendDecibels(values []float64, psd []float64, n int64) []float64 {
+	for i, power := range psd {
+		values = append(values, dsp.Decibels(power/float64(n)))
+		psd[i] = 0
+	}
+	return values
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mrecachinas/dcserver/internal/bluefile"
+)
+
+func TestSpectrogramBudget(t *testing.T) {
+	a, e := newArtifactApi(t, 0)
+	e.GET("/api/tasks/:id/artifacts/:name/spectrum", a.GetArtifactSpectrum)
+	id := createTestTask(t, a.DB, Task{Type: "collect"})
+
+	// A complex recording with room for 84 frames of 65536 bins at 99%
+	// overlap, over 5 million values all told
+	const samples = 120000
+	values := make([]float64, 2*samples)
+	for i := 0; i < samples; i++ {
+		values[2*i] = math.Cos(0.1 * float64(i))
+		values[2*i+1] = math.Sin(0.1 * float64(i))
+	}
+	data := bluefile.EncodeFloat32(values, binary.LittleEndian)
+	header := bluefile.NewHeader(1000, "CF", int64(len(data)), nil)
+	header.XDelta = 1e-6
+	hcb, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := putArtifact(e, id, "rec.tmp", bytes.NewReader(append(hcb, data...))); rec.Code != http.StatusCreated {
+		t.Fatalf("upload answered %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		frames int
+		status int
+		rows   int
+	}{
+		{maxSpectrumFrames, http.StatusBadRequest, 0},
+		{84, http.StatusBadRequest, 0},
+		// Averaged 2 and 3 to a row
+		{42, http.StatusOK, 42},
+		{32, http.StatusOK, 28},
+	}
+	for _, test := range tests {
+		target := "/api/tasks/" + id + "/artifacts/rec.tmp/spectrum?product=spectrogram&nfft=65536&overlap=0.99&output=raw&frames=" + strconv.Itoa(test.frames)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != test.status {
+			t.Errorf("%d frames answered %d, want %d", test.frames, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if rows := rec.Header().Get("X-Frames"); rows != strconv.Itoa(test.rows) {
+			t.Errorf("%d frames made %s rows, want %d", test.frames, rows, test.rows)
+		}
+		if want := 4 * test.rows * 65536; rec.Body.Len() != want {
+			t.Errorf("%d frames made %d bytes, want %d", test.frames, rec.Body.Len(), want)
+		}
+	}
+}
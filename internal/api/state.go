@@ -0,0 +1,83 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// State is where a task is in its lifecycle.
+type State string
+
+const (
+	// StatePending tasks have been requested but no worker has picked them up
+	StatePending State = "pending"
+	// StateRunning tasks have been picked up by a worker
+	StateRunning State = "running"
+	// StateStopping tasks have been asked to stop but haven't yet
+	StateStopping State = "stopping"
+	// StateStopped tasks finished normally (whether or not they were asked to)
+	StateStopped State = "stopped"
+	// StateFailed tasks finished with an error
+	StateFailed State = "failed"
+	// StateLost tasks stopped reporting in and their outcome is unknown
+	StateLost State = "lost"
+)
+
+// transitions lists the states each state is allowed to move to.
+// States without an entry (stopped, failed) are terminal.
+var transitions = map[State][]State{
+	StatePending:  {StateRunning, StateStopping, StateStopped, StateFailed, StateLost},
+	StateRunning:  {StateStopping, StateStopped, StateFailed, StateLost},
+	StateStopping: {StateStopped, StateFailed, StateLost},
+	StateLost:     {StatePending, StateRunning, StateStopped, StateFailed},
+}
+
+// CanTransitionTo reports whether a task in state s may move to state to.
+func (s State) CanTransitionTo(to State) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether a task in state s is finished for good.
+func (s State) IsTerminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// List is the status list tasks in state s are shown in.
+func (s State) List() string {
+	if s.IsTerminal() {
+		return StatusListHistorical
+	}
+	return StatusListActive
+}
+
+// HistoryEntry records a single state transition. A task's history
+// is append-only.
+type HistoryEntry struct {
+	From   State              `json:"from,omitempty" bson:"from,omitempty"`
+	To     State              `json:"to" bson:"to"`
+	Time   primitive.DateTime `json:"time" bson:"time"`
+	Actor  string             `json:"actor" bson:"actor"`
+	Reason string             `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// ErrTaskNotFound is returned when a task id doesn't match any task.
+var ErrTaskNotFound = errors.New("task not found")
+
+// TransitionError is returned when a task is asked to make a
+// transition its current state doesn't allow.
+type TransitionError struct {
+	Id   string
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("task %s can't go from %s to %s", e.Id, e.From, e.To)
+}
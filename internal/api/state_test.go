@@ -0,0 +1,63 @@
+package api
+
+import "testing"
+
+func TestStateTransitions(t *testing.T) {
+	states := []State{StatePending, StateRunning, StateStopping, StateStopped, StateFailed, StateLost}
+	// The lifecycle spelled out, rather than read back from transitions
+	allowed := map[State]map[State]bool{
+		StatePending: {
+			StateRunning:  true,
+			StateStopping: true,
+			StateStopped:  true,
+			StateFailed:   true,
+			StateLost:     true,
+		},
+		StateRunning: {
+			StateStopping: true,
+			StateStopped:  true,
+			StateFailed:   true,
+			StateLost:     true,
+		},
+		StateStopping: {
+			StateStopped: true,
+			StateFailed:  true,
+			StateLost:    true,
+		},
+		// A lost task is re-dispatched, turns up again or is given up on
+		StateLost: {
+			StatePending: true,
+			StateRunning: true,
+			StateStopped: true,
+			StateFailed:  true,
+		},
+		StateStopped: {},
+		StateFailed:  {},
+	}
+	for _, from := range states {
+		for _, to := range states {
+			if got, want := from.CanTransitionTo(to), allowed[from][to]; got != want {
+				t.Errorf("%s -> %s allowed = %v, want %v", from, to, got, want)
+			}
+		}
+		if from.CanTransitionTo("unknown") || State("unknown").CanTransitionTo(from) {
+			t.Errorf("%s: transition to or from an unknown state allowed", from)
+		}
+	}
+}
+
+func TestStateTerminal(t *testing.T) {
+	terminal := map[State]bool{
+		StatePending:  false,
+		StateRunning:  false,
+		StateStopping: false,
+		StateLost:     false,
+		StateStopped:  true,
+		StateFailed:   true,
+	}
+	for state, want := range terminal {
+		if state.IsTerminal() != want {
+			t.Errorf("%s: terminal = %v, want %v", state, state.IsTerminal(), want)
+		}
+	}
+}
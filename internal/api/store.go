@@ -0,0 +1,951 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"github.com/mrecachinas/dcserver/internal/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store is the storage backend behind the API. MongoStore is the
+// original (and default) backend; the embedded bolt backend and the
+// in-memory backend let dc run without a MongoDB server.
+type Store interface {
+	GetSingleStatus(id string) (*Status, error)
+	GetAllStatus() (*[]Status, error)
+	QueryStatus(q *StatusQuery) (*StatusPage, error)
+	CreateTask(task Task, actor string) (*primitive.ObjectID, error)
+	StopTask(id string, deadline time.Time, actor string) error
+	KillTask(id string, actor string, reason string) error
+	AddHistory(id string, actor string, reason string) error
+	RequestReconfigure(id string, changes map[string]interface{}, actor string) (int, error)
+	AckReconfigure(id string, revision int, rejection string, actor string) error
+	AddArtifact(id string, artifact Artifact, actor string) error
+	GetOverdueStops(now time.Time) (*[]Status, error)
+	GetDueStops(now time.Time) (*[]Status, error)
+	StartTask(id string, workerId string, actor string) error
+	TransitionTask(id string, to State, actor string, reason string) error
+	// FinishTask, UpdateProgress and RecordHeartbeat return
+	// ErrTaskNotFound unless workerId is running the task
+	FinishTask(id string, workerId string, to State, actor string, reason string) error
+	UpdateProgress(id string, workerId string, progress float64, message string) error
+	RecordHeartbeat(id string, workerId string) error
+	GetStaleTasks(cutoff time.Time) (*[]Status, error)
+	MarkTaskLost(id string, cutoff time.Time, actor string, reason string) error
+	ResumeTask(id string, workerId string, actor string) error
+	RedispatchTask(id string, attempt int, actor string, reason string) error
+	GetDueDispatches(now time.Time, limit int) (*[]OutboxEntry, error)
+	GetUndeliveredDispatches() (*[]OutboxEntry, error)
+	MarkDispatchDelivered(id string) error
+	RetryDispatch(id string, lastError string, nextAttempt time.Time) error
+	FailDispatch(id string, lastError string) error
+	GetLatestCatalog() (*CatalogVersion, error)
+	GetCatalogVersions(since int) (*[]CatalogVersion, error)
+	SaveCatalog(version CatalogVersion) error
+	CreateSchedule(schedule Schedule) error
+	GetSchedule(id string) (*Schedule, error)
+	GetAllSchedules() (*[]Schedule, error)
+	UpdateSchedule(schedule Schedule) error
+	DeleteSchedule(id string) error
+	CreateAPIToken(token auth.APIToken) error
+	GetAPIToken(hash string) (*auth.APIToken, error)
+	GetAllAPITokens() (*[]auth.APIToken, error)
+	DeleteAPIToken(id string) error
+	// AppendAuditEntry stores an audit entry, returning
+	// ErrAuditConflict if its Seq is taken. Entries are never changed
+	// or deleted once stored
+	AppendAuditEntry(entry AuditEntry) error
+	// LastAuditEntry returns the newest audit entry, or nil if there
+	// are none yet
+	LastAuditEntry() (*AuditEntry, error)
+	QueryAudit(q *AuditQuery) (*[]AuditEntry, error)
+	Close(ctx context.Context) error
+}
+
+// Names of the supported store backends (`--store`)
+const (
+	StoreMongo  = "mongo"
+	StoreBolt   = "bolt"
+	StoreMemory = "memory"
+)
+
+// SetupStore opens the store backend named in the config.
+func SetupStore(cfg *config.Config) (Store, error) {
+	switch cfg.Store {
+	case StoreMongo, "":
+		client, err := SetupMongoConnection(cfg.MongoHost, cfg.MongoPort)
+		if err != nil {
+			return nil, err
+		}
+		store := &MongoStore{client.Database(cfg.MongoDatabaseName)}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := store.EnsureIndexes(ctx); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreBolt:
+		return OpenBoltStore(cfg.BoltPath)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// newTaskRecord builds the record stored for a newly created task.
+// Every task starts out pending, with its start message in the outbox.
+func newTaskRecord(task Task, actor string) Status {
+	return Status{
+		Task:     task,
+		State:    StatePending,
+		Dispatch: DispatchPending,
+		Attempt:  1,
+		History: []HistoryEntry{{
+			To:     StatePending,
+			Time:   primitive.NewDateTimeFromTime(time.Now()),
+			Actor:  actor,
+			Reason: "task created",
+		}},
+	}
+}
+
+// Bucket names used by key/value backends
+const (
+	tasksBucket     = "tasks"
+	outboxBucket    = "outbox"
+	catalogBucket   = "catalog"
+	schedulesBucket = "schedules"
+	tokensBucket    = "tokens"
+	auditBucket     = "audit"
+)
+
+// errKeyNotFound is returned by kvTx.Get for missing keys.
+var errKeyNotFound = errors.New("key not found")
+
+// kvBackend is the little a key/value database has to provide for
+// kvStore to implement Store on top of it. Values are BSON-encoded,
+// so records look the same as they do in MongoDB.
+type kvBackend interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx kvTx) error) error
+	// Update runs fn in a read-write transaction, which is
+	// committed only if fn returns nil
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+// kvTx is a single transaction on a kvBackend.
+type kvTx interface {
+	Get(bucket string, key string, v interface{}) error
+	Put(bucket string, key string, v interface{}) error
+	Delete(bucket string, key string) error
+	// ForEach calls fn with every raw value in bucket, in key order
+	ForEach(bucket string, fn func(key string, raw []byte) error) error
+}
+
+// kvStore implements Store on top of any kvBackend. Every operation
+// runs in a single transaction, which is what makes the state machine's
+// conditional transitions safe.
+type kvStore struct {
+	kv kvBackend
+}
+
+// GetSingleStatus looks up a task's record by its hex id.
+func (s *kvStore) GetSingleStatus(id string) (*Status, error) {
+	key, err := taskKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var status Status
+	err = s.kv.View(func(tx kvTx) error {
+		return getTask(tx, key, &status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// GetAllStatus returns every task's record.
+func (s *kvStore) GetAllStatus() (*[]Status, error) {
+	return s.findTasks(func(*Status) bool { return true })
+}
+
+// QueryStatus returns a page of the tasks matching q.
+func (s *kvStore) QueryStatus(q *StatusQuery) (*StatusPage, error) {
+	statusList, err := s.findTasks(q.Matches)
+	if err != nil {
+		return nil, err
+	}
+	return pageStatus(*statusList, q)
+}
+
+// CreateTask stores a new pending task under a fresh ObjectId,
+// along with its outbox entry.
+func (s *kvStore) CreateTask(task Task, actor string) (*primitive.ObjectID, error) {
+	task.Id = primitive.NewObjectID()
+	record := newTaskRecord(task, actor)
+	entry := newOutboxEntry(task)
+	err := s.kv.Update(func(tx kvTx) error {
+		if err := tx.Put(tasksBucket, task.Id.Hex(), &record); err != nil {
+			return err
+		}
+		return tx.Put(outboxBucket, entry.Id.Hex(), &entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &task.Id, nil
+}
+
+// StopTask moves the task to stopping and sets its stop flag and,
+// if deadline is set, the time by which it's killed.
+func (s *kvStore) StopTask(id string, deadline time.Time, actor string) error {
+	return s.transitionTask(id, StateStopping, actor, "stop requested", nil, func(tx kvTx, status *Status) error {
+		status.StopFlag = true
+		if !deadline.IsZero() {
+			status.StopDeadline = primitive.NewDateTimeFromTime(deadline)
+		}
+		return nil
+	})
+}
+
+// KillTask moves the task to stopping with a kill requested or, if it's
+// already stopping, escalates the stop to a kill.
+func (s *kvStore) KillTask(id string, actor string, reason string) error {
+	notStopping := func(status *Status) bool { return status.State != StateStopping }
+	err := s.transitionTask(id, StateStopping, actor, reason, notStopping, func(tx kvTx, status *Status) error {
+		status.StopFlag = true
+		status.KillRequested = true
+		return nil
+	})
+	if err != ErrTaskNotFound {
+		return err
+	}
+
+	stopping := func(status *Status) bool { return status.State == StateStopping }
+	return s.recordEvent(id, actor, reason, stopping, func(status *Status) {
+		status.KillRequested = true
+	})
+}
+
+// AddHistory records something that happened to a task without
+// changing its state.
+func (s *kvStore) AddHistory(id string, actor string, reason string) error {
+	return s.recordEvent(id, actor, reason, nil, nil)
+}
+
+// RequestReconfigure records a parameters update for a running task,
+// returning its revision.
+func (s *kvStore) RequestReconfigure(id string, changes map[string]interface{}, actor string) (int, error) {
+	key, err := taskKey(id)
+	if err != nil {
+		return 0, err
+	}
+
+	var revision int
+	err = s.kv.Update(func(tx kvTx) error {
+		var status Status
+		if err := getTask(tx, key, &status); err != nil {
+			return err
+		}
+		if status.State != StateRunning {
+			return ErrTaskNotRunning
+		}
+
+		now := primitive.NewDateTimeFromTime(time.Now())
+		revision = status.ConfigRevision + 1
+		status.ConfigRevision = revision
+		status.Reconfiguration = &Reconfiguration{
+			Revision:    revision,
+			Parameters:  changes,
+			RequestedAt: now,
+			Actor:       actor,
+		}
+		status.History = append(status.History, HistoryEntry{
+			From:   status.State,
+			To:     status.State,
+			Time:   now,
+			Actor:  actor,
+			Reason: fmt.Sprintf("parameters update %d requested: %s", revision, describeChanges(changes)),
+		})
+		return tx.Put(tasksBucket, key, &status)
+	})
+	return revision, err
+}
+
+// AckReconfigure records the worker's answer to a parameters update,
+// merging the update into the task's parameters if it was applied. An
+// answer to an update that's been superseded only goes in the history.
+func (s *kvStore) AckReconfigure(id string, revision int, rejection string, actor string) error {
+	reason := ackReason(revision, rejection)
+	awaited := func(status *Status) bool {
+		r := status.Reconfiguration
+		return r != nil && r.Revision == revision && r.AckedAt == 0
+	}
+	err := s.recordEvent(id, actor, reason, awaited, func(status *Status) {
+		r := status.Reconfiguration
+		r.AckedAt = primitive.NewDateTimeFromTime(time.Now())
+		r.Applied = rejection == ""
+		r.Error = rejection
+		if !r.Applied {
+			return
+		}
+		if status.Parameters == nil {
+			status.Parameters = make(map[string]interface{}, len(r.Parameters))
+		}
+		for name, value := range r.Parameters {
+			status.Parameters[name] = value
+		}
+	})
+	if err != ErrTaskNotFound {
+		return err
+	}
+	return s.AddHistory(id, actor, reason)
+}
+
+// AddArtifact registers an artifact with a task, replacing any it had
+// with the same name.
+func (s *kvStore) AddArtifact(id string, artifact Artifact, actor string) error {
+	reason := fmt.Sprintf("artifact %s registered (%d bytes)", artifact.Name, artifact.Size)
+	return s.recordEvent(id, actor, reason, nil, func(status *Status) {
+		if existing, ok := findArtifact(status, artifact.Name); ok {
+			*existing = artifact
+			return
+		}
+		status.Artifacts = append(status.Artifacts, artifact)
+	})
+}
+
+// GetOverdueStops finds stopping tasks whose stop deadline has passed
+// without a kill being requested yet.
+func (s *kvStore) GetOverdueStops(now time.Time) (*[]Status, error) {
+	return s.findTasks(isOverdue(now))
+}
+
+// GetDueStops finds pending and running tasks whose stop time has passed.
+func (s *kvStore) GetDueStops(now time.Time) (*[]Status, error) {
+	return s.findTasks(isDueToStop(now))
+}
+
+// StartTask moves a task to running once a worker has picked it up.
+func (s *kvStore) StartTask(id string, workerId string, actor string) error {
+	return s.transitionTask(id, StateRunning, actor, "picked up by worker", nil, func(tx kvTx, status *Status) error {
+		status.WorkerId = workerId
+		status.LastHeartbeat = primitive.NewDateTimeFromTime(time.Now())
+		return nil
+	})
+}
+
+// TransitionTask moves a task to state `to`.
+func (s *kvStore) TransitionTask(id string, to State, actor string, reason string) error {
+	return s.transitionTask(id, to, actor, reason, nil, nil)
+}
+
+// FinishTask moves a task to state `to` at the report of workerId,
+// provided it's the task's worker.
+func (s *kvStore) FinishTask(id string, workerId string, to State, actor string, reason string) error {
+	return s.transitionTask(id, to, actor, reason, isRunBy(workerId), nil)
+}
+
+// UpdateProgress records how far along a task's worker says it is.
+func (s *kvStore) UpdateProgress(id string, workerId string, progress float64, message string) error {
+	return s.updateTask(id, isRunBy(workerId), func(status *Status) {
+		status.Progress = progress
+		status.ProgressMessage = message
+		status.LastHeartbeat = primitive.NewDateTimeFromTime(time.Now())
+	})
+}
+
+// RecordHeartbeat notes that a task's worker is still alive.
+func (s *kvStore) RecordHeartbeat(id string, workerId string) error {
+	return s.updateTask(id, isRunBy(workerId), func(status *Status) {
+		status.LastHeartbeat = primitive.NewDateTimeFromTime(time.Now())
+	})
+}
+
+// GetStaleTasks finds running and stopping tasks whose last
+// heartbeat is older than cutoff.
+func (s *kvStore) GetStaleTasks(cutoff time.Time) (*[]Status, error) {
+	return s.findTasks(isStale(cutoff))
+}
+
+// MarkTaskLost moves a task to lost, provided it is still stale.
+func (s *kvStore) MarkTaskLost(id string, cutoff time.Time, actor string, reason string) error {
+	return s.transitionTask(id, StateLost, actor, reason, isStale(cutoff), nil)
+}
+
+// ResumeTask moves a lost task back to running if workerId was running it.
+func (s *kvStore) ResumeTask(id string, workerId string, actor string) error {
+	cond := func(status *Status) bool {
+		return status.State == StateLost && isRunBy(workerId)(status)
+	}
+	return s.transitionTask(id, StateRunning, actor, "heartbeats resumed", cond, nil)
+}
+
+// RedispatchTask moves a lost task back to pending as its next attempt
+// and queues a new start message for it.
+func (s *kvStore) RedispatchTask(id string, attempt int, actor string, reason string) error {
+	return s.transitionTask(id, StatePending, actor, reason, nil, func(tx kvTx, status *Status) error {
+		status.Attempt = attempt
+		status.WorkerId = ""
+		status.StopFlag = false
+		status.Dispatch = DispatchPending
+
+		entry := newOutboxEntry(status.Task)
+		return tx.Put(outboxBucket, entry.Id.Hex(), &entry)
+	})
+}
+
+// GetDueDispatches returns up to limit pending outbox entries whose
+// next attempt is due by now.
+func (s *kvStore) GetDueDispatches(now time.Time, limit int) (*[]OutboxEntry, error) {
+	dueBy := primitive.NewDateTimeFromTime(now)
+	return s.findDispatches(limit, func(entry *OutboxEntry) bool {
+		return entry.State == DispatchPending && entry.NextAttempt <= dueBy
+	})
+}
+
+// GetUndeliveredDispatches returns every outbox entry that hasn't
+// been confirmed, whether still pending or given up on.
+func (s *kvStore) GetUndeliveredDispatches() (*[]OutboxEntry, error) {
+	return s.findDispatches(0, func(entry *OutboxEntry) bool {
+		return entry.State != DispatchDelivered
+	})
+}
+
+// MarkDispatchDelivered records that the bus confirmed an entry.
+func (s *kvStore) MarkDispatchDelivered(id string) error {
+	return s.updateDispatch(id, func(entry *OutboxEntry) {
+		entry.State = DispatchDelivered
+		entry.Attempts++
+		entry.LastError = ""
+		entry.DeliveredAt = primitive.NewDateTimeFromTime(time.Now())
+	})
+}
+
+// RetryDispatch records a failed attempt and when to try again.
+func (s *kvStore) RetryDispatch(id string, lastError string, nextAttempt time.Time) error {
+	return s.updateDispatch(id, func(entry *OutboxEntry) {
+		entry.Attempts++
+		entry.LastError = lastError
+		entry.NextAttempt = primitive.NewDateTimeFromTime(nextAttempt)
+	})
+}
+
+// FailDispatch records a failed attempt and gives up on the entry.
+func (s *kvStore) FailDispatch(id string, lastError string) error {
+	return s.updateDispatch(id, func(entry *OutboxEntry) {
+		entry.State = DispatchFailed
+		entry.Attempts++
+		entry.LastError = lastError
+	})
+}
+
+// GetLatestCatalog returns the newest catalog version.
+func (s *kvStore) GetLatestCatalog() (*CatalogVersion, error) {
+	versions, err := s.GetCatalogVersions(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(*versions) == 0 {
+		return nil, ErrCatalogNotFound
+	}
+	latest := (*versions)[len(*versions)-1]
+	return &latest, nil
+}
+
+// GetCatalogVersions returns every catalog version after since,
+// oldest first.
+func (s *kvStore) GetCatalogVersions(since int) (*[]CatalogVersion, error) {
+	versions := []CatalogVersion{}
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(catalogBucket, func(key string, raw []byte) error {
+			var version CatalogVersion
+			if err := bson.Unmarshal(raw, &version); err != nil {
+				return err
+			}
+			if version.Version > since {
+				versions = append(versions, version)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &versions, nil
+}
+
+// SaveCatalog stores a new catalog version.
+func (s *kvStore) SaveCatalog(version CatalogVersion) error {
+	return s.kv.Update(func(tx kvTx) error {
+		return tx.Put(catalogBucket, catalogKey(version.Version), &version)
+	})
+}
+
+// CreateSchedule stores a new schedule.
+func (s *kvStore) CreateSchedule(schedule Schedule) error {
+	return s.kv.Update(func(tx kvTx) error {
+		return tx.Put(schedulesBucket, schedule.Id.Hex(), &schedule)
+	})
+}
+
+// GetSchedule looks up a schedule by its hex id.
+func (s *kvStore) GetSchedule(id string) (*Schedule, error) {
+	key, err := taskKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule Schedule
+	err = s.kv.View(func(tx kvTx) error {
+		return getSchedule(tx, key, &schedule)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// GetAllSchedules returns every schedule.
+func (s *kvStore) GetAllSchedules() (*[]Schedule, error) {
+	schedules := []Schedule{}
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(schedulesBucket, func(key string, raw []byte) error {
+			var schedule Schedule
+			if err := bson.Unmarshal(raw, &schedule); err != nil {
+				return err
+			}
+			schedules = append(schedules, schedule)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &schedules, nil
+}
+
+// UpdateSchedule saves a schedule, as long as it's still at the
+// revision it was read at, and bumps its revision.
+func (s *kvStore) UpdateSchedule(schedule Schedule) error {
+	key := schedule.Id.Hex()
+	return s.kv.Update(func(tx kvTx) error {
+		var current Schedule
+		if err := getSchedule(tx, key, &current); err != nil {
+			return err
+		}
+		if current.Revision != schedule.Revision {
+			return ErrScheduleConflict
+		}
+		schedule.Revision++
+		return tx.Put(schedulesBucket, key, &schedule)
+	})
+}
+
+// DeleteSchedule deletes a schedule.
+func (s *kvStore) DeleteSchedule(id string) error {
+	key, err := taskKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		var schedule Schedule
+		if err := getSchedule(tx, key, &schedule); err != nil {
+			return err
+		}
+		return tx.Delete(schedulesBucket, key)
+	})
+}
+
+// CreateAPIToken stores a new API token, keyed by its hash.
+func (s *kvStore) CreateAPIToken(token auth.APIToken) error {
+	return s.kv.Update(func(tx kvTx) error {
+		return tx.Put(tokensBucket, token.Hash, &token)
+	})
+}
+
+// GetAPIToken looks up an API token by its hash.
+func (s *kvStore) GetAPIToken(hash string) (*auth.APIToken, error) {
+	var token auth.APIToken
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.Get(tokensBucket, hash, &token)
+	})
+	if err == errKeyNotFound {
+		return nil, auth.ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetAllAPITokens returns every API token.
+func (s *kvStore) GetAllAPITokens() (*[]auth.APIToken, error) {
+	tokens := []auth.APIToken{}
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(tokensBucket, func(key string, raw []byte) error {
+			var token auth.APIToken
+			if err := bson.Unmarshal(raw, &token); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// DeleteAPIToken revokes an API token by its hex id.
+func (s *kvStore) DeleteAPIToken(id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		hash := ""
+		err := tx.ForEach(tokensBucket, func(key string, raw []byte) error {
+			var token auth.APIToken
+			if err := bson.Unmarshal(raw, &token); err != nil {
+				return err
+			}
+			if token.Id == oid {
+				hash = key
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if hash == "" {
+			return auth.ErrAPITokenNotFound
+		}
+		return tx.Delete(tokensBucket, hash)
+	})
+}
+
+// AppendAuditEntry stores an audit entry, keyed by its Seq.
+func (s *kvStore) AppendAuditEntry(entry AuditEntry) error {
+	return s.kv.Update(func(tx kvTx) error {
+		key := auditKey(entry.Seq)
+		var existing AuditEntry
+		err := tx.Get(auditBucket, key, &existing)
+		if err == nil {
+			return ErrAuditConflict
+		}
+		if err != errKeyNotFound {
+			return err
+		}
+		return tx.Put(auditBucket, key, &entry)
+	})
+}
+
+// LastAuditEntry returns the newest audit entry, or nil if there are
+// none.
+func (s *kvStore) LastAuditEntry() (*AuditEntry, error) {
+	var last *AuditEntry
+	err := s.kv.View(func(tx kvTx) error {
+		var raw []byte
+		err := tx.ForEach(auditBucket, func(key string, value []byte) error {
+			raw = value
+			return nil
+		})
+		if err != nil || raw == nil {
+			return err
+		}
+		last = &AuditEntry{}
+		return bson.Unmarshal(raw, last)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// QueryAudit returns the audit entries matching q, oldest first.
+func (s *kvStore) QueryAudit(q *AuditQuery) (*[]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(auditBucket, func(key string, raw []byte) error {
+			if len(entries) >= q.Limit {
+				return nil
+			}
+			var entry AuditEntry
+			if err := bson.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if q.Matches(&entry) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// Close closes the underlying backend.
+func (s *kvStore) Close(ctx context.Context) error {
+	return s.kv.Close()
+}
+
+// findTasks returns every task for which match returns true.
+func (s *kvStore) findTasks(match func(*Status) bool) (*[]Status, error) {
+	statusList := []Status{}
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(tasksBucket, func(key string, raw []byte) error {
+			var status Status
+			if err := bson.Unmarshal(raw, &status); err != nil {
+				return err
+			}
+			if match(&status) {
+				statusList = append(statusList, status)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &statusList, nil
+}
+
+// findDispatches returns up to limit (or all, if limit is 0) outbox
+// entries for which match returns true.
+func (s *kvStore) findDispatches(limit int, match func(*OutboxEntry) bool) (*[]OutboxEntry, error) {
+	entries := []OutboxEntry{}
+	errLimitReached := errors.New("limit reached")
+	err := s.kv.View(func(tx kvTx) error {
+		return tx.ForEach(outboxBucket, func(key string, raw []byte) error {
+			var entry OutboxEntry
+			if err := bson.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if match(&entry) {
+				entries = append(entries, entry)
+			}
+			if limit > 0 && len(entries) == limit {
+				return errLimitReached
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errLimitReached {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// updateDispatch applies update to an outbox entry and mirrors its
+// state onto the entry's task.
+func (s *kvStore) updateDispatch(id string, update func(*OutboxEntry)) error {
+	key, err := taskKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		var entry OutboxEntry
+		err := tx.Get(outboxBucket, key, &entry)
+		if err == errKeyNotFound {
+			return ErrTaskNotFound
+		}
+		if err != nil {
+			return err
+		}
+		update(&entry)
+		if err := tx.Put(outboxBucket, key, &entry); err != nil {
+			return err
+		}
+
+		var status Status
+		err = getTask(tx, entry.TaskId.Hex(), &status)
+		if err == ErrTaskNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		status.Dispatch = entry.State
+		return tx.Put(tasksBucket, entry.TaskId.Hex(), &status)
+	})
+}
+
+// updateTask applies update to a task's record. If cond is given, the
+// task must satisfy it or ErrTaskNotFound is returned.
+func (s *kvStore) updateTask(id string, cond func(*Status) bool, update func(*Status)) error {
+	key, err := taskKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		var status Status
+		if err := getTask(tx, key, &status); err != nil {
+			return err
+		}
+		if cond != nil && !cond(&status) {
+			return ErrTaskNotFound
+		}
+		update(&status)
+		return tx.Put(tasksBucket, key, &status)
+	})
+}
+
+// recordEvent is kvStore's counterpart to MongoStore.recordEvent.
+func (s *kvStore) recordEvent(id string, actor string, reason string, cond func(*Status) bool, update func(*Status)) error {
+	key, err := taskKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		var status Status
+		if err := getTask(tx, key, &status); err != nil {
+			return err
+		}
+		if cond != nil && !cond(&status) {
+			return ErrTaskNotFound
+		}
+
+		status.History = append(status.History, HistoryEntry{
+			From:   status.State,
+			To:     status.State,
+			Time:   primitive.NewDateTimeFromTime(time.Now()),
+			Actor:  actor,
+			Reason: reason,
+		})
+		if update != nil {
+			update(&status)
+		}
+		return tx.Put(tasksBucket, key, &status)
+	})
+}
+
+// transitionTask is kvStore's counterpart to MongoStore.transitionTask.
+// If cond is given, the task must satisfy it or ErrTaskNotFound is
+// returned. set, if given, updates other fields alongside the state
+// (and may write other records in the same transaction).
+func (s *kvStore) transitionTask(id string, to State, actor string, reason string, cond func(*Status) bool, set func(kvTx, *Status) error) error {
+	key, err := taskKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Update(func(tx kvTx) error {
+		var status Status
+		if err := getTask(tx, key, &status); err != nil {
+			return err
+		}
+		if cond != nil && !cond(&status) {
+			return ErrTaskNotFound
+		}
+		if !status.State.CanTransitionTo(to) {
+			return &TransitionError{Id: id, From: status.State, To: to}
+		}
+
+		status.History = append(status.History, HistoryEntry{
+			From:   status.State,
+			To:     to,
+			Time:   primitive.NewDateTimeFromTime(time.Now()),
+			Actor:  actor,
+			Reason: reason,
+		})
+		status.State = to
+		if set != nil {
+			if err := set(tx, &status); err != nil {
+				return err
+			}
+		}
+		return tx.Put(tasksBucket, key, &status)
+	})
+}
+
+// taskKey normalizes a hex ObjectId into the key its task is stored under.
+func taskKey(id string) (string, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", err
+	}
+	return oid.Hex(), nil
+}
+
+// auditKey is the key an audit entry is stored under, padded so
+// entries iterate in order.
+func auditKey(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// catalogKey is the key a catalog version is stored under, padded
+// so versions iterate in order.
+func catalogKey(version int) string {
+	return fmt.Sprintf("%010d", version)
+}
+
+// getTask reads a task, translating a missing key into ErrTaskNotFound.
+func getTask(tx kvTx, key string, status *Status) error {
+	err := tx.Get(tasksBucket, key, status)
+	if err == errKeyNotFound {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// getSchedule reads a schedule, translating a missing key into
+// ErrScheduleNotFound.
+func getSchedule(tx kvTx, key string, schedule *Schedule) error {
+	err := tx.Get(schedulesBucket, key, schedule)
+	if err == errKeyNotFound {
+		return ErrScheduleNotFound
+	}
+	return err
+}
+
+// isOverdue is the kvStore equivalent of overdueFilter.
+func isOverdue(now time.Time) func(*Status) bool {
+	deadline := primitive.NewDateTimeFromTime(now)
+	return func(status *Status) bool {
+		return status.State == StateStopping && !status.KillRequested &&
+			status.StopDeadline != 0 && status.StopDeadline <= deadline
+	}
+}
+
+// isDueToStop is the kvStore equivalent of dueStopFilter.
+func isDueToStop(now time.Time) func(*Status) bool {
+	stopBy := primitive.NewDateTimeFromTime(now)
+	return func(status *Status) bool {
+		return (status.State == StatePending || status.State == StateRunning) &&
+			status.StopTime != 0 && status.StopTime <= stopBy
+	}
+}
+
+// isRunBy is the kvStore equivalent of workerFilter.
+func isRunBy(workerId string) func(*Status) bool {
+	return func(status *Status) bool {
+		return status.WorkerId == workerId
+	}
+}
+
+// isStale is the kvStore equivalent of staleFilter.
+func isStale(cutoff time.Time) func(*Status) bool {
+	staleBefore := primitive.NewDateTimeFromTime(cutoff)
+	return func(status *Status) bool {
+		return (status.State == StateRunning || status.State == StateStopping) &&
+			status.LastHeartbeat != 0 && status.LastHeartbeat < staleBefore
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OpenBoltStore opens (creating if needed) an embedded bolt database
+// at path, for single-node deployments without MongoDB.
+func OpenBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{kv: &boltKV{db}}, nil
+}
+
+// boltKV is a kvBackend backed by bolt, with one bolt bucket per bucket.
+type boltKV struct {
+	db *bolt.DB
+}
+
+func (b *boltKV) View(fn func(tx kvTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) Update(fn func(tx kvTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (b boltTx) Get(bucket string, key string, v interface{}) error {
+	bkt := b.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return errKeyNotFound
+	}
+	raw := bkt.Get([]byte(key))
+	if raw == nil {
+		return errKeyNotFound
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+func (b boltTx) Put(bucket string, key string, v interface{}) error {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bkt, err := b.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(key), raw)
+}
+
+func (b boltTx) Delete(bucket string, key string) error {
+	bkt := b.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete([]byte(key))
+}
+
+func (b boltTx) ForEach(bucket string, fn func(key string, raw []byte) error) error {
+	bkt := b.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	return bkt.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
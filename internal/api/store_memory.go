@@ -0,0 +1,123 @@
+package api
+
+import (
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// NewMemoryStore creates a Store that keeps everything in memory.
+// Nothing survives a restart, so it's meant for tests and demos.
+func NewMemoryStore() Store {
+	return &kvStore{kv: &memoryKV{buckets: make(map[string]map[string][]byte)}}
+}
+
+// memoryKV is a kvBackend backed by maps. Transactions are serialized
+// by a single lock, and writes are staged until the transaction
+// commits so a failed Update leaves nothing behind.
+type memoryKV struct {
+	sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func (m *memoryKV) View(fn func(tx kvTx) error) error {
+	m.RLock()
+	defer m.RUnlock()
+	return fn(&memoryTx{kv: m})
+}
+
+func (m *memoryKV) Update(fn func(tx kvTx) error) error {
+	m.Lock()
+	defer m.Unlock()
+	tx := &memoryTx{kv: m, writes: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for bucket, writes := range tx.writes {
+		if m.buckets[bucket] == nil {
+			m.buckets[bucket] = make(map[string][]byte)
+		}
+		for key, raw := range writes {
+			if raw == nil {
+				delete(m.buckets[bucket], key)
+			} else {
+				m.buckets[bucket][key] = raw
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryKV) Close() error {
+	return nil
+}
+
+// memoryTx reads through its staged writes (a nil value being a
+// delete) to the committed buckets. View transactions have no writes.
+type memoryTx struct {
+	kv     *memoryKV
+	writes map[string]map[string][]byte
+}
+
+func (tx *memoryTx) lookup(bucket string, key string) []byte {
+	if raw, ok := tx.writes[bucket][key]; ok {
+		return raw
+	}
+	return tx.kv.buckets[bucket][key]
+}
+
+func (tx *memoryTx) Get(bucket string, key string, v interface{}) error {
+	raw := tx.lookup(bucket, key)
+	if raw == nil {
+		return errKeyNotFound
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+func (tx *memoryTx) Put(bucket string, key string, v interface{}) error {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tx.stage(bucket, key, raw)
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket string, key string) error {
+	tx.stage(bucket, key, nil)
+	return nil
+}
+
+func (tx *memoryTx) ForEach(bucket string, fn func(key string, raw []byte) error) error {
+	keys := make([]string, 0, len(tx.kv.buckets[bucket])+len(tx.writes[bucket]))
+	for key := range tx.kv.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	for key := range tx.writes[bucket] {
+		if _, ok := tx.kv.buckets[bucket][key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if raw := tx.lookup(bucket, key); raw != nil {
+			if err := fn(key, raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) stage(bucket string, key string, raw []byte) {
+	if tx.writes == nil {
+		panic("memoryTx: write in a read-only transaction")
+	}
+	if tx.writes[bucket] == nil {
+		tx.writes[bucket] = make(map[string][]byte)
+	}
+	tx.writes[bucket][key] = raw
+}
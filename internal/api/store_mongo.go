@@ -0,0 +1,1190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore is the MongoDB Store backend. Tasks live in the
+// `tasks` collection.
+type MongoStore struct {
+	*mongo.Database
+}
+
+// EnsureIndexes creates the indexes behind status queries and the
+// background jobs' lookups, if they don't exist yet.
+func (db *MongoStore) EnsureIndexes(ctx context.Context) error {
+	indexes := map[string][]mongo.IndexModel{
+		"tasks": {
+			// Status queries, by default newest first
+			{Keys: bson.D{{Key: "start_time", Value: -1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "start_time", Value: -1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "type", Value: 1}, {Key: "start_time", Value: -1}}},
+			{Keys: bson.D{{Key: "tags", Value: 1}}},
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "start_time", Value: -1}}},
+			// GetDueStops, GetStaleTasks and GetOverdueStops
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "stop_time", Value: 1}}},
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "last_heartbeat", Value: 1}}},
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "stop_deadline", Value: 1}}},
+		},
+		"outbox": {
+			{Keys: bson.D{{Key: "state", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		},
+		"tokens": {
+			// GetAPIToken, on every request authenticated with one
+			{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"audit": {
+			// Audit queries, which come in sequence order
+			{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "target", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "time", Value: 1}}},
+		},
+	}
+	for collection, models := range indexes {
+		if _, err := db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("creating indexes on %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// GetSingleStatus performs a findOne query provided a task's ObjectId
+// represented as a hex string
+func (db *MongoStore) GetSingleStatus(id string) (*Status, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := db.Collection("tasks")
+	var status Status
+	err = collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&status)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// GetAllStatus performs the find all query equivalent to `list(db.tasks.find())`
+// in Python/PyMongo
+func (db *MongoStore) GetAllStatus() (*[]Status, error) {
+	collection := db.Collection("tasks")
+	var statusList []Status
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &statusList); err != nil {
+		return nil, err
+	}
+
+	return &statusList, nil
+}
+
+// QueryStatus returns a page of the tasks matching q, along with how
+// many match in total and in each state.
+func (db *MongoStore) QueryStatus(q *StatusQuery) (*StatusPage, error) {
+	collection := db.Collection("tasks")
+	filter := statusFilter(&q.StatusFilter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	page := &StatusPage{Status: []Status{}, Counts: make(map[State]int64)}
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": "$state", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		State State `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err = cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		page.Counts[count.State] = count.Count
+		page.Total += count.Count
+	}
+
+	field, descending := q.sortField()
+	direction := 1
+	if descending {
+		direction = -1
+	}
+	if q.Cursor != "" {
+		after, err := q.decodeCursor()
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.M{"$and": bson.A{filter, cursorFilter(field, descending, after)}}
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultStatusLimit
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit) + 1)
+
+	cursor, err = collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &page.Status); err != nil {
+		return nil, err
+	}
+	if len(page.Status) > limit {
+		page.Status = page.Status[:limit]
+		page.NextCursor = q.encodeCursor(&page.Status[limit-1])
+	}
+	return page, nil
+}
+
+// CreateTask creates an entry in MongoDB that the kicked off
+// process will modify, and its entry in the outbox collection.
+// Both are written in one transaction where the deployment supports
+// it; otherwise the outbox entry goes first, so the relay never sees
+// a task without one.
+func (db *MongoStore) CreateTask(task Task, actor string) (*primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	task.Id = primitive.NewObjectID()
+	record := newTaskRecord(task, actor)
+	entry := newOutboxEntry(task)
+
+	err := db.withTransaction(ctx, func(ctx context.Context) error {
+		_, err := db.Collection("outbox").InsertOne(ctx, entry)
+		if err != nil {
+			return err
+		}
+		_, err = db.Collection("tasks").InsertOne(ctx, record)
+		if err != nil {
+			db.Collection("outbox").DeleteOne(ctx, bson.M{"_id": entry.Id})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &task.Id, nil
+}
+
+// StopTask moves the requested task to stopping and sets its `stop_flag`,
+// so the running process will know to shutdown, and its `stop_deadline`
+// (if deadline is set), after which it's killed.
+func (db *MongoStore) StopTask(id string, deadline time.Time, actor string) error {
+	set := bson.M{"stop_flag": true}
+	if !deadline.IsZero() {
+		set["stop_deadline"] = primitive.NewDateTimeFromTime(deadline)
+	}
+	return db.transitionTask(id, StateStopping, actor, "stop requested", nil, set)
+}
+
+// KillTask moves the requested task to stopping with `kill_requested`
+// set or, if it's already stopping, escalates the stop to a kill.
+func (db *MongoStore) KillTask(id string, actor string, reason string) error {
+	notStopping := bson.M{"state": bson.M{"$ne": StateStopping}}
+	err := db.transitionTask(id, StateStopping, actor, reason, notStopping, bson.M{
+		"stop_flag":      true,
+		"kill_requested": true,
+	})
+	if err != ErrTaskNotFound {
+		return err
+	}
+
+	stopping := bson.M{"state": StateStopping}
+	return db.recordEvent(id, actor, reason, stopping, bson.M{"kill_requested": true})
+}
+
+// AddHistory records something that happened to a task without
+// changing its state.
+func (db *MongoStore) AddHistory(id string, actor string, reason string) error {
+	return db.recordEvent(id, actor, reason, nil, nil)
+}
+
+// RequestReconfigure records a parameters update for a running task as
+// its `reconfiguration`, bumping its `config_revision`, and returns the
+// new revision. The update is conditional on the revision it read, so
+// concurrent updates each get their own.
+func (db *MongoStore) RequestReconfigure(id string, changes map[string]interface{}, actor string) (int, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := db.Collection("tasks")
+	for {
+		var current struct {
+			State          State `bson:"state"`
+			ConfigRevision int   `bson:"config_revision"`
+		}
+		err = collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			return 0, ErrTaskNotFound
+		}
+		if err != nil {
+			return 0, err
+		}
+		if current.State != StateRunning {
+			return 0, ErrTaskNotRunning
+		}
+
+		// Revision 0 is left out of the document
+		var revisionFilter interface{} = current.ConfigRevision
+		if current.ConfigRevision == 0 {
+			revisionFilter = bson.M{"$exists": false}
+		}
+		revision := current.ConfigRevision + 1
+		now := primitive.NewDateTimeFromTime(time.Now())
+		updateResult, err := collection.UpdateOne(
+			ctx,
+			bson.M{"_id": oid, "state": StateRunning, "config_revision": revisionFilter},
+			bson.M{
+				"$set": bson.M{
+					"config_revision": revision,
+					"reconfiguration": Reconfiguration{
+						Revision:    revision,
+						Parameters:  changes,
+						RequestedAt: now,
+						Actor:       actor,
+					},
+				},
+				"$push": bson.M{"history": HistoryEntry{
+					From:   StateRunning,
+					To:     StateRunning,
+					Time:   now,
+					Actor:  actor,
+					Reason: fmt.Sprintf("parameters update %d requested: %s", revision, describeChanges(changes)),
+				}},
+			},
+		)
+		if err != nil {
+			return 0, err
+		}
+		if updateResult.MatchedCount == 1 {
+			return revision, nil
+		}
+		// The task moved on underneath us; check it again
+	}
+}
+
+// AckReconfigure records the worker's answer to a parameters update,
+// setting the applied changes in the task's `parameters`. An answer to
+// an update that's been superseded only goes in the history.
+func (db *MongoStore) AckReconfigure(id string, revision int, rejection string, actor string) error {
+	status, err := db.GetSingleStatus(id)
+	if err != nil {
+		return err
+	}
+
+	reason := ackReason(revision, rejection)
+	r := status.Reconfiguration
+	if r == nil || r.Revision != revision || r.AckedAt != 0 {
+		return db.AddHistory(id, actor, reason)
+	}
+
+	set := bson.M{
+		"reconfiguration.acked_at": primitive.NewDateTimeFromTime(time.Now()),
+		"reconfiguration.applied":  rejection == "",
+	}
+	if rejection != "" {
+		set["reconfiguration.error"] = rejection
+	} else {
+		for name, value := range r.Parameters {
+			set["parameters."+name] = value
+		}
+	}
+	awaited := bson.M{
+		"reconfiguration.revision": revision,
+		"reconfiguration.acked_at": bson.M{"$exists": false},
+	}
+	err = db.recordEvent(id, actor, reason, awaited, set)
+	if err != ErrTaskNotFound {
+		return err
+	}
+	return db.AddHistory(id, actor, reason)
+}
+
+// AddArtifact registers an artifact with a task, replacing any in its
+// `artifacts` with the same name. Like recordEvent, the update is
+// conditional on the state the history entry records.
+func (db *MongoStore) AddArtifact(id string, artifact Artifact, actor string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := db.Collection("tasks")
+	for {
+		var current struct {
+			State State `bson:"state"`
+		}
+		err = collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			return ErrTaskNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := HistoryEntry{
+			From:   current.State,
+			To:     current.State,
+			Time:   primitive.NewDateTimeFromTime(time.Now()),
+			Actor:  actor,
+			Reason: fmt.Sprintf("artifact %s registered (%d bytes)", artifact.Name, artifact.Size),
+		}
+
+		// Replace the artifact if the task has one by that name...
+		updateResult, err := collection.UpdateOne(
+			ctx,
+			bson.M{"_id": oid, "state": current.State, "artifacts.name": artifact.Name},
+			bson.M{"$set": bson.M{"artifacts.$": artifact}, "$push": bson.M{"history": entry}},
+		)
+		if err != nil {
+			return err
+		}
+		if updateResult.MatchedCount == 1 {
+			return nil
+		}
+
+		// ...or add it if it doesn't
+		updateResult, err = collection.UpdateOne(
+			ctx,
+			bson.M{"_id": oid, "state": current.State, "artifacts.name": bson.M{"$ne": artifact.Name}},
+			bson.M{"$push": bson.M{"artifacts": artifact, "history": entry}},
+		)
+		if err != nil {
+			return err
+		}
+		if updateResult.MatchedCount == 1 {
+			return nil
+		}
+		// The task moved on underneath us; try again
+	}
+}
+
+// GetOverdueStops finds stopping tasks whose `stop_deadline` has passed
+// without a kill being requested yet.
+func (db *MongoStore) GetOverdueStops(now time.Time) (*[]Status, error) {
+	collection := db.Collection("tasks")
+	var statusList []Status
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, overdueFilter(now))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &statusList); err != nil {
+		return nil, err
+	}
+
+	return &statusList, nil
+}
+
+// GetDueStops finds pending and running tasks whose stop time has passed.
+func (db *MongoStore) GetDueStops(now time.Time) (*[]Status, error) {
+	collection := db.Collection("tasks")
+	var statusList []Status
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, dueStopFilter(now))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &statusList); err != nil {
+		return nil, err
+	}
+
+	return &statusList, nil
+}
+
+// StartTask moves a task to running once a worker has picked it up.
+func (db *MongoStore) StartTask(id string, workerId string, actor string) error {
+	return db.transitionTask(id, StateRunning, actor, "picked up by worker", nil, bson.M{
+		"worker_id":      workerId,
+		"last_heartbeat": primitive.NewDateTimeFromTime(time.Now()),
+	})
+}
+
+// UpdateProgress records how far along a task's worker says it is.
+func (db *MongoStore) UpdateProgress(id string, workerId string, progress float64, message string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := workerFilter(workerId)
+	filter["_id"] = oid
+	collection := db.Collection("tasks")
+	updateResult, err := collection.UpdateOne(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{
+			"progress":         progress,
+			"progress_message": message,
+			"last_heartbeat":   primitive.NewDateTimeFromTime(time.Now()),
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	if updateResult.MatchedCount == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// TransitionTask moves a task to state `to`, recording who asked
+// for it and why in the task's history.
+func (db *MongoStore) TransitionTask(id string, to State, actor string, reason string) error {
+	return db.transitionTask(id, to, actor, reason, nil, nil)
+}
+
+// FinishTask moves a task to state `to` at the report of workerId,
+// provided it's the task's worker. Reports from a worker that lost the
+// task to another don't count.
+func (db *MongoStore) FinishTask(id string, workerId string, to State, actor string, reason string) error {
+	return db.transitionTask(id, to, actor, reason, workerFilter(workerId), nil)
+}
+
+// RecordHeartbeat notes that a task's worker is still alive.
+func (db *MongoStore) RecordHeartbeat(id string, workerId string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := workerFilter(workerId)
+	filter["_id"] = oid
+	collection := db.Collection("tasks")
+	updateResult, err := collection.UpdateOne(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{"last_heartbeat": primitive.NewDateTimeFromTime(time.Now())}},
+	)
+	if err != nil {
+		return err
+	}
+	if updateResult.MatchedCount == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// GetStaleTasks finds running and stopping tasks whose last
+// heartbeat is older than cutoff.
+func (db *MongoStore) GetStaleTasks(cutoff time.Time) (*[]Status, error) {
+	collection := db.Collection("tasks")
+	var statusList []Status
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, staleFilter(cutoff))
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &statusList); err != nil {
+		return nil, err
+	}
+
+	return &statusList, nil
+}
+
+// MarkTaskLost moves a task to lost, provided it is still stale as of
+// cutoff; a heartbeat that sneaks in first keeps the task alive, in
+// which case ErrTaskNotFound is returned.
+func (db *MongoStore) MarkTaskLost(id string, cutoff time.Time, actor string, reason string) error {
+	return db.transitionTask(id, StateLost, actor, reason, staleFilter(cutoff), nil)
+}
+
+// ResumeTask moves a lost task back to running when the worker that
+// was running it turns out to be alive. If the task isn't lost or has
+// since been re-dispatched, ErrTaskNotFound is returned.
+func (db *MongoStore) ResumeTask(id string, workerId string, actor string) error {
+	cond := workerFilter(workerId)
+	cond["state"] = StateLost
+	return db.transitionTask(id, StateRunning, actor, "heartbeats resumed", cond, nil)
+}
+
+// RedispatchTask moves a lost task back to pending as its next attempt
+// and queues a new start message for it in the outbox.
+// The previous worker is forgotten so it can't claim the task again.
+func (db *MongoStore) RedispatchTask(id string, attempt int, actor string, reason string) error {
+	status, err := db.GetSingleStatus(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entry := newOutboxEntry(status.Task)
+	return db.withTransaction(ctx, func(ctx context.Context) error {
+		_, err := db.Collection("outbox").InsertOne(ctx, entry)
+		if err != nil {
+			return err
+		}
+		err = db.transitionTaskIn(ctx, id, StatePending, actor, reason, nil, bson.M{
+			"attempt":   attempt,
+			"worker_id": "",
+			"stop_flag": false,
+			"dispatch":  DispatchPending,
+		})
+		if err != nil {
+			db.Collection("outbox").DeleteOne(ctx, bson.M{"_id": entry.Id})
+		}
+		return err
+	})
+}
+
+// GetDueDispatches returns up to limit pending outbox entries whose
+// next attempt is due by now.
+func (db *MongoStore) GetDueDispatches(now time.Time, limit int) (*[]OutboxEntry, error) {
+	filter := bson.M{
+		"state":        DispatchPending,
+		"next_attempt": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	}
+	opts := options.Find().SetSort(bson.M{"next_attempt": 1}).SetLimit(int64(limit))
+	return db.findDispatches(filter, opts)
+}
+
+// GetUndeliveredDispatches returns every outbox entry that hasn't
+// been confirmed, whether still pending or given up on.
+func (db *MongoStore) GetUndeliveredDispatches() (*[]OutboxEntry, error) {
+	filter := bson.M{"state": bson.M{"$ne": DispatchDelivered}}
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	return db.findDispatches(filter, opts)
+}
+
+// MarkDispatchDelivered records that the bus confirmed an entry.
+func (db *MongoStore) MarkDispatchDelivered(id string) error {
+	return db.updateDispatch(id, bson.M{
+		"$set": bson.M{
+			"state":        DispatchDelivered,
+			"last_error":   "",
+			"delivered_at": primitive.NewDateTimeFromTime(time.Now()),
+		},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// RetryDispatch records a failed attempt and when to try again.
+func (db *MongoStore) RetryDispatch(id string, lastError string, nextAttempt time.Time) error {
+	return db.updateDispatch(id, bson.M{
+		"$set": bson.M{
+			"last_error":   lastError,
+			"next_attempt": primitive.NewDateTimeFromTime(nextAttempt),
+		},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+// FailDispatch records a failed attempt and gives up on the entry.
+func (db *MongoStore) FailDispatch(id string, lastError string) error {
+	return db.updateDispatch(id, bson.M{
+		"$set": bson.M{
+			"state":      DispatchFailed,
+			"last_error": lastError,
+		},
+		"$inc": bson.M{"attempts": 1},
+	})
+}
+
+func (db *MongoStore) findDispatches(filter bson.M, opts *options.FindOptions) (*[]OutboxEntry, error) {
+	collection := db.Collection("outbox")
+	entries := []OutboxEntry{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	return &entries, nil
+}
+
+// updateDispatch applies update to an outbox entry and mirrors its
+// resulting state onto the entry's task.
+func (db *MongoStore) updateDispatch(id string, update bson.M) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var entry OutboxEntry
+	err = db.Collection("outbox").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": oid},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return ErrTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("tasks").UpdateOne(
+		ctx,
+		bson.M{"_id": entry.TaskId},
+		bson.M{"$set": bson.M{"dispatch": entry.State}},
+	)
+	return err
+}
+
+// GetLatestCatalog returns the newest catalog version.
+func (db *MongoStore) GetLatestCatalog() (*CatalogVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var version CatalogVersion
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+	err := db.Collection("catalog").FindOne(ctx, bson.M{}, opts).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCatalogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// GetCatalogVersions returns every catalog version after since,
+// oldest first.
+func (db *MongoStore) GetCatalogVersions(since int) (*[]CatalogVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	versions := []CatalogVersion{}
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	cursor, err := db.Collection("catalog").Find(ctx, bson.M{"_id": bson.M{"$gt": since}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &versions); err != nil {
+		return nil, err
+	}
+	return &versions, nil
+}
+
+// SaveCatalog stores a new catalog version.
+func (db *MongoStore) SaveCatalog(version CatalogVersion) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("catalog").InsertOne(ctx, version)
+	return err
+}
+
+// CreateSchedule inserts a new schedule into the schedules collection.
+func (db *MongoStore) CreateSchedule(schedule Schedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("schedules").InsertOne(ctx, schedule)
+	return err
+}
+
+// GetSchedule looks up a schedule by its hex id.
+func (db *MongoStore) GetSchedule(id string) (*Schedule, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var schedule Schedule
+	err = db.Collection("schedules").FindOne(ctx, bson.M{"_id": oid}).Decode(&schedule)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// GetAllSchedules returns every schedule.
+func (db *MongoStore) GetAllSchedules() (*[]Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	schedules := []Schedule{}
+	cursor, err := db.Collection("schedules").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &schedules); err != nil {
+		return nil, err
+	}
+	return &schedules, nil
+}
+
+// UpdateSchedule replaces a schedule, as long as it's still at the
+// revision it was read at, and bumps its revision.
+func (db *MongoStore) UpdateSchedule(schedule Schedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := db.Collection("schedules")
+	filter := bson.M{"_id": schedule.Id, "revision": schedule.Revision}
+	schedule.Revision++
+	result, err := collection.ReplaceOne(ctx, filter, schedule)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": schedule.Id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrScheduleNotFound
+	}
+	return ErrScheduleConflict
+}
+
+// DeleteSchedule deletes a schedule.
+func (db *MongoStore) DeleteSchedule(id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("schedules").DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// CreateAPIToken inserts a new API token into the tokens collection.
+func (db *MongoStore) CreateAPIToken(token auth.APIToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("tokens").InsertOne(ctx, token)
+	return err
+}
+
+// GetAPIToken looks up an API token by its hash.
+func (db *MongoStore) GetAPIToken(hash string) (*auth.APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var token auth.APIToken
+	err := db.Collection("tokens").FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, auth.ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetAllAPITokens returns every API token.
+func (db *MongoStore) GetAllAPITokens() (*[]auth.APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tokens := []auth.APIToken{}
+	cursor, err := db.Collection("tokens").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// DeleteAPIToken revokes an API token by its hex id.
+func (db *MongoStore) DeleteAPIToken(id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := db.Collection("tokens").DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return auth.ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// mongoErrDuplicateKey is the server error code for writes that
+// violate a unique index.
+const mongoErrDuplicateKey = 11000
+
+// AppendAuditEntry inserts an audit entry into the audit collection,
+// whose _id is the entry's Seq.
+func (db *MongoStore) AppendAuditEntry(entry AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := db.Collection("audit").InsertOne(ctx, entry)
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == mongoErrDuplicateKey {
+				return ErrAuditConflict
+			}
+		}
+	}
+	return err
+}
+
+// LastAuditEntry returns the newest audit entry, or nil if there are
+// none.
+func (db *MongoStore) LastAuditEntry() (*AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var entry AuditEntry
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+	err := db.Collection("audit").FindOne(ctx, bson.M{}, opts).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// QueryAudit returns the audit entries matching q, oldest first.
+func (db *MongoStore) QueryAudit(q *AuditQuery) (*[]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": bson.M{"$gt": q.After}}
+	if q.Actor != "" {
+		filter["actor"] = q.Actor
+	}
+	if len(q.Actions) > 0 {
+		filter["action"] = bson.M{"$in": q.Actions}
+	}
+	if q.Target != "" {
+		filter["target"] = q.Target
+	}
+	if q.Outcome != "" {
+		filter["outcome"] = q.Outcome
+	}
+	times := bson.M{}
+	if !q.Since.IsZero() {
+		times["$gte"] = primitive.NewDateTimeFromTime(q.Since)
+	}
+	if !q.Until.IsZero() {
+		times["$lt"] = primitive.NewDateTimeFromTime(q.Until)
+	}
+	if len(times) > 0 {
+		filter["time"] = times
+	}
+
+	entries := []AuditEntry{}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(q.Limit))
+	cursor, err := db.Collection("audit").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return &entries, nil
+}
+
+// withTransaction runs fn in a transaction when the deployment supports
+// them. Standalone servers don't, in which case fn runs on its own and
+// has to order its writes so that a partial result is recoverable.
+func (db *MongoStore) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	err := db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+		return err
+	})
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == mongoErrIllegalOperation {
+		return fn(ctx)
+	}
+	return err
+}
+
+// workerFilter matches tasks run by workerId. Tasks run by a worker
+// without an id have an empty worker_id or none at all.
+func workerFilter(workerId string) bson.M {
+	if workerId == "" {
+		return bson.M{"worker_id": bson.M{"$in": bson.A{"", nil}}}
+	}
+	return bson.M{"worker_id": workerId}
+}
+
+func staleFilter(cutoff time.Time) bson.M {
+	return bson.M{
+		"state":          bson.M{"$in": bson.A{StateRunning, StateStopping}},
+		"last_heartbeat": bson.M{"$lt": primitive.NewDateTimeFromTime(cutoff)},
+	}
+}
+
+func statusFilter(f *StatusFilter) bson.M {
+	filter := bson.M{}
+	if len(f.States) > 0 {
+		filter["state"] = bson.M{"$in": f.States}
+	}
+	if len(f.Types) > 0 {
+		filter["type"] = bson.M{"$in": f.Types}
+	}
+	if len(f.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": f.Tags}
+	}
+	startTime := bson.M{}
+	if !f.Since.IsZero() {
+		startTime["$gte"] = primitive.NewDateTimeFromTime(f.Since)
+	}
+	if !f.Until.IsZero() {
+		startTime["$lt"] = primitive.NewDateTimeFromTime(f.Until)
+	}
+	if len(startTime) > 0 {
+		filter["start_time"] = startTime
+	}
+	if f.Owner != "" {
+		filter["owner"] = f.Owner
+	}
+	return filter
+}
+
+// cursorFilter matches the tasks sorted after the cursor's position.
+func cursorFilter(field string, descending bool, after *statusCursor) bson.M {
+	op := "$gt"
+	if descending {
+		op = "$lt"
+	}
+	oid, _ := primitive.ObjectIDFromHex(after.Id)
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: oid}}
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: after.Value}},
+		bson.M{field: after.Value, "_id": bson.M{op: oid}},
+	}}
+}
+
+func overdueFilter(now time.Time) bson.M {
+	return bson.M{
+		"state":          StateStopping,
+		"kill_requested": bson.M{"$ne": true},
+		"stop_deadline":  bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	}
+}
+
+func dueStopFilter(now time.Time) bson.M {
+	return bson.M{
+		"state":     bson.M{"$in": bson.A{StatePending, StateRunning}},
+		"stop_time": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	}
+}
+
+// recordEvent adds a history entry to a task without changing its
+// state, along with any fields in `set`. Like transitionTask, the
+// update is conditional on the state the entry records, and if `cond`
+// is given the task must match it or ErrTaskNotFound is returned.
+func (db *MongoStore) recordEvent(id string, actor string, reason string, cond bson.M, set bson.M) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := db.Collection("tasks")
+	for {
+		var current struct {
+			State State `bson:"state"`
+		}
+		filter := bson.M{"_id": oid}
+		for field, value := range cond {
+			filter[field] = value
+		}
+		err = collection.FindOne(ctx, filter).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			return ErrTaskNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		update := bson.M{
+			"$push": bson.M{"history": HistoryEntry{
+				From:   current.State,
+				To:     current.State,
+				Time:   primitive.NewDateTimeFromTime(time.Now()),
+				Actor:  actor,
+				Reason: reason,
+			}},
+		}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		updateResult, err := collection.UpdateOne(
+			ctx,
+			bson.M{"$and": bson.A{filter, bson.M{"state": current.State}}},
+			update,
+		)
+		if err != nil {
+			return err
+		}
+		if updateResult.MatchedCount == 1 {
+			return nil
+		}
+		// The task moved on underneath us; record it against its new state
+	}
+}
+
+// transitionTask performs a state transition as a conditional update on
+// the task's current state, so concurrent transitions can't both win.
+// If the state changes underneath us, the transition is re-checked
+// against the new state. If `cond` is given, the task must also match
+// it or ErrTaskNotFound is returned. Any fields in `set` are updated
+// alongside.
+func (db *MongoStore) transitionTask(id string, to State, actor string, reason string, cond bson.M, set bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return db.transitionTaskIn(ctx, id, to, actor, reason, cond, set)
+}
+
+// transitionTaskIn is transitionTask within the given context,
+// e.g. a transaction's.
+func (db *MongoStore) transitionTaskIn(ctx context.Context, id string, to State, actor string, reason string, cond bson.M, set bson.M) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	collection := db.Collection("tasks")
+	for {
+		var current struct {
+			State State `bson:"state"`
+		}
+		filter := bson.M{"_id": oid}
+		for field, value := range cond {
+			filter[field] = value
+		}
+		err = collection.FindOne(ctx, filter).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			return ErrTaskNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !current.State.CanTransitionTo(to) {
+			return &TransitionError{Id: id, From: current.State, To: to}
+		}
+
+		update := bson.M{"state": to}
+		for field, value := range set {
+			update[field] = value
+		}
+		updateResult, err := collection.UpdateOne(
+			ctx,
+			bson.M{ // query/filter
+				"$and": bson.A{filter, bson.M{"state": current.State}},
+			},
+			bson.M{ // update
+				"$set": update,
+				"$push": bson.M{"history": HistoryEntry{
+					From:   current.State,
+					To:     to,
+					Time:   primitive.NewDateTimeFromTime(time.Now()),
+					Actor:  actor,
+					Reason: reason,
+				}},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if updateResult.MatchedCount == 1 {
+			return nil
+		}
+		// Someone else moved the task first; try again from its new state
+	}
+}
+
+// Close disconnects from MongoDB.
+func (db *MongoStore) Close(ctx context.Context) error {
+	return db.Client().Disconnect(ctx)
+}
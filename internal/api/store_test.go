@@ -0,0 +1,545 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// storeBackends open an empty Store of each backend that runs without
+// external services. MongoStore needs a MongoDB server and isn't
+// covered here.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+	{"bolt", func(t *testing.T) Store {
+		store, err := OpenBoltStore(filepath.Join(t.TempDir(), "dc.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close(context.Background()) })
+		return store
+	}},
+}
+
+// TestStore runs the same suite against every backend, so they behave alike.
+func TestStore(t *testing.T) {
+	suite := []struct {
+		name string
+		test func(t *testing.T, db Store)
+	}{
+		{"Transitions", testStoreTransitions},
+		{"StopAndKill", testStoreStopAndKill},
+		{"MarkTaskLost", testStoreMarkTaskLost},
+		{"WorkerReports", testStoreWorkerReports},
+		{"NotFound", testStoreNotFound},
+		{"QueryStatus", testStoreQueryStatus},
+		{"Outbox", testStoreOutbox},
+		{"Audit", testStoreAudit},
+	}
+	for _, backend := range storeBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range suite {
+				test := test
+				t.Run(test.name, func(t *testing.T) {
+					test.test(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+func createTestTask(t *testing.T, db Store, task Task) string {
+	t.Helper()
+	oid, err := db.CreateTask(task, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oid.Hex()
+}
+
+func getTestStatus(t *testing.T, db Store, id string) *Status {
+	t.Helper()
+	status, err := db.GetSingleStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// statesLeadingTo are the transitions that take a new task to each state.
+var statesLeadingTo = map[State][]State{
+	StatePending:  nil,
+	StateRunning:  {StateRunning},
+	StateStopping: {StateRunning, StateStopping},
+	StateLost:     {StateRunning, StateLost},
+	StateStopped:  {StateStopped},
+	StateFailed:   {StateFailed},
+}
+
+func testStoreTransitions(t *testing.T, db Store) {
+	for _, from := range knownStates {
+		for _, to := range knownStates {
+			id := createTestTask(t, db, Task{Type: "test"})
+			for _, state := range statesLeadingTo[from] {
+				if err := db.TransitionTask(id, state, "test", ""); err != nil {
+					t.Fatalf("taking task to %s: %v", from, err)
+				}
+			}
+			before := getTestStatus(t, db, id)
+
+			err := db.TransitionTask(id, to, "test", "because")
+			after := getTestStatus(t, db, id)
+			if from.CanTransitionTo(to) {
+				if err != nil {
+					t.Errorf("%s -> %s: %v", from, to, err)
+					continue
+				}
+				if after.State != to {
+					t.Errorf("%s -> %s: task is %s", from, to, after.State)
+				}
+				last := after.History[len(after.History)-1]
+				if last.From != from || last.To != to || last.Reason != "because" {
+					t.Errorf("%s -> %s: recorded %+v", from, to, last)
+				}
+				continue
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) {
+				t.Errorf("%s -> %s: got %v, want a TransitionError", from, to, err)
+				continue
+			}
+			if transitionErr.From != from || transitionErr.To != to {
+				t.Errorf("%s -> %s: got %v", from, to, err)
+			}
+			if status := errorStatus(err); status != http.StatusConflict {
+				t.Errorf("%s -> %s: answered %d, want 409", from, to, status)
+			}
+			if after.State != before.State || len(after.History) != len(before.History) {
+				t.Errorf("%s -> %s: rejected transition changed the task", from, to)
+			}
+		}
+	}
+}
+
+func testStoreStopAndKill(t *testing.T, db Store) {
+	id := createTestTask(t, db, Task{Type: "test"})
+	if err := db.StartTask(id, "worker-1", "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Minute)
+	if err := db.StopTask(id, deadline, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	status := getTestStatus(t, db, id)
+	if status.State != StateStopping || !status.StopFlag || status.KillRequested {
+		t.Errorf("after stop: state %s, stop flag %v, kill %v", status.State, status.StopFlag, status.KillRequested)
+	}
+	if status.StopDeadline != primitive.NewDateTimeFromTime(deadline) {
+		t.Errorf("stop deadline is %v, want %v", status.StopDeadline.Time(), deadline)
+	}
+
+	// Stopping twice isn't allowed, but escalating to a kill is
+	if err := db.StopTask(id, time.Time{}, "alice"); errorStatus(err) != http.StatusConflict {
+		t.Errorf("second stop: got %v, want a conflict", err)
+	}
+	if err := db.KillTask(id, "alice", "kill requested"); err != nil {
+		t.Fatal(err)
+	}
+	status = getTestStatus(t, db, id)
+	if status.State != StateStopping || !status.KillRequested {
+		t.Errorf("after kill: state %s, kill %v", status.State, status.KillRequested)
+	}
+
+	// Tasks that are done can't be stopped or killed
+	if err := db.TransitionTask(id, StateStopped, "worker-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StopTask(id, time.Time{}, "alice"); errorStatus(err) != http.StatusConflict {
+		t.Errorf("stopping a stopped task: got %v, want a conflict", err)
+	}
+	if err := db.KillTask(id, "alice", ""); err == nil {
+		t.Error("killed a stopped task")
+	}
+}
+
+func testStoreMarkTaskLost(t *testing.T, db Store) {
+	id := createTestTask(t, db, Task{Type: "test"})
+	if err := db.StartTask(id, "worker-1", "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The heartbeat StartTask recorded is newer than this cutoff
+	past := time.Now().Add(-time.Hour)
+	if err := db.MarkTaskLost(id, past, "reaper", ""); err != ErrTaskNotFound {
+		t.Errorf("marking a live task lost: got %v, want ErrTaskNotFound", err)
+	}
+	if stale, err := db.GetStaleTasks(past); err != nil || len(*stale) != 0 {
+		t.Errorf("stale tasks = %v, %v; want none", stale, err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if stale, err := db.GetStaleTasks(future); err != nil || len(*stale) != 1 {
+		t.Errorf("stale tasks = %v, %v; want the task", stale, err)
+	}
+	if err := db.MarkTaskLost(id, future, "reaper", "no heartbeats"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ResumeTask(id, "worker-2", "worker-2"); err != ErrTaskNotFound {
+		t.Errorf("resuming from another worker: got %v, want ErrTaskNotFound", err)
+	}
+	if err := db.ResumeTask(id, "worker-1", "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	if status := getTestStatus(t, db, id); status.State != StateRunning {
+		t.Errorf("resumed task is %s", status.State)
+	}
+}
+
+func testStoreWorkerReports(t *testing.T, db Store) {
+	id := createTestTask(t, db, Task{Type: "test"})
+	if err := db.StartTask(id, "worker-1", "worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	before := getTestStatus(t, db, id)
+
+	// Only the task's worker counts
+	if err := db.RecordHeartbeat(id, "worker-2"); err != ErrTaskNotFound {
+		t.Errorf("heartbeat from another worker: got %v, want ErrTaskNotFound", err)
+	}
+	if err := db.UpdateProgress(id, "worker-2", 0.5, "halfway"); err != ErrTaskNotFound {
+		t.Errorf("progress from another worker: got %v, want ErrTaskNotFound", err)
+	}
+	if err := db.FinishTask(id, "worker-2", StateFailed, "worker-2", ""); err != ErrTaskNotFound {
+		t.Errorf("failure from another worker: got %v, want ErrTaskNotFound", err)
+	}
+	status := getTestStatus(t, db, id)
+	if status.State != StateRunning || status.Progress != 0 || status.LastHeartbeat != before.LastHeartbeat {
+		t.Errorf("another worker's reports changed the task: %s, progress %v", status.State, status.Progress)
+	}
+
+	if err := db.UpdateProgress(id, "worker-1", 0.5, "halfway"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FinishTask(id, "worker-1", StateStopped, "worker-1", "done"); err != nil {
+		t.Fatal(err)
+	}
+	status = getTestStatus(t, db, id)
+	if status.State != StateStopped || status.Progress != 0.5 {
+		t.Errorf("after the worker's reports: %s, progress %v", status.State, status.Progress)
+	}
+}
+
+func testStoreNotFound(t *testing.T, db Store) {
+	missing := primitive.NewObjectID().Hex()
+	if _, err := db.GetSingleStatus(missing); errorStatus(err) != http.StatusNotFound {
+		t.Errorf("getting a missing task: got %v, want not found", err)
+	}
+	if err := db.TransitionTask(missing, StateRunning, "test", ""); errorStatus(err) != http.StatusNotFound {
+		t.Errorf("moving a missing task: got %v, want not found", err)
+	}
+	if _, err := db.GetSingleStatus("1234"); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("getting a malformed id: got %v, want bad request", err)
+	}
+}
+
+func testStoreQueryStatus(t *testing.T, db Store) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tasks := []struct {
+		typ   string
+		tags  []string
+		state State
+	}{
+		{"collect", []string{"lab"}, StatePending},
+		{"collect", []string{"lab", "night"}, StateRunning},
+		{"survey", nil, StateStopped},
+		{"collect", []string{"night"}, StateFailed},
+		{"survey", []string{"lab"}, StateRunning},
+		{"collect", nil, StateStopped},
+		{"survey", []string{"lab", "night"}, StatePending},
+	}
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = createTestTask(t, db, Task{
+			Type:      task.typ,
+			Tags:      task.tags,
+			StartTime: primitive.NewDateTimeFromTime(base.Add(time.Duration(i) * time.Hour)),
+		})
+		if task.state != StatePending {
+			if err := db.TransitionTask(ids[i], task.state, "test", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int
+	}{
+		{"newest first by default", "", []int{6, 5, 4, 3, 2, 1, 0}},
+		{"oldest first", "sort=start_time", []int{0, 1, 2, 3, 4, 5, 6}},
+		{"state", "state=running", []int{4, 1}},
+		{"states", "state=pending,stopped&sort=start_time", []int{0, 2, 5, 6}},
+		{"type", "type=survey", []int{6, 4, 2}},
+		{"tags", "tag=lab&tag=night", []int{6, 1}},
+		{"since and until", "since=2026-01-01T02:00:00Z&until=2026-01-01T04:00:00Z", []int{3, 2}},
+		{"combined", "type=collect&state=stopped,failed", []int{5, 3}},
+		{"nothing", "type=unknown", nil},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		query, err := ParseStatusQuery(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := db.QueryStatus(query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := statusIndexes(page.Status, ids); !equalInts(got, test.want) {
+			t.Errorf("%s: got tasks %v, want %v", test.name, got, test.want)
+		}
+		if page.Total != int64(len(test.want)) {
+			t.Errorf("%s: total is %d, want %d", test.name, page.Total, len(test.want))
+		}
+		if page.NextCursor != "" {
+			t.Errorf("%s: got a cursor for a single page", test.name)
+		}
+	}
+
+	page, err := db.QueryStatus(&StatusQuery{Sort: defaultStatusSort, Limit: maxStatusLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := map[State]int64{StatePending: 2, StateRunning: 2, StateStopped: 2, StateFailed: 1}
+	for state, count := range wantCounts {
+		if page.Counts[state] != count {
+			t.Errorf("%d %s tasks counted, want %d", page.Counts[state], state, count)
+		}
+	}
+
+	// Paging through with a cursor returns every task once, in order,
+	// whichever field it's sorted by
+	for _, sort := range []string{"start_time", "-start_time", "state", "-state", "id", "-id"} {
+		all, err := db.QueryStatus(&StatusQuery{Sort: sort, Limit: maxStatusLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paged []Status
+		query := &StatusQuery{Sort: sort, Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > len(tasks) {
+				t.Fatalf("sort %s: paging doesn't end", sort)
+			}
+			page, err := db.QueryStatus(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, page.Status...)
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if got, want := statusIndexes(paged, ids), statusIndexes(all.Status, ids); !equalInts(got, want) {
+			t.Errorf("sort %s: paged through %v, want %v", sort, got, want)
+		}
+	}
+
+	// A cursor only works with the sort it was made for
+	page, err = db.QueryStatus(&StatusQuery{Sort: "start_time", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.QueryStatus(&StatusQuery{Sort: "state", Limit: 2, Cursor: page.NextCursor})
+	if errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("cursor for another sort: got %v, want bad request", err)
+	}
+}
+
+// statusIndexes maps statuses to the indexes of their ids in ids.
+func statusIndexes(statuses []Status, ids []string) []int {
+	var indexes []int
+	for _, status := range statuses {
+		for i, id := range ids {
+			if status.Id.Hex() == id {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	return indexes
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testStoreOutbox(t *testing.T, db Store) {
+	now := time.Now()
+	first := createTestTask(t, db, Task{Type: "test"})
+	second := createTestTask(t, db, Task{Type: "test"})
+
+	due, err := db.GetDueDispatches(now.Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*due) != 2 {
+		t.Fatalf("%d dispatches due, want 2", len(*due))
+	}
+	entries := make(map[string]OutboxEntry)
+	for _, entry := range *due {
+		if entry.State != DispatchPending || entry.Task.Id != entry.TaskId {
+			t.Errorf("new outbox entry %+v", entry)
+		}
+		entries[entry.TaskId.Hex()] = entry
+	}
+	if limited, err := db.GetDueDispatches(now.Add(time.Second), 1); err != nil || len(*limited) != 1 {
+		t.Errorf("limit 1 returned %v, %v", limited, err)
+	}
+
+	// A failed attempt is retried later
+	entry := entries[first].Id.Hex()
+	if err := db.RetryDispatch(entry, "bus down", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	due, err = db.GetDueDispatches(now.Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*due) != 1 || (*due)[0].TaskId.Hex() != second {
+		t.Errorf("after a retry, due dispatches are %v", *due)
+	}
+	due, err = db.GetDueDispatches(now.Add(2*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*due) != 2 {
+		t.Errorf("%d dispatches due after the retry time, want 2", len(*due))
+	}
+	for _, retried := range *due {
+		if retried.TaskId.Hex() == first && (retried.Attempts != 1 || retried.LastError != "bus down") {
+			t.Errorf("retried entry has %d attempts, last error %q", retried.Attempts, retried.LastError)
+		}
+	}
+
+	// Delivery and giving up are mirrored onto the task
+	if err := db.MarkDispatchDelivered(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FailDispatch(entries[second].Id.Hex(), "bus down"); err != nil {
+		t.Fatal(err)
+	}
+	if status := getTestStatus(t, db, first); status.Dispatch != DispatchDelivered {
+		t.Errorf("delivered task's dispatch is %s", status.Dispatch)
+	}
+	if status := getTestStatus(t, db, second); status.Dispatch != DispatchFailed {
+		t.Errorf("failed task's dispatch is %s", status.Dispatch)
+	}
+	if due, err := db.GetDueDispatches(now.Add(2*time.Hour), 10); err != nil || len(*due) != 0 {
+		t.Errorf("due dispatches after delivery = %v, %v; want none", due, err)
+	}
+	undelivered, err := db.GetUndeliveredDispatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*undelivered) != 1 || (*undelivered)[0].TaskId.Hex() != second {
+		t.Errorf("undelivered dispatches are %v", *undelivered)
+	}
+
+	// Re-dispatching a lost task queues a new start message
+	if err := db.TransitionTask(first, StateRunning, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TransitionTask(first, StateLost, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RedispatchTask(first, 2, "reaper", "retrying"); err != nil {
+		t.Fatal(err)
+	}
+	status := getTestStatus(t, db, first)
+	if status.State != StatePending || status.Attempt != 2 || status.Dispatch != DispatchPending {
+		t.Errorf("re-dispatched task is %s, attempt %d, dispatch %s", status.State, status.Attempt, status.Dispatch)
+	}
+	due, err = db.GetDueDispatches(time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*due) != 1 || (*due)[0].TaskId.Hex() != first || (*due)[0].Id == entries[first].Id {
+		t.Errorf("after re-dispatch, due dispatches are %v", *due)
+	}
+}
+
+func testStoreAudit(t *testing.T, db Store) {
+	if last, err := db.LastAuditEntry(); err != nil || last != nil {
+		t.Fatalf("empty log's last entry = %v, %v", last, err)
+	}
+
+	log := SetupAuditLog(db)
+	for _, actor := range []string{"alice", "bob"} {
+		if err := log.Append(AuditEntry{Actor: actor, Action: "task.create", Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, err := db.LastAuditEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 2 || last.Actor != "bob" {
+		t.Fatalf("last entry is %+v", last)
+	}
+
+	// Seqs can't be reused
+	err = db.AppendAuditEntry(AuditEntry{Seq: 2, Actor: "mallory", Action: "task.create"})
+	if !errors.Is(err, ErrAuditConflict) {
+		t.Errorf("appending a taken seq: got %v, want ErrAuditConflict", err)
+	}
+
+	// Another server's log doesn't know about those entries yet; its
+	// append conflicts, and it retries after the last entry
+	other := SetupAuditLog(db)
+	other.last, other.loaded = nil, true
+	if err := other.Append(AuditEntry{Actor: "carol", Action: "task.stop", Outcome: AuditSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	third, err := db.LastAuditEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Seq != 3 || third.Actor != "carol" || third.PrevHash != last.Hash {
+		t.Errorf("entry appended after a conflict is %+v", third)
+	}
+
+	entries, err := db.QueryAudit(&AuditQuery{Actor: "bob", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*entries) != 1 || (*entries)[0].Seq != 2 {
+		t.Errorf("bob's entries are %v", *entries)
+	}
+	entries, err = db.QueryAudit(&AuditQuery{After: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*entries) != 1 || (*entries)[0].Seq != 2 {
+		t.Errorf("the page after 1 is %v", *entries)
+	}
+}
@@ -0,0 +1,556 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"golang.org/x/net/websocket"
+)
+
+// Defaults for the stream relay's limits
+const (
+	defaultStreamBuffer   = 64
+	defaultStreamMaxFrame = 4 << 20
+)
+
+// maxStreamDecimation is the most a decimating subscriber falls behind:
+// it gets at least one frame in this many.
+const maxStreamDecimation = 64
+
+// Backpressure policies for stream subscribers that can't keep up
+// (`?policy=`). Either way, frames are only dropped for the slow
+// subscriber, never held back from the others or the publisher.
+const (
+	// StreamPolicyDrop drops the frames that arrive while the
+	// subscriber's buffer is full
+	StreamPolicyDrop = "drop"
+	// StreamPolicyDecimate sends the subscriber only every Nth frame,
+	// doubling N each time its buffer fills and halving it each time
+	// the buffer drains
+	StreamPolicyDecimate = "decimate"
+)
+
+// ErrStreamPublished is returned when a stream already has a publisher.
+var ErrStreamPublished = errors.New("stream already has a publisher")
+
+// ErrStreamNotFound is returned for streams nobody is publishing or
+// subscribed to.
+var ErrStreamNotFound = errors.New("stream not found")
+
+// normalizeStreamMetadata fills in XDelta from SampleRate, and checks
+// the rest.
+func normalizeStreamMetadata(m *protocol.StreamMetadata) error {
+	if m.SampleRate < 0 || m.XDelta < 0 || m.Subsize < 0 {
+		return errors.New("sample_rate, xdelta and subsize can't be negative")
+	}
+	if m.Format != "" && len(m.Format) != 2 {
+		return fmt.Errorf("format %q must be a two-letter BLUE format code", m.Format)
+	}
+	if m.XDelta == 0 && m.SampleRate > 0 {
+		m.XDelta = 1 / m.SampleRate
+	}
+	return nil
+}
+
+// StreamInfo is what GetStreams and GetStream report about a stream.
+type StreamInfo struct {
+	Id          string                  `json:"id"`
+	Metadata    protocol.StreamMetadata `json:"metadata"`
+	Publishing  bool                    `json:"publishing"`
+	Frames      uint64                  `json:"frames"`
+	Bytes       uint64                  `json:"bytes"`
+	Subscribers []SubscriberInfo        `json:"subscribers"`
+	UpdatedAt   *time.Time              `json:"updated_at,omitempty"`
+}
+
+// SubscriberInfo reports how well a stream subscriber is keeping up.
+type SubscriberInfo struct {
+	Remote     string `json:"remote"`
+	Policy     string `json:"policy"`
+	Sent       uint64 `json:"sent"`
+	Dropped    uint64 `json:"dropped"`
+	Decimation int    `json:"decimation"`
+}
+
+// StreamRelay fans frames of live sample data out from the one worker
+// publishing each stream to every client subscribed to it, so workers
+// only ever send one copy. Streams exist while someone is publishing
+// or subscribed; subscribers may join before the publisher does, and
+// stay subscribed if it reconnects.
+type StreamRelay struct {
+	// Buffer is how many frames each subscriber may have waiting
+	Buffer int
+	// MaxFrame is the largest frame, in bytes, a publisher may send
+	MaxFrame int
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// SetupStreamRelay creates an empty StreamRelay, using the default
+// limits for any that aren't positive.
+func SetupStreamRelay(buffer int, maxFrame int) *StreamRelay {
+	if buffer <= 0 {
+		buffer = defaultStreamBuffer
+	}
+	if maxFrame <= 0 {
+		maxFrame = defaultStreamMaxFrame
+	}
+	return &StreamRelay{Buffer: buffer, MaxFrame: maxFrame, streams: make(map[string]*stream)}
+}
+
+type stream struct {
+	id string
+
+	mu          sync.RWMutex
+	metadata    protocol.StreamMetadata
+	header      []byte
+	publishing  bool
+	subscribers map[*streamSubscriber]struct{}
+	frames      uint64
+	bytes       uint64
+	updatedAt   time.Time
+}
+
+// streamSubscriber is one client's view of a stream. Frames are offered
+// to it by the publisher's goroutine only, and sent by its own.
+type streamSubscriber struct {
+	remote string
+	policy string
+	// frames holds the frames waiting to be sent; header holds the
+	// latest metadata, if it hasn't been sent yet
+	frames chan []byte
+	header chan []byte
+	done   chan struct{}
+
+	// every and skipped implement decimation
+	every   int32
+	skipped int
+	sent    uint64
+	dropped uint64
+}
+
+// acquire returns the stream with id, creating it if need be.
+func (r *StreamRelay) acquire(id string) *stream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.streams[id]
+	if !ok {
+		s = &stream{id: id, subscribers: make(map[*streamSubscriber]struct{})}
+		r.streams[id] = s
+	}
+	return s
+}
+
+// release forgets the stream once nobody's publishing or subscribed.
+func (r *StreamRelay) release(s *stream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.mu.RLock()
+	idle := !s.publishing && len(s.subscribers) == 0
+	s.mu.RUnlock()
+	if idle && r.streams[s.id] == s {
+		delete(r.streams, s.id)
+	}
+}
+
+// Info reports on the stream with id.
+func (r *StreamRelay) Info(id string) (*StreamInfo, error) {
+	r.mu.Lock()
+	s, ok := r.streams[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+	info := s.info()
+	return &info, nil
+}
+
+// List reports on every stream, by id.
+func (r *StreamRelay) List() []StreamInfo {
+	r.mu.Lock()
+	streams := make([]*stream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, s)
+	}
+	r.mu.Unlock()
+
+	infos := make([]StreamInfo, len(streams))
+	for i, s := range streams {
+		infos[i] = s.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+func (s *stream) info() StreamInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info := StreamInfo{
+		Id:          s.id,
+		Metadata:    s.metadata,
+		Publishing:  s.publishing,
+		Frames:      s.frames,
+		Bytes:       s.bytes,
+		Subscribers: make([]SubscriberInfo, 0, len(s.subscribers)),
+	}
+	if !s.updatedAt.IsZero() {
+		updatedAt := s.updatedAt
+		info.UpdatedAt = &updatedAt
+	}
+	for sub := range s.subscribers {
+		info.Subscribers = append(info.Subscribers, SubscriberInfo{
+			Remote:     sub.remote,
+			Policy:     sub.policy,
+			Sent:       atomic.LoadUint64(&sub.sent),
+			Dropped:    atomic.LoadUint64(&sub.dropped),
+			Decimation: int(atomic.LoadInt32(&sub.every)),
+		})
+	}
+	sort.Slice(info.Subscribers, func(i, j int) bool { return info.Subscribers[i].Remote < info.Subscribers[j].Remote })
+	return info
+}
+
+// setMetadata replaces the stream's metadata and passes it on to
+// every subscriber.
+func (s *stream) setMetadata(metadata protocol.StreamMetadata) error {
+	header, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = metadata
+	s.header = header
+	for sub := range s.subscribers {
+		sub.offerHeader(header)
+	}
+	return nil
+}
+
+// updateMetadata applies a publisher's JSON metadata update. Updates
+// replace the metadata entirely, except for the task producing the
+// stream, which is kept if the update leaves it out.
+func (s *stream) updateMetadata(raw []byte) error {
+	var metadata protocol.StreamMetadata
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return err
+	}
+	if err := normalizeStreamMetadata(&metadata); err != nil {
+		return err
+	}
+	if metadata.TaskId == "" {
+		s.mu.RLock()
+		metadata.TaskId = s.metadata.TaskId
+		s.mu.RUnlock()
+	}
+	return s.setMetadata(metadata)
+}
+
+// publish offers a frame to every subscriber.
+func (s *stream) publish(frame []byte) {
+	s.mu.Lock()
+	s.frames++
+	s.bytes += uint64(len(frame))
+	s.updatedAt = time.Now()
+	s.mu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for sub := range s.subscribers {
+		sub.offer(frame)
+	}
+}
+
+// offer queues a frame for the subscriber without ever blocking,
+// applying its backpressure policy if it's fallen behind.
+func (sub *streamSubscriber) offer(frame []byte) {
+	every := int(atomic.LoadInt32(&sub.every))
+	if sub.policy == StreamPolicyDecimate {
+		if len(sub.frames) == 0 && every > 1 {
+			// It's caught up; let it have more
+			every /= 2
+			atomic.StoreInt32(&sub.every, int32(every))
+		}
+		sub.skipped++
+		if sub.skipped < every {
+			atomic.AddUint64(&sub.dropped, 1)
+			return
+		}
+		sub.skipped = 0
+	}
+
+	select {
+	case sub.frames <- frame:
+	default:
+		atomic.AddUint64(&sub.dropped, 1)
+		if sub.policy == StreamPolicyDecimate && every < maxStreamDecimation {
+			atomic.StoreInt32(&sub.every, int32(every*2))
+		}
+	}
+}
+
+// offerHeader replaces any metadata the subscriber hasn't been sent yet.
+func (sub *streamSubscriber) offerHeader(header []byte) {
+	select {
+	case <-sub.header:
+	default:
+	}
+	sub.header <- header
+}
+
+// send writes the subscriber's frames to ws until it's done, sending
+// any new metadata ahead of the frames that follow it.
+func (sub *streamSubscriber) send(ws *websocket.Conn) error {
+	for {
+		select {
+		case header := <-sub.header:
+			if err := websocket.Message.Send(ws, string(header)); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+
+		select {
+		case <-sub.done:
+			return nil
+		case header := <-sub.header:
+			if err := websocket.Message.Send(ws, string(header)); err != nil {
+				return err
+			}
+		case frame := <-sub.frames:
+			if err := websocket.Message.Send(ws, frame); err != nil {
+				return err
+			}
+			atomic.AddUint64(&sub.sent, 1)
+		}
+	}
+}
+
+// streamFrame is a message received from a publisher; text messages
+// carry metadata and binary ones frames.
+type streamFrame struct {
+	data   []byte
+	binary bool
+}
+
+// streamCodec receives streamFrames, keeping track of which kind of
+// message each was.
+var streamCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		frame := v.(*streamFrame)
+		frame.data = data
+		frame.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// parseStreamMetadata reads a stream's initial metadata from the
+// publisher's query parameters.
+func parseStreamMetadata(params url.Values) (protocol.StreamMetadata, error) {
+	metadata := protocol.StreamMetadata{
+		TaskId: params.Get("task_id"),
+		Format: params.Get("format"),
+	}
+	floats := map[string]*float64{
+		"sample_rate": &metadata.SampleRate,
+		"xstart":      &metadata.XStart,
+		"xdelta":      &metadata.XDelta,
+	}
+	for name, field := range floats {
+		if value := params.Get(name); value != "" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return metadata, fmt.Errorf("%s must be a number", name)
+			}
+			*field = f
+		}
+	}
+	if value := params.Get("subsize"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return metadata, errors.New("subsize must be an integer")
+		}
+		metadata.Subsize = n
+	}
+	return metadata, normalizeStreamMetadata(&metadata)
+}
+
+// streamVisible reports whether the request's identity may see a
+// stream: any stream if it may read every task's status, otherwise
+// only streams of tasks it can see.
+func (a *Api) streamVisible(c echo.Context, info *StreamInfo) bool {
+	if identity := auth.FromContext(c); identity == nil || identity.Can(auth.PermStatusRead) {
+		return true
+	}
+	if info.Metadata.TaskId == "" {
+		return false
+	}
+	_, err := a.getVisibleStatus(c, info.Metadata.TaskId)
+	return err == nil
+}
+
+// GetStreams lists the streams being relayed that the request's
+// identity may see.
+func (a *Api) GetStreams(c echo.Context) error {
+	infos := []StreamInfo{}
+	for _, info := range a.Streams.List() {
+		if a.streamVisible(c, &info) {
+			infos = append(infos, info)
+		}
+	}
+	return c.JSON(http.StatusOK, infos)
+}
+
+// GetStream reports on a single stream: its metadata, how much it's
+// carried, and how each subscriber is keeping up.
+func (a *Api) GetStream(c echo.Context) error {
+	info, err := a.Streams.Info(c.Param("id"))
+	if err == nil && !a.streamVisible(c, info) {
+		err = ErrStreamNotFound
+	}
+	if err != nil {
+		return c.JSON(http.StatusNotFound, Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+// PublishStream is the websocket a worker publishes a stream on. The
+// stream's metadata comes from the query parameters (`task_id`,
+// `format`, `sample_rate`, `xstart`, `xdelta` and `subsize`) and any
+// JSON text messages the worker sends later; binary messages are
+// frames of samples, relayed as is. A stream has one publisher at a
+// time; others are turned away with a 409.
+func (a *Api) PublishStream(c echo.Context) error {
+	metadata, err := parseStreamMetadata(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+
+	s := a.Streams.acquire(c.Param("id"))
+	s.mu.Lock()
+	if s.publishing {
+		s.mu.Unlock()
+		return c.JSON(http.StatusConflict, Response{Msg: ErrStreamPublished.Error()})
+	}
+	s.publishing = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.publishing = false
+		s.mu.Unlock()
+		a.Streams.release(s)
+	}()
+	if err := s.setMetadata(metadata); err != nil {
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		ws.MaxPayloadBytes = a.Streams.MaxFrame
+		c.Logger().Infof("Publisher %s started stream %s", c.RealIP(), s.id)
+
+		for {
+			var frame streamFrame
+			err := streamCodec.Receive(ws, &frame)
+			if err == websocket.ErrFrameTooLarge {
+				c.Logger().Warnf("Dropping frame over %d bytes on stream %s", a.Streams.MaxFrame, s.id)
+				continue
+			}
+			if err != nil {
+				c.Logger().Infof("Publisher %s stopped stream %s: %v", c.RealIP(), s.id, err)
+				return
+			}
+			if frame.binary {
+				s.publish(frame.data)
+				continue
+			}
+
+			if err := s.updateMetadata(frame.data); err != nil {
+				c.Logger().Warnf("Ignoring bad metadata for stream %s: %v", s.id, err)
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// SubscribeStream is the websocket browsers watch a stream on, e.g.
+// with SigPlot's WPipeLayer. The client gets the stream's metadata as
+// a JSON text message, then each frame as a binary message. Clients
+// that can't keep up lose frames according to their `policy`:
+// StreamPolicyDrop (the default) or StreamPolicyDecimate. Identities
+// that may only see their own tasks can only subscribe to streams
+// already being published for one of them.
+func (a *Api) SubscribeStream(c echo.Context) error {
+	policy := c.QueryParam("policy")
+	switch policy {
+	case "":
+		policy = StreamPolicyDrop
+	case StreamPolicyDrop, StreamPolicyDecimate:
+	default:
+		msg := fmt.Sprintf("policy must be %s or %s", StreamPolicyDrop, StreamPolicyDecimate)
+		return c.JSON(http.StatusBadRequest, Response{Msg: msg})
+	}
+	if identity := auth.FromContext(c); identity != nil && !identity.Can(auth.PermStatusRead) {
+		info, err := a.Streams.Info(c.Param("id"))
+		if err != nil || !a.streamVisible(c, info) {
+			return c.JSON(http.StatusNotFound, Response{Msg: ErrStreamNotFound.Error()})
+		}
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		sub := &streamSubscriber{
+			remote: ws.Request().RemoteAddr,
+			policy: policy,
+			frames: make(chan []byte, a.Streams.Buffer),
+			header: make(chan []byte, 1),
+			done:   make(chan struct{}),
+			every:  1,
+		}
+		s := a.Streams.acquire(c.Param("id"))
+		s.mu.Lock()
+		if s.header != nil {
+			sub.header <- s.header
+		}
+		s.subscribers[sub] = struct{}{}
+		s.mu.Unlock()
+		c.Logger().Infof("Client %s subscribed to stream %s", sub.remote, s.id)
+
+		defer func() {
+			s.mu.Lock()
+			delete(s.subscribers, sub)
+			s.mu.Unlock()
+			a.Streams.release(s)
+		}()
+
+		// Anything the client sends is ignored; an error means it
+		// closed the connection
+		go func() {
+			defer close(sub.done)
+			for {
+				var msg []byte
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+			}
+		}()
+		if err := sub.send(ws); err != nil {
+			c.Logger().Infof("Client %s unsubscribed from stream %s: %v", sub.remote, s.id, err)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
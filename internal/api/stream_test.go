@@ -0,0 +1,358 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"golang.org/x/net/websocket"
+)
+
+func newTestSubscriber(policy string, buffer int) *streamSubscriber {
+	return &streamSubscriber{
+		policy: policy,
+		frames: make(chan []byte, buffer),
+		header: make(chan []byte, 1),
+		done:   make(chan struct{}),
+		every:  1,
+	}
+}
+
+func TestStreamOfferDrop(t *testing.T) {
+	sub := newTestSubscriber(StreamPolicyDrop, 4)
+	for i := 0; i < 10; i++ {
+		sub.offer([]byte{byte(i)})
+	}
+	// The first frames are kept; the ones that came while it was full
+	// are lost
+	if len(sub.frames) != 4 || sub.dropped != 6 || sub.every != 1 {
+		t.Fatalf("%d frames queued and %d dropped at 1 in %d, want 4 and 6 at 1 in 1", len(sub.frames), sub.dropped, sub.every)
+	}
+	for i := 0; i < 4; i++ {
+		if frame := <-sub.frames; frame[0] != byte(i) {
+			t.Errorf("frame %d is %d", i, frame[0])
+		}
+	}
+	sub.offer([]byte{10})
+	if frame := <-sub.frames; frame[0] != 10 || sub.dropped != 6 {
+		t.Errorf("after draining, got frame %d with %d dropped", frame[0], sub.dropped)
+	}
+}
+
+func TestStreamOfferDecimate(t *testing.T) {
+	sub := newTestSubscriber(StreamPolicyDecimate, 2)
+	for i := 0; i < 1000; i++ {
+		sub.offer([]byte{byte(i)})
+	}
+	// Every time the buffer was found full, the subscriber was sent
+	// half as many frames, down to the limit
+	if sub.every != maxStreamDecimation {
+		t.Errorf("stalled subscriber gets 1 frame in %d, want 1 in %d", sub.every, maxStreamDecimation)
+	}
+	if len(sub.frames) != 2 || sub.dropped != 998 {
+		t.Errorf("%d frames queued and %d dropped, want 2 and 998", len(sub.frames), sub.dropped)
+	}
+
+	// Once it catches up, it's sent twice as many each time it's
+	// found with nothing waiting
+	for want := int32(maxStreamDecimation / 2); want >= 1; want /= 2 {
+		for len(sub.frames) > 0 {
+			<-sub.frames
+		}
+		sub.offer(nil)
+		if sub.every != want {
+			t.Fatalf("caught up subscriber gets 1 frame in %d, want 1 in %d", sub.every, want)
+		}
+	}
+}
+
+// smallBufferListener gives the connections it accepts small send
+// buffers, so that a client that stops reading backs the relay up
+// after a frame or two, however large the system lets them grow.
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(4096)
+	}
+	return conn, err
+}
+
+// newStreamServer serves a stream relay with room for buffer frames
+// per subscriber.
+func newStreamServer(t *testing.T, buffer int) (*Api, *httptest.Server) {
+	t.Helper()
+	a := &Api{Streams: SetupStreamRelay(buffer, 0)}
+	e := echo.New()
+	e.GET("/api/streams/:id/publish", a.PublishStream)
+	e.GET("/api/streams/:id/ws", a.SubscribeStream)
+	srv := httptest.NewUnstartedServer(e)
+	srv.Listener = smallBufferListener{srv.Listener}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+func dialStream(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// receiveStream reads one message from a stream subscription.
+func receiveStream(t *testing.T, ws *websocket.Conn) streamFrame {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame streamFrame
+	if err := streamCodec.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// subscribers is how many clients are subscribed to stream id.
+func subscribers(a *Api, id string) int {
+	info, err := a.Streams.Info(id)
+	if err != nil {
+		return 0
+	}
+	return len(info.Subscribers)
+}
+
+func TestStreamHeaderBeforeFrames(t *testing.T) {
+	a, srv := newStreamServer(t, 0)
+
+	// One subscriber is waiting when the publisher starts, the other
+	// comes along after the frames have started
+	early := dialStream(t, srv, "/api/streams/s1/ws")
+	waitFor(t, "the early subscriber", func() bool { return subscribers(a, "s1") == 1 })
+	publisher := dialStream(t, srv, "/api/streams/s1/publish?sample_rate=1000&format=SF")
+	if err := websocket.Message.Send(publisher, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first frame", func() bool {
+		info, err := a.Streams.Info("s1")
+		return err == nil && info.Frames == 1
+	})
+	late := dialStream(t, srv, "/api/streams/s1/ws")
+	waitFor(t, "the late subscriber", func() bool { return subscribers(a, "s1") == 2 })
+	if err := websocket.Message.Send(publisher, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ws := range map[string]*websocket.Conn{"early": early, "late": late} {
+		header := receiveStream(t, ws)
+		var metadata protocol.StreamMetadata
+		if header.binary || json.Unmarshal(header.data, &metadata) != nil {
+			t.Fatalf("%s subscriber's first message is %q, want the metadata", name, header.data)
+		}
+		if metadata.Format != "SF" || metadata.XDelta != 0.001 {
+			t.Errorf("%s subscriber got metadata %+v", name, metadata)
+		}
+		if frame := receiveStream(t, ws); !frame.binary {
+			t.Errorf("%s subscriber's second message is %q, want a frame", name, frame.data)
+		}
+	}
+}
+
+func TestStreamSecondPublisher(t *testing.T) {
+	_, srv := newStreamServer(t, 0)
+	dialStream(t, srv, "/api/streams/s1/publish")
+
+	resp, err := http.Get(srv.URL + "/api/streams/s1/publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second publisher got %d, want 409", resp.StatusCode)
+	}
+	// Other streams are free
+	dialStream(t, srv, "/api/streams/s2/publish")
+}
+
+func TestStreamSlowSubscriber(t *testing.T) {
+	policies := []string{StreamPolicyDrop, StreamPolicyDecimate}
+	for i, policy := range policies {
+		t.Run(policy, func(t *testing.T) {
+			a, srv := newStreamServer(t, 8)
+			// The stalled subscriber never reads. The reading one has
+			// the other policy, which is how the two are told apart:
+			// frames can pile up for it too while the test is busy
+			// publishing them
+			dialStream(t, srv, "/api/streams/s1/ws?policy="+policy)
+			reader := dialStream(t, srv, "/api/streams/s1/ws?policy="+policies[1-i])
+			waitFor(t, "the subscribers", func() bool { return subscribers(a, "s1") == 2 })
+			publisher := dialStream(t, srv, "/api/streams/s1/publish")
+
+			// Large enough frames to fill the stalled connection's
+			// socket buffers and then its queue
+			const frames = 200
+			received := make(chan uint32, frames)
+			go func() {
+				defer close(received)
+				for {
+					var frame streamFrame
+					if err := streamCodec.Receive(reader, &frame); err != nil {
+						return
+					}
+					if frame.binary {
+						received <- binary.BigEndian.Uint32(frame.data)
+					}
+				}
+			}()
+			frame := make([]byte, 64<<10)
+			for i := 0; i < frames; i++ {
+				binary.BigEndian.PutUint32(frame, uint32(i))
+				publisher.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				if err := websocket.Message.Send(publisher, frame); err != nil {
+					t.Fatalf("publishing frame %d: %v", i, err)
+				}
+			}
+
+			// Every frame was either sent to or dropped for each
+			// subscriber but the stalled one, which is left with a
+			// full queue
+			var stalled, reading SubscriberInfo
+			waitFor(t, "every frame to be relayed", func() bool {
+				info, _ := a.Streams.Info("s1")
+				if info.Frames != frames || len(info.Subscribers) != 2 {
+					return false
+				}
+				stalled, reading = info.Subscribers[0], info.Subscribers[1]
+				if stalled.Policy != policy {
+					stalled, reading = reading, stalled
+				}
+				return reading.Sent+reading.Dropped == frames
+			})
+			if stalled.Policy != policy || stalled.Dropped == 0 {
+				t.Errorf("stalled subscriber is %+v, want one with policy %s dropping frames", stalled, policy)
+			}
+			if policy == StreamPolicyDecimate && stalled.Decimation <= 1 {
+				t.Errorf("stalled subscriber is sent 1 frame in %d", stalled.Decimation)
+			}
+
+			// The one reading got what it was sent, in order
+			if reading.Sent == 0 {
+				t.Fatal("the reading subscriber got no frames")
+			}
+			last := -1
+			for i := uint64(0); i < reading.Sent; i++ {
+				select {
+				case seq := <-received:
+					if int(seq) <= last {
+						t.Fatalf("frame %d came after %d", seq, last)
+					}
+					last = int(seq)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("received %d of the %d frames sent", i, reading.Sent)
+				}
+			}
+		})
+	}
+}
+
+// bearerIdentities authenticates bearer tokens that are the name of
+// one of its identities.
+type bearerIdentities map[string]*auth.Identity
+
+func (b bearerIdentities) Authenticate(r *http.Request) (*auth.Identity, error) {
+	identity, ok := b[strings.TrimPrefix(r.Header.Get(echo.HeaderAuthorization), "Bearer ")]
+	if !ok {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+func TestStreamVisibility(t *testing.T) {
+	a := &Api{DB: NewMemoryStore(), Streams: SetupStreamRelay(0, 0)}
+	identities := bearerIdentities{
+		"alice": {Subject: "alice", Roles: []string{auth.RoleRequester}},
+		"bob":   {Subject: "bob", Roles: []string{auth.RoleAnalyst}},
+	}
+	e := echo.New()
+	e.Use(auth.Middleware([]auth.Authenticator{identities}, func(c echo.Context) bool {
+		return strings.HasSuffix(c.Path(), "/publish")
+	}))
+	e.GET("/api/streams", a.GetStreams)
+	e.GET("/api/streams/:id", a.GetStream)
+	e.GET("/api/streams/:id/publish", a.PublishStream)
+	e.GET("/api/streams/:id/ws", a.SubscribeStream)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	alices := createTestTask(t, a.DB, Task{Type: "collect", Owner: "alice"})
+	carols := createTestTask(t, a.DB, Task{Type: "collect", Owner: "carol"})
+	dialStream(t, srv, "/api/streams/alices/publish?task_id="+alices)
+	dialStream(t, srv, "/api/streams/carols/publish?task_id="+carols)
+	dialStream(t, srv, "/api/streams/taskless/publish")
+
+	get := func(who string, path string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+who)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	tests := []struct {
+		who  string
+		want []string
+	}{
+		{"alice", []string{"alices"}},
+		{"bob", []string{"alices", "carols", "taskless"}},
+	}
+	for _, test := range tests {
+		var infos []StreamInfo
+		if err := json.NewDecoder(get(test.who, "/api/streams").Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.Id)
+		}
+		if strings.Join(ids, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s sees streams %v, want %v", test.who, ids, test.want)
+		}
+		for _, id := range []string{"alices", "carols", "taskless", "unpublished"} {
+			visible := false
+			for _, want := range test.want {
+				visible = visible || want == id
+			}
+			want := http.StatusNotFound
+			if visible {
+				want = http.StatusOK
+			}
+			if resp := get(test.who, "/api/streams/"+id); resp.StatusCode != want {
+				t.Errorf("%s got %d for stream %s, want %d", test.who, resp.StatusCode, id, want)
+			}
+			// Subscriptions they may make get as far as failing the
+			// websocket handshake of a plain GET
+			want = http.StatusBadRequest
+			if test.who == "alice" && !visible {
+				want = http.StatusNotFound
+			}
+			if resp := get(test.who, "/api/streams/"+id+"/ws"); resp.StatusCode != want {
+				t.Errorf("%s got %d subscribing to stream %s, want %d", test.who, resp.StatusCode, id, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/auth"
+)
+
+// APITokenRequest is the body of a request to create an API token.
+type APITokenRequest struct {
+	Name string `json:"name"`
+	// Roles are what the token is allowed to do
+	Roles []string `json:"roles"`
+	// ExpiresIn is how many seconds the token lasts; zero for one that
+	// doesn't expire
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// NewAPIToken is a newly created API token, including the token itself,
+// which isn't shown again.
+type NewAPIToken struct {
+	auth.APIToken
+	Token string `json:"token"`
+}
+
+// GetWhoami returns the Identity the request was authenticated as, or
+// 204 if authentication is off.
+func (a *Api) GetWhoami(c echo.Context) error {
+	identity := auth.FromContext(c)
+	if identity == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.JSON(http.StatusOK, identity)
+}
+
+// GetAPITokens lists the API tokens, without the tokens themselves.
+func (a *Api) GetAPITokens(c echo.Context) error {
+	tokens, err := a.DB.GetAllAPITokens()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// CreateAPIToken creates an API token for automation such as workers
+// and scripts to authenticate with. The token is in the response and
+// can't be looked up again; only its hash is stored.
+func (a *Api) CreateAPIToken(c echo.Context) error {
+	var request APITokenRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	var errs []FieldError
+	if request.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "is required"})
+	}
+	if len(request.Roles) == 0 {
+		errs = append(errs, FieldError{Field: "roles", Message: "needs at least one role"})
+	} else if err := auth.CheckRoles(request.Roles); err != nil {
+		errs = append(errs, FieldError{Field: "roles", Message: err.Error()})
+	}
+	if request.ExpiresIn < 0 {
+		errs = append(errs, FieldError{Field: "expires_in", Message: "can't be negative"})
+	}
+	if len(errs) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, Response{Msg: "Invalid API token", Errors: errs})
+	}
+
+	var expiresAt time.Time
+	if request.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(request.ExpiresIn) * time.Second)
+	}
+	record, token, err := auth.NewAPIToken(request.Name, request.Roles, actorOf(c), expiresAt)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+	if err := a.DB.CreateAPIToken(record); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusCreated, NewAPIToken{APIToken: record, Token: token})
+}
+
+// DeleteAPIToken revokes an API token.
+func (a *Api) DeleteAPIToken(c echo.Context) error {
+	id := c.Param("id")
+	if err := a.DB.DeleteAPIToken(id); err != nil {
+		c.Logger().Error(err)
+		return c.JSON(errorStatus(err), Response{Msg: err.Error()})
+	}
+	return c.JSON(http.StatusOK, Response{Msg: fmt.Sprintf("Successfully revoked API token %s", id)})
+}
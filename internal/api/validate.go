@@ -0,0 +1,338 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types a catalog parameter can have
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamFloat  = "float"
+	ParamBool   = "bool"
+	// ParamTime values are RFC 3339 timestamps, stored in UTC
+	ParamTime = "time"
+)
+
+// CatalogParameter defines one parameter of a task type. Default,
+// Min, Max and Enum are written as strings in the catalog XML and
+// interpreted according to Type.
+type CatalogParameter struct {
+	Name        string   `json:"name" xml:"name" bson:"name"`
+	Type        string   `json:"type" xml:"type" bson:"type"`
+	Description string   `json:"description,omitempty" xml:"description" bson:"description,omitempty"`
+	Required    bool     `json:"required,omitempty" xml:"required" bson:"required,omitempty"`
+	Default     string   `json:"default,omitempty" xml:"default" bson:"default,omitempty"`
+	Min         *float64 `json:"min,omitempty" xml:"min" bson:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty" xml:"max" bson:"max,omitempty"`
+	Enum        []string `json:"enum,omitempty" xml:"enum>value" bson:"enum,omitempty"`
+}
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned for requests with invalid fields.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return "invalid task: " + strings.Join(messages, "; ")
+}
+
+// validateTask checks task against its type's definition in catalog
+// and, if it's valid, fills in its resolved parameters: every value
+// converted to its declared type, with defaults for those left out.
+func validateTask(catalog *CatalogVersion, task *Task) error {
+	var errs []FieldError
+	if task.StopTime != 0 && task.StartTime != 0 && task.StopTime < task.StartTime {
+		errs = append(errs, FieldError{Field: "stop_time", Message: "must not be before start_time"})
+	}
+
+	if task.Type == "" {
+		errs = append(errs, FieldError{Field: "type", Message: "is required"})
+		return &ValidationError{Errors: errs}
+	}
+	entry, ok := catalog.Entry(task.Type)
+	if !ok {
+		errs = append(errs, FieldError{Field: "type", Message: fmt.Sprintf("unknown task type %q", task.Type)})
+		return &ValidationError{Errors: errs}
+	}
+	if entry.MaxDuration > 0 && task.StartTime != 0 && task.StopTime != 0 &&
+		task.StopTime.Time().Sub(task.StartTime.Time()) > time.Duration(entry.MaxDuration)*time.Second {
+		errs = append(errs, FieldError{
+			Field:   "stop_time",
+			Message: fmt.Sprintf("must be within %d seconds of start_time, the longest a %s task may run", entry.MaxDuration, task.Type),
+		})
+	}
+
+	resolved := make(map[string]interface{}, len(entry.Parameters))
+	defined := make(map[string]bool, len(entry.Parameters))
+	for _, param := range entry.Parameters {
+		defined[param.Name] = true
+		field := "parameters." + param.Name
+
+		raw, given := task.Parameters[param.Name]
+		if !given || raw == nil {
+			switch {
+			case param.Default != "":
+				value, err := param.parseDefault()
+				if err != nil {
+					// The catalog itself is wrong; say so rather than
+					// blaming the request
+					errs = append(errs, FieldError{Field: field, Message: "catalog default is invalid: " + err.Error()})
+					continue
+				}
+				resolved[param.Name] = value
+			case param.Required:
+				errs = append(errs, FieldError{Field: field, Message: "is required"})
+			}
+			continue
+		}
+
+		value, err := param.resolve(raw)
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: err.Error()})
+			continue
+		}
+		resolved[param.Name] = value
+	}
+
+	var unknown []string
+	for name := range task.Parameters {
+		if !defined[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{Field: "parameters." + name, Message: fmt.Sprintf("unknown parameter for task type %q", task.Type)})
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	task.Parameters = resolved
+	return nil
+}
+
+// validateUpdate checks changes to the parameters of a running task of
+// type taskType against its definition in catalog, returning them
+// resolved the same way validateTask resolves a new task's.
+func validateUpdate(catalog *CatalogVersion, taskType string, changes map[string]interface{}) (map[string]interface{}, error) {
+	if len(changes) == 0 {
+		return nil, &ValidationError{Errors: []FieldError{{Field: "parameters", Message: "must change at least one parameter"}}}
+	}
+	entry, ok := catalog.Entry(taskType)
+	if !ok {
+		return nil, &ValidationError{Errors: []FieldError{{Field: "type", Message: fmt.Sprintf("unknown task type %q", taskType)}}}
+	}
+	params := make(map[string]CatalogParameter, len(entry.Parameters))
+	for _, param := range entry.Parameters {
+		params[param.Name] = param
+	}
+
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []FieldError
+	resolved := make(map[string]interface{}, len(changes))
+	for _, name := range names {
+		field := "parameters." + name
+		param, ok := params[name]
+		if !ok {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("unknown parameter for task type %q", taskType)})
+			continue
+		}
+		if changes[name] == nil {
+			errs = append(errs, FieldError{Field: field, Message: "can't be removed from a running task"})
+			continue
+		}
+		value, err := param.resolve(changes[name])
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: err.Error()})
+			continue
+		}
+		resolved[name] = value
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	return resolved, nil
+}
+
+// checkParameterNames rejects parameter names that can't be stored
+// as field names: empty ones, ones containing `.` (which MongoDB would
+// take for a nested field) and ones starting with `$`. Parameters
+// checked against the catalog can only have the names it defines.
+func checkParameterNames(params map[string]interface{}) []FieldError {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []FieldError
+	for _, name := range names {
+		field := "parameters." + name
+		switch {
+		case name == "":
+			errs = append(errs, FieldError{Field: field, Message: "name must not be empty"})
+		case strings.Contains(name, "."):
+			errs = append(errs, FieldError{Field: field, Message: "name must not contain '.'"})
+		case strings.HasPrefix(name, "$"):
+			errs = append(errs, FieldError{Field: field, Message: "name must not start with '$'"})
+		}
+	}
+	return errs
+}
+
+// resolve converts a value decoded from JSON to the parameter's type
+// and checks it against the parameter's constraints.
+func (p CatalogParameter) resolve(raw interface{}) (interface{}, error) {
+	var value interface{}
+	switch p.Type {
+	case ParamString:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		value = s
+	case ParamInt:
+		f, ok := raw.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		// -2^63 is the only float64 at either end that fits an int64
+		if f >= 1<<63 || f < -1<<63 {
+			return nil, fmt.Errorf("must be between %d and %d", int64(math.MinInt64), int64(math.MaxInt64))
+		}
+		value = int64(f)
+	case ParamFloat:
+		f, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		value = f
+	case ParamBool:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		value = b
+	case ParamTime:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an RFC 3339 timestamp")
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("must be an RFC 3339 timestamp")
+		}
+		value = t.UTC().Format(time.RFC3339Nano)
+	default:
+		return nil, fmt.Errorf("has unsupported type %q in the catalog", p.Type)
+	}
+	return value, p.check(value)
+}
+
+// parseDefault converts the parameter's default from its catalog
+// string form. Defaults are subject to the same constraints as values.
+func (p CatalogParameter) parseDefault() (interface{}, error) {
+	var raw interface{} = p.Default
+	switch p.Type {
+	case ParamInt, ParamFloat:
+		f, err := strconv.ParseFloat(p.Default, 64)
+		if err != nil {
+			return nil, err
+		}
+		raw = f
+	case ParamBool:
+		b, err := strconv.ParseBool(p.Default)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+	return p.resolve(raw)
+}
+
+// check enforces the parameter's range and enum on a resolved value.
+func (p CatalogParameter) check(value interface{}) error {
+	var number float64
+	isNumber := true
+	switch v := value.(type) {
+	case int64:
+		number = float64(v)
+	case float64:
+		number = v
+	default:
+		isNumber = false
+	}
+	if isNumber {
+		if p.Min != nil && number < *p.Min {
+			return fmt.Errorf("must be at least %v", *p.Min)
+		}
+		if p.Max != nil && number > *p.Max {
+			return fmt.Errorf("must be at most %v", *p.Max)
+		}
+	}
+
+	if len(p.Enum) > 0 {
+		for _, allowed := range p.Enum {
+			if p.enumValue(allowed) == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(p.Enum, ", "))
+	}
+	return nil
+}
+
+// enumValue converts an enum entry from its catalog string form to
+// the parameter's type, so that "1.0" allows the int 1 and "1" allows
+// the float 1.0. Entries that don't convert allow nothing.
+func (p CatalogParameter) enumValue(allowed string) interface{} {
+	switch p.Type {
+	case ParamInt:
+		f, err := strconv.ParseFloat(allowed, 64)
+		if err != nil || f != math.Trunc(f) || f >= 1<<63 || f < -1<<63 {
+			return nil
+		}
+		return int64(f)
+	case ParamFloat:
+		f, err := strconv.ParseFloat(allowed, 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case ParamBool:
+		b, err := strconv.ParseBool(allowed)
+		if err != nil {
+			return nil
+		}
+		return b
+	case ParamTime:
+		t, err := time.Parse(time.RFC3339, allowed)
+		if err != nil {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return allowed
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveParameter(t *testing.T) {
+	tests := []struct {
+		param CatalogParameter
+		raw   interface{}
+		want  interface{}
+	}{
+		{CatalogParameter{Type: ParamInt}, 42.0, int64(42)},
+		{CatalogParameter{Type: ParamInt}, 4.5, nil},
+		{CatalogParameter{Type: ParamInt}, -9223372036854775808.0, int64(-1 << 63)},
+		// 2^63 is the first float64 past an int64
+		{CatalogParameter{Type: ParamInt}, 9223372036854775808.0, nil},
+		{CatalogParameter{Type: ParamInt}, 1e300, nil},
+		{CatalogParameter{Type: ParamInt}, -1e300, nil},
+		// Enums compare values, not how they're written
+		{CatalogParameter{Type: ParamInt, Enum: []string{"1.0", "2"}}, 1.0, int64(1)},
+		{CatalogParameter{Type: ParamInt, Enum: []string{"1.0", "2"}}, 3.0, nil},
+		{CatalogParameter{Type: ParamFloat, Enum: []string{"1", "2.50"}}, 2.5, 2.5},
+		{CatalogParameter{Type: ParamFloat, Enum: []string{"1", "2.50"}}, 1.0, 1.0},
+		{CatalogParameter{Type: ParamBool, Enum: []string{"TRUE"}}, true, true},
+		{CatalogParameter{Type: ParamBool, Enum: []string{"TRUE"}}, false, nil},
+		{CatalogParameter{Type: ParamTime, Enum: []string{"2026-03-01T13:00:00+01:00"}}, "2026-03-01T12:00:00Z", "2026-03-01T12:00:00Z"},
+		{CatalogParameter{Type: ParamString, Enum: []string{"iq", "real"}}, "iq", "iq"},
+		{CatalogParameter{Type: ParamString, Enum: []string{"iq", "real"}}, "IQ", nil},
+		// An enum entry that isn't of the parameter's type allows nothing
+		{CatalogParameter{Type: ParamInt, Enum: []string{"one"}}, 1.0, nil},
+	}
+	for _, test := range tests {
+		got, err := test.param.resolve(test.raw)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %v (enum %v): resolved to %v, want an error", test.param.Type, test.raw, test.param.Enum, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s %v (enum %v): got %v, %v; want %v", test.param.Type, test.raw, test.param.Enum, got, err, test.want)
+		}
+	}
+}
+
+func TestSubmitTaskWithoutCatalog(t *testing.T) {
+	a := &Api{DB: NewMemoryStore(), Catalog: &CatalogCache{}, Outbox: &OutboxRelay{}}
+	_, err := a.submitTask(Task{Type: "collect", Parameters: map[string]interface{}{"a.b": 1.0}}, "alice")
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "parameters.a.b" {
+		t.Fatalf("submitting a parameter named a.b: got %v", err)
+	}
+	if _, err := a.submitTask(Task{Type: "collect", Parameters: map[string]interface{}{"gain": 10.0}}, "alice"); err != nil {
+		t.Errorf("submitting without a catalog: %v", err)
+	}
+}
+
+func TestCheckParameterNames(t *testing.T) {
+	tests := []struct {
+		params map[string]interface{}
+		want   []string
+	}{
+		{map[string]interface{}{"gain": 10, "center_freq": 1e9}, nil},
+		{map[string]interface{}{"a.b": 1, "gain": 10}, []string{"parameters.a.b"}},
+		{map[string]interface{}{"$set": 1, "": 2}, []string{"parameters.", "parameters.$set"}},
+		{map[string]interface{}{"gain$": 1}, nil},
+	}
+	for _, test := range tests {
+		errs := checkParameterNames(test.params)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Field)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: rejected %v, want %v", test.params, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: rejected %v, want %v", test.params, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mrecachinas/dcserver/internal/bluefile"
+	"github.com/mrecachinas/dcserver/internal/dsp"
+)
+
+const (
+	defaultViewPoints = 2048
+	maxViewPoints     = 65536
+)
+
+// Output forms of views of recordings
+const (
+	// ViewOutputBlue is a BLUE file, which SigPlot can load like any
+	// other
+	ViewOutputBlue = "blue"
+	// ViewOutputRaw is bare little-endian float32s, described by the
+	// response's X-* headers
+	ViewOutputRaw = "raw"
+)
+
+// ErrInvalidView is returned for malformed requests for views of
+// recordings.
+var ErrInvalidView = errors.New("invalid view")
+
+// dataWindow is a window of a recording's elements.
+type dataWindow struct {
+	Offset int64
+	Count  int64
+}
+
+// parseDataWindow reads a window of the data described by header from
+// query parameters, given either by `start` and `stop`, in the data's x
+// units, or by `offset` and `count`, in elements. By default, it's all
+// of the data.
+func parseDataWindow(params url.Values, header *bluefile.Header) (dataWindow, error) {
+	window := dataWindow{Count: header.Elements}
+
+	byX := params.Get("start") != "" || params.Get("stop") != ""
+	byElement := params.Get("offset") != "" || params.Get("count") != ""
+	switch {
+	case byX && byElement:
+		return window, fmt.Errorf("%w: give either start and stop or offset and count", ErrInvalidView)
+	case byX:
+		if header.XDelta <= 0 {
+			return window, fmt.Errorf("%w: the file's xdelta is %v", ErrInvalidView, header.XDelta)
+		}
+		start, stop := header.XStart, header.XStart+float64(header.Elements)*header.XDelta
+		for name, bound := range map[string]*float64{"start": &start, "stop": &stop} {
+			if value := params.Get(name); value != "" {
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return window, fmt.Errorf("%w: %s must be a number", ErrInvalidView, name)
+				}
+				*bound = f
+			}
+		}
+		first := int64(math.Max(0, math.Floor((start-header.XStart)/header.XDelta)))
+		last := int64(math.Min(float64(header.Elements), math.Ceil((stop-header.XStart)/header.XDelta)))
+		if first >= last {
+			return window, fmt.Errorf("%w: no data from %v to %v", ErrInvalidView, start, stop)
+		}
+		window.Offset, window.Count = first, last-first
+	case byElement:
+		for name, field := range map[string]*int64{"offset": &window.Offset, "count": &window.Count} {
+			if value := params.Get(name); value != "" {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || n < 0 || (name == "count" && n == 0) {
+					return window, fmt.Errorf("%w: %s must be a whole number of elements", ErrInvalidView, name)
+				}
+				*field = n
+			}
+		}
+		if window.Offset >= header.Elements {
+			return window, fmt.Errorf("%w: offset %d is past the data's %d elements", ErrInvalidView, window.Offset, header.Elements)
+		}
+		if window.Count > header.Elements-window.Offset || params.Get("count") == "" {
+			window.Count = header.Elements - window.Offset
+		}
+	}
+	return window, nil
+}
+
+// parseViewOutput reads the `output` query parameter.
+func parseViewOutput(params url.Values) (string, error) {
+	switch value := params.Get("output"); value {
+	case "":
+		return ViewOutputBlue, nil
+	case ViewOutputBlue, ViewOutputRaw:
+		return value, nil
+	default:
+		return "", fmt.Errorf("%w: unknown output %q", ErrInvalidView, value)
+	}
+}
+
+// recording is an open window of a type 1000 BLUE file artifact.
+type recording struct {
+	Header *bluefile.Header
+	Window dataWindow
+	Data   *bluefile.DataReader
+
+	content io.Closer
+}
+
+func (r *recording) Close() error {
+	return r.content.Close()
+}
+
+// openRecording opens the window of a task's type 1000 BLUE file
+// artifact asked for by the request's query parameters. Only the window
+// is read from the artifact store.
+func (a *Api) openRecording(c echo.Context) (*recording, error) {
+	id, name := c.Param("id"), c.Param("name")
+	status, err := a.getVisibleStatus(c, id)
+	if err != nil {
+		return nil, err
+	}
+	artifact, ok := findArtifact(status, name)
+	if !ok {
+		return nil, ErrArtifactNotFound
+	}
+
+	ctx := c.Request().Context()
+	header, err := a.readArtifactHeader(ctx, id, artifact)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type/1000 != 1 {
+		return nil, fmt.Errorf("%w: only type 1000 files can be viewed, not type %d", ErrInvalidView, header.Type)
+	}
+	window, err := parseDataWindow(c.QueryParams(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := a.Artifacts.Open(ctx, artifactKey(id, name), artifact.Size)
+	if err != nil {
+		return nil, err
+	}
+	data, err := header.NewDataReader(content, window.Offset, window.Count)
+	if err != nil {
+		content.Close()
+		if errors.Is(err, bluefile.ErrUnsupportedFormat) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidView, err)
+		}
+		return nil, err
+	}
+	return &recording{Header: header, Window: window, Data: data, content: content}, nil
+}
+
+// XStart is the x of the first element of the window.
+func (r *recording) XStart() float64 {
+	return r.Header.XStart + float64(r.Window.Offset)*r.Header.XDelta
+}
+
+// timeCode is the BLUE timecode of x in the recording's data, if x is
+// in seconds.
+func (r *recording) timeCode(x float64) float64 {
+	if r.Header.TimeCode == 0 || r.Header.XUnits != 1 {
+		return 0
+	}
+	return r.Header.TimeCode + x - r.Header.XStart
+}
+
+// sendSignal replies with data described by header, as a BLUE file or,
+// for ViewOutputRaw, as bare data with its type 1000 or 2000 adjunct
+// header in X-* response headers.
+func sendSignal(c echo.Context, output string, header *bluefile.Header, data []byte) error {
+	if output == ViewOutputRaw {
+		response := c.Response().Header()
+		float := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+		response.Set("X-Format", header.Format)
+		response.Set("X-Xstart", float(header.XStart))
+		response.Set("X-Xdelta", float(header.XDelta))
+		response.Set("X-Xunits", strconv.Itoa(header.XUnits))
+		if header.Type/1000 == 2 {
+			response.Set("X-Subsize", strconv.Itoa(header.Subsize))
+			response.Set("X-Ystart", float(header.YStart))
+			response.Set("X-Ydelta", float(header.YDelta))
+			response.Set("X-Yunits", strconv.Itoa(header.YUnits))
+		}
+		return c.Blob(http.StatusOK, echo.MIMEOctetStream, data)
+	}
+
+	hcb, err := header.MarshalBinary()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+	return c.Blob(http.StatusOK, echo.MIMEOctetStream, append(hcb, data...))
+}
+
+// recordingError replies with an error from opening or reading a
+// recording.
+func recordingError(c echo.Context, err error) error {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		c.Logger().Error(err)
+	}
+	return c.JSON(status, Response{Msg: err.Error()})
+}
+
+// dataView is a requested decimated view of a recording.
+type dataView struct {
+	Points int
+	Method string
+	Output string
+}
+
+// parseDataView reads a dataView from query parameters: at most how
+// many `points` to return, the decimation `method` and the `output`
+// form.
+func parseDataView(params url.Values) (*dataView, error) {
+	view := &dataView{Points: defaultViewPoints, Method: dsp.MethodMinMax}
+	if value := params.Get("points"); value != "" {
+		points, err := strconv.Atoi(value)
+		if err != nil || points < 2 || points > maxViewPoints {
+			return nil, fmt.Errorf("%w: points must be a number from 2 to %d", ErrInvalidView, maxViewPoints)
+		}
+		view.Points = points
+	}
+	if value := params.Get("method"); value != "" {
+		switch value {
+		case dsp.MethodMinMax, dsp.MethodStride, dsp.MethodMean:
+			view.Method = value
+		default:
+			return nil, fmt.Errorf("%w: unknown method %q", ErrInvalidView, value)
+		}
+	}
+	output, err := parseViewOutput(params)
+	view.Output = output
+	return view, err
+}
+
+// GetArtifactView returns a decimated view of a window of a type 1000
+// BLUE file artifact, so a recording can be plotted without
+// downloading all of it. The window is binned down to at most `points`
+// elements by min/max envelope (the default), stride or mean, and
+// returned as a single-precision BLUE file SigPlot can load, or as raw
+// float32s with `output=raw`.
+func (a *Api) GetArtifactView(c echo.Context) error {
+	view, err := parseDataView(c.QueryParams())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{Msg: err.Error()})
+	}
+	rec, err := a.openRecording(c)
+	if err != nil {
+		return recordingError(c, err)
+	}
+	defer rec.Close()
+
+	// Bin the window so the output has at most view.Points elements;
+	// there's nothing to decimate if it's already that small
+	bins := int64(view.Points / dsp.PointsPerBin(view.Method))
+	factor := 1 + (rec.Window.Count-1)/bins
+	if factor <= 1 {
+		factor, view.Method = 1, dsp.MethodStride
+	}
+	decimator, err := dsp.NewDecimator(view.Method, factor, rec.Data.Components())
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, Response{Msg: err.Error()})
+	}
+	values := make([]float64, rec.Data.Components())
+	for {
+		err := rec.Data.ReadElement(values)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			return c.JSON(http.StatusBadGateway, Response{Msg: err.Error()})
+		}
+		decimator.Add(values)
+	}
+	decimator.Flush()
+
+	header := rec.Header
+	xstart := rec.XStart()
+	xdelta := header.XDelta * float64(factor) / float64(dsp.PointsPerBin(view.Method))
+	if view.Method == dsp.MethodMean {
+		// Averages are of the middle of their bins
+		xstart += header.XDelta * float64(factor-1) / 2
+	}
+	data := bluefile.EncodeFloat32(decimator.Output(), binary.LittleEndian)
+
+	out := bluefile.NewHeader(1000, header.Format[:1]+"F", int64(len(data)), []bluefile.Keyword{
+		{Name: "DECIMATION", Type: "A", Value: strconv.FormatInt(factor, 10)},
+		{Name: "METHOD", Type: "A", Value: view.Method},
+		{Name: "OFFSET", Type: "A", Value: strconv.FormatInt(rec.Window.Offset, 10)},
+	})
+	out.XStart, out.XDelta, out.XUnits = xstart, xdelta, header.XUnits
+	out.TimeCode = rec.timeCode(xstart)
+
+	response := c.Response().Header()
+	response.Set("X-Decimation", strconv.FormatInt(factor, 10))
+	response.Set("X-Method", view.Method)
+	return sendSignal(c, view.Output, out, data)
+}
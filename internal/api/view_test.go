@@ -0,0 +1,53 @@
+package api
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/mrecachinas/dcserver/internal/bluefile"
+)
+
+func TestParseDataWindow(t *testing.T) {
+	header := &bluefile.Header{Elements: 100, XStart: 10, XDelta: 0.5}
+	tests := []struct {
+		query string
+		want  dataWindow
+		err   bool
+	}{
+		{"", dataWindow{0, 100}, false},
+		{"offset=10&count=20", dataWindow{10, 20}, false},
+		{"offset=10", dataWindow{10, 90}, false},
+		{"count=20", dataWindow{0, 20}, false},
+		{"offset=90&count=20", dataWindow{90, 10}, false},
+		// offset+count would overflow
+		{"offset=1&count=" + strconv.FormatInt(math.MaxInt64, 10), dataWindow{1, 99}, false},
+		{"offset=99&count=" + strconv.FormatInt(math.MaxInt64, 10), dataWindow{99, 1}, false},
+		{"start=12&stop=17", dataWindow{4, 10}, false},
+		{"start=0", dataWindow{0, 100}, false},
+		{"stop=1e300", dataWindow{0, 100}, false},
+		{"offset=100", dataWindow{}, true},
+		{"offset=-1", dataWindow{}, true},
+		{"count=0", dataWindow{}, true},
+		{"count=x", dataWindow{}, true},
+		{"offset=" + strconv.FormatUint(math.MaxUint64, 10), dataWindow{}, true},
+		{"start=70", dataWindow{}, true},
+		{"start=12&count=5", dataWindow{}, true},
+	}
+	for _, test := range tests {
+		params, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		window, err := parseDataWindow(params, header)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%q: window %+v, want an error", test.query, window)
+		case !test.err && err != nil:
+			t.Errorf("%q: %v", test.query, err)
+		case !test.err && window != test.want:
+			t.Errorf("%q: window %+v, want %+v", test.query, window, test.want)
+		}
+	}
+}
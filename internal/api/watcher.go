@@ -0,0 +1,511 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/websocket"
+)
+
+// statusEventBacklog is the number of recent events kept in memory
+// so reconnecting clients can resume without a full snapshot.
+const statusEventBacklog = 1024
+
+// Server error codes returned when change streams can't be used
+// (e.g., a standalone mongod) or when a resume token has fallen
+// off the oplog.
+const (
+	mongoErrIllegalOperation        = 20
+	mongoErrChangeStreamFatal       = 280
+	mongoErrChangeStreamHistoryLost = 286
+	mongoErrChangeStreamReplicaSet  = 40573
+)
+
+var errChangeStreamsUnsupported = errors.New("change streams are not supported by this deployment")
+
+// StatusWatcher is the single, server-wide watcher on the tasks collection.
+// It turns changes into StatusEvents and broadcasts them to every
+// subscriber in the WebsocketConnectionPool. It prefers MongoDB change
+// streams and falls back to polling when they aren't available (or
+// the store isn't MongoDB).
+type StatusWatcher struct {
+	sync.RWMutex
+	DB       Store
+	Pool     *WebsocketConnectionPool
+	Catalog  *CatalogCache
+	Interval time.Duration
+
+	// epoch distinguishes resume tokens handed out by this watcher
+	// from those handed out before a restart or resync.
+	epoch   int64
+	seq     uint64
+	backlog []StatusEvent
+	// owners are the owners of the unfinished tasks the watcher has
+	// seen, for telling who may hear of their deletion. Finished tasks
+	// are forgotten, so it doesn't grow with the task history.
+	owners map[string]string
+}
+
+// SetupStatusWatcher creates a StatusWatcher that broadcasts to pool,
+// sending new subscribers catalog's tasks along with their statuses.
+// interval is only used when falling back to polling.
+func SetupStatusWatcher(db Store, pool *WebsocketConnectionPool, catalog *CatalogCache, interval time.Duration) *StatusWatcher {
+	return &StatusWatcher{
+		DB:       db,
+		Pool:     pool,
+		Catalog:  catalog,
+		Interval: interval,
+		epoch:    time.Now().UnixNano(),
+		owners:   make(map[string]string),
+	}
+}
+
+// Run watches the tasks collection until ctx is cancelled.
+func (w *StatusWatcher) Run(ctx context.Context) {
+	mongoStore, ok := w.DB.(*MongoStore)
+	if !ok {
+		w.poll(ctx)
+		return
+	}
+
+	var resumeToken bson.Raw
+	backoff := time.Second
+	for restarted := false; ctx.Err() == nil; restarted = true {
+		opened, err := w.watchChangeStream(ctx, mongoStore, &resumeToken, restarted)
+		if errors.Is(err, errChangeStreamsUnsupported) {
+			log.Infof("Change streams unavailable; polling tasks every %s", w.Interval)
+			w.poll(ctx)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Change stream on tasks failed: %v", err)
+		}
+		if opened {
+			// The stream was up, so this is a fresh failure
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// watchChangeStream opens a change stream on the tasks collection and
+// publishes every insert, update, replace and delete until an error
+// occurs, reporting whether the stream opened at all. resumeToken is
+// updated as the stream goes so a restarted stream picks up where this
+// one left off. A restarted stream that has no resume token to pick up
+// from may have missed changes, so every client is resynced.
+func (w *StatusWatcher) watchChangeStream(ctx context.Context, db *MongoStore, resumeToken *bson.Raw, restarted bool) (bool, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+		}}},
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	resuming := *resumeToken != nil
+	if resuming {
+		opts.SetResumeAfter(*resumeToken)
+	}
+
+	stream, err := db.Collection("tasks").Watch(ctx, pipeline, opts)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) {
+			switch cmdErr.Code {
+			case mongoErrIllegalOperation, mongoErrChangeStreamReplicaSet:
+				return false, errChangeStreamsUnsupported
+			case mongoErrChangeStreamFatal, mongoErrChangeStreamHistoryLost:
+				// Our resume point is gone, so the next stream starts
+				// over, and resyncs everyone
+				*resumeToken = nil
+			}
+		}
+		return false, err
+	}
+	defer stream.Close(context.Background())
+	// Keep the stream's place from the start, in case it fails before
+	// any event comes through
+	if token := stream.ResumeToken(); token != nil {
+		*resumeToken = token
+	}
+	if restarted && !resuming {
+		w.Resync()
+	}
+
+	for stream.Next(ctx) {
+		var change struct {
+			OperationType string `bson:"operationType"`
+			DocumentKey   struct {
+				Id primitive.ObjectID `bson:"_id"`
+			} `bson:"documentKey"`
+			FullDocument *Status `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			return true, err
+		}
+		*resumeToken = stream.ResumeToken()
+
+		event := StatusEvent{Id: change.DocumentKey.Id.Hex()}
+		switch change.OperationType {
+		case "insert":
+			event.Type = StatusEventInsert
+		case "update", "replace":
+			event.Type = StatusEventUpdate
+		case "delete":
+			event.Type = StatusEventDelete
+		}
+		if event.Type != StatusEventDelete {
+			// With UpdateLookup, the document may already be gone by the
+			// time we look it up; the delete event will follow.
+			if change.FullDocument == nil {
+				continue
+			}
+			event.Status = change.FullDocument
+		}
+		w.Publish(event)
+	}
+	if token := stream.ResumeToken(); token != nil {
+		*resumeToken = token
+	}
+	return true, stream.Err()
+}
+
+// poll is the fallback for deployments without change streams. It
+// re-reads the tasks collection every Interval and publishes the
+// difference from the previous read.
+func (w *StatusWatcher) poll(ctx context.Context) {
+	var previous map[primitive.ObjectID][]byte
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		statusList, err := w.DB.GetAllStatus()
+		if err != nil {
+			log.Errorf("Error polling tasks: %v", err)
+		} else {
+			w.rememberOwners(*statusList)
+			current := make(map[primitive.ObjectID][]byte, len(*statusList))
+			for i := range *statusList {
+				status := &(*statusList)[i]
+				raw, err := bson.Marshal(status)
+				if err != nil {
+					log.Errorf("Error encoding status %s: %v", status.Id.Hex(), err)
+					continue
+				}
+				current[status.Id] = raw
+
+				// The first read only seeds the comparison
+				if previous == nil {
+					continue
+				}
+				if old, ok := previous[status.Id]; !ok {
+					w.Publish(StatusEvent{Type: StatusEventInsert, Id: status.Id.Hex(), Status: status})
+				} else if !bytes.Equal(old, raw) {
+					w.Publish(StatusEvent{Type: StatusEventUpdate, Id: status.Id.Hex(), Status: status})
+				}
+			}
+			for id := range previous {
+				if _, ok := current[id]; !ok {
+					w.Publish(StatusEvent{Type: StatusEventDelete, Id: id.Hex()})
+				}
+			}
+			previous = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Publish assigns the event a resume token, remembers it for
+// reconnecting clients and broadcasts it to the subscribers
+// it concerns.
+func (w *StatusWatcher) Publish(event StatusEvent) {
+	event.Version = WebsocketVersion
+	if event.Status != nil {
+		event.List = event.Status.State.List()
+	}
+
+	w.Lock()
+	if event.Status != nil {
+		w.rememberOwner(event.Id, event.Status)
+	} else if event.Type == StatusEventDelete {
+		event.owner = w.owners[event.Id]
+		delete(w.owners, event.Id)
+	}
+	w.seq++
+	event.ResumeToken = w.token()
+	w.backlog = append(w.backlog, event)
+	if len(w.backlog) > statusEventBacklog {
+		w.backlog = w.backlog[len(w.backlog)-statusEventBacklog:]
+	}
+	w.Unlock()
+
+	w.Pool.SendEventToPool(event)
+}
+
+// Resync invalidates every outstanding resume token and sends a
+// fresh snapshot to every subscriber. It is used when the watcher
+// can't guarantee it saw every change. A subscriber whose snapshot
+// can't be taken is disconnected, to start over when it reconnects.
+func (w *StatusWatcher) Resync() {
+	w.Lock()
+	w.epoch = time.Now().UnixNano()
+	w.seq = 0
+	w.backlog = nil
+	w.Unlock()
+
+	w.Pool.RLock()
+	subscribers := make(map[*websocket.Conn]*StatusQuery, len(w.Pool.Connections))
+	for connection, subscriber := range w.Pool.Connections {
+		subscribers[connection] = subscriber.Query
+	}
+	w.Pool.RUnlock()
+
+	for connection, query := range subscribers {
+		if err := w.sendSnapshot(connection, query, false); err != nil {
+			log.Errorf("Error taking snapshot for resync: %v", err)
+			w.Pool.CloseWebsocketConnection(connection)
+		}
+	}
+}
+
+// Subscribe adds ws to the pool, to be sent changes to the tasks
+// matching query's filter. If resumeToken is still covered by the
+// backlog, only the events the client missed are replayed; otherwise the
+// client is sent a snapshot of query's first page first. Events are
+// idempotent, so a client may see a change both in its snapshot and as
+// an event.
+func (w *StatusWatcher) Subscribe(ws *websocket.Conn, resumeToken string, query *StatusQuery) error {
+	// Holding the pool lock blocks broadcasts until ws is registered,
+	// so nothing published after the replay is missed.
+	w.Pool.Lock()
+	if events, ok := w.since(resumeToken); ok {
+		subscriber := w.Pool.add(ws, query)
+		for _, event := range events {
+			if event, ok := eventFor(event, query); ok {
+				subscriber.enqueue(event)
+			}
+		}
+		w.Pool.Unlock()
+		return nil
+	}
+	w.Pool.Unlock()
+
+	return w.sendSnapshot(ws, query, true)
+}
+
+// snapshotAttempts is how many times sendSnapshot takes a snapshot
+// when the watcher resyncs while it's being taken.
+const snapshotAttempts = 3
+
+// sendSnapshot queues a snapshot of query for ws, followed by the
+// events published while it was being taken, so that ws misses none.
+// The snapshot is taken without holding the pool lock, so broadcasts
+// carry on meanwhile. With add, ws is added to the pool; otherwise it
+// must already be in it, and nothing is sent if it has since left.
+func (w *StatusWatcher) sendSnapshot(ws *websocket.Conn, query *StatusQuery, add bool) error {
+	for attempt := 0; attempt < snapshotAttempts; attempt++ {
+		snapshot, err := w.snapshot(query)
+		if err != nil {
+			return err
+		}
+
+		w.Pool.Lock()
+		events, ok := w.since(snapshot.ResumeToken)
+		if !ok {
+			// The watcher resynced; the snapshot may be missing changes
+			w.Pool.Unlock()
+			continue
+		}
+		subscriber, found := w.Pool.Connections[ws]
+		if add {
+			subscriber = w.Pool.add(ws, query)
+		} else if !found {
+			w.Pool.Unlock()
+			return nil
+		}
+		subscriber.enqueue(snapshot)
+		for _, event := range events {
+			if event, ok := eventFor(event, query); ok {
+				subscriber.enqueue(event)
+			}
+		}
+		w.Pool.Unlock()
+		return nil
+	}
+	return errors.New("the watcher kept resyncing while taking a snapshot")
+}
+
+// snapshot reads the statuses matching query, split into every active
+// one (up to the most a query returns) and its first page of
+// historical ones, along with the catalog and the resume token that
+// incremental updates should continue from.
+func (w *StatusWatcher) snapshot(query *StatusQuery) (*StatusSnapshot, error) {
+	w.RLock()
+	token := w.token()
+	w.RUnlock()
+
+	snapshot := &StatusSnapshot{
+		Version:     WebsocketVersion,
+		Type:        StatusEventSnapshot,
+		ResumeToken: token,
+		Status:      StatusLists{Active: []Status{}, Historical: []Status{}},
+		Tasks:       []CatalogEntry{},
+		Counts:      make(map[State]int64),
+	}
+
+	first := *query
+	first.Cursor = ""
+	if active, ok := first.restrictStates(activeStates); ok {
+		active.Limit = maxStatusLimit
+		page, err := w.DB.QueryStatus(active)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Status.Active = page.Status
+		for state, count := range page.Counts {
+			snapshot.Counts[state] = count
+		}
+	}
+	if historical, ok := first.restrictStates(historicalStates); ok {
+		page, err := w.DB.QueryStatus(historical)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Status.Historical = page.Status
+		snapshot.HistoricalCursor = page.NextCursor
+		for state, count := range page.Counts {
+			snapshot.Counts[state] = count
+		}
+	}
+
+	w.rememberOwners(snapshot.Status.Active)
+	w.rememberOwners(snapshot.Status.Historical)
+
+	if catalog, err := w.Catalog.Current(); err == nil {
+		snapshot.Tasks = catalog.Entries
+	}
+	return snapshot, nil
+}
+
+// rememberOwners records the owners of statuses, so that deletes of
+// tasks the watcher hasn't seen change since it started can still be
+// sent to those who may see them.
+func (w *StatusWatcher) rememberOwners(statuses []Status) {
+	w.Lock()
+	defer w.Unlock()
+	for i := range statuses {
+		w.rememberOwner(statuses[i].Id.Hex(), &statuses[i])
+	}
+}
+
+// rememberOwner records the owner of the task with id while it's
+// unfinished, and forgets it once it's finished. The caller must hold
+// the lock.
+func (w *StatusWatcher) rememberOwner(id string, status *Status) {
+	if status.State.IsTerminal() {
+		delete(w.owners, id)
+		return
+	}
+	w.owners[id] = status.Owner
+}
+
+// eventFor adapts event to a subscriber's query. Changes that take a
+// task out of its filter become StatusEventRemove, and tasks that were
+// never in it are left out (false). Tasks don't change owner, so
+// subscribers that may only see their own never hear of anyone else's,
+// including their deletion; deletes of tasks whose owner the watcher
+// never learned, or forgot when they finished, only go to subscribers
+// who may see every task.
+func eventFor(event StatusEvent, query *StatusQuery) (StatusEvent, bool) {
+	if event.Status == nil {
+		return event, query.Owner == "" || event.owner == query.Owner
+	}
+	if query.Matches(event.Status) {
+		return event, true
+	}
+	if event.Type == StatusEventInsert || query.Owner != "" && event.Status.Owner != query.Owner {
+		return event, false
+	}
+	return StatusEvent{
+		Version:     event.Version,
+		Type:        StatusEventRemove,
+		ResumeToken: event.ResumeToken,
+		Id:          event.Id,
+	}, true
+}
+
+// since returns the events published after resumeToken, or false if
+// they're no longer (or were never) available.
+func (w *StatusWatcher) since(resumeToken string) ([]StatusEvent, bool) {
+	epoch, seq, err := parseResumeToken(resumeToken)
+	if err != nil {
+		return nil, false
+	}
+
+	w.RLock()
+	defer w.RUnlock()
+	if epoch != w.epoch || seq > w.seq {
+		return nil, false
+	}
+	if seq == w.seq {
+		return nil, true
+	}
+	if len(w.backlog) == 0 || w.backlog[0].seq() > seq+1 {
+		return nil, false
+	}
+	start := len(w.backlog) - int(w.seq-seq)
+	return append([]StatusEvent(nil), w.backlog[start:]...), true
+}
+
+// token must be called with w locked.
+func (w *StatusWatcher) token() string {
+	return fmt.Sprintf("%d-%d", w.epoch, w.seq)
+}
+
+func parseResumeToken(token string) (int64, uint64, error) {
+	parts := strings.SplitN(token, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed resume token %q", token)
+	}
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return epoch, seq, nil
+}
+
+// seq recovers the sequence number from an event's resume token.
+func (e StatusEvent) seq() uint64 {
+	_, seq, _ := parseResumeToken(e.ResumeToken)
+	return seq
+}
@@ -3,72 +3,135 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"golang.org/x/net/websocket"
 )
 
-// UpdaterWebsocket handles broadcasting updates to the database;
-// Note: this just means querying the collection every
-// `api.Cfg.PollingInterval` seconds and returning the *entire*
-// contents of the collection.
+// UpdaterWebsocket subscribes the client to the server-wide StatusWatcher.
+// It takes the same filters as /api/status, and the message version
+// (`v`) the client speaks. The client first gets a snapshot of the
+// matching tasks, split into active and historical, and the task
+// catalog (or, if it passes a still-valid `resume_token`, just the
+// events it missed) and then every insert, update and delete to
+// matching tasks as it happens. Identities that may only see their own
+// tasks only ever hear about those.
 func (a *Api) UpdaterWebsocket(c echo.Context) error {
+	if v := c.QueryParam("v"); v != "" && v != strconv.Itoa(WebsocketVersion) {
+		msg := fmt.Sprintf("unsupported websocket version %s; this server speaks version %d", v, WebsocketVersion)
+		return c.String(http.StatusBadRequest, msg)
+	}
+	query, err := ParseStatusQuery(c.QueryParams())
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	restrictToVisible(c, query)
+
 	websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
 
-		// Create a new connection entry in our connection map
-		a.Websocket.Lock()
-		a.Websocket.Connections[ws] = struct{}{}
+		if err := a.Watcher.Subscribe(ws, c.QueryParam("resume_token"), query); err != nil {
+			c.Logger().Error(err)
+			c.Logger().Error("Error subscribing client to status updates")
+			return
+		}
 		defer a.Websocket.CloseWebsocketConnection(ws)
-		a.Websocket.Unlock()
 
+		a.Websocket.RLock()
 		msg := fmt.Sprintf(
 			"Client %s joined. %d total connections.",
 			c.Request().Host,
 			len(a.Websocket.Connections),
 		)
+		a.Websocket.RUnlock()
 		c.Logger().Info(msg)
 
-		delay := time.Duration(a.Cfg.PollingInterval) * time.Second
-
-		// TODO: Make error handling/logging more useful? Break if error occurs?
-		for range time.Tick(delay) {
-			go func() {
-				// Get ALL records every N seconds
-				statusList, err := a.DB.GetAllStatus()
-				if err != nil {
-					c.Logger().Error("Error getting all status from database")
-				}
-
-				// Broadcast result to all connections
-				err = a.Websocket.SendMessageToPool(statusList)
-				if err != nil {
-					c.Logger().Error(err)
-					c.Logger().Error("Error sending message to pool")
-				}
-
-				// Read inbound websocket messages;
-				// if we get an error back, that means the client
-				// closed the connection
-				msg := ""
-				err = websocket.Message.Receive(ws, &msg)
-				if err != nil {
-					msg := fmt.Sprintf(
-						"Client %s quitting. %d connections remain.",
-						c.Request().Host,
-						len(a.Websocket.Connections),
-					)
-					c.Logger().Error(err)
-					c.Logger().Info(msg)
-					return
-				}
-			}()
+		// Read inbound websocket messages until we get an error back,
+		// which means the client closed the connection
+		for {
+			msg := ""
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				c.Logger().Infof("Client %s quitting: %v", c.Request().Host, err)
+				return
+			}
 		}
 	}).ServeHTTP(c.Response(), c.Request())
 	return nil
 }
 
+// A websocket subscriber that falls websocketSendBuffer messages
+// behind, or takes longer than websocketWriteTimeout to accept one, is
+// stalled (e.g. a suspended browser tab) and gets disconnected, rather
+// than holding up everyone else. It can resume where it left off when
+// it reconnects.
+const websocketSendBuffer = 256
+
+var websocketWriteTimeout = 10 * time.Second
+
+// WebsocketSubscriber is a connection in the pool: the query it
+// subscribed with and the messages queued for it, which its own
+// goroutine writes so that a slow client only delays itself.
+type WebsocketSubscriber struct {
+	Query   *StatusQuery
+	conn    *websocket.Conn
+	send    chan interface{}
+	dropped chan struct{}
+	drop    sync.Once
+}
+
+// add registers connection with query and starts writing its queue.
+// The pool must be locked.
+func (pool *WebsocketConnectionPool) add(connection *websocket.Conn, query *StatusQuery) *WebsocketSubscriber {
+	subscriber := &WebsocketSubscriber{
+		Query:   query,
+		conn:    connection,
+		send:    make(chan interface{}, websocketSendBuffer),
+		dropped: make(chan struct{}),
+	}
+	pool.Connections[connection] = subscriber
+	go subscriber.write()
+	return subscriber
+}
+
+// write sends the subscriber's queued messages until the queue is
+// closed. If a write fails or times out, or the subscriber falls too
+// far behind, the connection is closed, which ends the client's read
+// loop and so removes it from the pool.
+func (s *WebsocketSubscriber) write() {
+	defer s.conn.Close()
+	for {
+		select {
+		case message, ok := <-s.send:
+			if !ok {
+				return
+			}
+			s.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err := websocket.JSON.Send(s.conn, message); err != nil {
+				return
+			}
+		case <-s.dropped:
+			return
+		}
+	}
+}
+
+// enqueue queues message for the subscriber without blocking, dropping
+// the subscriber if its queue is full. The pool must be (read) locked,
+// which keeps the queue from being closed meanwhile.
+func (s *WebsocketSubscriber) enqueue(message interface{}) {
+	select {
+	case s.send <- message:
+	default:
+		// Closing the connection here would wait for a write that's
+		// stuck, so leave it to the writer
+		s.drop.Do(func() { close(s.dropped) })
+	}
+}
+
 // SendMessageToPool sends a message to every connection
 func (pool *WebsocketConnectionPool) SendMessageToPool(message interface{}) error {
 	jsonMsg, err := json.Marshal(&message)
@@ -78,13 +141,24 @@ func (pool *WebsocketConnectionPool) SendMessageToPool(message interface{}) erro
 
 	pool.RLock()
 	defer pool.RUnlock()
-	for connection := range pool.Connections {
-		// TODO: What to do when this errors?
-		if err := websocket.Message.Send(connection, string(jsonMsg)); err != nil {
+	for _, subscriber := range pool.Connections {
+		subscriber.enqueue(json.RawMessage(jsonMsg))
+	}
+	return nil
+}
+
+// SendEventToPool sends a status event to every connection whose
+// query it concerns.
+func (pool *WebsocketConnectionPool) SendEventToPool(event StatusEvent) {
+	pool.RLock()
+	defer pool.RUnlock()
+	for _, subscriber := range pool.Connections {
+		event, ok := eventFor(event, subscriber.Query)
+		if !ok {
 			continue
 		}
+		subscriber.enqueue(event)
 	}
-	return nil
 }
 
 // CloseWebsocketConnection closes a single websocket connection and
@@ -92,6 +166,9 @@ func (pool *WebsocketConnectionPool) SendMessageToPool(message interface{}) erro
 func (pool *WebsocketConnectionPool) CloseWebsocketConnection(connection *websocket.Conn) {
 	pool.Lock()
 	connection.Close()
-	delete(pool.Connections, connection)
+	if subscriber, ok := pool.Connections[connection]; ok {
+		close(subscriber.send)
+		delete(pool.Connections, connection)
+	}
 	pool.Unlock()
 }
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/websocket"
+)
+
+// newWebsocketServer serves UpdaterWebsocket over a memory store.
+func newWebsocketServer(t *testing.T) (*Api, *httptest.Server) {
+	t.Helper()
+	db := NewMemoryStore()
+	catalog, err := SetupCatalogCache(db, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := SetupWebsocketConnectionPool()
+	a := &Api{DB: db, Websocket: pool, Watcher: SetupStatusWatcher(db, pool, catalog, time.Second)}
+
+	e := echo.New()
+	e.GET("/ws", a.UpdaterWebsocket)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+func dialWebsocket(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func waitForConnections(t *testing.T, pool *WebsocketConnectionPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.RLock()
+		count := len(pool.Connections)
+		pool.RUnlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d websocket connections, want %d", count, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStalledSubscriberIsDropped(t *testing.T) {
+	timeout := websocketWriteTimeout
+	websocketWriteTimeout = time.Second
+	defer func() { websocketWriteTimeout = timeout }()
+	a, srv := newWebsocketServer(t)
+
+	reader := dialWebsocket(t, srv)
+	var snapshot StatusSnapshot
+	if err := websocket.JSON.Receive(reader, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// The stalled subscriber never reads anything
+	dialWebsocket(t, srv)
+	waitForConnections(t, a.Websocket, 2)
+
+	// Large enough to fill the stalled connection's socket buffers and
+	// then its queue
+	padding := strings.Repeat("x", 64<<10)
+	events := 2 * websocketSendBuffer
+	for i := 0; i < events; i++ {
+		status := &Status{Task: Task{
+			Id:         primitive.NewObjectID(),
+			Parameters: map[string]interface{}{"padding": padding},
+		}, State: StateRunning}
+
+		published := make(chan struct{})
+		go func() {
+			a.Watcher.Publish(StatusEvent{Type: StatusEventInsert, Id: status.Id.Hex(), Status: status})
+			close(published)
+		}()
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("publishing event %d blocked", i)
+		}
+
+		reader.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var event StatusEvent
+		if err := websocket.JSON.Receive(reader, &event); err != nil {
+			t.Fatalf("receiving event %d: %v", i, err)
+		}
+		if event.Id != status.Id.Hex() {
+			t.Fatalf("event %d is for %s, want %s", i, event.Id, status.Id.Hex())
+		}
+	}
+	waitForConnections(t, a.Websocket, 1)
+}
+
+func TestResyncSendsSnapshots(t *testing.T) {
+	a, srv := newWebsocketServer(t)
+
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws := dialWebsocket(t, srv)
+		var snapshot StatusSnapshot
+		if err := websocket.JSON.Receive(ws, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, ws)
+	}
+	waitForConnections(t, a.Websocket, len(clients))
+
+	a.Watcher.Resync()
+	for i, ws := range clients {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var snapshot StatusSnapshot
+		if err := websocket.JSON.Receive(ws, &snapshot); err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if snapshot.Type != StatusEventSnapshot {
+			t.Errorf("client %d got a %s, want a snapshot", i, snapshot.Type)
+		}
+	}
+}
+
+func TestDeletesOnlyReachOwners(t *testing.T) {
+	db := NewMemoryStore()
+	catalog, err := SetupCatalogCache(db, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := SetupStatusWatcher(db, SetupWebsocketConnectionPool(), catalog, time.Second)
+
+	// The watcher learns the owners of tasks from events and from
+	// snapshots, which have tasks that haven't changed since it started
+	alices := primitive.NewObjectID().Hex()
+	bobs := createTestTask(t, db, Task{Type: "collect", Owner: "bob"})
+	if _, err := w.snapshot(&StatusQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	token := w.token()
+	w.Publish(StatusEvent{Type: StatusEventInsert, Id: alices, Status: &Status{Task: Task{Owner: "alice"}, State: StatePending}})
+	for _, id := range []string{alices, bobs, primitive.NewObjectID().Hex()} {
+		w.Publish(StatusEvent{Type: StatusEventDelete, Id: id})
+	}
+	events, ok := w.since(token)
+	if !ok {
+		t.Fatal("events fell out of the backlog")
+	}
+
+	tests := []struct {
+		owner string
+		want  int
+	}{
+		{"", 3},
+		{"alice", 1},
+		{"bob", 1},
+		{"carol", 0},
+	}
+	for _, test := range tests {
+		var deletes []string
+		for _, event := range events {
+			if event, ok := eventFor(event, &StatusQuery{StatusFilter: StatusFilter{Owner: test.owner}}); ok && event.Type == StatusEventDelete {
+				deletes = append(deletes, event.Id)
+			}
+		}
+		if len(deletes) != test.want {
+			t.Errorf("owner %q heard of deleting %v, want %d deletes", test.owner, deletes, test.want)
+			continue
+		}
+		switch test.owner {
+		case "alice":
+			if deletes[0] != alices {
+				t.Errorf("alice heard of deleting %s, want %s", deletes[0], alices)
+			}
+		case "bob":
+			if deletes[0] != bobs {
+				t.Errorf("bob heard of deleting %s, want %s", deletes[0], bobs)
+			}
+		}
+	}
+}
+
+func TestWatcherForgetsFinishedOwners(t *testing.T) {
+	db := NewMemoryStore()
+	catalog, err := SetupCatalogCache(db, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := SetupStatusWatcher(db, SetupWebsocketConnectionPool(), catalog, time.Second)
+	owners := func() int {
+		w.RLock()
+		defer w.RUnlock()
+		return len(w.owners)
+	}
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id := primitive.NewObjectID().Hex()
+		ids = append(ids, id)
+		w.Publish(StatusEvent{Type: StatusEventInsert, Id: id, Status: &Status{Task: Task{Owner: "alice"}, State: StateRunning}})
+	}
+	if n := owners(); n != len(ids) {
+		t.Fatalf("watcher knows %d owners of running tasks, want %d", n, len(ids))
+	}
+	for _, id := range ids {
+		w.Publish(StatusEvent{Type: StatusEventUpdate, Id: id, Status: &Status{Task: Task{Owner: "alice"}, State: StateStopped}})
+	}
+	if n := owners(); n != 0 {
+		t.Errorf("watcher still knows %d owners of finished tasks", n)
+	}
+
+	// Snapshots don't bring them back either
+	stopped := createTestTask(t, db, Task{Type: "collect", Owner: "alice"})
+	if err := db.TransitionTask(stopped, StateStopped, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	pending := createTestTask(t, db, Task{Type: "collect", Owner: "alice"})
+	if _, err := w.snapshot(&StatusQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	w.RLock()
+	_, knowsStopped := w.owners[stopped]
+	_, knowsPending := w.owners[pending]
+	w.RUnlock()
+	if knowsStopped || !knowsPending {
+		t.Errorf("after a snapshot, the watcher knows the owner of the stopped task: %v, of the pending one: %v", knowsStopped, knowsPending)
+	}
+}
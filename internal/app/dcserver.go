@@ -2,7 +2,9 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,6 +13,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/internal/auth"
 	"github.com/mrecachinas/dcserver/internal/config"
 
 	"github.com/mrecachinas/dcserver/internal/api"
@@ -19,27 +22,78 @@ import (
 
 // Run is the main entrypoint into the DCServer app.
 // It handles parsing the command-line, setting up
-// connections to MongoDB and RabbitMQ, and
+// the store backend and the message bus, and
 // instantiates and runs the echo server.
 func Run(cfg *config.Config) {
+	if cfg.CreateAPIToken != "" {
+		if err := CreateAPIToken(cfg, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dcapi, err := api.NewDCAPI(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer dcapi.MongoClient.Disconnect(ctx)
-		defer dcapi.AMQPClient.Close()
-		defer dcapi.AMQPChannel.Close()
+		defer dcapi.DB.Close(ctx)
+		defer dcapi.Bus.Close()
 		cancel()
 	}()
 
+	// Watch the tasks collection for changes to push to websocket clients,
+	// listen for worker reports, relay the outbox, refresh the task catalog,
+	// look for lost tasks, stop tasks at their stop time, kill tasks that
+	// overrun their stop deadline and run schedules until we shut down
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go dcapi.Watcher.Run(bgCtx)
+	go dcapi.Outbox.Run(bgCtx)
+	go dcapi.Catalog.Run(bgCtx)
+	go dcapi.RunReaper(bgCtx)
+	go dcapi.RunAutoStop(bgCtx)
+	go dcapi.RunStopEscalation(bgCtx)
+	go dcapi.RunScheduler(bgCtx)
+	if err := dcapi.Bus.ConsumeReports(bgCtx, dcapi.HandleReport); err != nil {
+		log.Fatal(err)
+	}
+
+	serverTLS, err := SetupTLS(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if serverTLS != nil && serverTLS.Reloader != nil {
+		go serverTLS.Reloader.Run(bgCtx, time.Duration(cfg.TLSReloadInterval)*time.Second)
+	}
+
 	e := SetupEchoServer(dcapi)
 
+	// Answer ACME http-01 challenges, and redirect everything else
+	// to the API over HTTPS
+	var challengeServer *http.Server
+	if serverTLS != nil && serverTLS.ACME != nil && cfg.ACMEHTTPAddress != "" {
+		challengeServer = &http.Server{Addr: cfg.ACMEHTTPAddress, Handler: serverTLS.ACME.HTTPHandler(nil)}
+		go func() {
+			if err := challengeServer.ListenAndServe(); err != http.ErrServerClosed {
+				e.Logger.Error(err)
+			}
+		}()
+	}
+
 	// Run server
 	address := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 	go func() {
-		if err := e.Start(address); err != nil {
+		var err error
+		if serverTLS == nil {
+			err = e.Start(address)
+		} else {
+			e.TLSServer.Addr = address
+			e.TLSServer.TLSConfig = serverTLS.Config
+			err = e.StartServer(e.TLSServer)
+		}
+		if err != nil {
 			e.Logger.Info("Shutting down the server")
 		}
 	}()
@@ -51,6 +105,9 @@ func Run(cfg *config.Config) {
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if challengeServer != nil {
+		challengeServer.Shutdown(ctx)
+	}
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
@@ -61,6 +118,9 @@ func Run(cfg *config.Config) {
 func SetupEchoServer(dcapi *api.Api) *echo.Echo {
 	// Setup server
 	e := echo.New()
+	// Client IPs go in the audit log, so take them from the connection
+	// rather than headers any client can set
+	e.IPExtractor = echo.ExtractIPDirect()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
@@ -72,18 +132,117 @@ func SetupEchoServer(dcapi *api.Api) *echo.Echo {
 		e.Logger.SetLevel(log.INFO)
 	}
 
+	// Everything but the web app and the health check needs credentials
+	// once authentication is on
+	if len(dcapi.Authenticators) > 0 {
+		e.Use(auth.Middleware(dcapi.Authenticators, isPublicRoute))
+	} else {
+		e.Logger.Warn("Authentication is off; anyone who can reach dc can start and stop tasks")
+	}
+
 	webappFS := http.FileServer(ui.GetFileSystem())
 
 	// Setup routes
 	e.GET("/", echo.WrapHandler(webappFS))
 	e.GET("/static/*", echo.WrapHandler(webappFS))
 
-	e.GET("/api/status", dcapi.GetAllStatus)
-	e.GET("/api/status/:id", dcapi.GetStatus)
+	// What each route needs on top of credentials. Catalog and whoami
+	// only need credentials, and handlers narrow what identities that
+	// may only see or control their own tasks get
+	readStatus := auth.Require(auth.PermStatusRead, auth.PermStatusReadOwn)
+	readAllStatus := auth.Require(auth.PermStatusRead)
+	createTask := auth.Require(auth.PermTaskCreate)
+	controlTask := auth.Require(auth.PermTaskControl, auth.PermTaskControlOwn)
+	reportTask := auth.Require(auth.PermTaskReport)
+	readArtifact := auth.Require(auth.PermArtifactRead)
+	readSchedule := auth.Require(auth.PermStatusRead, auth.PermScheduleWrite)
+	writeSchedule := auth.Require(auth.PermScheduleWrite)
+	readStream := auth.Require(auth.PermStreamRead)
+	manageTokens := auth.Require(auth.PermTokenManage)
+	readAudit := auth.Require(auth.PermAuditRead)
+
+	// Control actions are recorded in the audit log, including
+	// attempts denied for lack of permission
+	audited := dcapi.Audited
+
+	e.GET("/healthz", dcapi.Healthz)
+	e.GET("/api/status", dcapi.GetAllStatus, readStatus)
+	e.GET("/api/status/active", dcapi.GetActiveStatus, readStatus)
+	e.GET("/api/status/historical", dcapi.GetHistoricalStatus, readStatus)
+	e.GET("/api/status/:id", dcapi.GetStatus, readStatus)
 	e.GET("/api/tasks", dcapi.GetTasks)
-	e.POST("/api/tasks/create", dcapi.CreateTask)
-	e.POST("/api/tasks/:id/stop", dcapi.StopTask)
-	e.GET("/ws", dcapi.UpdaterWebsocket)
+	e.GET("/api/catalog/changes", dcapi.GetCatalogChanges)
+	e.GET("/api/tasks/undelivered", dcapi.GetUndelivered, readAllStatus)
+	e.POST("/api/tasks/create", dcapi.CreateTask, audited(api.AuditTaskCreate), createTask)
+	e.POST("/api/tasks/update", dcapi.UpdateTask, audited(api.AuditTaskUpdate), controlTask)
+	e.POST("/api/tasks/:id/stop", dcapi.StopTask, audited(api.AuditTaskStop), controlTask)
+	e.POST("/api/tasks/:id/kill", dcapi.KillTask, audited(api.AuditTaskKill), controlTask)
+	e.POST("/api/tasks/:id/report", dcapi.ReportTask, reportTask)
+	e.POST("/api/tasks/:id/heartbeat", dcapi.HeartbeatTask, reportTask)
+	e.GET("/api/tasks/:id/artifacts", dcapi.GetArtifacts, readArtifact)
+	e.GET("/api/tasks/:id/artifacts/:name", dcapi.GetArtifact, readArtifact)
+	e.GET("/api/tasks/:id/artifacts/:name/header", dcapi.GetArtifactHeader, readArtifact)
+	e.GET("/api/tasks/:id/artifacts/:name/view", dcapi.GetArtifactView, readArtifact)
+	e.GET("/api/tasks/:id/artifacts/:name/spectrum", dcapi.GetArtifactSpectrum, readArtifact)
+	e.PUT("/api/tasks/:id/artifacts/:name", dcapi.PutArtifact, reportTask)
+	e.GET("/api/schedules", dcapi.GetSchedules, readSchedule)
+	e.POST("/api/schedules", dcapi.CreateSchedule, audited(api.AuditScheduleCreate), writeSchedule)
+	e.GET("/api/schedules/:id", dcapi.GetSchedule, readSchedule)
+	e.DELETE("/api/schedules/:id", dcapi.DeleteSchedule, audited(api.AuditScheduleDelete), writeSchedule)
+	e.POST("/api/schedules/:id/pause", dcapi.PauseSchedule, audited(api.AuditSchedulePause), writeSchedule)
+	e.POST("/api/schedules/:id/resume", dcapi.ResumeSchedule, audited(api.AuditScheduleResume), writeSchedule)
+	e.GET("/api/schedules/:id/preview", dcapi.PreviewSchedule, readSchedule)
+	e.GET("/api/streams", dcapi.GetStreams, readStream)
+	e.GET("/api/streams/:id", dcapi.GetStream, readStream)
+	e.GET("/api/streams/:id/publish", dcapi.PublishStream, reportTask)
+	e.GET("/api/streams/:id/ws", dcapi.SubscribeStream, readStream)
+	e.GET("/api/whoami", dcapi.GetWhoami)
+	e.GET("/api/tokens", dcapi.GetAPITokens, manageTokens)
+	e.POST("/api/tokens", dcapi.CreateAPIToken, audited(api.AuditTokenCreate), manageTokens)
+	e.DELETE("/api/tokens/:id", dcapi.DeleteAPIToken, audited(api.AuditTokenDelete), manageTokens)
+	e.GET("/api/audit", dcapi.GetAudit, readAudit)
+	e.GET("/api/audit/verify", dcapi.VerifyAudit, readAudit)
+	e.GET("/ws", dcapi.UpdaterWebsocket, readStatus)
 
 	return e
 }
+
+// publicRoutes are the routes that don't need credentials.
+var publicRoutes = map[string]bool{
+	"/":         true,
+	"/static/*": true,
+	"/healthz":  true,
+}
+
+func isPublicRoute(c echo.Context) bool {
+	return publicRoutes[c.Path()]
+}
+
+// CreateAPIToken creates an API token named in the config and writes
+// it to w, for bootstrapping: once authentication is on, creating
+// tokens through the API takes credentials.
+func CreateAPIToken(cfg *config.Config, w io.Writer) error {
+	if err := auth.CheckRoles(cfg.APITokenRoles); err != nil {
+		return err
+	}
+	db, err := api.SetupStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close(context.Background())
+
+	record, token, err := auth.NewAPIToken(cfg.CreateAPIToken, cfg.APITokenRoles, "cli", time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := db.CreateAPIToken(record); err != nil {
+		return err
+	}
+	entry := api.AuditEntry{Actor: "cli", Action: api.AuditTokenCreate, Target: record.Id.Hex(), Outcome: api.AuditSuccess}
+	entry.Params, _ = json.Marshal(map[string]interface{}{"name": record.Name, "roles": record.Roles})
+	if err := api.SetupAuditLog(db).Append(entry); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, token)
+	return err
+}
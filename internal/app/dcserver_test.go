@@ -0,0 +1,212 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrecachinas/dcserver/internal/api"
+	"github.com/mrecachinas/dcserver/internal/config"
+	"github.com/mrecachinas/dcserver/pkg/worker"
+)
+
+// newInProcessServer runs dc on the memory store and in-process bus,
+// with its background work going until the test ends.
+func newInProcessServer(t *testing.T) (*api.Api, *httptest.Server) {
+	t.Helper()
+	cfg := &config.Config{
+		Store:             api.StoreMemory,
+		Bus:               api.BusInProc,
+		ArtifactDir:       t.TempDir(),
+		PollingInterval:   1,
+		HeartbeatInterval: 10,
+		HeartbeatMisses:   3,
+		OutboxMaxAttempts: 10,
+		StopGracePeriod:   30,
+	}
+	dcapi, err := api.NewDCAPI(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dcapi.Outbox.Run(ctx)
+	if err := dcapi.Bus.ConsumeReports(ctx, dcapi.HandleReport); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(SetupEchoServer(dcapi))
+	t.Cleanup(srv.Close)
+	return dcapi, srv
+}
+
+func postJSON(t *testing.T, url string, body string, want int) api.Response {
+	t.Helper()
+	res, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var response api.Response
+	json.NewDecoder(res.Body).Decode(&response)
+	if res.StatusCode != want {
+		t.Fatalf("POST %s answered %d (%s), want %d", url, res.StatusCode, response.Msg, want)
+	}
+	return response
+}
+
+func getStatus(t *testing.T, srv *httptest.Server, id string) api.Status {
+	t.Helper()
+	res, err := http.Get(srv.URL + "/api/status/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var status api.Status
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func waitForState(t *testing.T, srv *httptest.Server, id string, state api.State) api.Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := getStatus(t, srv, id)
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s is still %s, want %s", id, status.State, state)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestTaskLifecycleInProcess takes a task from creation to stopped
+// through the API, the outbox relay and a pkg/worker worker, all in
+// one process.
+func TestTaskLifecycleInProcess(t *testing.T) {
+	dcapi, srv := newInProcessServer(t)
+
+	started := make(chan string, 1)
+	bus := dcapi.Bus.(*api.ChannelBus)
+	w := worker.New(bus.WorkerTransport(), func(ctx context.Context, task *worker.Task) error {
+		started <- task.Id
+		<-ctx.Done()
+		return nil
+	}, worker.Options{WorkerId: "worker-1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		w.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-workerDone
+	}()
+
+	created := postJSON(t, srv.URL+"/api/tasks/create", `{"type": "collect", "tags": ["test"]}`, http.StatusCreated)
+
+	select {
+	case id := <-started:
+		if id != created.Id {
+			t.Fatalf("worker started %s, want %s", id, created.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never started the task")
+	}
+	status := waitForState(t, srv, created.Id, api.StateRunning)
+	if status.WorkerId != "worker-1" {
+		t.Errorf("task is running on %q, want worker-1", status.WorkerId)
+	}
+	if status.Dispatch != api.DispatchDelivered {
+		t.Errorf("task's dispatch is %s, want delivered", status.Dispatch)
+	}
+
+	postJSON(t, srv.URL+"/api/tasks/"+created.Id+"/stop", "", http.StatusOK)
+	status = waitForState(t, srv, created.Id, api.StateStopped)
+
+	var states []api.State
+	for _, entry := range status.History {
+		if len(states) == 0 || states[len(states)-1] != entry.To {
+			states = append(states, entry.To)
+		}
+	}
+	want := []api.State{api.StatePending, api.StateRunning, api.StateStopping, api.StateStopped}
+	if len(states) != len(want) {
+		t.Fatalf("task went through %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("task went through %v, want %v", states, want)
+		}
+	}
+
+	// A stopped task can't be stopped again
+	postJSON(t, srv.URL+"/api/tasks/"+created.Id+"/stop", "", http.StatusConflict)
+}
+
+func TestCreateTaskMalformed(t *testing.T) {
+	_, srv := newInProcessServer(t)
+	response := postJSON(t, srv.URL+"/api/tasks/create", `{"type": `, http.StatusBadRequest)
+	if response.Msg == "" {
+		t.Error("no message saying what's wrong with the request")
+	}
+}
+
+func TestAuditedRequests(t *testing.T) {
+	_, srv := newInProcessServer(t)
+
+	// A client can't pass itself off as somewhere else
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/tasks/create", strings.NewReader(`{"type": "collect"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// Nor send more than the audit log records
+	huge := `{"type": "collect", "parameters": {"padding": "` + strings.Repeat("x", 2<<20) + `"}}`
+	postJSON(t, srv.URL+"/api/tasks/create", huge, http.StatusRequestEntityTooLarge)
+
+	res, err = http.Get(srv.URL + "/api/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var page api.AuditPage
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 {
+		t.Fatalf("%d audit entries, want 2", len(page.Entries))
+	}
+	for _, entry := range page.Entries {
+		if entry.SourceIP != "127.0.0.1" {
+			t.Errorf("entry %d is from %s, want 127.0.0.1", entry.Seq, entry.SourceIP)
+		}
+	}
+	var oversized api.AuditEntry
+	for _, entry := range page.Entries {
+		if entry.Status == http.StatusRequestEntityTooLarge {
+			oversized = entry
+		}
+	}
+	if oversized.Outcome != api.AuditFailure || len(oversized.Params) != 0 {
+		t.Errorf("oversized request recorded as %+v", oversized)
+	}
+}
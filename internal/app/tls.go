@@ -0,0 +1,257 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/mrecachinas/dcserver/internal/auth"
+	"github.com/mrecachinas/dcserver/internal/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS is how the API is served over TLS.
+type TLS struct {
+	Config *tls.Config
+	// Reloader watches the certificate files, if there are any
+	Reloader *CertReloader
+	// ACME gets and renews certificates in ACME mode
+	ACME *autocert.Manager
+}
+
+// SetupTLS sets up serving the API over TLS with the certificate
+// files in the config, or with certificates from an ACME CA for the
+// configured domains. With neither, it returns nil: the API is served
+// over plain HTTP. A client CA makes the server ask for and verify
+// client certificates, which mtls authentication relies on.
+func SetupTLS(cfg *config.Config) (*TLS, error) {
+	acmeMode := len(cfg.ACMEDomains) > 0
+	filesMode := cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""
+	for _, method := range cfg.Auth {
+		if method == auth.MethodMTLS && cfg.TLSClientCAFile == "" {
+			return nil, errors.New("mtls authentication needs a TLS client CA")
+		}
+	}
+	switch {
+	case acmeMode && filesMode:
+		return nil, errors.New("TLS certificates come from either files or ACME, not both")
+	case filesMode && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == ""):
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	case !acmeMode && !filesMode:
+		if cfg.TLSClientCAFile != "" {
+			return nil, errors.New("verifying client certificates needs TLS")
+		}
+		return nil, nil
+	}
+	if cfg.TLSRequireClientCert && cfg.TLSClientCAFile == "" {
+		return nil, errors.New("requiring client certificates needs a TLS client CA")
+	}
+
+	s := &TLS{}
+	if filesMode || cfg.TLSClientCAFile != "" {
+		reloader, err := NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.Reloader = reloader
+	}
+
+	if acmeMode {
+		manager, err := setupACME(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.ACME = manager
+		s.Config = manager.TLSConfig()
+	} else {
+		s.Config = &tls.Config{
+			GetCertificate: s.Reloader.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+	s.Config.MinVersion = tls.VersionTLS12
+
+	if cfg.TLSClientCAFile != "" {
+		s.Config.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.TLSRequireClientCert {
+			s.Config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		s.Config.ClientCAs = s.Reloader.ClientCAs()
+		// Pick up the client CA as it is when each client connects,
+		// since it may have been reloaded
+		base := s.Config
+		s.Config = base.Clone()
+		s.Config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientCAs = s.Reloader.ClientCAs()
+			// The ACME CA doesn't have a client certificate to
+			// present when it checks tls-alpn-01 challenges. It offers
+			// acme-tls/1 alone, and autocert answers such a hello with
+			// nothing but the challenge certificate.
+			if s.ACME != nil && len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+				config.ClientAuth = tls.NoClientCert
+			}
+			return config, nil
+		}
+	}
+	return s, nil
+}
+
+// setupACME creates the autocert.Manager that gets certificates for
+// the configured domains, answering tls-alpn-01 challenges on the API's
+// own port and, with an ACME HTTP address, http-01 ones.
+func setupACME(cfg *config.Config) (*autocert.Manager, error) {
+	client := http.DefaultClient
+	if cfg.ACMECACertFile != "" {
+		cacert, err := os.ReadFile(cfg.ACMECACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cacert) {
+			return nil, fmt.Errorf("%s has no PEM certificates", cfg.ACMECACertFile)
+		}
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+		Client: &acme.Client{
+			DirectoryURL: cfg.ACMEDirectoryURL,
+			HTTPClient:   client,
+		},
+	}, nil
+}
+
+// CertReloader serves a certificate and client CA loaded from files,
+// loading them again when they change on disk. Certificates can then
+// be renewed (e.g. by cert-manager or certbot) without a restart.
+type CertReloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	stamps    map[string]fileStamp
+}
+
+// fileStamp is what changes about a file when it's rewritten.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader creates a CertReloader and loads the files, any of
+// which may be empty.
+func NewCertReloader(certFile string, keyFile string, clientCAFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again if any of them changed, reporting
+// whether they did. If they can't be loaded, e.g. because only the
+// certificate has been replaced so far, the ones already loaded are
+// kept and the next Reload tries again.
+func (r *CertReloader) Reload() (bool, error) {
+	stamps := make(map[string]fileStamp)
+	for _, name := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		stamps[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	r.mu.RLock()
+	changed := len(stamps) != len(r.stamps)
+	for name, stamp := range stamps {
+		if r.stamps[name] != stamp {
+			changed = true
+		}
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.CertFile != "" {
+		loaded, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &loaded
+	}
+	var clientCAs *x509.CertPool
+	if r.ClientCAFile != "" {
+		cacert, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(cacert) {
+			return false, fmt.Errorf("%s has no PEM certificates", r.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.clientCAs, r.stamps = cert, clientCAs, stamps
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Run checks the files for changes every interval until ctx is
+// cancelled.
+func (r *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				log.Errorf("Error reloading TLS files, keeping the ones loaded: %v", err)
+			} else if reloaded {
+				log.Info("Reloaded TLS files")
+			}
+		}
+	}
+}
+
+// GetCertificate returns the certificate, for tls.Config.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ClientCAs returns the client CA pool.
+func (r *CertReloader) ClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clientCAs
+}
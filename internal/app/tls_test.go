@@ -0,0 +1,550 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrecachinas/dcserver/internal/config"
+	"golang.org/x/crypto/acme"
+)
+
+// certTemplate is a certificate for name, valid for the next 90 days.
+func certTemplate(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// newKeyPair makes a self-signed certificate for name, PEM encoded
+// along with its key.
+func newKeyPair(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := certTemplate(t, name)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+}
+
+// rewrite replaces a file's contents, moving its modification time on
+// so the change shows even on file systems with coarse timestamps.
+func rewrite(t *testing.T, name string, data []byte) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certA, keyA := newKeyPair(t, "a.example.test")
+	rewrite(t, certFile, certA)
+	rewrite(t, keyFile, keyA)
+
+	r, err := NewCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if name := served(); name != "a.example.test" {
+		t.Fatalf("serving %s, want a.example.test", name)
+	}
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("Reload of unchanged files = %v, %v", reloaded, err)
+	}
+
+	// Only the certificate has been replaced so far
+	certB, keyB := newKeyPair(t, "b.example.test")
+	rewrite(t, certFile, certB)
+	if reloaded, err := r.Reload(); reloaded || err == nil {
+		t.Errorf("Reload of a mismatched pair = %v, %v; want an error", reloaded, err)
+	}
+	if name := served(); name != "a.example.test" {
+		t.Errorf("serving %s after a failed reload, want a.example.test", name)
+	}
+
+	rewrite(t, keyFile, keyB)
+	if reloaded, err := r.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload of a new pair = %v, %v", reloaded, err)
+	}
+	if name := served(); name != "b.example.test" {
+		t.Errorf("serving %s, want b.example.test", name)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	clientCAFile := filepath.Join(dir, "client-ca.crt")
+	cert, key := newKeyPair(t, "dc.example.test")
+	clientCA, _ := newKeyPair(t, "client-ca.example.test")
+	rewrite(t, certFile, cert)
+	rewrite(t, keyFile, key)
+	rewrite(t, clientCAFile, clientCA)
+
+	serverTLS, err := SetupTLS(&config.Config{
+		TLSCertFile:          certFile,
+		TLSKeyFile:           keyFile,
+		TLSClientCAFile:      clientCAFile,
+		TLSRequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	handshakes := make(chan error)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cert)
+	// Without ACME there are no challenges to answer, and a hello
+	// that offers more than acme-tls/1 isn't from an ACME CA either
+	for _, protos := range [][]string{nil, {"http/1.1"}, {acme.ALPNProto}, {acme.ALPNProto, "http/1.1"}} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			ServerName: "dc.example.test",
+			RootCAs:    roots,
+			NextProtos: protos,
+		})
+		if err == nil {
+			// With TLS 1.3 the client finds out on its first read
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if err := <-handshakes; err == nil {
+			t.Errorf("protocols %v: accepted a client without a certificate", protos)
+		}
+	}
+}
+
+// acmeStandIn is an ACME CA, like Pebble, for one domain at a time. It
+// checks http-01 challenges against Challenges and issues certificates
+// signed by its own CA.
+type acmeStandIn struct {
+	*httptest.Server
+	// Challenges is the base URL http-01 challenges are fetched from
+	Challenges string
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	domain     string
+	token      string
+	authz      string
+	chain      []byte
+	orders     int
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := certTemplate(t, "Stand-in ACME CA")
+	template.IsCA, template.BasicConstraintsValid = true, true
+	template.KeyUsage = x509.KeyUsageCertSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &acmeStandIn{ca: ca, caKey: caKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", s.directory)
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/new-account", s.newAccount)
+	mux.HandleFunc("/new-order", s.newOrder)
+	mux.HandleFunc("/order", s.getOrder)
+	mux.HandleFunc("/authz", s.getAuthz)
+	mux.HandleFunc("/challenge", s.challenge)
+	mux.HandleFunc("/finalize", s.finalize)
+	mux.HandleFunc("/cert", s.cert)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.nonce++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", s.nonce))
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// readJWS decodes a request's JWS payload into payload, if it has one,
+// and returns its protected header.
+func readJWS(r *http.Request, payload interface{}) (map[string]json.RawMessage, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var protected map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &protected); err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		raw, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, payload); err != nil {
+			return nil, err
+		}
+	}
+	return protected, nil
+}
+
+func problem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": detail})
+}
+
+func reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeStandIn) directory(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, "", map[string]string{
+		"newNonce":   s.URL + "/new-nonce",
+		"newAccount": s.URL + "/new-account",
+		"newOrder":   s.URL + "/new-order",
+	})
+}
+
+func (s *acmeStandIn) newAccount(w http.ResponseWriter, r *http.Request) {
+	protected, err := readJWS(r, nil)
+	if err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var jwk struct {
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(protected["jwk"], &jwk); err != nil || jwk.Crv != "P-256" {
+		problem(w, http.StatusBadRequest, "account key must be a P-256 JWK")
+		return
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	thumbprint, err := acme.JWKThumbprint(&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+	if err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.thumbprint = thumbprint
+	s.mu.Unlock()
+	reply(w, http.StatusCreated, s.URL+"/account", map[string]string{"status": acme.StatusValid})
+}
+
+func (s *acmeStandIn) newOrder(w http.ResponseWriter, r *http.Request) {
+	var order struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if _, err := readJWS(r, &order); err != nil || len(order.Identifiers) != 1 || order.Identifiers[0].Type != "dns" {
+		problem(w, http.StatusBadRequest, "orders must be for one domain")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders++
+	s.domain = order.Identifiers[0].Value
+	s.token = fmt.Sprintf("token-%d", s.orders)
+	s.authz = acme.StatusPending
+	s.chain = nil
+	reply(w, http.StatusCreated, s.URL+"/order", s.order())
+}
+
+// order is the order as it stands. s.mu must be held.
+func (s *acmeStandIn) order() map[string]interface{} {
+	order := map[string]interface{}{
+		"status":         acme.StatusPending,
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.domain}},
+		"authorizations": []string{s.URL + "/authz"},
+		"finalize":       s.URL + "/finalize",
+	}
+	switch {
+	case s.chain != nil:
+		order["status"] = acme.StatusValid
+		order["certificate"] = s.URL + "/cert"
+	case s.authz == acme.StatusValid:
+		order["status"] = acme.StatusReady
+	case s.authz == acme.StatusInvalid:
+		order["status"] = acme.StatusInvalid
+	}
+	return order
+}
+
+func (s *acmeStandIn) getOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply(w, http.StatusOK, s.URL+"/order", s.order())
+}
+
+// challengeObject is the order's http-01 challenge. s.mu must be held.
+func (s *acmeStandIn) challengeObject() map[string]string {
+	return map[string]string{"type": "http-01", "url": s.URL + "/challenge", "token": s.token, "status": s.authz}
+}
+
+func (s *acmeStandIn) getAuthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply(w, http.StatusOK, "", map[string]interface{}{
+		"identifier": map[string]string{"type": "dns", "value": s.domain},
+		"status":     s.authz,
+		"challenges": []map[string]string{s.challengeObject()},
+	})
+}
+
+// challenge validates the http-01 challenge the way a CA would: by
+// fetching the key authorization from the domain.
+func (s *acmeStandIn) challenge(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	domain, token, thumbprint := s.domain, s.token, s.thumbprint
+	s.mu.Unlock()
+
+	status := acme.StatusInvalid
+	request, err := http.NewRequest(http.MethodGet, s.Challenges+"/.well-known/acme-challenge/"+token, nil)
+	if err == nil {
+		request.Host = domain
+		if response, err := http.DefaultClient.Do(request); err == nil {
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK && string(body) == token+"."+thumbprint {
+				status = acme.StatusValid
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authz = status
+	reply(w, http.StatusOK, "", s.challengeObject())
+}
+
+func (s *acmeStandIn) finalize(w http.ResponseWriter, r *http.Request) {
+	var finalize struct {
+		CSR string `json:"csr"`
+	}
+	if _, err := readJWS(r, &finalize); err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	if err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.authz != acme.StatusValid {
+		problem(w, http.StatusForbidden, "order isn't ready")
+		return
+	}
+	// Like Let's Encrypt, take the common name as one of the names
+	names := csr.DNSNames
+	if csr.Subject.CommonName != "" && (len(names) == 0 || names[0] != csr.Subject.CommonName) {
+		names = append([]string{csr.Subject.CommonName}, names...)
+	}
+	if len(names) != 1 || names[0] != s.domain {
+		problem(w, http.StatusBadRequest, fmt.Sprintf("CSR is for %v, not %s", names, s.domain))
+		return
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		problem(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...)
+	reply(w, http.StatusOK, s.URL+"/order", s.order())
+}
+
+func (s *acmeStandIn) cert(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(s.chain)
+}
+
+// TestACME gets a certificate from the stand-in CA through the API's
+// TLS config, answering its http-01 challenge, and then serves it from
+// the cache.
+func TestACME(t *testing.T) {
+	ca := newACMEStandIn(t)
+	dir := t.TempDir()
+	caCertFile := filepath.Join(dir, "acme-ca.crt")
+	rewrite(t, caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}))
+
+	const domain = "dc.example.test"
+	cfg := &config.Config{
+		ACMEDomains:      []string{domain},
+		ACMEDirectoryURL: ca.URL + "/dir",
+		ACMECacheDir:     filepath.Join(dir, "cache"),
+		ACMECACertFile:   caCertFile,
+	}
+	serverTLS, err := SetupTLS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenges := httptest.NewServer(serverTLS.ACME.HTTPHandler(nil))
+	t.Cleanup(challenges.Close)
+	ca.Challenges = challenges.URL
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.ca)
+	for i := 0; i < 2; i++ {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), &tls.Config{ServerName: domain, RootCAs: roots})
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		if leaf.Subject.CommonName != domain {
+			t.Errorf("connection %d got a certificate for %s, want %s", i+1, leaf.Subject.CommonName, domain)
+		}
+	}
+
+	ca.mu.Lock()
+	orders := ca.orders
+	ca.mu.Unlock()
+	if orders != 1 {
+		t.Errorf("%d orders, want 1 with the certificate cached after", orders)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.ACMECacheDir, domain)); err != nil {
+		t.Errorf("certificate isn't in the cache directory: %v", err)
+	}
+}
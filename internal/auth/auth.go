@@ -0,0 +1,132 @@
+// Package auth identifies who is making requests to dc: users, by JWT
+// bearer tokens from an OIDC provider; automation, by long-lived API
+// tokens; and machines, by TLS client certificates.
+//
+// Each way of authenticating is an Authenticator. Middleware tries them
+// in turn and records the Identity of the first that recognizes the
+// request's credentials, turning away requests without any.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Ways of authenticating (`--auth`)
+const (
+	MethodJWT   = "jwt"
+	MethodToken = "token"
+	MethodMTLS  = "mtls"
+)
+
+// AccessTokenParam is the query parameter websocket clients, which
+// can't set an Authorization header, send their bearer token in.
+const AccessTokenParam = "access_token"
+
+// identityKey is where Middleware keeps the Identity in the echo context.
+const identityKey = "identity"
+
+// ErrNoCredentials is returned by an Authenticator for requests that
+// don't carry the kind of credentials it checks.
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrInvalidCredentials is returned by an Authenticator for requests
+// whose credentials it checked and rejected.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is who made a request.
+type Identity struct {
+	// Subject identifies them, in task history among other places:
+	// `jwt:<iss>|<sub>` for JWTs, `token:<id>` for API tokens and
+	// `cert:<CN>` for client certificates
+	Subject string `json:"subject"`
+	// Method is how they authenticated
+	Method string `json:"method"`
+	// Roles are what they're allowed to do
+	Roles []string `json:"roles"`
+	// Claims are the claims of the JWT they authenticated with
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Authenticator identifies the sender of a request from one kind of
+// credentials.
+type Authenticator interface {
+	// Authenticate returns the Identity the request's credentials
+	// belong to, ErrNoCredentials if it has none of the kind the
+	// Authenticator checks, or an error wrapping ErrInvalidCredentials
+	// if they aren't valid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Middleware authenticates every request skip doesn't skip with the
+// first of authenticators that finds credentials it checks, and
+// replies 401 to requests with none or with invalid ones. A bearer
+// token sent in the AccessTokenParam is taken out of the request's URL
+// once it's been checked, so it isn't logged.
+func Middleware(authenticators []Authenticator, skip middleware.Skipper) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skip != nil && skip(c) {
+				return next(c)
+			}
+			identity, err := authenticate(authenticators, c.Request())
+			stripAccessToken(c.Request())
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="dc"`)
+				return c.JSON(http.StatusUnauthorized, map[string]string{"msg": err.Error()})
+			}
+			c.Set(identityKey, identity)
+			return next(c)
+		}
+	}
+}
+
+func authenticate(authenticators []Authenticator, r *http.Request) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errors.New("authentication required")
+}
+
+// FromContext returns the Identity Middleware found for a request, or
+// nil if it wasn't authenticated.
+func FromContext(c echo.Context) *Identity {
+	identity, _ := c.Get(identityKey).(*Identity)
+	return identity
+}
+
+// bearerToken returns the bearer token in the request's Authorization
+// header or, for websocket upgrades, its AccessTokenParam.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	if isWebsocketUpgrade(r) {
+		return r.URL.Query().Get(AccessTokenParam)
+	}
+	return ""
+}
+
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(echo.HeaderUpgrade), "websocket")
+}
+
+// stripAccessToken takes the AccessTokenParam out of the request's URL.
+func stripAccessToken(r *http.Request) {
+	query := r.URL.Query()
+	if _, ok := query[AccessTokenParam]; !ok {
+		return
+	}
+	query.Del(AccessTokenParam)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CertAuthenticator identifies machines by the TLS client certificates
+// they connect with. It relies on the server having verified the
+// certificate against its client CAs; unverified certificates aren't
+// credentials.
+type CertAuthenticator struct {
+	// Roles are given to every certificate, since certificates don't
+	// say what they're for
+	Roles []string
+}
+
+// Authenticate identifies the request by its client certificate's
+// common name or, without one, its first DNS name.
+func (a CertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: client certificate has no name", ErrInvalidCredentials)
+	}
+	return &Identity{Subject: "cert:" + name, Method: MethodMTLS, Roles: a.Roles}, nil
+}
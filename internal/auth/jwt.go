@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched keys are used before
+	// they're fetched again
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval is how soon after a fetch an unknown key
+	// id can make the keys be fetched again, e.g. after the provider
+	// rotates its keys, or after a fetch fails
+	jwksMinRefreshInterval = time.Minute
+	// jwksFetchTimeout bounds a fetch, for clients without a timeout
+	// of their own
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwtMethods are the signing algorithms accepted: the asymmetric ones,
+// since the keys come from a JWKS.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWTAuthenticator authenticates bearer JWTs, such as OIDC access
+// tokens, signed by one of the keys in a JSON Web Key Set.
+type JWTAuthenticator struct {
+	// JWKSURL is where the key set is published, e.g. the
+	// `jwks_uri` of an OIDC provider's discovery document
+	JWKSURL string
+	// Issuer and Audience, if set, are what tokens' `iss` and `aud`
+	// claims must be
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim holding the subject's roles, a dotted
+	// path for nested claims such as Keycloak's `realm_access.roles`
+	RolesClaim string
+
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+	// attempted is when the keys were last fetched or failed to be,
+	// and fetching is closed once a fetch in progress is done
+	attempted time.Time
+	fetching  chan struct{}
+}
+
+// NewJWTAuthenticator creates a JWTAuthenticator that fetches keys from
+// jwksURL with client. If client is nil, http.DefaultClient is used;
+// either way, fetches time out after jwksFetchTimeout unless the client
+// has a timeout already.
+func NewJWTAuthenticator(jwksURL string, issuer string, audience string, rolesClaim string, client *http.Client) (*JWTAuthenticator, error) {
+	if jwksURL == "" {
+		return nil, errors.New("jwt authentication needs a JWKS URL")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if client.Timeout == 0 {
+		withTimeout := *client
+		withTimeout.Timeout = jwksFetchTimeout
+		client = &withTimeout
+	}
+	return &JWTAuthenticator{
+		JWKSURL:    jwksURL,
+		Issuer:     issuer,
+		Audience:   audience,
+		RolesClaim: rolesClaim,
+		client:     client,
+	}, nil
+}
+
+// Authenticate checks the request's bearer token, unless it's an API
+// token. Tokens have to be signed by a key in the key set and unexpired.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	raw := bearerToken(r)
+	if raw == "" || strings.HasPrefix(raw, APITokenPrefix) {
+		return nil, ErrNoCredentials
+	}
+
+	parser := jwt.NewParser(jwt.WithValidMethods(jwtMethods))
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(raw, claims, a.keyFor); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%w: token has no expiry", ErrInvalidCredentials)
+	}
+	if a.Issuer != "" && !claims.VerifyIssuer(a.Issuer, true) {
+		return nil, fmt.Errorf("%w: token isn't from %s", ErrInvalidCredentials, a.Issuer)
+	}
+	if a.Audience != "" && !hasAudience(claims, a.Audience) {
+		return nil, fmt.Errorf("%w: token isn't for %s", ErrInvalidCredentials, a.Audience)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+	// Subjects are only unique per issuer
+	issuer, _ := claims["iss"].(string)
+	roles := knownRoles(rolesClaim(claims, a.RolesClaim))
+	return &Identity{Subject: "jwt:" + issuer + "|" + subject, Method: MethodJWT, Roles: roles, Claims: claims}, nil
+}
+
+// rolesClaim reads the roles out of the claim at path, which may be a
+// list of strings or a string of them separated by spaces or commas.
+func rolesClaim(claims jwt.MapClaims, path string) []string {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	switch value := value.(type) {
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		var roles []string
+		for _, role := range value {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// hasAudience is whether a token's `aud` claim, which may be a string
+// or a list of them, includes audience.
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyFor looks up the key a token says it was signed with. The key
+// set is fetched without holding the lock, and by one request at a
+// time: the others use the keys they have meanwhile or, if their key
+// isn't one of them, wait for the fetch.
+func (a *JWTAuthenticator) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	key, ok := a.lookup(kid)
+	stale := time.Since(a.fetched) > jwksRefreshInterval
+	switch {
+	case ok && !stale:
+		a.mu.Unlock()
+		return key, nil
+	case a.fetching != nil:
+		fetching := a.fetching
+		a.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		<-fetching
+		a.mu.Lock()
+		key, ok = a.lookup(kid)
+		a.mu.Unlock()
+		return keyOrUnknown(key, ok, kid)
+	case time.Since(a.attempted) < jwksMinRefreshInterval:
+		// Fetched, or failed to, too recently to try again
+		a.mu.Unlock()
+		return keyOrUnknown(key, ok, kid)
+	}
+	fetching := make(chan struct{})
+	a.fetching, a.attempted = fetching, time.Now()
+	a.mu.Unlock()
+
+	keys, err := a.fetch()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fetching = nil
+	close(fetching)
+	if err != nil {
+		// Stick with the keys we have until the key set is back
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	a.keys, a.fetched = keys, time.Now()
+	key, ok = a.lookup(kid)
+	return keyOrUnknown(key, ok, kid)
+}
+
+func keyOrUnknown(key interface{}, ok bool, kid string) (interface{}, error) {
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup finds a key by id. Tokens without a key id can only be
+// checked against a key set of one key.
+func (a *JWTAuthenticator) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+// jwk is a JSON Web Key, as much of it as is needed for RSA and EC
+// public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch downloads the key set, skipping keys that aren't for
+// signatures or of a kind it doesn't know.
+func (a *JWTAuthenticator) fetch() (map[string]interface{}, error) {
+	response, err := a.client.Get(a.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", a.JWKSURL, response.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", a.JWKSURL, err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %q", k.Kty)
+	}
+}
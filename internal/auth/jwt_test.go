@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksServer publishes a key set of one RSA key, answering with status
+// (or the keys, if it's zero) after delay, and counts its requests.
+type jwksServer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	requests int32
+	status   int32
+	delay    int64
+}
+
+func newJWKSServer(t *testing.T, delay time.Duration) *jwksServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &jwksServer{key: key, delay: int64(delay)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		select {
+		case <-time.After(time.Duration(atomic.LoadInt64(&s.delay))):
+		case <-r.Context().Done():
+			return
+		}
+		if status := atomic.LoadInt32(&s.status); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []jwk{{
+				Kty: "RSA",
+				Kid: "key-1",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) request(t *testing.T, kid string) *http.Request {
+	t.Helper()
+	return s.requestFrom(t, kid, "https://idp.example.test")
+}
+
+// requestFrom is a request with a token for alice from issuer.
+func (s *jwksServer) requestFrom(t *testing.T, kid string, issuer string) *http.Request {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": issuer,
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	r.Header.Set("Authorization", "Bearer "+signed)
+	return r
+}
+
+func newTestJWTAuthenticator(t *testing.T, s *jwksServer, client *http.Client) *JWTAuthenticator {
+	t.Helper()
+	a, err := NewJWTAuthenticator(s.URL, "", "", "", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	s := newJWKSServer(t, 0)
+	a := newTestJWTAuthenticator(t, s, nil)
+
+	identity, err := a.Authenticate(s.request(t, "key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "jwt:https://idp.example.test|alice" || identity.Method != MethodJWT {
+		t.Errorf("authenticated as %s by %s", identity.Subject, identity.Method)
+	}
+	// Another issuer's alice is someone else
+	other, err := a.Authenticate(s.requestFrom(t, "key-1", "https://other.example.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Subject == identity.Subject {
+		t.Errorf("alice of two issuers are both %s", other.Subject)
+	}
+	if _, err := a.Authenticate(s.request(t, "key-2")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown key: got %v, want invalid credentials", err)
+	}
+	// The unknown key was fetched for just once
+	if requests := atomic.LoadInt32(&s.requests); requests != 1 {
+		t.Errorf("key set fetched %d times, want 1", requests)
+	}
+}
+
+func TestJWTFetchTimeout(t *testing.T) {
+	if a := newTestJWTAuthenticator(t, newJWKSServer(t, 0), &http.Client{}); a.client.Timeout != jwksFetchTimeout {
+		t.Errorf("client times out after %v, want %v", a.client.Timeout, jwksFetchTimeout)
+	}
+
+	s := newJWKSServer(t, time.Minute)
+	a := newTestJWTAuthenticator(t, s, &http.Client{Timeout: 50 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Authenticate(s.request(t, "key-1"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("got %v, want invalid credentials", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("authentication blocked on a hung key set endpoint")
+	}
+}
+
+func TestJWTFailedFetchIsRateLimited(t *testing.T) {
+	s := newJWKSServer(t, 0)
+	atomic.StoreInt32(&s.status, http.StatusServiceUnavailable)
+	a := newTestJWTAuthenticator(t, s, nil)
+
+	for i := 0; i < 5; i++ {
+		if _, err := a.Authenticate(s.request(t, "key-1")); err == nil {
+			t.Fatal("authenticated without a key set")
+		}
+	}
+	if requests := atomic.LoadInt32(&s.requests); requests != 1 {
+		t.Errorf("key set fetched %d times after it failed, want 1", requests)
+	}
+}
+
+func TestJWTOneFetchAtATime(t *testing.T) {
+	s := newJWKSServer(t, 100*time.Millisecond)
+	a := newTestJWTAuthenticator(t, s, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		r := s.request(t, "key-1")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Authenticate(r)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if requests := atomic.LoadInt32(&s.requests); requests != 1 {
+		t.Errorf("key set fetched %d times, want 1", requests)
+	}
+}
+
+func TestJWTStaleKeysDuringFetch(t *testing.T) {
+	s := newJWKSServer(t, 0)
+	a := newTestJWTAuthenticator(t, s, &http.Client{Timeout: 2 * time.Second})
+	if _, err := a.Authenticate(s.request(t, "key-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are due a refresh, and the key set endpoint hangs
+	a.mu.Lock()
+	a.fetched = a.fetched.Add(-2 * jwksRefreshInterval)
+	a.attempted = a.fetched
+	a.mu.Unlock()
+	atomic.StoreInt64(&s.delay, int64(time.Minute))
+	fetching := make(chan error, 1)
+	go func() {
+		_, err := a.Authenticate(s.request(t, "key-1"))
+		fetching <- err
+	}()
+	for atomic.LoadInt32(&s.requests) < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Requests meanwhile go ahead with the keys there are
+	start := time.Now()
+	if _, err := a.Authenticate(s.request(t, "key-1")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("authenticating took %v while the keys were being fetched", elapsed)
+	}
+	if err := <-fetching; err != nil {
+		t.Errorf("failed fetch: %v, want the stale key", err)
+	}
+}
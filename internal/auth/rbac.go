@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Permission is something an identity may be allowed to do.
+type Permission string
+
+// Permissions
+const (
+	// PermStatusRead is reading the status of every task, and
+	// PermStatusReadOwn of the tasks the identity owns
+	PermStatusRead    Permission = "status:read"
+	PermStatusReadOwn Permission = "status:read:own"
+	PermTaskCreate    Permission = "task:create"
+	// PermTaskControl is stopping, killing and reconfiguring any task,
+	// and PermTaskControlOwn the tasks the identity owns
+	PermTaskControl    Permission = "task:control"
+	PermTaskControlOwn Permission = "task:control:own"
+	// PermTaskReport is what workers do: report on tasks, send
+	// heartbeats, upload artifacts and publish streams
+	PermTaskReport    Permission = "task:report"
+	PermArtifactRead  Permission = "artifact:read"
+	PermStreamRead    Permission = "stream:read"
+	PermScheduleWrite Permission = "schedule:write"
+	PermTokenManage   Permission = "token:manage"
+	PermAuditRead     Permission = "audit:read"
+)
+
+// Roles
+const (
+	// RoleAdmin may do anything
+	RoleAdmin = "admin"
+	// RoleOperator may start, stop and schedule any task
+	RoleOperator = "operator"
+	// RoleRequester may start tasks, and see and stop their own
+	RoleRequester = "requester"
+	// RoleAnalyst may only read status and artifacts
+	RoleAnalyst = "analyst"
+	// RoleWorker is for workers
+	RoleWorker = "worker"
+	// RoleAuditor may read status, artifacts and the audit log
+	RoleAuditor = "auditor"
+)
+
+// rolePermissions are what each role may do.
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermStatusRead, PermTaskCreate, PermTaskControl, PermTaskReport,
+		PermArtifactRead, PermStreamRead, PermScheduleWrite, PermTokenManage,
+		PermAuditRead,
+	},
+	RoleOperator: {
+		PermStatusRead, PermTaskCreate, PermTaskControl,
+		PermArtifactRead, PermStreamRead, PermScheduleWrite,
+	},
+	RoleRequester: {
+		PermStatusReadOwn, PermTaskCreate, PermTaskControlOwn,
+		PermArtifactRead, PermStreamRead,
+	},
+	RoleAnalyst: {PermStatusRead, PermArtifactRead, PermStreamRead},
+	RoleWorker:  {PermTaskReport},
+	RoleAuditor: {PermStatusRead, PermArtifactRead, PermAuditRead},
+}
+
+// ErrForbidden is returned for requests the identity isn't allowed to make.
+var ErrForbidden = errors.New("forbidden")
+
+// IsKnownRole reports whether role is one of the roles.
+func IsKnownRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// CheckRoles returns an error naming the first of roles that isn't
+// known.
+func CheckRoles(roles []string) error {
+	for _, role := range roles {
+		if !IsKnownRole(role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+// Can reports whether the identity has permission through any of its
+// roles.
+func (i *Identity) Can(permission Permission) bool {
+	for _, role := range i.Roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Require lets requests through whose identity has any of permissions,
+// and replies 403 to the rest. Requests without an identity, which
+// Middleware only lets through with authentication off, aren't checked.
+func Require(permissions ...Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity := FromContext(c)
+			if identity == nil {
+				return next(c)
+			}
+			for _, permission := range permissions {
+				if identity.Can(permission) {
+					return next(c)
+				}
+			}
+			names := make([]string, len(permissions))
+			for i, permission := range permissions {
+				names[i] = string(permission)
+			}
+			msg := fmt.Sprintf("%v: %s needs %s", ErrForbidden, identity.Subject, strings.Join(names, " or "))
+			return c.JSON(http.StatusForbidden, map[string]string{"msg": msg})
+		}
+	}
+}
+
+// knownRoles keeps the roles in roles that are known, e.g. out of a
+// JWT's claims, which may hold roles meant for other services.
+func knownRoles(roles []string) []string {
+	var known []string
+	for _, role := range roles {
+		if IsKnownRole(role) {
+			known = append(known, role)
+		}
+	}
+	return known
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APITokenPrefix starts every API token, which tells them apart from
+// JWTs.
+const APITokenPrefix = "dc_"
+
+// ErrAPITokenNotFound is returned for API tokens that don't exist.
+var ErrAPITokenNotFound = errors.New("API token not found")
+
+// APIToken is a long-lived token for automation, such as workers and
+// scripts. Only its hash is stored; the token itself is shown once,
+// when it's created.
+type APIToken struct {
+	Id   primitive.ObjectID `json:"id" bson:"_id"`
+	Name string             `json:"name" bson:"name"`
+	// Hash is the hex SHA-256 of the token
+	Hash string `json:"-" bson:"hash"`
+	// Prefix is the start of the token, to recognize it by
+	Prefix string `json:"prefix" bson:"prefix"`
+	// Roles are what the token is allowed to do
+	Roles     []string           `json:"roles" bson:"roles"`
+	CreatedAt primitive.DateTime `json:"created_at" bson:"created_at"`
+	CreatedBy string             `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	// ExpiresAt is zero for tokens that don't expire
+	ExpiresAt primitive.DateTime `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+// Expired is whether the token has expired by now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != 0 && t.ExpiresAt.Time().Before(now)
+}
+
+// TokenStore looks up API tokens by hash.
+type TokenStore interface {
+	GetAPIToken(hash string) (*APIToken, error)
+}
+
+// NewAPIToken generates an API token named name with roles, returning
+// the record to store and the token to hand over.
+func NewAPIToken(name string, roles []string, createdBy string, expiresAt time.Time) (APIToken, string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return APIToken{}, "", err
+	}
+	token := APITokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	record := APIToken{
+		Id:        primitive.NewObjectID(),
+		Name:      name,
+		Hash:      HashAPIToken(token),
+		Prefix:    token[:len(APITokenPrefix)+6],
+		Roles:     roles,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+		CreatedBy: createdBy,
+	}
+	if !expiresAt.IsZero() {
+		record.ExpiresAt = primitive.NewDateTimeFromTime(expiresAt)
+	}
+	return record, token, nil
+}
+
+// HashAPIToken hashes an API token for storage. The tokens are random
+// enough that a fast hash is as good as a slow one.
+func HashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// TokenAuthenticator authenticates bearer API tokens.
+type TokenAuthenticator struct {
+	Tokens TokenStore
+}
+
+// Authenticate checks the request's bearer token, if it's an API
+// token, against the stored ones.
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	raw := bearerToken(r)
+	if !strings.HasPrefix(raw, APITokenPrefix) {
+		return nil, ErrNoCredentials
+	}
+	token, err := a.Tokens.GetAPIToken(HashAPIToken(raw))
+	if errors.Is(err, ErrAPITokenNotFound) {
+		return nil, fmt.Errorf("%w: unknown API token", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Expired(time.Now()) {
+		return nil, fmt.Errorf("%w: API token %q has expired", ErrInvalidCredentials, token.Name)
+	}
+	// Token names needn't be unique, so the token is known by its id
+	return &Identity{Subject: "token:" + token.Id.Hex(), Method: MethodToken, Roles: token.Roles}, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tokenMap is a TokenStore of tokens by hash.
+type tokenMap map[string]APIToken
+
+func (m tokenMap) GetAPIToken(hash string) (*APIToken, error) {
+	token, ok := m[hash]
+	if !ok {
+		return nil, ErrAPITokenNotFound
+	}
+	return &token, nil
+}
+
+func tokenRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestTokenAuthenticate(t *testing.T) {
+	tokens := tokenMap{}
+	a := &TokenAuthenticator{Tokens: tokens}
+	newToken := func(name string, expiresAt time.Time) string {
+		record, token, err := NewAPIToken(name, []string{RoleOperator}, "admin", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[record.Hash] = record
+		return token
+	}
+	// Two tokens by the same name
+	first, second := newToken("ci", time.Time{}), newToken("ci", time.Time{})
+	expired := newToken("old", time.Now().Add(-time.Minute))
+
+	identities := map[string]bool{}
+	for _, token := range []string{first, second} {
+		identity, err := a.Authenticate(tokenRequest(token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.Method != MethodToken || len(identity.Roles) != 1 || identity.Roles[0] != RoleOperator {
+			t.Errorf("authenticated by %s with roles %v", identity.Method, identity.Roles)
+		}
+		identities[identity.Subject] = true
+	}
+	if len(identities) != 2 {
+		t.Errorf("two tokens named ci are both %v", identities)
+	}
+
+	for name, token := range map[string]string{"expired": expired, "unknown": APITokenPrefix + "nope"} {
+		if _, err := a.Authenticate(tokenRequest(token)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s token: got %v, want invalid credentials", name, err)
+		}
+	}
+	if _, err := a.Authenticate(tokenRequest("eyJhbGciOi")); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("JWT: got %v, want no credentials", err)
+	}
+}
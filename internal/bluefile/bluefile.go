@@ -0,0 +1,426 @@
+// Package bluefile reads X-Midas BLUE files (also known as Platinum
+// files), the format SigPlot reads natively, and writes simple ones.
+//
+// A BLUE file starts with a 512-byte header control block: the fixed
+// header, up to 92 bytes of main header keywords, and a 256-byte
+// adjunct header whose layout depends on the file's type. Type 1000
+// files hold one-dimensional data and type 2000 files frames of
+// Subsize elements. An optional extended header of typed keywords
+// follows the data.
+package bluefile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// HeaderSize is the size of the header control block, and the unit
+// ExtStart is counted in.
+const HeaderSize = 512
+
+// maxExtSize bounds how much extended header ReadHeader will read.
+const maxExtSize = 16 << 20
+
+// ErrNotBlue is returned for files that don't start with a BLUE header.
+var ErrNotBlue = errors.New("not a BLUE file")
+
+// epoch is when BLUE timecodes count from.
+var epoch = time.Date(1950, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Header is a parsed BLUE header, along with what follows from it
+// about the data.
+type Header struct {
+	Version string `json:"version" bson:"version"`
+	// HeadRep and DataRep are the byte orders of the header and the
+	// data: `EEEI` for little-endian, `IEEE` for big-endian
+	HeadRep  string `json:"head_rep" bson:"head_rep"`
+	DataRep  string `json:"data_rep" bson:"data_rep"`
+	Detached bool   `json:"detached,omitempty" bson:"detached,omitempty"`
+	// ExtStart is where the extended header starts, in 512-byte
+	// blocks, and ExtSize its size in bytes
+	ExtStart int `json:"ext_start" bson:"ext_start"`
+	ExtSize  int `json:"ext_size" bson:"ext_size"`
+	// DataStart and DataSize are the offset and size of the data,
+	// in bytes
+	DataStart float64 `json:"data_start" bson:"data_start"`
+	DataSize  float64 `json:"data_size" bson:"data_size"`
+	Type      int     `json:"type" bson:"type"`
+	Format    string  `json:"format" bson:"format"`
+	// TimeCode is the time of the first sample, in seconds since
+	// 1950-01-01 UTC; zero if it isn't set
+	TimeCode float64    `json:"timecode,omitempty" bson:"timecode,omitempty"`
+	Time     *time.Time `json:"time,omitempty" bson:"time,omitempty"`
+
+	// The type 1000 and 2000 adjunct header
+	XStart  float64 `json:"xstart" bson:"xstart"`
+	XDelta  float64 `json:"xdelta" bson:"xdelta"`
+	XUnits  int     `json:"xunits" bson:"xunits"`
+	Subsize int     `json:"subsize,omitempty" bson:"subsize,omitempty"`
+	YStart  float64 `json:"ystart,omitempty" bson:"ystart,omitempty"`
+	YDelta  float64 `json:"ydelta,omitempty" bson:"ydelta,omitempty"`
+	YUnits  int     `json:"yunits,omitempty" bson:"yunits,omitempty"`
+
+	// ElementSize is the size of one element (e.g., one complex
+	// sample) in bytes, Elements how many elements the data holds and,
+	// for type 2000 files, Frames how many frames
+	ElementSize float64 `json:"element_size" bson:"element_size"`
+	Elements    int64   `json:"elements" bson:"elements"`
+	Frames      int64   `json:"frames,omitempty" bson:"frames,omitempty"`
+	// Duration is the span of the data along x, in XUnits
+	Duration float64 `json:"duration,omitempty" bson:"duration,omitempty"`
+
+	// Keywords are the main header's keywords and ExtKeywords the
+	// extended header's
+	Keywords    []Keyword `json:"keywords,omitempty" bson:"keywords,omitempty"`
+	ExtKeywords []Keyword `json:"ext_keywords,omitempty" bson:"ext_keywords,omitempty"`
+}
+
+// Keyword is a header keyword. Main header keywords are always strings;
+// extended header keywords are typed, Type being their format type
+// code (e.g. `D` for float64).
+type Keyword struct {
+	Name  string      `json:"name" bson:"name"`
+	Type  string      `json:"type" bson:"type"`
+	Value interface{} `json:"value" bson:"value"`
+}
+
+// ByteOrder is the byte order of the file's data.
+func (h *Header) ByteOrder() binary.ByteOrder {
+	return byteOrder(h.DataRep)
+}
+
+func byteOrder(rep string) binary.ByteOrder {
+	if rep == "IEEE" {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Keyword looks up a keyword by name, in the extended header first.
+func (h *Header) Keyword(name string) (interface{}, bool) {
+	for _, keywords := range [][]Keyword{h.ExtKeywords, h.Keywords} {
+		for _, keyword := range keywords {
+			if keyword.Name == name {
+				return keyword.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ReadHeader reads the header control block from the start of r and,
+// if the file has one, the extended header. Only the header is read,
+// not the data.
+func ReadHeader(r io.ReadSeeker) (*Header, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hcb := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, hcb); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrNotBlue
+		}
+		return nil, err
+	}
+	h, err := ParseHeader(hcb)
+	if err != nil {
+		return nil, err
+	}
+	if h.ExtSize <= 0 {
+		return h, nil
+	}
+
+	if h.ExtSize > maxExtSize {
+		return nil, fmt.Errorf("extended header of %d bytes is too large", h.ExtSize)
+	}
+	if _, err := r.Seek(int64(h.ExtStart)*HeaderSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	ext := make([]byte, h.ExtSize)
+	if _, err := io.ReadFull(r, ext); err != nil {
+		return nil, fmt.Errorf("reading extended header: %w", err)
+	}
+	h.ExtKeywords, err = ParseExtKeywords(ext, byteOrder(h.HeadRep))
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ParseHeader parses a 512-byte header control block.
+func ParseHeader(hcb []byte) (*Header, error) {
+	if len(hcb) < HeaderSize || string(hcb[0:4]) != "BLUE" {
+		return nil, ErrNotBlue
+	}
+	h := &Header{
+		Version: string(hcb[0:4]),
+		HeadRep: string(hcb[4:8]),
+		DataRep: string(hcb[8:12]),
+	}
+	for _, rep := range []string{h.HeadRep, h.DataRep} {
+		if rep != "EEEI" && rep != "IEEE" {
+			return nil, fmt.Errorf("%w: unknown representation %q", ErrNotBlue, rep)
+		}
+	}
+	order := byteOrder(h.HeadRep)
+	i32 := func(offset int) int { return int(int32(order.Uint32(hcb[offset:]))) }
+	f64 := func(offset int) float64 { return math.Float64frombits(order.Uint64(hcb[offset:])) }
+
+	h.Detached = i32(12) != 0
+	h.ExtStart = i32(24)
+	h.ExtSize = i32(28)
+	h.DataStart = f64(32)
+	h.DataSize = f64(40)
+	h.Type = i32(48)
+	h.Format = string(hcb[52:54])
+	h.TimeCode = f64(56)
+	if h.TimeCode != 0 {
+		seconds, fraction := math.Modf(h.TimeCode)
+		t := epoch.Add(time.Duration(seconds) * time.Second).Add(time.Duration(fraction * float64(time.Second)))
+		h.Time = &t
+	}
+
+	keyLength := i32(160)
+	if keyLength < 0 || keyLength > 92 {
+		keyLength = 92
+	}
+	h.Keywords = parseMainKeywords(hcb[164 : 164+keyLength])
+
+	adjunct := 256
+	switch h.Type / 1000 {
+	case 1:
+		h.XStart = f64(adjunct)
+		h.XDelta = f64(adjunct + 8)
+		h.XUnits = i32(adjunct + 16)
+	case 2:
+		h.XStart = f64(adjunct)
+		h.XDelta = f64(adjunct + 8)
+		h.XUnits = i32(adjunct + 16)
+		h.Subsize = i32(adjunct + 20)
+		h.YStart = f64(adjunct + 24)
+		h.YDelta = f64(adjunct + 32)
+		h.YUnits = i32(adjunct + 40)
+	}
+
+	if size, err := ElementSize(h.Format); err == nil {
+		h.ElementSize = size
+		h.Elements = int64(h.DataSize / size)
+	}
+	switch {
+	case h.Type/1000 == 2 && h.Subsize > 0:
+		h.Frames = h.Elements / int64(h.Subsize)
+		h.Duration = float64(h.Frames) * h.YDelta
+	case h.Type/1000 == 1:
+		h.Duration = float64(h.Elements) * h.XDelta
+	}
+	return h, nil
+}
+
+// parseMainKeywords splits the main header's `NAME=VALUE` keywords,
+// which are separated by NULs.
+func parseMainKeywords(raw []byte) []Keyword {
+	var keywords []Keyword
+	for _, field := range bytes.Split(raw, []byte{0}) {
+		pair := strings.TrimSpace(string(field))
+		if pair == "" {
+			continue
+		}
+		name, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			name, value = pair[:i], pair[i+1:]
+		}
+		keywords = append(keywords, Keyword{Name: name, Type: "A", Value: value})
+	}
+	return keywords
+}
+
+// ParseExtKeywords parses an extended header. Each keyword is a record
+// of its total length (int32), the length of everything but its value
+// (int16), the length of its name (int8) and its type code, followed
+// by its value, its name and padding to a multiple of 8 bytes.
+func ParseExtKeywords(ext []byte, order binary.ByteOrder) ([]Keyword, error) {
+	var keywords []Keyword
+	for offset := 0; offset+8 <= len(ext); {
+		lkey := int(int32(order.Uint32(ext[offset:])))
+		lext := int(int16(order.Uint16(ext[offset+4:])))
+		ltag := int(ext[offset+6])
+		typ := ext[offset+7]
+		if lkey == 0 {
+			// Trailing padding
+			break
+		}
+		if lkey < 8 || lext < 8+ltag || lext > lkey || offset+lkey > len(ext) {
+			return keywords, fmt.Errorf("malformed extended header keyword at byte %d", offset)
+		}
+
+		valueStart := offset + 8
+		valueEnd := offset + lkey - lext + 8
+		name := string(ext[valueEnd : valueEnd+ltag])
+		value, err := decodeValue(ext[valueStart:valueEnd], typ, order)
+		if err != nil {
+			return keywords, fmt.Errorf("extended header keyword %s: %w", name, err)
+		}
+		keywords = append(keywords, Keyword{Name: name, Type: string(typ), Value: value})
+		offset += lkey
+	}
+	return keywords, nil
+}
+
+// decodeValue decodes a keyword value of type typ: a single value, or
+// a slice of them if there's more than one.
+func decodeValue(raw []byte, typ byte, order binary.ByteOrder) (interface{}, error) {
+	if typ == 'A' || typ == 'a' {
+		return strings.TrimRight(string(raw), "\x00 "), nil
+	}
+
+	var size int
+	var decode func([]byte) interface{}
+	switch typ {
+	case 'B', 'b':
+		size, decode = 1, func(b []byte) interface{} { return int8(b[0]) }
+	case 'O', 'o':
+		size, decode = 1, func(b []byte) interface{} { return b[0] }
+	case 'I', 'i':
+		size, decode = 2, func(b []byte) interface{} { return int16(order.Uint16(b)) }
+	case 'L', 'l':
+		size, decode = 4, func(b []byte) interface{} { return int32(order.Uint32(b)) }
+	case 'X', 'x':
+		size, decode = 8, func(b []byte) interface{} { return int64(order.Uint64(b)) }
+	case 'F', 'f':
+		size, decode = 4, func(b []byte) interface{} { return float64(math.Float32frombits(order.Uint32(b))) }
+	case 'D', 'd':
+		size, decode = 8, func(b []byte) interface{} { return math.Float64frombits(order.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+	if len(raw)%size != 0 {
+		return nil, fmt.Errorf("%d bytes isn't a whole number of type %q values", len(raw), typ)
+	}
+
+	values := make([]interface{}, len(raw)/size)
+	for i := range values {
+		values[i] = decode(raw[i*size:])
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return values, nil
+}
+
+// formatModes are the number of values in an element of each format
+// mode (the first letter of the format code).
+var formatModes = map[byte]int{
+	'S': 1, 'C': 2, 'V': 3, 'Q': 4, 'M': 9, 'T': 16,
+	'1': 1, '2': 2, '3': 3, '4': 4, '5': 5, '6': 6, '7': 7, '8': 8, '9': 9,
+}
+
+// formatTypes are the sizes, in bytes, of a value of each format type
+// (the second letter of the format code). `P` is packed bits.
+var formatTypes = map[byte]float64{
+	'P': 1.0 / 8, 'O': 1, 'B': 1, 'I': 2, 'L': 4, 'X': 8, 'F': 4, 'D': 8, 'A': 1,
+}
+
+// ElementSize is the size in bytes of one element of format, e.g. 8
+// for `CF` (a pair of float32s).
+func ElementSize(format string) (float64, error) {
+	if len(format) != 2 {
+		return 0, fmt.Errorf("format %q must be two letters", format)
+	}
+	mode, ok := formatModes[format[0]]
+	if !ok {
+		return 0, fmt.Errorf("format %q has unknown mode %q", format, format[0])
+	}
+	size, ok := formatTypes[format[1]]
+	if !ok {
+		return 0, fmt.Errorf("format %q has unknown type %q", format, format[1])
+	}
+	return float64(mode) * size, nil
+}
+
+// NewHeader makes the header of a BLUE file of data in format, with
+// no extended header, data starting right after the header and the
+// data's byte order. Keywords go in the main header, as far as they
+// fit.
+func NewHeader(typ int, format string, dataSize int64, keywords []Keyword) *Header {
+	h := &Header{
+		Version:   "BLUE",
+		HeadRep:   "EEEI",
+		DataRep:   "EEEI",
+		DataStart: HeaderSize,
+		DataSize:  float64(dataSize),
+		Type:      typ,
+		Format:    format,
+		Keywords:  keywords,
+	}
+	if size, err := ElementSize(format); err == nil {
+		h.ElementSize = size
+		h.Elements = int64(float64(dataSize) / size)
+	}
+	return h
+}
+
+// MarshalBinary encodes the header control block of a type 1000 or
+// 2000 file. Main header keywords that don't fit in its 92 bytes are
+// left out, as is the extended header.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if h.HeadRep != "EEEI" && h.HeadRep != "IEEE" {
+		return nil, fmt.Errorf("unknown representation %q", h.HeadRep)
+	}
+	hcb := make([]byte, HeaderSize)
+	order := byteOrder(h.HeadRep)
+	putI32 := func(offset int, v int) { order.PutUint32(hcb[offset:], uint32(int32(v))) }
+	putF64 := func(offset int, v float64) { order.PutUint64(hcb[offset:], math.Float64bits(v)) }
+
+	copy(hcb[0:4], "BLUE")
+	copy(hcb[4:8], h.HeadRep)
+	copy(hcb[8:12], h.DataRep)
+	if h.Detached {
+		putI32(12, 1)
+	}
+	putI32(24, h.ExtStart)
+	putI32(28, h.ExtSize)
+	putF64(32, h.DataStart)
+	putF64(40, h.DataSize)
+	putI32(48, h.Type)
+	copy(hcb[52:54], h.Format)
+	putF64(56, h.TimeCode)
+
+	var keywords strings.Builder
+	for _, keyword := range h.Keywords {
+		pair := fmt.Sprintf("%s=%v", keyword.Name, keyword.Value)
+		if keywords.Len() > 0 {
+			pair = "\x00" + pair
+		}
+		if keywords.Len()+len(pair) > 92 {
+			break
+		}
+		keywords.WriteString(pair)
+	}
+	putI32(160, keywords.Len())
+	copy(hcb[164:256], keywords.String())
+
+	adjunct := 256
+	switch h.Type / 1000 {
+	case 1:
+		putF64(adjunct, h.XStart)
+		putF64(adjunct+8, h.XDelta)
+		putI32(adjunct+16, h.XUnits)
+	case 2:
+		putF64(adjunct, h.XStart)
+		putF64(adjunct+8, h.XDelta)
+		putI32(adjunct+16, h.XUnits)
+		putI32(adjunct+20, h.Subsize)
+		putF64(adjunct+24, h.YStart)
+		putF64(adjunct+32, h.YDelta)
+		putI32(adjunct+40, h.YUnits)
+	default:
+		return nil, fmt.Errorf("can't encode type %d headers", h.Type)
+	}
+	return hcb, nil
+}
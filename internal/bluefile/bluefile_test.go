@@ -0,0 +1,286 @@
+package bluefile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	keywords := []Keyword{
+		{Name: "IO", Type: "A", Value: "X-Midas"},
+		{Name: "VER", Type: "A", Value: "2.0"},
+	}
+	for _, rep := range []string{"EEEI", "IEEE"} {
+		for _, typ := range []int{1000, 2000} {
+			h := NewHeader(typ, "CF", 8*4096, keywords)
+			h.HeadRep, h.DataRep = rep, rep
+			h.XStart, h.XDelta, h.XUnits = 1.5, 1e-6, 1
+			h.TimeCode = 2.5e9 + 0.25
+			if typ == 2000 {
+				h.Subsize = 1024
+				h.YStart, h.YDelta, h.YUnits = 0, 1e-3, 1
+			}
+
+			hcb, err := h.MarshalBinary()
+			if err != nil {
+				t.Fatalf("type %d %s: %v", typ, rep, err)
+			}
+			if len(hcb) != HeaderSize {
+				t.Fatalf("type %d %s: header is %d bytes, want %d", typ, rep, len(hcb), HeaderSize)
+			}
+			got, err := ParseHeader(hcb)
+			if err != nil {
+				t.Fatalf("type %d %s: %v", typ, rep, err)
+			}
+
+			if got.HeadRep != rep || got.DataRep != rep {
+				t.Errorf("type %d %s: representations are %s/%s", typ, rep, got.HeadRep, got.DataRep)
+			}
+			if got.Type != typ || got.Format != "CF" {
+				t.Errorf("type %d %s: got type %d format %s", typ, rep, got.Type, got.Format)
+			}
+			if got.DataStart != HeaderSize || got.DataSize != 8*4096 {
+				t.Errorf("type %d %s: data is %v bytes at %v", typ, rep, got.DataSize, got.DataStart)
+			}
+			if got.XStart != h.XStart || got.XDelta != h.XDelta || got.XUnits != h.XUnits {
+				t.Errorf("type %d %s: x is %v+%v (units %d)", typ, rep, got.XStart, got.XDelta, got.XUnits)
+			}
+			if got.TimeCode != h.TimeCode || got.Time == nil {
+				t.Errorf("type %d %s: timecode is %v, time %v", typ, rep, got.TimeCode, got.Time)
+			}
+			if got.ElementSize != 8 || got.Elements != 4096 {
+				t.Errorf("type %d %s: %d elements of %v bytes", typ, rep, got.Elements, got.ElementSize)
+			}
+			if !reflect.DeepEqual(got.Keywords, keywords) {
+				t.Errorf("type %d %s: keywords are %v, want %v", typ, rep, got.Keywords, keywords)
+			}
+
+			switch typ {
+			case 1000:
+				if want := 4096 * h.XDelta; got.Duration != want {
+					t.Errorf("type %d %s: duration is %v, want %v", typ, rep, got.Duration, want)
+				}
+			case 2000:
+				if got.Subsize != 1024 || got.YDelta != h.YDelta || got.YUnits != h.YUnits {
+					t.Errorf("type %d %s: frames of %d every %v (units %d)", typ, rep, got.Subsize, got.YDelta, got.YUnits)
+				}
+				if got.Frames != 4 || got.Duration != 4*h.YDelta {
+					t.Errorf("type %d %s: %d frames over %v", typ, rep, got.Frames, got.Duration)
+				}
+			}
+		}
+	}
+}
+
+func TestParseHeaderNotBlue(t *testing.T) {
+	hcb, err := NewHeader(1000, "SF", 0, nil).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := hcb[:100]
+	notBlue := append([]byte("RIFF"), hcb[4:]...)
+	badRep := append([]byte(nil), hcb...)
+	copy(badRep[4:8], "VAXD")
+	for name, hcb := range map[string][]byte{"short": short, "magic": notBlue, "representation": badRep} {
+		if _, err := ParseHeader(hcb); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+// extKeyword encodes an extended header keyword the way X-Midas lays
+// them out: lkey, lext, ltag and type, then the value, the name and
+// padding to a multiple of 8 bytes.
+func extKeyword(order binary.ByteOrder, name string, typ byte, value []byte) []byte {
+	padding := (8 - (8+len(value)+len(name))%8) % 8
+	lext := 8 + len(name) + padding
+	lkey := lext + len(value)
+	raw := make([]byte, 8, lkey)
+	order.PutUint32(raw, uint32(lkey))
+	order.PutUint16(raw[4:], uint16(lext))
+	raw[6] = byte(len(name))
+	raw[7] = typ
+	raw = append(raw, value...)
+	raw = append(raw, name...)
+	return append(raw, make([]byte, padding)...)
+}
+
+func TestReadHeaderExtended(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f64 := make([]byte, 8)
+		order.PutUint64(f64, math.Float64bits(2.4e9))
+		i32s := make([]byte, 12)
+		for i, v := range []int32{1, -2, 3} {
+			order.PutUint32(i32s[4*i:], uint32(v))
+		}
+		var ext []byte
+		// Names and values of lengths that need no padding, and 1, 4
+		// and 6 bytes of it
+		ext = append(ext, extKeyword(order, "CENTERHZ", 'D', f64)...)
+		ext = append(ext, extKeyword(order, "RF_FREQ", 'D', f64)...)
+		ext = append(ext, extKeyword(order, "CHANNELS", 'L', i32s)...)
+		ext = append(ext, extKeyword(order, "SITE", 'A', []byte("north field"))...)
+		ext = append(ext, extKeyword(order, "G", 'B', []byte{0xfe})...)
+		// Trailing padding
+		ext = append(ext, make([]byte, 16)...)
+
+		rep := "EEEI"
+		if order == binary.BigEndian {
+			rep = "IEEE"
+		}
+		h := NewHeader(1000, "SF", 16, nil)
+		h.HeadRep, h.DataRep = rep, rep
+		// The data fills the second block and the extended header
+		// starts on the third
+		h.ExtStart = 2
+		h.ExtSize = len(ext)
+		hcb, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := append(hcb, make([]byte, 16)...)
+		file = append(file, make([]byte, HeaderSize-len(file)%HeaderSize)...)
+		file = append(file, ext...)
+
+		got, err := ReadHeader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: %v", rep, err)
+		}
+		want := []Keyword{
+			{Name: "CENTERHZ", Type: "D", Value: 2.4e9},
+			{Name: "RF_FREQ", Type: "D", Value: 2.4e9},
+			{Name: "CHANNELS", Type: "L", Value: []interface{}{int32(1), int32(-2), int32(3)}},
+			{Name: "SITE", Type: "A", Value: "north field"},
+			{Name: "G", Type: "B", Value: int8(-2)},
+		}
+		if !reflect.DeepEqual(got.ExtKeywords, want) {
+			t.Errorf("%s: extended keywords are %#v, want %#v", rep, got.ExtKeywords, want)
+		}
+		if v, ok := got.Keyword("SITE"); !ok || v != "north field" {
+			t.Errorf("%s: Keyword(SITE) = %v, %v", rep, v, ok)
+		}
+	}
+}
+
+func TestParseExtKeywordsMalformed(t *testing.T) {
+	order := binary.LittleEndian
+	valid := extKeyword(order, "GAIN", 'D', make([]byte, 8))
+	with := func(change func(raw []byte) []byte) []byte {
+		return change(append([]byte(nil), valid...))
+	}
+
+	tests := map[string][]byte{
+		"lkey too small": with(func(raw []byte) []byte {
+			order.PutUint32(raw, 4)
+			return raw
+		}),
+		"negative lkey": with(func(raw []byte) []byte {
+			order.PutUint32(raw, uint32(0xfffffff8))
+			return raw
+		}),
+		"lkey past the end": with(func(raw []byte) []byte {
+			order.PutUint32(raw, uint32(len(raw)+8))
+			return raw
+		}),
+		"lext past lkey": with(func(raw []byte) []byte {
+			order.PutUint16(raw[4:], uint16(len(raw)+8))
+			return raw
+		}),
+		"negative lext": with(func(raw []byte) []byte {
+			order.PutUint16(raw[4:], 0xfff0)
+			return raw
+		}),
+		"name past lext": with(func(raw []byte) []byte {
+			raw[6] = 200
+			return raw
+		}),
+		"unknown type": with(func(raw []byte) []byte {
+			raw[7] = 'Z'
+			return raw
+		}),
+		"partial value": extKeyword(order, "GAIN", 'D', make([]byte, 6)),
+		"truncated":     valid[:len(valid)-4],
+		"bad second keyword": append(append([]byte(nil), valid...), with(func(raw []byte) []byte {
+			order.PutUint32(raw, 3)
+			return raw
+		})...),
+	}
+	for name, ext := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panicked: %v", name, r)
+				}
+			}()
+			if _, err := ParseExtKeywords(ext, order); err == nil {
+				t.Errorf("%s: parsed", name)
+			}
+		}()
+	}
+}
+
+func TestReadHeaderExtendedTooLarge(t *testing.T) {
+	h := NewHeader(1000, "SF", 0, nil)
+	h.ExtStart = 1
+	h.ExtSize = maxExtSize + 1
+	hcb, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHeader(bytes.NewReader(hcb)); err == nil {
+		t.Error("read an oversized extended header")
+	}
+}
+
+func TestNewDataReaderWindow(t *testing.T) {
+	values := []float64{0, 1, 2, 3, 4, 5, 6, 7}
+	hcb, err := NewHeader(1000, "SF", 4*int64(len(values)), nil).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ParseHeader(hcb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := append(hcb, EncodeFloat32(values, h.ByteOrder())...)
+
+	tests := []struct {
+		offset, count int64
+		want          []float64
+	}{
+		{0, 8, values},
+		{2, 3, []float64{2, 3, 4}},
+		{6, 10, []float64{6, 7}},
+		{5, -1, []float64{5, 6, 7}},
+		// offset+count would overflow
+		{1, math.MaxInt64, values[1:]},
+		{8, 1, nil},
+	}
+	for _, test := range tests {
+		data, err := h.NewDataReader(bytes.NewReader(file), test.offset, test.count)
+		if err != nil {
+			t.Errorf("offset %d count %d: %v", test.offset, test.count, err)
+			continue
+		}
+		if data.Remaining() != int64(len(test.want)) {
+			t.Errorf("offset %d count %d: %d elements to read, want %d", test.offset, test.count, data.Remaining(), len(test.want))
+		}
+		var got []float64
+		value := make([]float64, 1)
+		for data.ReadElement(value) == nil {
+			got = append(got, value[0])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("offset %d count %d: read %v, want %v", test.offset, test.count, got, test.want)
+		}
+	}
+
+	for _, offset := range []int64{-1, 9} {
+		if _, err := h.NewDataReader(bytes.NewReader(file), offset, 1); err == nil {
+			t.Errorf("read from offset %d of 8 elements", offset)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package bluefile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrUnsupportedFormat is returned when reading data in a format whose
+// values can't be converted to numbers, e.g. packed bits.
+var ErrUnsupportedFormat = errors.New("unsupported data format")
+
+// Components is the number of values in an element of format, e.g. 2
+// for complex formats.
+func Components(format string) int {
+	if len(format) == 0 {
+		return 0
+	}
+	return formatModes[format[0]]
+}
+
+// valueDecoder converts one value of a format type to a float64.
+func valueDecoder(typ byte, order binary.ByteOrder) (int, func([]byte) float64, error) {
+	switch typ {
+	case 'B':
+		return 1, func(b []byte) float64 { return float64(int8(b[0])) }, nil
+	case 'O':
+		return 1, func(b []byte) float64 { return float64(b[0]) }, nil
+	case 'I':
+		return 2, func(b []byte) float64 { return float64(int16(order.Uint16(b))) }, nil
+	case 'L':
+		return 4, func(b []byte) float64 { return float64(int32(order.Uint32(b))) }, nil
+	case 'X':
+		return 8, func(b []byte) float64 { return float64(int64(order.Uint64(b))) }, nil
+	case 'F':
+		return 4, func(b []byte) float64 { return float64(math.Float32frombits(order.Uint32(b))) }, nil
+	case 'D':
+		return 8, func(b []byte) float64 { return math.Float64frombits(order.Uint64(b)) }, nil
+	default:
+		return 0, nil, fmt.Errorf("%w: type %q", ErrUnsupportedFormat, typ)
+	}
+}
+
+// DataReader reads a window of a BLUE file's elements as float64s.
+type DataReader struct {
+	r          *bufio.Reader
+	decode     func([]byte) float64
+	valueSize  int
+	components int
+	remaining  int64
+	buf        []byte
+}
+
+// NewDataReader reads count elements of the data in r, starting at
+// element offset. count is cut short at the end of the data.
+func (h *Header) NewDataReader(r io.ReadSeeker, offset int64, count int64) (*DataReader, error) {
+	if h.Detached {
+		return nil, errors.New("the file's data is detached")
+	}
+	if len(h.Format) != 2 {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, h.Format)
+	}
+	valueSize, decode, err := valueDecoder(h.Format[1], h.ByteOrder())
+	if err != nil {
+		return nil, err
+	}
+	components := Components(h.Format)
+	if components == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, h.Format)
+	}
+	if offset < 0 || offset > h.Elements {
+		return nil, fmt.Errorf("offset %d is outside the data's %d elements", offset, h.Elements)
+	}
+	if count < 0 || count > h.Elements-offset {
+		count = h.Elements - offset
+	}
+
+	start := int64(h.DataStart) + offset*int64(valueSize*components)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &DataReader{
+		r:          bufio.NewReaderSize(r, 64<<10),
+		decode:     decode,
+		valueSize:  valueSize,
+		components: components,
+		remaining:  count,
+		buf:        make([]byte, valueSize*components),
+	}, nil
+}
+
+// Components is the number of values in each element read.
+func (d *DataReader) Components() int {
+	return d.components
+}
+
+// Remaining is the number of elements left to read.
+func (d *DataReader) Remaining() int64 {
+	return d.remaining
+}
+
+// ReadElement reads the next element's values into values, which must
+// have room for Components of them. It returns io.EOF after the last
+// element of the window.
+func (d *DataReader) ReadElement(values []float64) error {
+	if d.remaining <= 0 {
+		return io.EOF
+	}
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	for i := 0; i < d.components; i++ {
+		values[i] = d.decode(d.buf[i*d.valueSize:])
+	}
+	d.remaining--
+	return nil
+}
+
+// EncodeFloat32 encodes values as float32s in order, for the data of
+// an `SF` or `CF` file.
+func EncodeFloat32(values []float64, order binary.ByteOrder) []byte {
+	raw := make([]byte, 4*len(values))
+	for i, v := range values {
+		order.PutUint32(raw[4*i:], math.Float32bits(float32(v)))
+	}
+	return raw
+}
@@ -3,20 +3,60 @@ package config
 // Config is a struct that encapsulates CLI-parsed arguments.
 // Note that it is also JSON serializable and deserializable.
 type Config struct {
-	Host               string `json:"host"`
-	Port               int    `json:"port"`
-	Debug              bool   `json:"debug"`
-	MongoHost          string `json:"mongo_host"`
-	MongoPort          int    `json:"mongo_port"`
-	MongoDatabaseName  string `json:"mongo_dbname"`
-	AMQPHost           string `json:"amqp_host"`
-	AMQPPort           int    `json:"amqp_port"`
-	AMQPUser           string `json:"amqp_user"`
-	AMQPPassword       string `json:"amqp_password"`
-	AMQPOutputExchange string `json:"amqp_output_exchange"`
-	TaskURL            string `json:"task_url"`
-	ClientCertFile     string `json:"client_certfile"`
-	ClientKeyFile      string `json:"client_keyfile"`
-	CACertFile         string `json:"cacert_file"`
-	PollingInterval    int    `json:"polling_interval"`
+	Host                 string   `json:"host"`
+	Port                 int      `json:"port"`
+	Debug                bool     `json:"debug"`
+	Store                string   `json:"store"`
+	BoltPath             string   `json:"bolt_path"`
+	Bus                  string   `json:"bus"`
+	NATSURL              string   `json:"nats_url"`
+	MongoHost            string   `json:"mongo_host"`
+	MongoPort            int      `json:"mongo_port"`
+	MongoDatabaseName    string   `json:"mongo_dbname"`
+	AMQPHost             string   `json:"amqp_host"`
+	AMQPPort             int      `json:"amqp_port"`
+	AMQPUser             string   `json:"amqp_user"`
+	AMQPPassword         string   `json:"amqp_password"`
+	AMQPOutputExchange   string   `json:"amqp_output_exchange"`
+	AMQPReportQueue      string   `json:"amqp_report_queue"`
+	AMQPControlExchange  string   `json:"amqp_control_exchange"`
+	TaskURL              string   `json:"task_url"`
+	ClientCertFile       string   `json:"client_certfile"`
+	ClientKeyFile        string   `json:"client_keyfile"`
+	CACertFile           string   `json:"cacert_file"`
+	PollingInterval      int      `json:"polling_interval"`
+	HeartbeatInterval    int      `json:"heartbeat_interval"`
+	HeartbeatMisses      int      `json:"heartbeat_misses"`
+	OutboxMaxAttempts    int      `json:"outbox_max_attempts"`
+	StopGracePeriod      int      `json:"stop_grace_period"`
+	CatalogInterval      int      `json:"catalog_interval"`
+	StreamBuffer         int      `json:"stream_buffer"`
+	StreamMaxFrame       int      `json:"stream_max_frame"`
+	ArtifactStore        string   `json:"artifact_store"`
+	ArtifactDir          string   `json:"artifact_dir"`
+	ArtifactMaxSize      int64    `json:"artifact_max_size"`
+	S3Endpoint           string   `json:"s3_endpoint"`
+	S3Bucket             string   `json:"s3_bucket"`
+	S3Region             string   `json:"s3_region"`
+	S3AccessKey          string   `json:"s3_access_key"`
+	S3SecretKey          string   `json:"s3_secret_key"`
+	Auth                 []string `json:"auth"`
+	JWKSURL              string   `json:"jwks_url"`
+	JWTIssuer            string   `json:"jwt_issuer"`
+	JWTAudience          string   `json:"jwt_audience"`
+	JWTRolesClaim        string   `json:"jwt_roles_claim"`
+	MTLSRoles            []string `json:"mtls_roles"`
+	CreateAPIToken       string   `json:"create_api_token"`
+	APITokenRoles        []string `json:"api_token_roles"`
+	TLSCertFile          string   `json:"tls_certfile"`
+	TLSKeyFile           string   `json:"tls_keyfile"`
+	TLSClientCAFile      string   `json:"tls_client_cafile"`
+	TLSRequireClientCert bool     `json:"tls_require_client_cert"`
+	TLSReloadInterval    int      `json:"tls_reload_interval"`
+	ACMEDomains          []string `json:"acme_domains"`
+	ACMEDirectoryURL     string   `json:"acme_directory_url"`
+	ACMECacheDir         string   `json:"acme_cache_dir"`
+	ACMEEmail            string   `json:"acme_email"`
+	ACMECACertFile       string   `json:"acme_cacert_file"`
+	ACMEHTTPAddress      string   `json:"acme_http_address"`
 }
@@ -0,0 +1,130 @@
+// Package dsp decimates recorded signal data and computes its spectra,
+// so it can be plotted in a browser without sending all of it.
+package dsp
+
+import (
+	"fmt"
+	"math"
+)
+
+// Decimation methods
+const (
+	// MethodMinMax keeps the smallest and largest value of each bin,
+	// in the order they occurred, so the plot keeps the data's
+	// envelope and spikes aren't lost
+	MethodMinMax = "minmax"
+	// MethodStride keeps the first value of each bin
+	MethodStride = "stride"
+	// MethodMean keeps the average of each bin
+	MethodMean = "mean"
+)
+
+// Decimator reduces a stream of elements, each of one or more values
+// (e.g. the real and imaginary parts of a complex sample), by a factor,
+// binning every factor elements into one (or, for MethodMinMax, two)
+// output elements. Each value of an element is decimated on its own.
+type Decimator struct {
+	method     string
+	factor     int64
+	components int
+
+	// n is how many elements the current bin has so far
+	n int64
+	// first and second are the bin's first value (stride), sum (mean)
+	// or minimum and maximum (minmax); firstAt and secondAt where in
+	// the bin the minimum and maximum are
+	first    []float64
+	second   []float64
+	firstAt  []int64
+	secondAt []int64
+
+	out []float64
+}
+
+// NewDecimator creates a Decimator for elements of the given number of
+// components.
+func NewDecimator(method string, factor int64, components int) (*Decimator, error) {
+	switch method {
+	case MethodMinMax, MethodStride, MethodMean:
+	default:
+		return nil, fmt.Errorf("unknown decimation method %q", method)
+	}
+	if factor < 1 {
+		return nil, fmt.Errorf("decimation factor %d must be at least 1", factor)
+	}
+	if components < 1 {
+		return nil, fmt.Errorf("elements must have at least one component, not %d", components)
+	}
+	return &Decimator{
+		method:     method,
+		factor:     factor,
+		components: components,
+		first:      make([]float64, components),
+		second:     make([]float64, components),
+		firstAt:    make([]int64, components),
+		secondAt:   make([]int64, components),
+	}, nil
+}
+
+// PointsPerBin is how many output elements each bin becomes.
+func PointsPerBin(method string) int {
+	if method == MethodMinMax {
+		return 2
+	}
+	return 1
+}
+
+// Add adds an element's values to the current bin, finishing the bin
+// once it has factor elements.
+func (d *Decimator) Add(values []float64) {
+	for i, v := range values[:d.components] {
+		switch {
+		case d.n == 0:
+			d.first[i], d.second[i] = v, v
+			d.firstAt[i], d.secondAt[i] = 0, 0
+		case d.method == MethodMean:
+			d.first[i] += v
+		case d.method == MethodMinMax:
+			if v < d.first[i] || math.IsNaN(d.first[i]) {
+				d.first[i], d.firstAt[i] = v, d.n
+			}
+			if v > d.second[i] || math.IsNaN(d.second[i]) {
+				d.second[i], d.secondAt[i] = v, d.n
+			}
+		}
+	}
+	d.n++
+	if d.n == d.factor {
+		d.Flush()
+	}
+}
+
+// Flush finishes the current bin, even if it isn't full.
+func (d *Decimator) Flush() {
+	if d.n == 0 {
+		return
+	}
+	switch d.method {
+	case MethodStride:
+		d.out = append(d.out, d.first...)
+	case MethodMean:
+		for _, sum := range d.first {
+			d.out = append(d.out, sum/float64(d.n))
+		}
+	case MethodMinMax:
+		for i := 0; i < d.components; i++ {
+			if d.secondAt[i] < d.firstAt[i] {
+				d.first[i], d.second[i] = d.second[i], d.first[i]
+			}
+		}
+		d.out = append(d.out, d.first...)
+		d.out = append(d.out, d.second...)
+	}
+	d.n = 0
+}
+
+// Output returns the values of the finished bins' output elements,
+// interleaved by component.
+func (d *Decimator) Output() []float64 {
+	return d.out
+}
@@ -0,0 +1,105 @@
+package dsp
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// FFT computes discrete Fourier transforms of a fixed, power-of-two
+// size.
+type FFT struct {
+	size     int
+	twiddles []complex128
+	reversed []int
+}
+
+// NewFFT plans FFTs of size points.
+func NewFFT(size int) (*FFT, error) {
+	if size < 2 || size&(size-1) != 0 {
+		return nil, fmt.Errorf("FFT size %d isn't a power of two", size)
+	}
+	f := &FFT{
+		size:     size,
+		twiddles: make([]complex128, size/2),
+		reversed: make([]int, size),
+	}
+	for k := range f.twiddles {
+		f.twiddles[k] = cmplx.Rect(1, -2*math.Pi*float64(k)/float64(size))
+	}
+	bits := 0
+	for 1<<bits < size {
+		bits++
+	}
+	for i := range f.reversed {
+		r := 0
+		for b := 0; b < bits; b++ {
+			r |= (i >> b & 1) << (bits - 1 - b)
+		}
+		f.reversed[i] = r
+	}
+	return f, nil
+}
+
+// Size is the number of points transformed.
+func (f *FFT) Size() int {
+	return f.size
+}
+
+// Transform replaces x, which must have Size values, with its discrete
+// Fourier transform.
+func (f *FFT) Transform(x []complex128) {
+	for i, r := range f.reversed {
+		if i < r {
+			x[i], x[r] = x[r], x[i]
+		}
+	}
+	for span := 2; span <= f.size; span <<= 1 {
+		half, stride := span/2, f.size/span
+		for start := 0; start < f.size; start += span {
+			for k := 0; k < half; k++ {
+				t := f.twiddles[k*stride] * x[start+k+half]
+				x[start+k+half] = x[start+k] - t
+				x[start+k] += t
+			}
+		}
+	}
+}
+
+// Window functions
+const (
+	WindowRect     = "rect"
+	WindowHann     = "hann"
+	WindowHamming  = "hamming"
+	WindowBlackman = "blackman"
+)
+
+// Window returns the coefficients of the named window function over
+// size points. The windows are periodic, as is usual for spectral
+// analysis.
+func Window(name string, size int) ([]float64, error) {
+	var coefficients []float64
+	switch name {
+	case WindowRect:
+		coefficients = []float64{1}
+	case WindowHann:
+		coefficients = []float64{0.5, 0.5}
+	case WindowHamming:
+		coefficients = []float64{0.54, 0.46}
+	case WindowBlackman:
+		coefficients = []float64{0.42, 0.5, 0.08}
+	default:
+		return nil, fmt.Errorf("unknown window %q", name)
+	}
+
+	window := make([]float64, size)
+	for i := range window {
+		phase := 2 * math.Pi * float64(i) / float64(size)
+		sign := 1.0
+		for k, a := range coefficients {
+			window[i] += sign * a * math.Cos(float64(k)*phase)
+			sign = -sign
+		}
+	}
+	return window, nil
+}
@@ -0,0 +1,153 @@
+package dsp
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Spectrum cuts a stream of real or complex samples into overlapping,
+// windowed frames and transforms them.
+type Spectrum struct {
+	fft     *FFT
+	step    int
+	window  []float64
+	complex bool
+	// scale turns squared magnitudes into power spectral density
+	scale float64
+
+	samples []complex128
+	n       int
+	frame   []complex128
+}
+
+// NewSpectrum creates a Spectrum of frames of size samples, each
+// starting overlap (a fraction from 0 up to 1) of a frame after the
+// last, weighted by the named window. components is 1 for real samples
+// and 2 for complex ones; sampleRate is used to scale power spectral
+// densities.
+func NewSpectrum(size int, overlap float64, window string, components int, sampleRate float64) (*Spectrum, error) {
+	fft, err := NewFFT(size)
+	if err != nil {
+		return nil, err
+	}
+	if overlap < 0 || overlap >= 1 {
+		return nil, fmt.Errorf("overlap %v must be from 0 up to 1", overlap)
+	}
+	if components != 1 && components != 2 {
+		return nil, fmt.Errorf("can't transform elements of %d components", components)
+	}
+	coefficients, err := Window(window, size)
+	if err != nil {
+		return nil, err
+	}
+	step := size - int(math.Round(overlap*float64(size)))
+	if step < 1 {
+		step = 1
+	}
+
+	var power float64
+	for _, w := range coefficients {
+		power += w * w
+	}
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+	return &Spectrum{
+		fft:     fft,
+		step:    step,
+		window:  coefficients,
+		complex: components == 2,
+		scale:   1 / (sampleRate * power),
+		samples: make([]complex128, size),
+		frame:   make([]complex128, size),
+	}, nil
+}
+
+// Step is how many samples each frame starts after the last.
+func (s *Spectrum) Step() int {
+	return s.step
+}
+
+// Frames is how many whole frames there are in count samples.
+func (s *Spectrum) Frames(count int64) int64 {
+	size := int64(s.fft.Size())
+	if count < size {
+		return 0
+	}
+	return 1 + (count-size)/int64(s.step)
+}
+
+// Bins is how many frequency bins each frame's spectrum has: every one
+// for complex samples, and the non-negative frequencies for real ones.
+func (s *Spectrum) Bins() int {
+	if s.complex {
+		return s.fft.Size()
+	}
+	return s.fft.Size()/2 + 1
+}
+
+// FirstBin is the frequency of the first bin, as a fraction of the
+// sample rate.
+func (s *Spectrum) FirstBin() float64 {
+	if s.complex {
+		return -0.5
+	}
+	return 0
+}
+
+// Add adds a sample, whose values are its real and, for complex
+// samples, imaginary parts. Once a frame is complete, it returns the
+// frame's transform, valid until the next call, and true.
+func (s *Spectrum) Add(values []float64) ([]complex128, bool) {
+	if s.complex {
+		s.samples[s.n] = complex(values[0], values[1])
+	} else {
+		s.samples[s.n] = complex(values[0], 0)
+	}
+	s.n++
+	if s.n < len(s.samples) {
+		return nil, false
+	}
+
+	for i, sample := range s.samples {
+		s.frame[i] = sample * complex(s.window[i], 0)
+	}
+	s.fft.Transform(s.frame)
+	copy(s.samples, s.samples[s.step:])
+	s.n -= s.step
+	return s.frame, true
+}
+
+// Ordered returns the bins of a frame's transform in order of
+// frequency: shifted so negative frequencies come first for complex
+// samples, or just the non-negative ones for real samples.
+func (s *Spectrum) Ordered(frame []complex128) []complex128 {
+	ordered := make([]complex128, 0, s.Bins())
+	if s.complex {
+		half := len(frame) / 2
+		ordered = append(ordered, frame[half:]...)
+		return append(ordered, frame[:half]...)
+	}
+	return append(ordered, frame[:s.Bins()]...)
+}
+
+// AddPower adds the power spectral density of a frame's transform to
+// psd, which has Bins values, in the order of Ordered. Real samples'
+// densities are one-sided.
+func (s *Spectrum) AddPower(psd []float64, frame []complex128) {
+	for i, bin := range s.Ordered(frame) {
+		magnitude := cmplx.Abs(bin)
+		power := magnitude * magnitude * s.scale
+		if !s.complex && i != 0 && i != len(psd)-1 {
+			power *= 2
+		}
+		psd[i] += power
+	}
+}
+
+// Decibels converts a power to decibels, with a floor so empty bins
+// don't become -Inf.
+func Decibels(power float64) float64 {
+	return 10 * math.Log10(math.Max(power, 1e-30))
+}
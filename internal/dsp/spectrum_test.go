@@ -0,0 +1,200 @@
+package dsp
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// dft is the textbook O(n²) discrete Fourier transform.
+func dft(x []complex128) []complex128 {
+	n := len(x)
+	out := make([]complex128, n)
+	for k := range out {
+		for j, v := range x {
+			out[k] += v * cmplx.Rect(1, -2*math.Pi*float64(k*j)/float64(n))
+		}
+	}
+	return out
+}
+
+func TestFFTMatchesDFT(t *testing.T) {
+	for _, size := range []int{2, 4, 8, 64, 256} {
+		fft, err := NewFFT(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := make([]complex128, size)
+		for i := range x {
+			// Something with no symmetry to hide mistakes behind
+			x[i] = complex(math.Sin(0.7*float64(i))+float64(i%3), math.Cos(1.3*float64(i*i)))
+		}
+		want := dft(x)
+		fft.Transform(x)
+		for k := range x {
+			if cmplx.Abs(x[k]-want[k]) > 1e-9*float64(size) {
+				t.Errorf("size %d: bin %d is %v, want %v", size, k, x[k], want[k])
+				break
+			}
+		}
+	}
+}
+
+func TestNewFFTInvalid(t *testing.T) {
+	for _, size := range []int{-8, 0, 1, 3, 100} {
+		if _, err := NewFFT(size); err == nil {
+			t.Errorf("planned an FFT of size %d", size)
+		}
+	}
+}
+
+// psdOf runs samples through a Spectrum and returns the average power
+// spectral density of its frames.
+func psdOf(t *testing.T, s *Spectrum, samples [][]float64) []float64 {
+	t.Helper()
+	psd := make([]float64, s.Bins())
+	frames := 0
+	for _, sample := range samples {
+		if frame, ok := s.Add(sample); ok {
+			s.AddPower(psd, frame)
+			frames++
+		}
+	}
+	if frames == 0 {
+		t.Fatal("no whole frames")
+	}
+	for i := range psd {
+		psd[i] /= float64(frames)
+	}
+	return psd
+}
+
+func peak(psd []float64) int {
+	peak := 0
+	for i, p := range psd {
+		if p > psd[peak] {
+			peak = i
+		}
+	}
+	return peak
+}
+
+func TestPSDOfTone(t *testing.T) {
+	const (
+		size       = 64
+		sampleRate = 1000.0
+		amplitude  = 2.0
+		// A tone in the middle of a bin, so no window leaks it into
+		// bins far away
+		frequency = 125.0
+	)
+	binWidth := sampleRate / size
+
+	tests := []struct {
+		name       string
+		components int
+		sample     func(i int) []float64
+		frequency  float64
+		// power is the tone's mean power, which the PSD must add up to
+		power float64
+	}{
+		{
+			"real", 1,
+			func(i int) []float64 {
+				return []float64{amplitude * math.Cos(2*math.Pi*frequency*float64(i)/sampleRate)}
+			},
+			frequency, amplitude * amplitude / 2,
+		},
+		{
+			"complex", 2,
+			func(i int) []float64 {
+				phase := -2 * math.Pi * frequency * float64(i) / sampleRate
+				return []float64{amplitude * math.Cos(phase), amplitude * math.Sin(phase)}
+			},
+			-frequency, amplitude * amplitude,
+		},
+	}
+	for _, test := range tests {
+		for _, window := range []string{WindowRect, WindowHann, WindowHamming, WindowBlackman} {
+			s, err := NewSpectrum(size, 0.5, window, test.components, sampleRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples := make([][]float64, 4*size)
+			for i := range samples {
+				samples[i] = test.sample(i)
+			}
+			psd := psdOf(t, s, samples)
+
+			bin := peak(psd)
+			if got := (s.FirstBin() + float64(bin)/size) * sampleRate; got != test.frequency {
+				t.Errorf("%s %s: peak at %v Hz, want %v Hz", test.name, window, got, test.frequency)
+			}
+			// Parseval: the density over every bin adds up to the
+			// signal's power
+			var total float64
+			for _, p := range psd {
+				total += p * binWidth
+			}
+			if math.Abs(total-test.power) > 1e-9 {
+				t.Errorf("%s %s: total power is %v, want %v", test.name, window, total, test.power)
+			}
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	frame := make([]complex128, 8)
+	for i := range frame {
+		frame[i] = complex(float64(i), 0)
+	}
+
+	s, err := NewSpectrum(8, 0, WindowRect, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Negative frequencies first, then DC up to just under Nyquist
+	want := []float64{4, 5, 6, 7, 0, 1, 2, 3}
+	for i, bin := range s.Ordered(frame) {
+		if real(bin) != want[i] {
+			t.Errorf("complex: ordered bins are %v, want %v", s.Ordered(frame), want)
+			break
+		}
+	}
+
+	s, err = NewSpectrum(8, 0, WindowRect, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DC up to and including Nyquist
+	want = []float64{0, 1, 2, 3, 4}
+	ordered := s.Ordered(frame)
+	if len(ordered) != len(want) {
+		t.Fatalf("real: %d ordered bins, want %d", len(ordered), len(want))
+	}
+	for i, bin := range ordered {
+		if real(bin) != want[i] {
+			t.Errorf("real: ordered bins are %v, want %v", ordered, want)
+			break
+		}
+	}
+}
+
+func TestSpectrumFrames(t *testing.T) {
+	s, err := NewSpectrum(8, 0.75, WindowHann, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Step() != 2 {
+		t.Fatalf("step is %d, want 2", s.Step())
+	}
+	frames := 0
+	for i := 0; i < 20; i++ {
+		if _, ok := s.Add([]float64{1}); ok {
+			frames++
+		}
+	}
+	if frames != 7 || s.Frames(20) != 7 {
+		t.Errorf("20 samples made %d frames, Frames says %d; want 7", frames, s.Frames(20))
+	}
+}
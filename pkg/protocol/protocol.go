@@ -0,0 +1,146 @@
+// Package protocol defines the messages exchanged between dc and the
+// workers that carry out its tasks.
+package protocol
+
+import "time"
+
+// DefaultReportQueue is the AMQP queue dc consumes worker reports from.
+const DefaultReportQueue = "dc.reports"
+
+// StartMessage is published to the output exchange when a task is created.
+// It carries everything a worker needs to start the task.
+type StartMessage struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	StopTime  time.Time `json:"stop_time,omitempty"`
+	// Parameters are the task's parameters, checked against its
+	// type's definition and with defaults filled in
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// ReportKind says what a Report is about.
+type ReportKind string
+
+const (
+	// ReportStarted is sent when a worker picks up a task
+	ReportStarted ReportKind = "started"
+	// ReportHeartbeat is sent periodically while a task runs
+	ReportHeartbeat ReportKind = "heartbeat"
+	// ReportProgress carries a progress update
+	ReportProgress ReportKind = "progress"
+	// ReportSucceeded is sent when a task finishes on its own
+	ReportSucceeded ReportKind = "succeeded"
+	// ReportStopped is sent when a task finishes because dc asked it to
+	ReportStopped ReportKind = "stopped"
+	// ReportFailed is sent when a task finishes with an error
+	ReportFailed ReportKind = "failed"
+	// ReportStopAck is sent when a worker receives a stop or kill
+	// request; Command says which
+	ReportStopAck ReportKind = "stop_ack"
+	// ReportReconfigureAck is sent when a worker has applied, or
+	// refused (with an Error), the parameters update with Revision
+	ReportReconfigureAck ReportKind = "reconfigure_ack"
+)
+
+// Report is sent by a worker to tell dc about a task it's running.
+type Report struct {
+	TaskId   string     `json:"task_id"`
+	WorkerId string     `json:"worker_id,omitempty"`
+	Kind     ReportKind `json:"kind"`
+	Progress float64    `json:"progress,omitempty"`
+	Message  string     `json:"message,omitempty"`
+	// Command is the command a ReportStopAck acknowledges
+	Command CommandKind `json:"command,omitempty"`
+	// Revision is the parameters update a ReportReconfigureAck
+	// acknowledges, and Error why it was refused, if it was
+	Revision int       `json:"revision,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Ack is dc's reply to a Report. StopRequested tells the worker
+// the task has been asked to stop, by StopDeadline if one is set;
+// KillRequested tells it to abandon the task right away.
+type Ack struct {
+	StopRequested bool      `json:"stop_requested"`
+	StopDeadline  time.Time `json:"stop_deadline,omitempty"`
+	KillRequested bool      `json:"kill_requested,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// CommandKind says what a Command asks a worker to do.
+type CommandKind string
+
+const (
+	// CommandStop asks a worker to stop a task gracefully, by the
+	// command's Deadline if it has one
+	CommandStop CommandKind = "stop"
+	// CommandKill asks a worker to abandon a task right away, whether
+	// or not its handler has returned
+	CommandKill CommandKind = "kill"
+	// CommandReconfigure asks a worker to change some of a running
+	// task's parameters
+	CommandReconfigure CommandKind = "reconfigure"
+)
+
+// Command is published by dc to control a task that a worker is
+// already running. Commands are routed to the worker running the task
+// if dc knows which one it is, and by task otherwise (see RoutingKey).
+type Command struct {
+	Kind     CommandKind `json:"kind"`
+	TaskId   string      `json:"task_id"`
+	WorkerId string      `json:"worker_id,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Deadline time.Time   `json:"deadline,omitempty"`
+	// Parameters are the changed parameters of a CommandReconfigure,
+	// resolved like a StartMessage's, and Revision numbers the update
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Revision   int                    `json:"revision,omitempty"`
+	Time       time.Time              `json:"time"`
+}
+
+// RoutingKey is the routing key (or, on NATS, subject suffix)
+// the command is published under.
+func (c Command) RoutingKey() string {
+	if c.WorkerId != "" {
+		return WorkerRoutingKey(c.WorkerId)
+	}
+	return CommandRoutingKey(c.TaskId)
+}
+
+// DefaultControlExchange is the AMQP topic exchange commands are
+// published to.
+const DefaultControlExchange = "dc.control"
+
+// CommandRoutingKey is the routing key (or, on NATS, subject suffix)
+// commands for a task no known worker is running are published under.
+func CommandRoutingKey(taskId string) string {
+	return "task." + taskId
+}
+
+// WorkerRoutingKey is the routing key (or, on NATS, subject suffix)
+// commands for tasks run by workerId are published under.
+func WorkerRoutingKey(workerId string) string {
+	return "worker." + workerId
+}
+
+// StreamMetadata describes the samples in the frames a worker publishes
+// to dc's stream relay. dc passes it on to viewers as a JSON text
+// message when they join and whenever it changes, which is what
+// SigPlot's WPipeLayer expects.
+type StreamMetadata struct {
+	// TaskId is the task producing the stream, if any
+	TaskId string `json:"task_id,omitempty"`
+	// Format is the samples' BLUE format code, e.g. `SF` for scalar
+	// float32 or `CF` for complex float32
+	Format     string  `json:"format,omitempty"`
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	XStart     float64 `json:"xstart"`
+	// XDelta is the time between samples; dc defaults it to the
+	// reciprocal of SampleRate
+	XDelta float64 `json:"xdelta,omitempty"`
+	// Subsize is the frame size of two-dimensional (e.g., spectrogram)
+	// data, zero for one-dimensional data
+	Subsize int `json:"subsize,omitempty"`
+}
@@ -0,0 +1,275 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"github.com/streadway/amqp"
+)
+
+// AMQPTransport receives start messages from dc's output exchange and
+// sends reports to dc's report queue, waiting for dc's Ack on a private
+// reply queue. Commands for the worker arrive on another private queue
+// bound to dc's control exchange.
+type AMQPTransport struct {
+	Conn *amqp.Connection
+	// Exchange is dc's output exchange (`--amqp-output-exchange`)
+	Exchange string
+	// Queue is the work queue bound to Exchange. Workers sharing a
+	// Queue share the tasks between them.
+	Queue string
+	// RoutingKey is used to bind Queue to Exchange
+	RoutingKey string
+	// ReportQueue is the queue dc consumes reports from
+	// (`--amqp-report-queue`)
+	ReportQueue string
+	// ControlExchange is the exchange dc publishes commands to
+	// (`--amqp-control-exchange`)
+	ControlExchange string
+
+	setupOnce  sync.Once
+	setupErr   error
+	publishMu  sync.Mutex
+	publishCh  *amqp.Channel
+	replyQueue string
+
+	pendingMu sync.Mutex
+	pending   map[string]chan *protocol.Ack
+}
+
+// NewAMQPTransport creates an AMQPTransport on an existing connection.
+func NewAMQPTransport(conn *amqp.Connection, exchange string, queue string) *AMQPTransport {
+	return &AMQPTransport{
+		Conn:            conn,
+		Exchange:        exchange,
+		Queue:           queue,
+		ReportQueue:     protocol.DefaultReportQueue,
+		ControlExchange: protocol.DefaultControlExchange,
+		pending:         make(map[string]chan *protocol.Ack),
+	}
+}
+
+// DialAMQP connects to the broker at url and creates an AMQPTransport.
+func DialAMQP(url string, exchange string, queue string) (*AMQPTransport, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewAMQPTransport(conn, exchange, queue), nil
+}
+
+// Receive declares Queue, binds it to Exchange and delivers every
+// start message published there.
+func (t *AMQPTransport) Receive(ctx context.Context) (<-chan *Delivery, error) {
+	ch, err := t.Conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Only take one message at a time per channel so idle workers
+	// get a fair share of the queue.
+	if err := ch.Qos(1, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if _, err := ch.QueueDeclare(t.Queue, true, false, false, false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if err := ch.QueueBind(t.Queue, t.RoutingKey, t.Exchange, false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	messages, err := ch.Consume(t.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	deliveries := make(chan *Delivery)
+	go func() {
+		defer close(deliveries)
+		defer ch.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var start protocol.StartMessage
+				if err := json.Unmarshal(message.Body, &start); err != nil {
+					// Nobody will ever be able to decode it, so drop it
+					message.Nack(false, false)
+					continue
+				}
+				delivery := &Delivery{
+					Task: start,
+					Ack:  func() error { return message.Ack(false) },
+					Nack: func(requeue bool) error { return message.Nack(false, requeue) },
+				}
+				select {
+				case deliveries <- delivery:
+				case <-ctx.Done():
+					message.Nack(false, true)
+					return
+				}
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Commands binds an exclusive queue to ControlExchange under workerId's
+// routing key and delivers every command published there.
+func (t *AMQPTransport) Commands(ctx context.Context, workerId string) (<-chan protocol.Command, error) {
+	ch, err := t.Conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	err = ch.QueueBind(queue.Name, protocol.WorkerRoutingKey(workerId), t.ControlExchange, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	messages, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	commands := make(chan protocol.Command)
+	go func() {
+		defer close(commands)
+		defer ch.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var command protocol.Command
+				if err := json.Unmarshal(message.Body, &command); err != nil {
+					continue
+				}
+				select {
+				case commands <- command:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return commands, nil
+}
+
+// Report publishes report to ReportQueue and waits for dc's Ack.
+func (t *AMQPTransport) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	t.setupOnce.Do(func() { t.setupErr = t.setupReplies() })
+	if t.setupErr != nil {
+		return nil, t.setupErr
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	correlationId, err := newCorrelationId()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan *protocol.Ack, 1)
+	t.pendingMu.Lock()
+	t.pending[correlationId] = reply
+	t.pendingMu.Unlock()
+	defer func() {
+		t.pendingMu.Lock()
+		delete(t.pending, correlationId)
+		t.pendingMu.Unlock()
+	}()
+
+	t.publishMu.Lock()
+	err = t.publishCh.Publish("", t.ReportQueue, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: correlationId,
+		ReplyTo:       t.replyQueue,
+		Body:          body,
+	})
+	t.publishMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ack := <-reply:
+		if ack.Error != "" {
+			return ack, fmt.Errorf("dc rejected %s report: %s", report.Kind, ack.Error)
+		}
+		return ack, nil
+	}
+}
+
+// setupReplies opens the channel reports are published on and an
+// exclusive queue dc's Acks come back on.
+func (t *AMQPTransport) setupReplies() error {
+	ch, err := t.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	replies, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	t.publishCh = ch
+	t.replyQueue = queue.Name
+
+	go func() {
+		for message := range replies {
+			var ack protocol.Ack
+			if err := json.Unmarshal(message.Body, &ack); err != nil {
+				continue
+			}
+			t.pendingMu.Lock()
+			reply, ok := t.pending[message.CorrelationId]
+			t.pendingMu.Unlock()
+			if ok {
+				reply <- &ack
+			}
+		}
+	}()
+	return nil
+}
+
+// Close closes the underlying connection.
+func (t *AMQPTransport) Close() error {
+	return t.Conn.Close()
+}
+
+func newCorrelationId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UploadArtifact uploads the file at path to dc, served at baseURL
+// (e.g. http://localhost:1337), as an output artifact of the task with
+// taskId, under the file's base name. format is optional; dc guesses
+// it from the file's extension if it's empty. If client is nil,
+// http.DefaultClient is used.
+func UploadArtifact(ctx context.Context, client *http.Client, baseURL string, taskId string, path string, format string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// dc checks the upload against the file's checksum
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	endpoint := fmt.Sprintf("%s/api/tasks/%s/artifacts/%s", strings.TrimSuffix(baseURL, "/"), url.PathEscape(taskId), url.PathEscape(name))
+	if format != "" {
+		endpoint += "?format=" + url.QueryEscape(format)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, file)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Checksum-Sha256", hex.EncodeToString(hash.Sum(nil)))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		var reply struct {
+			Msg string `json:"msg"`
+		}
+		json.NewDecoder(response.Body).Decode(&reply)
+		return fmt.Errorf("dc rejected artifact %s (HTTP %d): %s", name, response.StatusCode, reply.Msg)
+	}
+	return nil
+}
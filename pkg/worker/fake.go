@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// FakeTransport is an in-memory Transport for unit testing workers
+// without RabbitMQ or a running dc. Tests feed it start messages with
+// Start, ask tasks to stop with RequestStop, RequestKill or
+// SendCommand, and inspect what the worker reported with Reports
+// or WaitFor.
+type FakeTransport struct {
+	deliveries chan *Delivery
+	commands   chan protocol.Command
+
+	mu      sync.Mutex
+	changed chan struct{}
+	reports []protocol.Report
+	stops   map[string]bool
+	kills   map[string]bool
+	acked   map[string]bool
+	// nacked maps the tasks whose start message was rejected to
+	// whether it was requeued
+	nacked map[string]bool
+}
+
+// NewFakeTransport creates an empty FakeTransport.
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{
+		deliveries: make(chan *Delivery, 64),
+		commands:   make(chan protocol.Command, 64),
+		changed:    make(chan struct{}),
+		stops:      make(map[string]bool),
+		kills:      make(map[string]bool),
+		acked:      make(map[string]bool),
+		nacked:     make(map[string]bool),
+	}
+}
+
+// Start queues a start message for the worker to pick up.
+func (f *FakeTransport) Start(start protocol.StartMessage) {
+	f.deliveries <- &Delivery{
+		Task: start,
+		Ack: func() error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.acked[start.Id] = true
+			f.notifyLocked()
+			return nil
+		},
+		Nack: func(requeue bool) error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.nacked[start.Id] = requeue
+			f.notifyLocked()
+			return nil
+		},
+	}
+}
+
+// RequestStop makes every following Ack for taskId ask the task to stop,
+// as dc does once someone stops the task.
+func (f *FakeTransport) RequestStop(taskId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stops[taskId] = true
+}
+
+// RequestKill makes every following Ack for taskId ask for the task
+// to be killed.
+func (f *FakeTransport) RequestKill(taskId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kills[taskId] = true
+}
+
+// SendCommand delivers command to the worker, as if dc had published it.
+func (f *FakeTransport) SendCommand(command protocol.Command) {
+	f.commands <- command
+}
+
+// Close stops delivering start messages and commands; Worker.Run then
+// returns ErrTransportClosed.
+func (f *FakeTransport) Close() {
+	close(f.deliveries)
+	close(f.commands)
+}
+
+// Receive implements Source.
+func (f *FakeTransport) Receive(ctx context.Context) (<-chan *Delivery, error) {
+	return f.deliveries, nil
+}
+
+// Commands implements CommandSource. Every command sent with
+// SendCommand is delivered, whatever workerId is.
+func (f *FakeTransport) Commands(ctx context.Context, workerId string) (<-chan protocol.Command, error) {
+	return f.commands, nil
+}
+
+// Report implements Reporter by recording report.
+func (f *FakeTransport) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reports = append(f.reports, report)
+	f.notifyLocked()
+	return &protocol.Ack{
+		StopRequested: f.stops[report.TaskId] || f.kills[report.TaskId],
+		KillRequested: f.kills[report.TaskId],
+	}, nil
+}
+
+// Reports returns every report received for taskId, oldest first.
+func (f *FakeTransport) Reports(taskId string) []protocol.Report {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reports []protocol.Report
+	for _, report := range f.reports {
+		if report.TaskId == taskId {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// Acked reports whether the start message for taskId was acknowledged.
+func (f *FakeTransport) Acked(taskId string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acked[taskId]
+}
+
+// Nacked reports whether the start message for taskId was rejected.
+func (f *FakeTransport) Nacked(taskId string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, nacked := f.nacked[taskId]
+	return nacked
+}
+
+// Requeued reports whether the start message for taskId was rejected
+// and handed back to the queue.
+func (f *FakeTransport) Requeued(taskId string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nacked[taskId]
+}
+
+// WaitFor blocks until a report of the given kind arrives for taskId
+// (or already has) and returns it.
+func (f *FakeTransport) WaitFor(ctx context.Context, taskId string, kind protocol.ReportKind) (protocol.Report, error) {
+	for {
+		f.mu.Lock()
+		for _, report := range f.reports {
+			if report.TaskId == taskId && report.Kind == kind {
+				f.mu.Unlock()
+				return report, nil
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return protocol.Report{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// notifyLocked wakes up anyone in WaitFor. f.mu must be held.
+func (f *FakeTransport) notifyLocked() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
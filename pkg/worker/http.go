@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// HTTPReporter sends reports to dc's `POST /api/tasks/:id/report` endpoint.
+type HTTPReporter struct {
+	// BaseURL is where dc is being served, e.g. http://localhost:1337
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHTTPReporter creates an HTTPReporter. If client is nil,
+// http.DefaultClient is used.
+func NewHTTPReporter(baseURL string, client *http.Client) *HTTPReporter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPReporter{BaseURL: strings.TrimSuffix(baseURL, "/"), Client: client}
+}
+
+// Report POSTs report to dc and decodes its Ack.
+func (r *HTTPReporter) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/api/tasks/%s/report", r.BaseURL, url.PathEscape(report.TaskId))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := r.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var ack protocol.Ack
+	if err := json.NewDecoder(response.Body).Decode(&ack); err != nil {
+		return nil, fmt.Errorf("decoding dc's reply to %s report (HTTP %d): %w", report.Kind, response.StatusCode, err)
+	}
+	if response.StatusCode >= 300 {
+		return &ack, fmt.Errorf("dc rejected %s report (HTTP %d): %s", report.Kind, response.StatusCode, ack.Error)
+	}
+	return &ack, nil
+}
+
+// TokenTransport authenticates requests to dc with an API token,
+// passing them on to Base (http.DefaultTransport if it's nil).
+type TokenTransport struct {
+	Token string
+	Base  http.RoundTripper
+}
+
+// RoundTrip sends the request with the token as its bearer token.
+func (t *TokenTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.Token)
+	return base.RoundTrip(request)
+}
+
+// NewTokenClient creates a client that authenticates with an API token,
+// for NewHTTPReporter and UploadArtifact to use with a dc that requires
+// authentication.
+func NewTokenClient(token string) *http.Client {
+	return &http.Client{Transport: &TokenTransport{Token: token}}
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+	"golang.org/x/net/websocket"
+)
+
+// Stream publishes live sample data through dc's stream relay
+// (`/api/streams/:id/publish`), which passes each frame on to every
+// viewer subscribed to the stream.
+type Stream struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+// DialStream starts publishing the stream with id to dc, served at
+// baseURL (e.g. http://localhost:1337), described by metadata. dc
+// turns the connection away if the stream already has a publisher.
+func DialStream(baseURL string, id string, metadata protocol.StreamMetadata) (*Stream, error) {
+	return DialStreamWithToken(baseURL, id, "", metadata)
+}
+
+// DialStreamWithToken is DialStream for a dc that requires
+// authentication, authenticating with an API token.
+func DialStreamWithToken(baseURL string, id string, token string, metadata protocol.StreamMetadata) (*Stream, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	origin := base.String()
+	switch base.Scheme {
+	case "https":
+		base.Scheme = "wss"
+	default:
+		base.Scheme = "ws"
+	}
+	base.Path += fmt.Sprintf("/api/streams/%s/publish", url.PathEscape(id))
+
+	params := url.Values{}
+	if metadata.TaskId != "" {
+		params.Set("task_id", metadata.TaskId)
+	}
+	if metadata.Format != "" {
+		params.Set("format", metadata.Format)
+	}
+	if metadata.SampleRate != 0 {
+		params.Set("sample_rate", strconv.FormatFloat(metadata.SampleRate, 'g', -1, 64))
+	}
+	if metadata.XStart != 0 {
+		params.Set("xstart", strconv.FormatFloat(metadata.XStart, 'g', -1, 64))
+	}
+	if metadata.XDelta != 0 {
+		params.Set("xdelta", strconv.FormatFloat(metadata.XDelta, 'g', -1, 64))
+	}
+	if metadata.Subsize != 0 {
+		params.Set("subsize", strconv.Itoa(metadata.Subsize))
+	}
+	base.RawQuery = params.Encode()
+
+	config, err := websocket.NewConfig(base.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		config.Header.Set("Authorization", "Bearer "+token)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{ws: ws}, nil
+}
+
+// Send publishes a frame of samples, encoded as the metadata's format
+// says.
+func (s *Stream) Send(frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return websocket.Message.Send(s.ws, frame)
+}
+
+// SetMetadata replaces the stream's metadata, e.g. when the task is
+// retuned. Frames sent after it are described by the new metadata.
+func (s *Stream) SetMetadata(metadata protocol.StreamMetadata) error {
+	raw, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return websocket.Message.Send(s.ws, string(raw))
+}
+
+// Close stops publishing the stream. Viewers stay subscribed, in case
+// another publisher picks it up.
+func (s *Stream) Close() error {
+	return s.ws.Close()
+}
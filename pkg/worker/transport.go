@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// Delivery is a single start message. Exactly one of Ack or Nack
+// must be called once the worker has decided what to do with it.
+type Delivery struct {
+	Task protocol.StartMessage
+	Ack  func() error
+	Nack func(requeue bool) error
+}
+
+// Source delivers start messages published by dc.
+type Source interface {
+	// Receive starts delivering start messages. The channel is closed
+	// when the source shuts down or ctx is cancelled.
+	Receive(ctx context.Context) (<-chan *Delivery, error)
+}
+
+// Reporter sends reports about running tasks back to dc. If dc rejects
+// a report, its Ack is returned along with an error; if dc can't be
+// reached at all, the Ack is nil.
+type Reporter interface {
+	Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error)
+}
+
+// CommandSource delivers the commands dc publishes for a worker.
+// Transports that implement it let dc stop or kill tasks right away;
+// otherwise the worker only learns of it from the Ack to its next report.
+type CommandSource interface {
+	// Commands starts delivering commands for workerId. The channel
+	// is closed when the source shuts down or ctx is cancelled.
+	Commands(ctx context.Context, workerId string) (<-chan protocol.Command, error)
+}
+
+// Transport is everything a Worker needs to talk to dc.
+type Transport interface {
+	Source
+	Reporter
+}
+
+// Split combines a Source and a Reporter into a Transport, e.g. to
+// receive start messages over AMQP but report over HTTP. If source is
+// also a CommandSource, so is the Transport.
+func Split(source Source, reporter Reporter) Transport {
+	if commands, ok := source.(CommandSource); ok {
+		return splitCommandTransport{splitTransport{source, reporter}, commands}
+	}
+	return splitTransport{source, reporter}
+}
+
+type splitTransport struct {
+	Source
+	Reporter
+}
+
+type splitCommandTransport struct {
+	splitTransport
+	CommandSource
+}
@@ -0,0 +1,285 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mrecachinas/dcserver/pkg/protocol"
+)
+
+// failingTransport answers ReportStarted with ack and err instead of
+// recording it.
+type failingTransport struct {
+	*FakeTransport
+	ack *protocol.Ack
+	err error
+}
+
+func (f *failingTransport) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	if report.Kind == protocol.ReportStarted {
+		return f.ack, f.err
+	}
+	return f.FakeTransport.Report(ctx, report)
+}
+
+// gatedTransport holds up ReportStarted until release is closed.
+type gatedTransport struct {
+	*FakeTransport
+	release chan struct{}
+}
+
+func (g *gatedTransport) Report(ctx context.Context, report protocol.Report) (*protocol.Ack, error) {
+	if report.Kind == protocol.ReportStarted {
+		<-g.release
+	}
+	return g.FakeTransport.Report(ctx, report)
+}
+
+// runWorker runs a worker over transport until the test ends.
+func runWorker(t *testing.T, transport Transport, handler Handler, opts Options) {
+	t.Helper()
+	if opts.WorkerId == "" {
+		opts.WorkerId = "test-worker"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		New(transport, handler, opts).Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitFor(t *testing.T, fake *FakeTransport, taskId string, kind protocol.ReportKind) protocol.Report {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := fake.WaitFor(ctx, taskId, kind)
+	if err != nil {
+		t.Fatalf("waiting for %s report: %v", kind, err)
+	}
+	return report
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// untilStopped is a well-behaved handler that runs until it's asked to stop.
+func untilStopped(ctx context.Context, task *Task) error {
+	<-ctx.Done()
+	return nil
+}
+
+// ignoringStop returns a handler that ignores its context and runs
+// until the test ends.
+func ignoringStop(t *testing.T) Handler {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	return func(ctx context.Context, task *Task) error {
+		<-release
+		return nil
+	}
+}
+
+func TestAckAfterStarted(t *testing.T) {
+	fake := NewFakeTransport()
+	transport := &gatedTransport{FakeTransport: fake, release: make(chan struct{})}
+	runWorker(t, transport, untilStopped, Options{})
+
+	fake.Start(protocol.StartMessage{Id: "task"})
+	time.Sleep(50 * time.Millisecond)
+	if fake.Acked("task") {
+		t.Fatal("start message acked before the started report went out")
+	}
+	close(transport.release)
+	eventually(t, "ack", func() bool { return fake.Acked("task") })
+	waitFor(t, fake, "task", protocol.ReportStarted)
+}
+
+func TestNack(t *testing.T) {
+	tests := []struct {
+		name    string
+		ack     *protocol.Ack
+		requeue bool
+	}{
+		{"unreachable", nil, true},
+		{"rejected", &protocol.Ack{Error: "task is already running"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := NewFakeTransport()
+			transport := &failingTransport{FakeTransport: fake, ack: test.ack, err: errors.New("report failed")}
+			called := make(chan struct{}, 1)
+			runWorker(t, transport, func(ctx context.Context, task *Task) error {
+				called <- struct{}{}
+				return nil
+			}, Options{})
+
+			fake.Start(protocol.StartMessage{Id: "task"})
+			eventually(t, "nack", func() bool { return fake.Nacked("task") })
+			if fake.Acked("task") {
+				t.Error("start message was acked too")
+			}
+			if got := fake.Requeued("task"); got != test.requeue {
+				t.Errorf("requeued = %v, want %v", got, test.requeue)
+			}
+			select {
+			case <-called:
+				t.Error("handler ran")
+			default:
+			}
+		})
+	}
+}
+
+func TestStopCancelsContext(t *testing.T) {
+	fake := NewFakeTransport()
+	runWorker(t, fake, untilStopped, Options{})
+
+	fake.Start(protocol.StartMessage{Id: "task"})
+	waitFor(t, fake, "task", protocol.ReportStarted)
+	fake.SendCommand(protocol.Command{Kind: protocol.CommandStop, TaskId: "task"})
+
+	ack := waitFor(t, fake, "task", protocol.ReportStopAck)
+	if ack.Command != protocol.CommandStop {
+		t.Errorf("acked a %s command, want stop", ack.Command)
+	}
+	stopped := waitFor(t, fake, "task", protocol.ReportStopped)
+	if stopped.Message != "" {
+		t.Errorf("stopped with message %q, want none", stopped.Message)
+	}
+}
+
+func TestStopAckedByReport(t *testing.T) {
+	fake := NewFakeTransport()
+	runWorker(t, fake, func(ctx context.Context, task *Task) error {
+		for ctx.Err() == nil {
+			task.Progress(0.5, "")
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}, Options{})
+
+	fake.Start(protocol.StartMessage{Id: "task"})
+	waitFor(t, fake, "task", protocol.ReportStarted)
+	fake.RequestStop("task")
+	waitFor(t, fake, "task", protocol.ReportStopped)
+}
+
+func TestAbandon(t *testing.T) {
+	tests := []struct {
+		name    string
+		command protocol.Command
+	}{
+		{"stop deadline", protocol.Command{Kind: protocol.CommandStop, Deadline: time.Now().Add(50 * time.Millisecond)}},
+		{"kill", protocol.Command{Kind: protocol.CommandKill}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := NewFakeTransport()
+			runWorker(t, fake, ignoringStop(t), Options{})
+
+			fake.Start(protocol.StartMessage{Id: "task"})
+			waitFor(t, fake, "task", protocol.ReportStarted)
+			command := test.command
+			command.TaskId = "task"
+			fake.SendCommand(command)
+
+			stopped := waitFor(t, fake, "task", protocol.ReportStopped)
+			if stopped.Message != "task killed" {
+				t.Errorf("stopped with message %q, want %q", stopped.Message, "task killed")
+			}
+		})
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	tests := []struct {
+		name        string
+		reconfigure ReconfigureFunc
+		wantError   bool
+	}{
+		{"applied", func(task *Task, changes map[string]interface{}) error { return nil }, false},
+		{"refused", func(task *Task, changes map[string]interface{}) error { return errors.New("gain is fixed") }, true},
+		{"unsupported", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := NewFakeTransport()
+			var got map[string]interface{}
+			opts := Options{}
+			if test.reconfigure != nil {
+				opts.Reconfigure = func(task *Task, changes map[string]interface{}) error {
+					got = changes
+					return test.reconfigure(task, changes)
+				}
+			}
+			runWorker(t, fake, untilStopped, opts)
+
+			fake.Start(protocol.StartMessage{Id: "task"})
+			waitFor(t, fake, "task", protocol.ReportStarted)
+			fake.SendCommand(protocol.Command{
+				Kind:       protocol.CommandReconfigure,
+				TaskId:     "task",
+				Parameters: map[string]interface{}{"gain": 10.0},
+				Revision:   2,
+			})
+
+			ack := waitFor(t, fake, "task", protocol.ReportReconfigureAck)
+			if ack.Revision != 2 {
+				t.Errorf("acked revision %d, want 2", ack.Revision)
+			}
+			if (ack.Error != "") != test.wantError {
+				t.Errorf("ack error = %q, want error: %v", ack.Error, test.wantError)
+			}
+			if test.reconfigure != nil && got["gain"] != 10.0 {
+				t.Errorf("Reconfigure got %v, want gain 10", got)
+			}
+		})
+	}
+}
+
+func TestHeartbeatsWhileStopping(t *testing.T) {
+	fake := NewFakeTransport()
+	runWorker(t, fake, func(ctx context.Context, task *Task) error {
+		<-ctx.Done()
+		// Take a while to wind down
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}, Options{HeartbeatInterval: 10 * time.Millisecond})
+
+	fake.Start(protocol.StartMessage{Id: "task"})
+	waitFor(t, fake, "task", protocol.ReportStarted)
+	fake.SendCommand(protocol.Command{Kind: protocol.CommandStop, TaskId: "task"})
+	waitFor(t, fake, "task", protocol.ReportStopped)
+
+	// Heartbeats between the stop request and the task stopping
+	heartbeats := 0
+	stopping := false
+	for _, report := range fake.Reports("task") {
+		switch report.Kind {
+		case protocol.ReportStopAck:
+			stopping = true
+		case protocol.ReportHeartbeat:
+			if stopping {
+				heartbeats++
+			}
+		}
+	}
+	if heartbeats < 5 {
+		t.Errorf("%d heartbeats while the task was stopping, want one every 10ms", heartbeats)
+	}
+}
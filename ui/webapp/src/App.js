@@ -13,13 +13,33 @@ import AppNavbar from "./components/AppNavbar";
 
 import "rsuite/dist/styles/rsuite-default.css";
 
-const setTaskField = (fieldname) => (fieldvalue) =>
+// Version of the websocket messages this app understands
+const WEBSOCKET_VERSION = 1;
+
+// Apply a websocket message to the `{status, tasks}` state: snapshots
+// replace it, events move a single task between the lists
+const applyMessage = (info, message) => {
+  if (message.type === "snapshot") {
+    return { status: message.status, tasks: message.tasks };
+  }
+  const without = (list) => list.filter((status) => status.id !== message.id);
+  const status = {
+    active: without(info.status.active),
+    historical: without(info.status.historical),
+  };
+  if (message.status && message.list in status) {
+    status[message.list] = [message.status, ...status[message.list]];
+  }
+  return { ...info, status };
+};
+
+const setTaskField = (id, fieldname) => (fieldvalue) =>
   fetch("/api/tasks/update", {
     method: "POST",
     headers: {
       "Content-Type": "application/json",
     },
-    body: JSON.stringify({ [fieldname]: fieldvalue }),
+    body: JSON.stringify({ id, parameters: { [fieldname]: fieldvalue } }),
   });
 
 export default function App() {
@@ -27,7 +47,7 @@ export default function App() {
 
   const [updateTime, setUpdateTime] = useState(null);
 
-  // `{status, tasks}` returned from websockets
+  // `{status, tasks}` built from websocket messages
   const [info, setInfo] = useState({
     status: { historical: [], active: [] },
     tasks: [],
@@ -40,14 +60,21 @@ export default function App() {
   // `useEffect` operates similar to `componentDidMount`
   // and `componentDidUpdate`
   useEffect(() => {
-    const websocketURL = `ws://${window.location.hostname}:${window.location.port}/ws`;
+    const websocketURL = `ws://${window.location.hostname}:${window.location.port}/ws?v=${WEBSOCKET_VERSION}`;
     try {
       webSocket.current = new WebSocket(websocketURL);
       webSocket.current.onmessage = async (message) => {
-        const data = await message.data.text()
+        const data =
+          typeof message.data === "string"
+            ? message.data
+            : await message.data.text();
         console.log(data);
         const jsonData = JSON.parse(data);
-        setInfo(jsonData);
+        if (jsonData.v !== WEBSOCKET_VERSION) {
+          setMessage(`ERROR: Unsupported message version ${jsonData.v}`);
+          return;
+        }
+        setInfo((info) => applyMessage(info, jsonData));
         const updateTimeString = `Last Updated: ${new Date().toLocaleString()}`;
         setMessage(updateTimeString);
       };
@@ -101,11 +128,15 @@ export default function App() {
           />
           <Route
             path="/active/:id"
-            render={(id) => <StreamingPlotView streamID={id} />}
+            render={({ match }) => (
+              <StreamingPlotView streamID={match.params.id} />
+            )}
           />
           <Route
             path="/historical/:id"
-            render={(id) => <HistoricalPlotView historicalID={id} />}
+            render={({ match }) => (
+              <HistoricalPlotView historicalID={match.params.id} />
+            )}
           />
           <Route
             path="/active"
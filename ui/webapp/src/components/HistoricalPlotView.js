@@ -1,10 +1,34 @@
-import React from "react";
+import React, { useEffect, useState } from "react";
 import { SigPlot, HrefLayer } from "react-sigplot";
 
 export default function HistoricalPlotView({ historicalID }) {
-  // TODO: Get base URL...
-  // const href = `/api/${historicalID}`;
-  const href = "https://sigplot.lgsinnovations.com/dat/penny.prm";
+  const [href, setHref] = useState(null);
+  const [message, setMessage] = useState("Loading artifacts...");
+
+  // Plot the task's first BLUE artifact. One-dimensional recordings are
+  // decimated by the server so large ones don't have to be downloaded;
+  // SigPlot pages through anything else with Range requests
+  useEffect(() => {
+    const base = `/api/tasks/${encodeURIComponent(historicalID)}/artifacts`;
+    fetch(base)
+      .then((response) => response.json())
+      .then((artifacts) => {
+        const artifact = (artifacts || []).find((a) => a.format === "blue");
+        if (artifact) {
+          const href = `${base}/${encodeURIComponent(artifact.name)}`;
+          const oneDimensional =
+            artifact.header && Math.floor(artifact.header.type / 1000) === 1;
+          setHref(oneDimensional ? `${href}/view?points=4096` : href);
+        } else {
+          setMessage("This task has no recordings to plot");
+        }
+      })
+      .catch(() => setMessage("ERROR: Couldn't load the task's artifacts"));
+  }, [historicalID]);
+
+  if (!href) {
+    return <div>{message}</div>;
+  }
   return (
     <div>
       <SigPlot height={400} width={"100%"}>
@@ -2,8 +2,10 @@ import React from "react";
 import { SigPlot, WPipeLayer } from "react-sigplot";
 
 export default function StreamingPlotView({ streamID }) {
-  // TODO: Get base URL...
-  const wsurl = `/${streamID}`;
+  const scheme = window.location.protocol === "https:" ? "wss" : "ws";
+  const wsurl = `${scheme}://${window.location.host}/api/streams/${encodeURIComponent(
+    streamID
+  )}/ws?policy=decimate`;
   return (
     <div>
       <SigPlot>
@@ -1,15 +1,17 @@
 import { useHistory } from "react-router-dom";
 import DataTable from "react-data-table-component";
 
-const columnify = (keynames) => {
-  return keynames.map((element) => {
+// Only scalar fields make sensible columns
+const columnify = (row, keynames) => {
+  const scalars = keynames.filter((key) => typeof row[key] !== "object");
+  return scalars.map((element) => {
     return { name: element, selector: element, sortable: true };
   });
 };
 
 export default function TableView({ listName, data }) {
   const keynames = data.length > 0 ? Object.keys(data[0]) : [];
-  const columns = columnify(keynames);
+  const columns = columnify(data[0], keynames);
 
   const history = useHistory();
 
@@ -21,7 +23,7 @@ export default function TableView({ listName, data }) {
       persistTableHead
       highlightOnHover
       onRowClicked={(row) =>
-        history.push(`/${listName.toLowerCase()}/${row.uuid}`)
+        history.push(`/${listName.toLowerCase()}/${row.id || row.uuid}`)
       }
     />
   );
@@ -14,6 +14,8 @@ fake = Faker()
 async def hello(websocket, path):
     while True:
         msg = json.dumps({
+            "v": 1,
+            "type": "snapshot",
             "status": {
                 "active": [
                     {"name": fake.name(), "company": fake.company(), "ssn": fake.ssn(), "uuid": uuid.uuid4().hex}